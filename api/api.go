@@ -103,6 +103,8 @@ type API struct {
 	*TriggerAPI
 	*ResourcesAPI
 	*RulesAPI
+	*ChangesAPI
+	*SearchAPI
 }
 
 type TriggerPlanner interface {
@@ -118,12 +120,16 @@ func NewAPI(viewStore ViewStore, pipeStore PipeStore, ruleStore RuleStore, planS
 		TriggerAPI:   &TriggerAPI{},
 		ResourcesAPI: &ResourcesAPI{},
 		RulesAPI:     &RulesAPI{},
+		ChangesAPI:   &ChangesAPI{},
+		SearchAPI:    &SearchAPI{},
 	}
 	a.ViewsAPI.Init(viewStore, pipeStore)
 	a.PipesAPI.Init(pipeStore, ruleStore)
 	a.TriggerAPI.Init(ruleStore, pipeStore, planStore, resultStore, newTriggerPlanner)
 	a.ResourcesAPI.Init(resourceStore, a.PipesAPI, a.ViewsAPI, a.RulesAPI)
 	a.RulesAPI.Init(ruleStore)
+	a.ChangesAPI.Init(resultStore)
+	a.SearchAPI.Init(resultStore)
 	return a
 }
 
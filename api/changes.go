@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/status"
+)
+
+// ChangeKind is the kind of a value change between events.
+type ChangeKind = string
+
+const (
+	ChangeAdded   ChangeKind = "added"
+	ChangeRemoved ChangeKind = "removed"
+	ChangeChanged ChangeKind = "changed"
+)
+
+// Change is a difference in a pipe value between an event and
+// the previous event for the same URL with results for the pipe.
+//
+// Values are compared by pipe name and sequence so changes are
+// also found across versions of a pipe.
+type Change struct {
+	Event      int64      `json:"event,omitempty"`
+	PrevEvent  int64      `json:"prev_event,omitempty"`
+	URL        string     `json:"url,omitempty"`
+	ReceivedAt time.Time  `json:"received_at,omitempty"`
+	Pipe       string     `json:"pipe,omitempty"`
+	Sequence   int        `json:"sequence,omitempty"`
+	Kind       ChangeKind `json:"kind,omitempty"`
+	Old        any        `json:"old,omitempty"`
+	New        any        `json:"new,omitempty"`
+}
+
+// ChangeFilter selects the changes returned by ScanChanges.
+//
+// Empty fields match all changes.
+type ChangeFilter struct {
+	URL string
+	// Pipe matches changes by pipe name and optional digest.
+	Pipe integrity.NameDigest
+	Kind ChangeKind
+	// After matches changes of events after the event ID.
+	After int64
+}
+
+func ValidateChangeKind(kind ChangeKind) error {
+	switch kind {
+	case "", ChangeAdded, ChangeRemoved, ChangeChanged:
+		return nil
+	default:
+		return fmt.Errorf("change kind is not supported (%q): %w", kind, status.ErrInvalidArgument)
+	}
+}
+
+type ChangesAPI struct {
+	results ResultStore
+}
+
+func (a *ChangesAPI) Init(results ResultStore) {
+	*a = ChangesAPI{
+		results: results,
+	}
+}
+
+type ListChangesRequest struct {
+	URL string `json:"url,omitempty"`
+	// Pipe is the name or name@digest of the pipe.
+	Pipe string     `json:"pipe,omitempty"`
+	Kind ChangeKind `json:"kind,omitempty"`
+	// After lists changes of events after the event ID.
+	After int64 `json:"after,omitempty"`
+	// Limit is the maximum number of changes which defaults to 100.
+	Limit int `json:"limit,omitempty"`
+}
+
+type ListChangesResponse struct {
+	Changes []*Change `json:"changes,omitempty"`
+}
+
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+)
+
+// ListChanges lists changes ordered by event.
+//
+// Use the event of the last change as After to list the next changes.
+func (a *ChangesAPI) ListChanges(ctx context.Context, req *ListChangesRequest) (*ListChangesResponse, error) {
+	filter := &ChangeFilter{
+		URL:   req.URL,
+		Kind:  req.Kind,
+		After: req.After,
+	}
+	if err := ValidateChangeKind(req.Kind); err != nil {
+		return nil, err
+	}
+	if req.Pipe != "" {
+		pipe, err := integrity.ParseNameDigest(req.Pipe)
+		if err != nil {
+			return nil, err
+		}
+		filter.Pipe = pipe
+	}
+	limit := req.Limit
+	switch {
+	case limit == 0:
+		limit = defaultChangesLimit
+	case limit < 0 || limit > maxChangesLimit:
+		return nil, fmt.Errorf("limit must be between 1 and %d (%d): %w", maxChangesLimit, limit, status.ErrInvalidArgument)
+	}
+	var changes []*Change
+	for c, err := range a.results.ScanChanges(ctx, filter) {
+		if err != nil {
+			return nil, err
+		}
+		// Changes of an event are not split across responses.
+		if len(changes) >= limit && c.Event != changes[len(changes)-1].Event {
+			break
+		}
+		changes = append(changes, c)
+	}
+	return &ListChangesResponse{Changes: changes}, nil
+}
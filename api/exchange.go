@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+
+	"github.com/wenooij/nuggit/status"
+)
+
+// ExchangeResultsStream is an ExchangeResultsRequest with results which are decoded as they are stored.
+type ExchangeResultsStream struct {
+	Trigger *TriggerEvent
+	Batch   *TriggerBatch
+	// Results decodes the results of the request one at a time.
+	// It can only be iterated once.
+	Results iter.Seq2[TriggerResult, error]
+}
+
+// DecodeExchangeResults reads the trigger and batch of an ExchangeResultsRequest
+// from r and returns a stream which decodes the results as they are iterated.
+//
+// The trigger and batch must precede the results in the request.
+// Results larger than maxResultSize bytes fail with ErrResourceExhausted
+// as soon as that many bytes of the result are read.
+// A non-positive maxResultSize disables the limit.
+func DecodeExchangeResults(r io.Reader, maxResultSize int64) (*ExchangeResultsStream, error) {
+	lr := &resultLimitReader{r: r, limit: -1}
+	d := json.NewDecoder(lr)
+	if tok, err := d.Token(); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("body is required: %w", status.ErrInvalidArgument)
+		}
+		return nil, decodeError(err)
+	} else if tok != json.Delim('{') {
+		return nil, fmt.Errorf("exchange must be a JSON object: %w", status.ErrInvalidArgument)
+	}
+	stream := &ExchangeResultsStream{Results: func(func(TriggerResult, error) bool) {}}
+	for d.More() {
+		key, err := d.Token()
+		if err != nil {
+			return nil, decodeError(err)
+		}
+		switch key {
+		case "trigger":
+			err = d.Decode(&stream.Trigger)
+		case "batch":
+			err = d.Decode(&stream.Batch)
+		case "results":
+			tok, err := d.Token()
+			if err != nil {
+				return nil, decodeError(err)
+			}
+			if tok == nil {
+				continue
+			}
+			if tok != json.Delim('[') {
+				return nil, fmt.Errorf("results must be an array: %w", status.ErrInvalidArgument)
+			}
+			stream.Results = decodeResults(d, lr, maxResultSize)
+			return stream, nil
+		default:
+			err = d.Decode(new(json.RawMessage))
+		}
+		if err != nil {
+			return nil, decodeError(err)
+		}
+	}
+	if _, err := d.Token(); err != nil {
+		return nil, decodeError(err)
+	}
+	return stream, nil
+}
+
+// decodeResults decodes the elements of the results array and the rest of the request.
+func decodeResults(d *json.Decoder, lr *resultLimitReader, maxResultSize int64) iter.Seq2[TriggerResult, error] {
+	return func(yield func(TriggerResult, error) bool) {
+		for d.More() {
+			if maxResultSize > 0 {
+				lr.limit, lr.max = d.InputOffset()+maxResultSize, maxResultSize
+			}
+			var res TriggerResult
+			err := d.Decode(&res)
+			lr.limit = -1
+			if err != nil {
+				yield(TriggerResult{}, decodeError(err))
+				return
+			}
+			if !yield(res, nil) {
+				return
+			}
+		}
+		if _, err := d.Token(); err != nil {
+			yield(TriggerResult{}, decodeError(err))
+			return
+		}
+		for d.More() {
+			key, err := d.Token()
+			if err != nil {
+				yield(TriggerResult{}, decodeError(err))
+				return
+			}
+			if key == "trigger" || key == "batch" {
+				yield(TriggerResult{}, fmt.Errorf("%s must precede the results of an exchange: %w", key, status.ErrInvalidArgument))
+				return
+			}
+			if err := d.Decode(new(json.RawMessage)); err != nil {
+				yield(TriggerResult{}, decodeError(err))
+				return
+			}
+		}
+		if _, err := d.Token(); err != nil {
+			yield(TriggerResult{}, decodeError(err))
+		}
+	}
+}
+
+// resultLimitReader fails reads past the end of the result being decoded
+// so that oversized results are not buffered by the decoder.
+type resultLimitReader struct {
+	r     io.Reader
+	n     int64 // Bytes read from r.
+	limit int64 // Input offset at which reads fail or -1.
+	max   int64 // Result size limit for errors.
+}
+
+func (l *resultLimitReader) Read(p []byte) (int, error) {
+	if l.limit >= 0 {
+		if l.n >= l.limit {
+			return 0, fmt.Errorf("result is too large (> %d bytes): %w", l.max, status.ErrResourceExhausted)
+		}
+		if rem := l.limit - l.n; int64(len(p)) > rem {
+			p = p[:rem]
+		}
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	return n, err
+}
+
+// decodeError returns errors from the underlying reader such as size limits
+// as is and marks other errors as invalid.
+func decodeError(err error) error {
+	if errors.Is(err, status.ErrResourceExhausted) {
+		return err
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("%v: %w", err, status.ErrInvalidArgument)
+}
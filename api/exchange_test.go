@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/status"
+	"github.com/wenooij/nuggit/trigger"
+)
+
+func TestDecodeExchangeResults(t *testing.T) {
+	body := `{"trigger":{"plan":"p","event":"e"},"extra":[1,{"a":2}],"batch":{"sequence":3},"results":[
+{"pipe":"title@1","result":"a"},
+{"pipe":"title@1","result":"` + strings.Repeat("b", 128) + `"}
+]}`
+	stream, err := DecodeExchangeResults(strings.NewReader(body), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.Trigger.GetPlan() != "p" || stream.Trigger.GetEvent() != "e" || stream.Batch.GetSequence() != 3 {
+		t.Errorf("DecodeExchangeResults(): got trigger %+v and batch %+v", stream.Trigger, stream.Batch)
+	}
+	var n int
+	for res, err := range stream.Results {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Pipe != "title@1" {
+			t.Errorf("DecodeExchangeResults(): got result pipe %q, want title@1", res.Pipe)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Errorf("DecodeExchangeResults(): got %d results, want 2", n)
+	}
+
+	stream, err = DecodeExchangeResults(strings.NewReader(body), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n = 0
+	for _, err := range stream.Results {
+		if err != nil {
+			if !errors.Is(err, status.ErrResourceExhausted) {
+				t.Errorf("DecodeExchangeResults(large result): got error %v, want ErrResourceExhausted", err)
+			}
+			break
+		}
+		n++
+	}
+	if n != 1 {
+		t.Errorf("DecodeExchangeResults(large result): got %d results before the error, want 1", n)
+	}
+
+	// Oversized results fail without reading the rest of the result.
+	large := &countingReader{r: strings.NewReader(`{"results":[{"result":"` + strings.Repeat("b", 1<<20) + `"}]}`)}
+	stream, err = DecodeExchangeResults(large, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err = range stream.Results {
+		if err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, status.ErrResourceExhausted) {
+		t.Errorf("DecodeExchangeResults(streamed large result): got error %v, want ErrResourceExhausted", err)
+	}
+	if large.n > 1024 {
+		t.Errorf("DecodeExchangeResults(streamed large result): read %d bytes, want at most 1024", large.n)
+	}
+
+	stream, err = DecodeExchangeResults(strings.NewReader(`{"results":[{"result":"a"}],"trigger":{"plan":"p"}}`), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err = range stream.Results {
+		if err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, status.ErrInvalidArgument) {
+		t.Errorf("DecodeExchangeResults(trigger after results): got error %v, want ErrInvalidArgument", err)
+	}
+
+	for _, body := range []string{``, `[]`, `{"trigger":`} {
+		if _, err := DecodeExchangeResults(strings.NewReader(body), 0); !errors.Is(err, status.ErrInvalidArgument) {
+			t.Errorf("DecodeExchangeResults(%q): got error %v, want ErrInvalidArgument", body, err)
+		}
+	}
+}
+
+type countingReader struct {
+	r *strings.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += n
+	return n, err
+}
+
+type planMap map[string]*trigger.Plan
+
+func (m planMap) Store(ctx context.Context, uuid string, plan *trigger.Plan) error {
+	m[uuid] = plan
+	return nil
+}
+
+func (m planMap) Load(ctx context.Context, uuid string) (*trigger.Plan, error) {
+	plan, found := m[uuid]
+	if !found {
+		return nil, status.ErrNotFound
+	}
+	return plan, nil
+}
+
+func (m planMap) Finish(ctx context.Context, uuid string) error { return nil }
+
+func TestExchangeEventCanonical(t *testing.T) {
+	var a TriggerAPI
+	a.Init(nil, nil, planMap{
+		"p":  {},
+		"sp": {Canonical: &nuggit.CanonicalURL{KeepFragment: true, KeepParams: []string{"utm_source"}}},
+	}, nil, nil)
+
+	const rawURL = "HTTPS://Example.com:443/a?utm_source=x&b=1#/route"
+	for _, tc := range []struct {
+		plan string
+		want string
+	}{
+		{"p", "https://example.com/a?b=1"},
+		{"sp", "https://example.com/a?b=1&utm_source=x#/route"},
+	} {
+		event, err := a.exchangeEvent(context.Background(), &TriggerEvent{Plan: tc.plan, URL: rawURL}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.URL != tc.want || event.RawURL != rawURL {
+			t.Errorf("exchangeEvent(%q): got url %q and raw url %q, want %q and %q", tc.plan, event.URL, event.RawURL, tc.want, rawURL)
+		}
+	}
+
+	if _, err := a.exchangeEvent(context.Background(), &TriggerEvent{Plan: "missing", URL: rawURL}, nil); !errors.Is(err, status.ErrNotFound) {
+		t.Errorf("exchangeEvent(missing plan): got error %v, want ErrNotFound", err)
+	}
+}
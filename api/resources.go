@@ -7,6 +7,7 @@ import (
 
 	"github.com/wenooij/nuggit"
 	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/rules"
 	"github.com/wenooij/nuggit/status"
 	"gopkg.in/yaml.v3"
 )
@@ -234,6 +235,54 @@ func (m *ResourceMetadata) SetDigest(digest string) {
 	}
 }
 
+// ResourceFilter selects the resources returned by ScanResources.
+//
+// Empty fields match all resources.
+type ResourceFilter struct {
+	Kind   Kind   `json:"kind,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Digest string `json:"digest,omitempty"`
+	// UUID matches view and rule resources by the UUID of the view or rule.
+	UUID string `json:"uuid,omitempty"`
+	// Labels matches resources with all of the labels.
+	Labels []string `json:"labels,omitempty"`
+}
+
+func (f *ResourceFilter) GetKind() Kind {
+	if f == nil {
+		return ""
+	}
+	return f.Kind
+}
+
+func (f *ResourceFilter) GetName() string {
+	if f == nil {
+		return ""
+	}
+	return f.Name
+}
+
+func (f *ResourceFilter) GetDigest() string {
+	if f == nil {
+		return ""
+	}
+	return f.Digest
+}
+
+func (f *ResourceFilter) GetUUID() string {
+	if f == nil {
+		return ""
+	}
+	return f.UUID
+}
+
+func (f *ResourceFilter) GetLabels() []string {
+	if f == nil {
+		return nil
+	}
+	return f.Labels
+}
+
 type ResourcesAPI struct {
 	store ResourceStore
 	pipes *PipesAPI
@@ -269,6 +318,13 @@ func (a *ResourcesAPI) CreateResource(ctx context.Context, req *CreateResourceRe
 	default:
 		return nil, fmt.Errorf("unsupported API version (%q): %w", apiVersion, status.ErrUnimplemented)
 	}
+	if req.Resource.Metadata == nil {
+		req.Resource.Metadata = new(ResourceMetadata)
+	}
+	// The digest of the spec as sent identifies the stored resource.
+	if err := integrity.SetCheckDigest(req.Resource, req.Resource.GetDigest()); err != nil {
+		return nil, fmt.Errorf("%v: %w", err, status.ErrInvalidArgument)
+	}
 	switch kind := req.Resource.GetKind(); kind {
 	case KindPipe:
 		p := new(Pipe)
@@ -309,14 +365,20 @@ func (a *ResourcesAPI) CreateResource(ctx context.Context, req *CreateResourceRe
 	case KindRule:
 		r := new(nuggit.Rule)
 		if rule := req.Resource.GetRule(); rule != nil {
-			*r = *rule
+			// Normalize here so the stored resource refers to the same rule.
+			normalized, err := rules.Normalize(*rule)
+			if err != nil {
+				return nil, err
+			}
+			*r = normalized
 		}
-		if _, err := a.rules.CreateRule(ctx, &CreateRuleRequest{
+		resp, err := a.rules.CreateRule(ctx, &CreateRuleRequest{
 			Rule: r,
-		}); err != nil {
+		})
+		if err != nil {
 			return nil, err
 		}
-		if err := a.store.StoreRuleResource(ctx, req.Resource, *r); err != nil {
+		if err := a.store.StoreRuleResource(ctx, req.Resource, &Rule{ID: resp.Rule.GetID(), Rule: *r}); err != nil {
 			return nil, err
 		}
 		return &CreateResourceResponse{}, nil
@@ -324,3 +386,140 @@ func (a *ResourcesAPI) CreateResource(ctx context.Context, req *CreateResourceRe
 		return nil, fmt.Errorf("unsupported resource kind (%q): %w", kind, status.ErrUnimplemented)
 	}
 }
+
+type LookupResourceRequest struct {
+	Kind Kind `json:"kind,omitempty"`
+	// Name is the name or name@digest of the resource.
+	Name   string `json:"name,omitempty"`
+	Digest string `json:"digest,omitempty"`
+	// UUID is the UUID of a view or rule resource.
+	UUID string `json:"uuid,omitempty"`
+}
+
+type LookupResourceResponse struct {
+	Resources []*Resource `json:"resources,omitempty"`
+}
+
+// LookupResource returns the resources matching the request in the order they were stored.
+//
+// LookupResource returns ErrNotFound when no resources match.
+func (a *ResourcesAPI) LookupResource(ctx context.Context, req *LookupResourceRequest) (*LookupResourceResponse, error) {
+	filter, err := lookupFilter(req)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := a.scanResources(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(rs) == 0 {
+		return nil, fmt.Errorf("resource not found: %w", status.ErrNotFound)
+	}
+	return &LookupResourceResponse{Resources: rs}, nil
+}
+
+// lookupFilter returns the filter for a lookup of the name or name@digest, UUID or kind.
+func lookupFilter(req *LookupResourceRequest) (*ResourceFilter, error) {
+	if req.Kind == "" && req.Name == "" && req.UUID == "" {
+		return nil, fmt.Errorf("kind, name or uuid is required: %w", status.ErrInvalidArgument)
+	}
+	if req.Kind != "" {
+		if _, err := NewResourceSpec(req.Kind); err != nil {
+			return nil, err
+		}
+	}
+	filter := &ResourceFilter{Kind: req.Kind, Digest: req.Digest, UUID: req.UUID}
+	if req.Name != "" {
+		nameDigest, err := integrity.ParseNameDigest(req.Name)
+		if err != nil {
+			return nil, err
+		}
+		if digest := nameDigest.GetDigest(); digest != "" {
+			if req.Digest != "" && req.Digest != digest {
+				return nil, fmt.Errorf("digest does not match the name (%q != %q): %w", req.Digest, digest, status.ErrInvalidArgument)
+			}
+			filter.Digest = digest
+		}
+		filter.Name = nameDigest.GetName()
+	}
+	return filter, nil
+}
+
+func (a *ResourcesAPI) scanResources(ctx context.Context, filter *ResourceFilter) ([]*Resource, error) {
+	var rs []*Resource
+	for r, err := range a.store.ScanResources(ctx, filter) {
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+type ListResourcesRequest struct {
+	Filter *ResourceFilter `json:"filter,omitempty"`
+}
+
+type ListResourcesResponse struct {
+	Resources []*Resource `json:"resources,omitempty"`
+}
+
+func (a *ResourcesAPI) ListResources(ctx context.Context, req *ListResourcesRequest) (*ListResourcesResponse, error) {
+	if kind := req.Filter.GetKind(); kind != "" {
+		if _, err := NewResourceSpec(kind); err != nil {
+			return nil, err
+		}
+	}
+	rs, err := a.scanResources(ctx, req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	return &ListResourcesResponse{Resources: rs}, nil
+}
+
+type DeleteResourceRequest struct {
+	Kind Kind `json:"kind,omitempty"`
+	// Name is the name or name@digest of the resource.
+	Name   string `json:"name,omitempty"`
+	Digest string `json:"digest,omitempty"`
+	// UUID is the UUID of a view or rule resource.
+	UUID string `json:"uuid,omitempty"`
+}
+
+type DeleteResourceResponse struct{}
+
+// DeleteResource deletes the pipe, view or rule of a single resource along with the resource.
+//
+// Deleting a pipe deletes its results and fails with ErrFailedPrecondition
+// when other pipes or views depend on it.
+func (a *ResourcesAPI) DeleteResource(ctx context.Context, req *DeleteResourceRequest) (*DeleteResourceResponse, error) {
+	filter, err := lookupFilter((*LookupResourceRequest)(req))
+	if err != nil {
+		return nil, err
+	}
+	rs, err := a.scanResources(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	switch len(rs) {
+	case 0:
+		return nil, fmt.Errorf("resource not found: %w", status.ErrNotFound)
+	case 1:
+	default:
+		return nil, fmt.Errorf("resource is ambiguous (%d resources match), provide a kind, digest or uuid: %w", len(rs), status.ErrInvalidArgument)
+	}
+	switch r := rs[0]; r.GetKind() {
+	case KindPipe:
+		err = a.pipes.store.Delete(ctx, integrity.Key(r))
+	case KindView:
+		_, err = a.views.DeleteView(ctx, &DeleteViewRequest{View: r.GetMetadata().GetUUID()})
+	case KindRule:
+		_, err = a.rules.DeleteRule(ctx, &DeleteRuleRequest{ID: r.GetMetadata().GetUUID()})
+	default:
+		err = fmt.Errorf("unsupported resource kind (%q): %w", r.GetKind(), status.ErrUnimplemented)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &DeleteResourceResponse{}, nil
+}
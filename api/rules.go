@@ -2,12 +2,53 @@ package api
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/rules"
+	"github.com/wenooij/nuggit/status"
 )
 
 const rulesBaseURI = "/api/rules"
 
+type Rule struct {
+	ID          string `json:"id,omitempty"`
+	nuggit.Rule `json:",omitempty"`
+}
+
+func (r *Rule) GetID() string {
+	if r == nil {
+		return ""
+	}
+	return r.ID
+}
+
+func (r *Rule) GetRule() nuggit.Rule {
+	if r == nil {
+		return nuggit.Rule{}
+	}
+	return r.Rule
+}
+
+type RuleFilter struct {
+	Hostname string `json:"hostname,omitempty"`
+	Label    string `json:"label,omitempty"`
+}
+
+func (f *RuleFilter) GetHostname() string {
+	if f == nil {
+		return ""
+	}
+	return f.Hostname
+}
+
+func (f *RuleFilter) GetLabel() string {
+	if f == nil {
+		return ""
+	}
+	return f.Label
+}
+
 type RulesAPI struct {
 	rules RuleStore
 }
@@ -18,39 +59,195 @@ func (a *RulesAPI) Init(rules RuleStore) {
 	}
 }
 
+// normalizeRule validates and normalizes the rule before it is stored.
+func normalizeRule(rule *nuggit.Rule) (nuggit.Rule, error) {
+	if err := provided("rule", "is", rule); err != nil {
+		return nuggit.Rule{}, err
+	}
+	if err := ValidateRule(*rule); err != nil {
+		return nuggit.Rule{}, err
+	}
+	return rules.Normalize(*rule)
+}
+
 type CreateRuleRequest struct {
 	Rule *nuggit.Rule `json:"rule,omitempty"`
 }
 
-type CreateRuleResponse struct{}
+type CreateRuleResponse struct {
+	Rule *Ref `json:"rule,omitempty"`
+}
 
+// CreateRule stores the rule.
+//
+// Creating a rule which is already stored replaces its labels and policy
+// and returns the existing rule ID.
 func (a *RulesAPI) CreateRule(ctx context.Context, req *CreateRuleRequest) (*CreateRuleResponse, error) {
+	rule, err := normalizeRule(req.Rule)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := newRef(rulesBaseURI)
+	if err != nil {
+		return nil, err
+	}
+	r := &Rule{ID: ref.ID, Rule: rule}
+	if err := a.rules.StoreRule(ctx, r); err != nil {
+		return nil, err
+	}
+	ref = newRefID(rulesBaseURI, r.ID)
+	return &CreateRuleResponse{Rule: &ref}, nil
+}
+
+type ListRulesRequest struct {
+	Filter *RuleFilter `json:"filter,omitempty"`
+}
+
+type ListRulesResponse struct {
+	Rules []*Rule `json:"rules,omitempty"`
+}
+
+func (a *RulesAPI) ListRules(ctx context.Context, req *ListRulesRequest) (*ListRulesResponse, error) {
+	filter := req.Filter
+	if hostname := filter.GetHostname(); hostname != "" {
+		normalized, err := rules.NormalizeHostname(hostname)
+		if err != nil {
+			return nil, err
+		}
+		filter = &RuleFilter{Hostname: normalized, Label: filter.GetLabel()}
+	}
+	var rs []*Rule
+	for r, err := range a.rules.ScanRules(ctx, filter) {
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return &ListRulesResponse{Rules: rs}, nil
+}
+
+type GetRuleRequest struct {
+	Rule string `json:"rule,omitempty"`
+}
+
+type GetRuleResponse struct {
+	Rule *Rule `json:"rule,omitempty"`
+}
+
+func (a *RulesAPI) GetRule(ctx context.Context, req *GetRuleRequest) (*GetRuleResponse, error) {
 	if err := provided("rule", "is", req.Rule); err != nil {
 		return nil, err
 	}
-	if err := ValidateRule(*req.Rule); err != nil {
+	r, err := a.rules.LoadRule(ctx, req.Rule)
+	if err != nil {
+		return nil, err
+	}
+	return &GetRuleResponse{Rule: r}, nil
+}
+
+type UpdateRuleRequest struct {
+	ID   string       `json:"id,omitempty"`
+	Rule *nuggit.Rule `json:"rule,omitempty"`
+}
+
+type UpdateRuleResponse struct {
+	Rule *Ref `json:"rule,omitempty"`
+}
+
+// UpdateRule replaces the rule with the given ID, including its labels.
+func (a *RulesAPI) UpdateRule(ctx context.Context, req *UpdateRuleRequest) (*UpdateRuleResponse, error) {
+	if err := provided("id", "is", req.ID); err != nil {
+		return nil, err
+	}
+	rule, err := normalizeRule(req.Rule)
+	if err != nil {
 		return nil, err
 	}
-	if err := a.rules.StoreRule(ctx, *req.Rule); err != nil {
+	if err := a.rules.UpdateRule(ctx, &Rule{ID: req.ID, Rule: rule}); err != nil {
+		return nil, err
+	}
+	ref := newRefID(rulesBaseURI, req.ID)
+	return &UpdateRuleResponse{Rule: &ref}, nil
+}
+
+type EnableRuleRequest struct {
+	Rule string `json:"rule,omitempty"`
+}
+
+type EnableRuleResponse struct{}
+
+func (a *RulesAPI) EnableRule(ctx context.Context, req *EnableRuleRequest) (*EnableRuleResponse, error) {
+	if err := a.updateStoredRule(ctx, req.Rule, func(r *nuggit.Rule) { r.Disable = false }); err != nil {
 		return nil, err
 	}
-	return &CreateRuleResponse{}, nil
+	return &EnableRuleResponse{}, nil
+}
+
+type DisableRuleRequest struct {
+	Rule string `json:"rule,omitempty"`
+}
+
+type DisableRuleResponse struct{}
+
+func (a *RulesAPI) DisableRule(ctx context.Context, req *DisableRuleRequest) (*DisableRuleResponse, error) {
+	if err := a.updateStoredRule(ctx, req.Rule, func(r *nuggit.Rule) { r.Disable = true }); err != nil {
+		return nil, err
+	}
+	return &DisableRuleResponse{}, nil
+}
+
+type UpdateRuleLabelsRequest struct {
+	Rule   string   `json:"rule,omitempty"`
+	Labels []string `json:"labels,omitempty"`
+}
+
+type UpdateRuleLabelsResponse struct{}
+
+// UpdateRuleLabels replaces the labels of the stored rule in place.
+func (a *RulesAPI) UpdateRuleLabels(ctx context.Context, req *UpdateRuleLabelsRequest) (*UpdateRuleLabelsResponse, error) {
+	for _, label := range req.Labels {
+		if label == "" {
+			return nil, fmt.Errorf("labels must not be empty: %w", status.ErrInvalidArgument)
+		}
+	}
+	if err := a.updateStoredRule(ctx, req.Rule, func(r *nuggit.Rule) { r.Labels = req.Labels }); err != nil {
+		return nil, err
+	}
+	return &UpdateRuleLabelsResponse{}, nil
+}
+
+func (a *RulesAPI) updateStoredRule(ctx context.Context, id string, update func(*nuggit.Rule)) error {
+	if err := provided("rule", "is", id); err != nil {
+		return err
+	}
+	return a.rules.UpdateRuleFunc(ctx, id, update)
 }
 
 type DeleteRuleRequest struct {
+	// ID of the rule to delete.
+	ID string `json:"id,omitempty"`
+	// Rule to delete when ID is not provided.
+	// All fields must match the stored rule including its labels.
 	Rule *nuggit.Rule `json:"rule,omitempty"`
 }
 
 type DeleteRuleResponse struct{}
 
 func (a *RulesAPI) DeleteRule(ctx context.Context, req *DeleteRuleRequest) (*DeleteRuleResponse, error) {
-	if err := provided("rule", "is", req.Rule); err != nil {
-		return nil, err
+	if req.ID != "" {
+		if err := exclude("rule", "is", req.Rule); err != nil {
+			return nil, err
+		}
+		if err := a.rules.DeleteRuleByID(ctx, req.ID); err != nil {
+			return nil, err
+		}
+		return &DeleteRuleResponse{}, nil
 	}
-	if err := ValidateRule(*req.Rule); err != nil {
+	rule, err := normalizeRule(req.Rule)
+	if err != nil {
 		return nil, err
 	}
-	if err := a.rules.DeleteRule(ctx, *req.Rule); err != nil {
+	if err := a.rules.DeleteRule(ctx, rule); err != nil {
 		return nil, err
 	}
 	return &DeleteRuleResponse{}, nil
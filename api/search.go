@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/status"
+)
+
+// SearchHit is a string result matching a search query.
+type SearchHit struct {
+	Event      int64     `json:"event,omitempty"`
+	URL        string    `json:"url,omitempty"`
+	Timestamp  time.Time `json:"timestamp,omitempty"`
+	ReceivedAt time.Time `json:"received_at,omitempty"`
+	Pipe       string    `json:"pipe,omitempty"`
+	Sequence   int       `json:"sequence,omitempty"`
+	// Snippet is the text around the matched terms.
+	// Matched terms are enclosed in brackets.
+	Snippet string `json:"snippet,omitempty"`
+}
+
+// SearchFilter selects the results returned by SearchResults.
+type SearchFilter struct {
+	// Query is an SQLite FTS5 query such as `"breaking news" OR election`.
+	Query string
+	// Pipe matches results by pipe name and optional digest.
+	Pipe integrity.NameDigest
+	URL  string
+	// Offset is the number of hits to skip.
+	Offset int
+	// Limit is the maximum number of hits or 0 for all hits.
+	Limit int
+}
+
+type SearchAPI struct {
+	results ResultStore
+}
+
+func (a *SearchAPI) Init(results ResultStore) {
+	*a = SearchAPI{
+		results: results,
+	}
+}
+
+type SearchResultsRequest struct {
+	Query string `json:"query,omitempty"`
+	// Pipe is the name or name@digest of the pipe.
+	Pipe string `json:"pipe,omitempty"`
+	URL  string `json:"url,omitempty"`
+	// Offset is the number of hits to skip.
+	Offset int `json:"offset,omitempty"`
+	// Limit is the maximum number of hits which defaults to 100.
+	Limit int `json:"limit,omitempty"`
+}
+
+type SearchResultsResponse struct {
+	Hits []*SearchHit `json:"hits,omitempty"`
+}
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+// SearchResults searches string results ordered by relevance.
+func (a *SearchAPI) SearchResults(ctx context.Context, req *SearchResultsRequest) (*SearchResultsResponse, error) {
+	if req.Query == "" {
+		return nil, fmt.Errorf("query is required: %w", status.ErrInvalidArgument)
+	}
+	filter := &SearchFilter{
+		Query:  req.Query,
+		URL:    req.URL,
+		Offset: req.Offset,
+	}
+	if req.Pipe != "" {
+		pipe, err := integrity.ParseNameDigest(req.Pipe)
+		if err != nil {
+			return nil, err
+		}
+		filter.Pipe = pipe
+	}
+	if req.Offset < 0 {
+		return nil, fmt.Errorf("offset must not be negative (%d): %w", req.Offset, status.ErrInvalidArgument)
+	}
+	limit := req.Limit
+	switch {
+	case limit == 0:
+		limit = defaultSearchLimit
+	case limit < 0 || limit > maxSearchLimit:
+		return nil, fmt.Errorf("limit must be between 1 and %d (%d): %w", maxSearchLimit, limit, status.ErrInvalidArgument)
+	}
+	filter.Limit = limit
+	var hits []*SearchHit
+	for h, err := range a.results.SearchResults(ctx, filter) {
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, h)
+	}
+	return &SearchResultsResponse{Hits: hits}, nil
+}
@@ -17,29 +17,79 @@ type PipeStore interface {
 	ScanNames(context.Context) iter.Seq2[integrity.NameDigest, error]
 	Scan(context.Context) iter.Seq2[*Pipe, error]
 	ScanDependencies(ctx context.Context, pipe integrity.NameDigest) iter.Seq2[*Pipe, error]
+	// Delete deletes the pipe along with its results and resources.
+	//
+	// Delete returns ErrFailedPrecondition when other pipes or views depend on the pipe.
+	Delete(ctx context.Context, pipe integrity.NameDigest) error
 }
 
 type RuleStore interface {
-	StoreRule(ctx context.Context, rule nuggit.Rule) error
+	// StoreRule stores a new rule with the given ID.
+	//
+	// When the same rule is already stored, its labels and policy are replaced
+	// and the rule ID is set to the ID of the existing rule.
+	StoreRule(ctx context.Context, rule *Rule) error
+	LoadRule(ctx context.Context, id string) (*Rule, error)
+	ScanRules(ctx context.Context, filter *RuleFilter) iter.Seq2[*Rule, error]
+	// UpdateRule replaces the stored rule and its labels in place.
+	UpdateRule(ctx context.Context, rule *Rule) error
+	// UpdateRuleFunc loads the rule, applies update and replaces the stored rule atomically.
+	UpdateRuleFunc(ctx context.Context, id string, update func(*nuggit.Rule)) error
 	DeleteRule(ctx context.Context, rule nuggit.Rule) error
+	DeleteRuleByID(ctx context.Context, id string) error
 	ScanMatched(ctx context.Context, u *url.URL) iter.Seq2[*Pipe, error]
+	ScanMatchedRules(ctx context.Context, u *url.URL) iter.Seq2[*Rule, error]
+	// ScanLabeledPipes returns the enabled pipes carrying any of the labels.
+	//
+	// Pipes carrying a label of a disabled rule are excluded.
+	ScanLabeledPipes(ctx context.Context, labels []string) iter.Seq2[*Pipe, error]
 }
 
 type PlanStore interface {
 	Store(ctx context.Context, uuid string, plan *trigger.Plan) error
+	Load(ctx context.Context, uuid string) (*trigger.Plan, error)
 	Finish(ctx context.Context, uuid string) error
 }
 
 type ResultStore interface {
-	StoreResults(ctx context.Context, trigger *TriggerEvent, results []TriggerResult) error
+	// StoreResults stores the results for the trigger event.
+	//
+	// StoreResults returns ErrAlreadyExists when the batch was already stored
+	// and ErrFailedPrecondition when its sequence was stored with a different idempotency key.
+	StoreResults(ctx context.Context, trigger *TriggerEvent, batch *TriggerBatch, results []TriggerResult) error
+	// StreamResults is like StoreResults but reads the results from an iterator.
+	//
+	// Nothing is stored when the iterator fails.
+	StreamResults(ctx context.Context, trigger *TriggerEvent, batch *TriggerBatch, results iter.Seq2[TriggerResult, error]) error
+	// ScanChanges returns the changes matching the filter ordered by event, pipe and sequence.
+	ScanChanges(ctx context.Context, filter *ChangeFilter) iter.Seq2[*Change, error]
+	// SearchResults returns the string results matching the search query ordered by relevance.
+	SearchResults(ctx context.Context, filter *SearchFilter) iter.Seq2[*SearchHit, error]
 }
 
 type ResourceStore interface {
 	StorePipeResource(context.Context, *Resource, *Pipe) error
 	StoreViewResource(ctx context.Context, r *Resource, viewUUID string) error
-	StoreRuleResource(context.Context, *Resource, nuggit.Rule) error
+	StoreRuleResource(context.Context, *Resource, *Rule) error
+	// ScanResources returns the resources matching the filter in the order they were stored.
+	ScanResources(ctx context.Context, filter *ResourceFilter) iter.Seq2[*Resource, error]
 }
 
 type ViewStore interface {
+	// Store stores the view.
+	//
+	// Store returns AlreadyExists when an identical view is stored.
 	Store(ctx context.Context, uuid string, view nuggit.View) error
+	// Update replaces the stored view by UUID.
+	Update(ctx context.Context, uuid string, view nuggit.View) error
+	// Delete deletes the view by UUID.
+	Delete(ctx context.Context, uuid string) error
+	// Load loads the view by UUID or alias.
+	//
+	// When several views share the alias, the latest one is loaded.
+	Load(ctx context.Context, view string) (*View, error)
+	Scan(ctx context.Context) iter.Seq2[*View, error]
+	// ScanRows returns the rows of the view matching the query in order
+	// starting after the query cursor.
+	ScanRows(ctx context.Context, uuid string, query *ViewQuery) iter.Seq2[*ViewRow, error]
 }
@@ -0,0 +1,959 @@
+// Package storetest provides a conformance suite for implementations of the api stores.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/status"
+	"github.com/wenooij/nuggit/trigger"
+)
+
+// Stores is a set of stores which share the same backend.
+type Stores struct {
+	Pipes     api.PipeStore
+	Rules     api.RuleStore
+	Plans     api.PlanStore
+	Results   api.ResultStore
+	Resources api.ResourceStore
+	Views     api.ViewStore
+}
+
+// Run runs the conformance suite.
+//
+// newStores is called once per subtest and must return empty stores.
+func Run(t *testing.T, newStores func(t *testing.T) *Stores) {
+	for _, tc := range []struct {
+		name string
+		test func(*testing.T, *Stores)
+	}{
+		{"PipeRoundTrip", testPipeRoundTrip},
+		{"PipeDependencies", testPipeDependencies},
+		{"RuleLifecycle", testRuleLifecycle},
+		{"RuleMatching", testRuleMatching},
+		{"LabelDisabling", testLabelDisabling},
+		{"Resources", testResources},
+		{"PlanRoundTrip", testPlanRoundTrip},
+		{"ResultBatches", testResultBatches},
+		{"StreamedResults", testStreamedResults},
+		{"ViewRows", testViewRows},
+		{"ViewLifecycle", testViewLifecycle},
+		{"FloatingViewColumns", testFloatingViewColumns},
+		{"Changes", testChanges},
+		{"ChangesMultipleDigests", testChangesMultipleDigests},
+		{"Repeats", testRepeats},
+		{"Search", testSearch},
+	} {
+		t.Run(tc.name, func(t *testing.T) { tc.test(t, newStores(t)) })
+	}
+}
+
+func newPipe(t *testing.T, name string, actions ...nuggit.Action) *api.Pipe {
+	t.Helper()
+	pipe := &api.Pipe{Name: name, Pipe: nuggit.Pipe{Actions: actions}}
+	if err := integrity.SetDigest(pipe); err != nil {
+		t.Fatal(err)
+	}
+	return pipe
+}
+
+func pipeRef(p *api.Pipe) nuggit.Action {
+	return nuggit.Action{"action": "pipe", "name": p.GetName(), "digest": p.GetDigest()}
+}
+
+func storePipes(t *testing.T, s *Stores, pipes ...*api.Pipe) {
+	t.Helper()
+	for _, p := range pipes {
+		if err := s.Pipes.Store(context.Background(), p); err != nil {
+			t.Fatalf("Store(%q): %v", integrity.Key(p), err)
+		}
+	}
+}
+
+func storeLabeledPipe(t *testing.T, s *Stores, pipe *api.Pipe, labels ...string) {
+	t.Helper()
+	storePipes(t, s, pipe)
+	resource := &api.Resource{
+		APIVersion: "v1",
+		Kind:       api.KindPipe,
+		Metadata:   &api.ResourceMetadata{Labels: labels},
+	}
+	if err := s.Resources.StorePipeResource(context.Background(), resource, pipe); err != nil {
+		t.Fatalf("StorePipeResource(%q): %v", integrity.Key(pipe), err)
+	}
+}
+
+func storeRule(t *testing.T, s *Stores, id string, rule nuggit.Rule) *api.Rule {
+	t.Helper()
+	r := &api.Rule{ID: id, Rule: rule}
+	if err := s.Rules.StoreRule(context.Background(), r); err != nil {
+		t.Fatalf("StoreRule(%q): %v", id, err)
+	}
+	return r
+}
+
+func collect[E any](t *testing.T, seq func(func(E, error) bool)) []E {
+	t.Helper()
+	var es []E
+	for e, err := range seq {
+		if err != nil {
+			t.Fatal(err)
+		}
+		es = append(es, e)
+	}
+	return es
+}
+
+func pipeKeys(pipes []*api.Pipe) []string {
+	keys := make([]string, 0, len(pipes))
+	for _, p := range pipes {
+		keys = append(keys, pipeKey(p))
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+func pipeKey(p integrity.NameDigest) string {
+	return p.GetName() + "@" + p.GetDigest()
+}
+
+func seq(i int) *int { return &i }
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func testPipeRoundTrip(t *testing.T, s *Stores) {
+	ctx := context.Background()
+	pipe := newPipe(t, "title", nuggit.Action{"action": "documentElement"}, nuggit.Action{"action": "innerText"})
+	storePipes(t, s, pipe)
+
+	got, err := s.Pipes.Load(ctx, pipe)
+	if err != nil {
+		t.Fatalf("Load(%q): %v", integrity.Key(pipe), err)
+	}
+	if integrity.Key(got) != integrity.Key(pipe) || !slices.EqualFunc(got.GetActions(), pipe.GetActions(), func(a, b nuggit.Action) bool {
+		return a.GetAction() == b.GetAction()
+	}) {
+		t.Errorf("Load(%q): got %+v, want %+v", integrity.Key(pipe), got, pipe)
+	}
+
+	if err := s.Pipes.Store(ctx, pipe); !errors.Is(err, status.ErrAlreadyExists) {
+		t.Errorf("Store(existing): got error %v, want ErrAlreadyExists", err)
+	}
+	if _, err := s.Pipes.Load(ctx, integrity.KeyLit("title", "0000000000000000000000000000000000000000")); !errors.Is(err, status.ErrNotFound) {
+		t.Errorf("Load(missing): got error %v, want ErrNotFound", err)
+	}
+
+	names := collect(t, s.Pipes.ScanNames(ctx))
+	if len(names) != 1 || integrity.Key(names[0]) != integrity.Key(pipe) {
+		t.Errorf("ScanNames: got %v, want [%v]", names, integrity.Key(pipe))
+	}
+	if got := pipeKeys(collect(t, s.Pipes.Scan(ctx))); !slices.Equal(got, []string{pipeKey(pipe)}) {
+		t.Errorf("Scan: got %v, want [%v]", got, integrity.Key(pipe))
+	}
+}
+
+func testPipeDependencies(t *testing.T, s *Stores) {
+	ctx := context.Background()
+	a := newPipe(t, "base", nuggit.Action{"action": "documentElement"})
+	b := newPipe(t, "middle", pipeRef(a), nuggit.Action{"action": "innerText"})
+	c := newPipe(t, "top", pipeRef(b))
+	storePipes(t, s, a, b, c)
+
+	got := pipeKeys(collect(t, s.Pipes.ScanDependencies(ctx, c)))
+	want := pipeKeys([]*api.Pipe{a, b})
+	if !slices.Equal(got, want) {
+		t.Errorf("ScanDependencies(%q): got %v, want %v", integrity.Key(c), got, want)
+	}
+	if got := collect(t, s.Pipes.ScanDependencies(ctx, a)); len(got) != 0 {
+		t.Errorf("ScanDependencies(%q): got %d pipes, want none", integrity.Key(a), len(got))
+	}
+}
+
+func testRuleLifecycle(t *testing.T, s *Stores) {
+	ctx := context.Background()
+	rule := storeRule(t, s, "rule-1", nuggit.Rule{Hostname: "example.com", Labels: []string{"a"}})
+
+	// Storing the same rule again keeps the existing ID and replaces the labels.
+	again := storeRule(t, s, "rule-2", nuggit.Rule{Hostname: "example.com", Labels: []string{"b"}})
+	if again.GetID() != rule.GetID() {
+		t.Errorf("StoreRule(existing): got ID %q, want %q", again.GetID(), rule.GetID())
+	}
+	got, err := s.Rules.LoadRule(ctx, rule.GetID())
+	if err != nil {
+		t.Fatalf("LoadRule(%q): %v", rule.GetID(), err)
+	}
+	if got.Hostname != "example.com" || !slices.Equal(got.Labels, []string{"b"}) {
+		t.Errorf("LoadRule(%q): got %+v, want hostname example.com and labels [b]", rule.GetID(), got)
+	}
+
+	// Disable is not part of the identity of a rule.
+	if err := s.Rules.UpdateRule(ctx, &api.Rule{ID: rule.GetID(), Rule: nuggit.Rule{Hostname: "example.com", Labels: []string{"b"}, Disable: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if enabled := storeRule(t, s, "rule-4", nuggit.Rule{Hostname: "example.com", Labels: []string{"b"}}); enabled.GetID() != rule.GetID() {
+		t.Errorf("StoreRule(disabled rule): got ID %q, want %q", enabled.GetID(), rule.GetID())
+	}
+	if got, err := s.Rules.LoadRule(ctx, rule.GetID()); err != nil || got.Disable {
+		t.Errorf("LoadRule(stored again): got %+v, %v, want an enabled rule", got, err)
+	}
+
+	other := storeRule(t, s, "rule-3", nuggit.Rule{Hostname: "example.org"})
+	if rules := collect(t, s.Rules.ScanRules(ctx, &api.RuleFilter{Label: "b"})); len(rules) != 1 || rules[0].GetID() != rule.GetID() {
+		t.Errorf("ScanRules(label b): got %v, want [%q]", rules, rule.GetID())
+	}
+	if rules := collect(t, s.Rules.ScanRules(ctx, nil)); len(rules) != 2 {
+		t.Errorf("ScanRules: got %d rules, want 2", len(rules))
+	}
+
+	// Updating a rule to the fields of another rule conflicts.
+	if err := s.Rules.UpdateRule(ctx, &api.Rule{ID: other.GetID(), Rule: nuggit.Rule{Hostname: "example.com"}}); !errors.Is(err, status.ErrAlreadyExists) {
+		t.Errorf("UpdateRule(conflict): got error %v, want ErrAlreadyExists", err)
+	}
+	if err := s.Rules.UpdateRule(ctx, &api.Rule{ID: "missing", Rule: nuggit.Rule{Hostname: "example.net"}}); !errors.Is(err, status.ErrNotFound) {
+		t.Errorf("UpdateRule(missing): got error %v, want ErrNotFound", err)
+	}
+
+	// Concurrent updates of the same rule are not lost.
+	var wg sync.WaitGroup
+	for _, label := range []string{"c", "d", "e", "f"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Rules.UpdateRuleFunc(ctx, rule.GetID(), func(r *nuggit.Rule) { r.Labels = append(r.Labels, label) }); err != nil {
+				t.Errorf("UpdateRuleFunc(%q): %v", label, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got, err := s.Rules.LoadRule(ctx, rule.GetID()); err != nil || len(got.Labels) != 5 {
+		t.Errorf("LoadRule(after concurrent updates): got %+v, %v, want 5 labels", got, err)
+	}
+	if err := s.Rules.UpdateRuleFunc(ctx, other.GetID(), func(r *nuggit.Rule) { r.Hostname = "example.com" }); !errors.Is(err, status.ErrAlreadyExists) {
+		t.Errorf("UpdateRuleFunc(conflict): got error %v, want ErrAlreadyExists", err)
+	}
+
+	if err := s.Rules.DeleteRule(ctx, nuggit.Rule{Hostname: "example.org", Labels: []string{"x"}}); !errors.Is(err, status.ErrFailedPrecondition) {
+		t.Errorf("DeleteRule(wrong labels): got error %v, want ErrFailedPrecondition", err)
+	}
+	if err := s.Rules.DeleteRule(ctx, nuggit.Rule{Hostname: "example.org"}); err != nil {
+		t.Errorf("DeleteRule: %v", err)
+	}
+	if err := s.Rules.DeleteRuleByID(ctx, rule.GetID()); err != nil {
+		t.Errorf("DeleteRuleByID(%q): %v", rule.GetID(), err)
+	}
+	if _, err := s.Rules.LoadRule(ctx, rule.GetID()); !errors.Is(err, status.ErrNotFound) {
+		t.Errorf("LoadRule(deleted): got error %v, want ErrNotFound", err)
+	}
+	if err := s.Rules.DeleteRuleByID(ctx, rule.GetID()); !errors.Is(err, status.ErrNotFound) {
+		t.Errorf("DeleteRuleByID(deleted): got error %v, want ErrNotFound", err)
+	}
+}
+
+func testRuleMatching(t *testing.T, s *Stores) {
+	ctx := context.Background()
+	news := newPipe(t, "headline", nuggit.Action{"action": "documentElement"})
+	shop := newPipe(t, "price", nuggit.Action{"action": "innerText"})
+	storeLabeledPipe(t, s, news, "news")
+	storeLabeledPipe(t, s, shop, "shop")
+
+	storeRule(t, s, "rule-news", nuggit.Rule{Hostname: "*.example.com", PathGlob: "/news/**", Labels: []string{"news"}})
+	storeRule(t, s, "rule-shop", nuggit.Rule{Hostname: "shop.example.com", Labels: []string{"shop"}})
+	disabled := storeRule(t, s, "rule-disabled", nuggit.Rule{Hostname: "news.example.com", Labels: []string{"shop"}})
+	disabled.Disable = true
+	if err := s.Rules.UpdateRule(ctx, disabled); err != nil {
+		t.Fatal(err)
+	}
+	storeRule(t, s, "rule-invalid", nuggit.Rule{Hostname: "bad.example.com", URLPattern: "(", Labels: []string{"news"}})
+
+	for _, tc := range []struct {
+		url   string
+		rules []string
+		pipes []*api.Pipe
+	}{
+		{"https://news.example.com/news/2024/story", []string{"rule-news"}, []*api.Pipe{news}},
+		// The disabled rule shares the shop label so the shop pipe is suppressed.
+		{"https://SHOP.example.com/news/sale?utm_source=x", []string{"rule-news", "rule-shop"}, []*api.Pipe{news}},
+		{"https://example.com/news/story", nil, nil},
+		{"https://news.example.com/", nil, nil},
+		// The rule with an invalid pattern is skipped without failing the others.
+		{"https://bad.example.com/news/story", []string{"rule-news"}, []*api.Pipe{news}},
+	} {
+		u := mustParseURL(t, tc.url)
+		var ids []string
+		for _, r := range collect(t, s.Rules.ScanMatchedRules(ctx, u)) {
+			ids = append(ids, r.GetID())
+		}
+		slices.Sort(ids)
+		if !slices.Equal(ids, tc.rules) {
+			t.Errorf("ScanMatchedRules(%q): got %v, want %v", tc.url, ids, tc.rules)
+		}
+		if got, want := pipeKeys(collect(t, s.Rules.ScanMatched(ctx, u))), pipeKeys(tc.pipes); !slices.Equal(got, want) {
+			t.Errorf("ScanMatched(%q): got %v, want %v", tc.url, got, want)
+		}
+	}
+}
+
+func testLabelDisabling(t *testing.T, s *Stores) {
+	ctx := context.Background()
+	v1 := newPipe(t, "title", nuggit.Action{"action": "documentElement"})
+	storeLabeledPipe(t, s, v1, "news", "title")
+
+	if got := pipeKeys(collect(t, s.Rules.ScanLabeledPipes(ctx, []string{"news"}))); !slices.Equal(got, pipeKeys([]*api.Pipe{v1})) {
+		t.Errorf("ScanLabeledPipes: got %v, want [%v]", got, integrity.Key(v1))
+	}
+
+	// Storing a new digest of the same name disables the older one.
+	v2 := newPipe(t, "title", nuggit.Action{"action": "documentElement"}, nuggit.Action{"action": "innerText"})
+	storePipes(t, s, v2)
+	if got := collect(t, s.Rules.ScanLabeledPipes(ctx, []string{"news", "title"})); len(got) != 0 {
+		t.Errorf("ScanLabeledPipes(after new digest): got %v, want none", pipeKeys(got))
+	}
+
+	if err := s.Resources.StorePipeResource(ctx, &api.Resource{APIVersion: "v1", Kind: api.KindPipe, Metadata: &api.ResourceMetadata{Labels: []string{"news"}}}, v2); err != nil {
+		t.Fatal(err)
+	}
+	if got := pipeKeys(collect(t, s.Rules.ScanLabeledPipes(ctx, []string{"news"}))); !slices.Equal(got, pipeKeys([]*api.Pipe{v2})) {
+		t.Errorf("ScanLabeledPipes(new digest): got %v, want [%v]", got, integrity.Key(v2))
+	}
+	if err := s.Resources.StorePipeResource(ctx, &api.Resource{APIVersion: "v1", Kind: api.KindPipe}, v2); !errors.Is(err, status.ErrAlreadyExists) {
+		t.Errorf("StorePipeResource(existing): got error %v, want ErrAlreadyExists", err)
+	}
+}
+
+func testResources(t *testing.T, s *Stores) {
+	ctx := context.Background()
+	base := newPipe(t, "base", nuggit.Action{"action": "documentElement"})
+	title := newPipe(t, "title", pipeRef(base))
+	storePipes(t, s, base, title)
+	for _, r := range []struct {
+		pipe   *api.Pipe
+		labels []string
+	}{{base, []string{"news"}}, {title, []string{"news", "sports"}}} {
+		if err := s.Resources.StorePipeResource(ctx, &api.Resource{
+			APIVersion: api.V1,
+			Kind:       api.KindPipe,
+			Metadata:   &api.ResourceMetadata{Name: r.pipe.GetName(), Digest: r.pipe.GetDigest(), Labels: r.labels},
+		}, r.pipe); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rule := &api.Rule{ID: "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c77", Rule: nuggit.Rule{Hostname: "example.com"}}
+	if err := s.Rules.StoreRule(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Resources.StoreRuleResource(ctx, &api.Resource{
+		APIVersion: api.V1,
+		Kind:       api.KindRule,
+		Metadata:   &api.ResourceMetadata{Name: "example", Digest: "abc123"},
+	}, rule); err != nil {
+		t.Fatal(err)
+	}
+
+	resourceKeys := func(filter *api.ResourceFilter) []string {
+		var keys []string
+		for _, r := range collect(t, s.Resources.ScanResources(ctx, filter)) {
+			keys = append(keys, r.GetKind()+" "+pipeKey(r))
+		}
+		return keys
+	}
+	for _, tc := range []struct {
+		filter *api.ResourceFilter
+		want   []string
+	}{
+		{nil, []string{"pipe " + pipeKey(base), "pipe " + pipeKey(title), "rule example@abc123"}},
+		{&api.ResourceFilter{Labels: []string{"news", "sports"}}, []string{"pipe " + pipeKey(title)}},
+		{&api.ResourceFilter{Name: "base", Digest: base.GetDigest()}, []string{"pipe " + pipeKey(base)}},
+		{&api.ResourceFilter{Kind: api.KindRule}, []string{"rule example@abc123"}},
+		{&api.ResourceFilter{UUID: rule.ID}, []string{"rule example@abc123"}},
+		{&api.ResourceFilter{Kind: api.KindView}, nil},
+	} {
+		if got := resourceKeys(tc.filter); !slices.Equal(got, tc.want) {
+			t.Errorf("ScanResources(%+v): got %q, want %q", tc.filter, got, tc.want)
+		}
+	}
+	rs := collect(t, s.Resources.ScanResources(ctx, &api.ResourceFilter{Kind: api.KindRule}))
+	if len(rs) != 1 || rs[0].GetRule().GetHostname() != "example.com" {
+		t.Errorf("ScanResources(rule): got spec %+v, want the stored rule", rs)
+	}
+	// Updating the rule keeps its resource.
+	if err := s.Rules.UpdateRule(ctx, &api.Rule{ID: rule.ID, Rule: nuggit.Rule{Hostname: "example.com", Disable: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resourceKeys(&api.ResourceFilter{Kind: api.KindRule}), []string{"rule example@abc123"}; !slices.Equal(got, want) {
+		t.Errorf("ScanResources(after UpdateRule): got %q, want %q", got, want)
+	}
+
+	if err := s.Pipes.Delete(ctx, base); !errors.Is(err, status.ErrFailedPrecondition) {
+		t.Errorf("Delete(pipe with dependents): got error %v, want ErrFailedPrecondition", err)
+	}
+	for _, p := range []*api.Pipe{title, base} {
+		if err := s.Pipes.Delete(ctx, p); err != nil {
+			t.Errorf("Delete(%q): %v", pipeKey(p), err)
+		}
+	}
+	if err := s.Pipes.Delete(ctx, base); !errors.Is(err, status.ErrNotFound) {
+		t.Errorf("Delete(deleted pipe): got error %v, want ErrNotFound", err)
+	}
+	if err := s.Rules.DeleteRuleByID(ctx, rule.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := resourceKeys(nil); len(got) > 0 {
+		t.Errorf("ScanResources(after delete): got %q, want no resources", got)
+	}
+}
+
+func testPlanRoundTrip(t *testing.T, s *Stores) {
+	ctx := context.Background()
+	const plan = "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c10"
+	want := &trigger.Plan{
+		Exchanges: []int{0},
+		Steps:     []trigger.PlanStep{{Action: nuggit.Action{"action": "exchange"}}},
+		Canonical: &nuggit.CanonicalURL{KeepFragment: true},
+	}
+	if err := s.Plans.Store(ctx, plan, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Plans.Load(ctx, plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.GetExchanges(), want.Exchanges) || len(got.GetSteps()) != 1 || !got.GetCanonical().GetKeepFragment() {
+		t.Errorf("Load(): got plan %+v, want %+v", got, want)
+	}
+	if _, err := s.Plans.Load(ctx, "missing"); !errors.Is(err, status.ErrNotFound) {
+		t.Errorf("Load(missing): got error %v, want ErrNotFound", err)
+	}
+}
+
+func testResultBatches(t *testing.T, s *Stores) {
+	ctx := context.Background()
+	pipe := newPipe(t, "title", nuggit.Action{"action": "documentElement"})
+	storePipes(t, s, pipe)
+
+	const plan = "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c11"
+	if err := s.Plans.Store(ctx, plan, &trigger.Plan{}); err != nil {
+		t.Fatal(err)
+	}
+
+	event := &api.TriggerEvent{Plan: plan, URL: "https://example.com/", Event: "page-1"}
+	results := []api.TriggerResult{{Pipe: pipeKey(pipe), Result: "title"}}
+	store := func(batch *api.TriggerBatch) error {
+		return s.Results.StoreResults(ctx, event, batch, results)
+	}
+
+	if err := store(&api.TriggerBatch{Sequence: seq(0), IdempotencyKey: "k0"}); err != nil {
+		t.Fatalf("StoreResults(batch 0): %v", err)
+	}
+	if err := store(&api.TriggerBatch{Sequence: seq(1), IdempotencyKey: "k1"}); err != nil {
+		t.Fatalf("StoreResults(batch 1): %v", err)
+	}
+	if err := store(&api.TriggerBatch{Sequence: seq(1), IdempotencyKey: "k2"}); !errors.Is(err, status.ErrFailedPrecondition) {
+		t.Errorf("StoreResults(sequence with another idempotency key): got error %v, want ErrFailedPrecondition", err)
+	}
+	if err := store(&api.TriggerBatch{Sequence: seq(2), IdempotencyKey: "k0"}); !errors.Is(err, status.ErrAlreadyExists) {
+		t.Errorf("StoreResults(replayed idempotency key): got error %v, want ErrAlreadyExists", err)
+	}
+	if err := store(&api.TriggerBatch{Sequence: seq(2), IdempotencyKey: "k2"}); err != nil {
+		t.Errorf("StoreResults(batch 2): %v", err)
+	}
+
+	// Batches without a sequence only collide on their idempotency key.
+	event = &api.TriggerEvent{Plan: plan, URL: "https://example.com/", Event: "page-2"}
+	for _, key := range []string{"k3", "k4"} {
+		if err := store(&api.TriggerBatch{IdempotencyKey: key}); err != nil {
+			t.Errorf("StoreResults(batch %q without sequence): %v", key, err)
+		}
+	}
+	if err := store(&api.TriggerBatch{IdempotencyKey: "k4"}); !errors.Is(err, status.ErrAlreadyExists) {
+		t.Errorf("StoreResults(replayed batch without sequence): got error %v, want ErrAlreadyExists", err)
+	}
+
+	// Events without a key are stored separately.
+	event = &api.TriggerEvent{Plan: plan, URL: "https://example.com/"}
+	if err := store(nil); err != nil {
+		t.Errorf("StoreResults(no batch): %v", err)
+	}
+	if err := store(nil); err != nil {
+		t.Errorf("StoreResults(no batch again): %v", err)
+	}
+
+	event = &api.TriggerEvent{Plan: "0192d5c1-5f1a-7c3e-9a9b-000000000000"}
+	if err := store(nil); !errors.Is(err, status.ErrNotFound) {
+		t.Errorf("StoreResults(missing plan): got error %v, want ErrNotFound", err)
+	}
+}
+
+func testStreamedResults(t *testing.T, s *Stores) {
+	ctx := context.Background()
+	pipe := newPipe(t, "title", nuggit.Action{"action": "documentElement"})
+	storePipes(t, s, pipe)
+
+	const plan = "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c11"
+	if err := s.Plans.Store(ctx, plan, &trigger.Plan{}); err != nil {
+		t.Fatal(err)
+	}
+
+	event := &api.TriggerEvent{Plan: plan, URL: "https://example.com/", Event: "page-1"}
+	batch := &api.TriggerBatch{Sequence: seq(0)}
+	errTooLarge := fmt.Errorf("result is too large: %w", status.ErrResourceExhausted)
+	failing := func(yield func(api.TriggerResult, error) bool) {
+		if yield(api.TriggerResult{Pipe: pipeKey(pipe), Result: "title"}, nil) {
+			yield(api.TriggerResult{}, errTooLarge)
+		}
+	}
+	if err := s.Results.StreamResults(ctx, event, batch, failing); !errors.Is(err, status.ErrResourceExhausted) {
+		t.Errorf("StreamResults(failing): got error %v, want ErrResourceExhausted", err)
+	}
+	// Nothing was stored so the batch is not a replay.
+	if err := s.Results.StoreResults(ctx, event, batch, []api.TriggerResult{{Pipe: pipeKey(pipe), Result: "title"}}); err != nil {
+		t.Errorf("StoreResults(after failed stream): %v", err)
+	}
+}
+
+func testViewRows(t *testing.T, s *Stores) {
+	ctx := context.Background()
+	title := newPipe(t, "title", nuggit.Action{"action": "documentElement"})
+	price := &api.Pipe{Name: "price", Pipe: nuggit.Pipe{
+		Actions: []nuggit.Action{{"action": "documentElement"}},
+		Point:   nuggit.Point{Scalar: nuggit.Int},
+	}}
+	if err := integrity.SetDigest(price); err != nil {
+		t.Fatal(err)
+	}
+	other := newPipe(t, "other", nuggit.Action{"action": "documentElement"})
+	storePipes(t, s, title, price, other)
+
+	const uuid = "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c22"
+	view := nuggit.View{Alias: "products", Columns: []nuggit.ViewColumn{
+		{Pipe: pipeKey(title), Point: nuggit.Point{Scalar: nuggit.String}},
+		{Pipe: pipeKey(price), Alias: "cost", Point: nuggit.Point{Scalar: nuggit.Int}},
+	}}
+	if err := s.Views.Store(ctx, uuid, view); err != nil {
+		t.Fatal(err)
+	}
+
+	const plan = "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c11"
+	if err := s.Plans.Store(ctx, plan, &trigger.Plan{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct {
+		title string
+		price int
+		hour  int
+	}{{"a", 30, 3}, {"b", 10, 1}, {"c", 20, 2}} {
+		event := &api.TriggerEvent{Plan: plan, URL: "https://example.com/" + r.title, Timestamp: time.Date(2024, 1, 1, r.hour, 0, 0, 0, time.UTC)}
+		if err := s.Results.StoreResults(ctx, event, nil, []api.TriggerResult{
+			{Pipe: pipeKey(title), Result: r.title, Scalar: nuggit.String},
+			{Pipe: pipeKey(price), Result: r.price, Scalar: nuggit.Int},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Events without results for the view pipes have no rows.
+	if err := s.Results.StoreResults(ctx, &api.TriggerEvent{Plan: plan}, nil, []api.TriggerResult{{Pipe: pipeKey(other), Result: "x"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := s.Views.Load(ctx, "products"); err != nil || v.GetID() != uuid {
+		t.Errorf("Load(alias): got %q, %v, want %q", v.GetID(), err, uuid)
+	}
+	if views := collect(t, s.Views.Scan(ctx)); len(views) != 1 || views[0].GetAlias() != "products" {
+		t.Errorf("Scan(): got %d views, want products", len(views))
+	}
+
+	var a api.ViewsAPI
+	a.Init(s.Views, s.Pipes)
+	// query returns the titles of all pages of rows.
+	query := func(req *api.QueryViewRequest) string {
+		t.Helper()
+		req.View = "products"
+		req.Columns = []string{"title"}
+		var titles []any
+		for range 10 {
+			resp, err := a.QueryView(ctx, req)
+			if err != nil {
+				t.Fatalf("QueryView(): %v", err)
+			}
+			for _, row := range resp.Rows {
+				titles = append(titles, row...)
+			}
+			if resp.NextCursor == "" {
+				return fmt.Sprint(titles...)
+			}
+			req.Cursor = resp.NextCursor
+		}
+		t.Fatalf("QueryView(): got too many pages of rows (%v)", titles)
+		return ""
+	}
+	for _, tc := range []struct {
+		name string
+		req  *api.QueryViewRequest
+		want string
+	}{
+		{"all", &api.QueryViewRequest{}, "abc"},
+		{"order", &api.QueryViewRequest{OrderBy: "cost", Limit: 2}, "bca"},
+		{"desc", &api.QueryViewRequest{OrderBy: "cost", Desc: true, Limit: 1}, "acb"},
+		{"timestamp", &api.QueryViewRequest{OrderBy: "timestamp", Limit: 1}, "bca"},
+		{"timestamp desc", &api.QueryViewRequest{OrderBy: "timestamp", Desc: true, Limit: 1}, "acb"},
+		{"filter", &api.QueryViewRequest{Filters: []api.ViewFilter{{Column: "cost", Op: api.ViewFilterGt, Value: "15"}}}, "ac"},
+		{"contains", &api.QueryViewRequest{Filters: []api.ViewFilter{{Column: "url", Op: api.ViewFilterContains, Value: "/b"}}}, "b"},
+	} {
+		if got := query(tc.req); got != tc.want {
+			t.Errorf("QueryView(%s): got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := a.QueryView(ctx, &api.QueryViewRequest{View: "products", Columns: []string{"missing"}}); !errors.Is(err, status.ErrInvalidArgument) {
+		t.Errorf("QueryView(missing column): got error %v, want ErrInvalidArgument", err)
+	}
+}
+
+func testViewLifecycle(t *testing.T, s *Stores) {
+	ctx := context.Background()
+	title := newPipe(t, "title", nuggit.Action{"action": "documentElement"})
+	storePipes(t, s, title)
+
+	const uuid = "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c33"
+	view := nuggit.View{Alias: "titles", Columns: []nuggit.ViewColumn{
+		{Pipe: pipeKey(title), Point: nuggit.Point{Scalar: nuggit.String}},
+	}}
+	if err := s.Views.Store(ctx, uuid, view); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Views.Store(ctx, "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c44", view); !errors.Is(err, status.ErrAlreadyExists) {
+		t.Errorf("Store(identical): got error %v, want ErrAlreadyExists", err)
+	}
+
+	view.Columns[0].Alias = "name"
+	if err := s.Views.Update(ctx, uuid, view); err != nil {
+		t.Fatalf("Update(%q): %v", uuid, err)
+	}
+	if v, err := s.Views.Load(ctx, "titles"); err != nil || v.GetID() != uuid || v.Columns[0].Alias != "name" {
+		t.Errorf("Load(updated): got %+v, %v, want column alias name", v, err)
+	}
+	if err := s.Views.Update(ctx, "missing", view); !errors.Is(err, status.ErrNotFound) {
+		t.Errorf("Update(missing): got error %v, want ErrNotFound", err)
+	}
+
+	if err := s.Views.Delete(ctx, uuid); err != nil {
+		t.Fatalf("Delete(%q): %v", uuid, err)
+	}
+	if _, err := s.Views.Load(ctx, uuid); !errors.Is(err, status.ErrNotFound) {
+		t.Errorf("Load(deleted): got error %v, want ErrNotFound", err)
+	}
+	if err := s.Views.Delete(ctx, uuid); !errors.Is(err, status.ErrNotFound) {
+		t.Errorf("Delete(deleted): got error %v, want ErrNotFound", err)
+	}
+}
+
+func testFloatingViewColumns(t *testing.T, s *Stores) {
+	ctx := context.Background()
+	v1 := newPipe(t, "title", nuggit.Action{"action": "documentElement"})
+	storeLabeledPipe(t, s, v1, "news")
+
+	const uuid = "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c55"
+	view := nuggit.View{Alias: "titles", Columns: []nuggit.ViewColumn{
+		{Pipe: "title", Point: nuggit.Point{Scalar: nuggit.String}, Floating: true, WithDigest: true},
+	}}
+	if err := s.Views.Store(ctx, uuid, view); err != nil {
+		t.Fatal(err)
+	}
+
+	const plan = "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c11"
+	if err := s.Plans.Store(ctx, plan, &trigger.Plan{}); err != nil {
+		t.Fatal(err)
+	}
+	storeTitle := func(pipe *api.Pipe, title string) {
+		t.Helper()
+		event := &api.TriggerEvent{Plan: plan, URL: "https://example.com/" + title}
+		if err := s.Results.StoreResults(ctx, event, nil, []api.TriggerResult{{Pipe: pipeKey(pipe), Result: title, Scalar: nuggit.String}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storeTitle(v1, "a")
+	storeTitle(v1, "b")
+
+	// Publishing a new version of the pipe keeps the rows of the old version.
+	v2 := newPipe(t, "title", nuggit.Action{"action": "innerText"})
+	storeLabeledPipe(t, s, v2, "news")
+	storeTitle(v2, "c")
+
+	// When both versions have a result in the row, the value and digest are of the newest version.
+	event := &api.TriggerEvent{Plan: plan, URL: "https://example.com/d"}
+	if err := s.Results.StoreResults(ctx, event, nil, []api.TriggerResult{
+		{Pipe: pipeKey(v1), Result: "x", Scalar: nuggit.String},
+		{Pipe: pipeKey(v2), Result: "d", Scalar: nuggit.String},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var a api.ViewsAPI
+	a.Init(s.Views, s.Pipes)
+	resp, err := a.QueryView(ctx, &api.QueryViewRequest{View: "titles", Columns: []string{"title", "title_digest"}})
+	if err != nil {
+		t.Fatalf("QueryView(): %v", err)
+	}
+	want := fmt.Sprint([][]any{{"a", v1.GetDigest()}, {"b", v1.GetDigest()}, {"c", v2.GetDigest()}, {"d", v2.GetDigest()}})
+	if got := fmt.Sprint(resp.Rows); got != want {
+		t.Errorf("QueryView(): got %s, want %s", got, want)
+	}
+}
+
+func testChanges(t *testing.T, s *Stores) {
+	ctx := context.Background()
+	price := newPipe(t, "price", nuggit.Action{"action": "documentElement"})
+	storePipes(t, s, price)
+
+	const plan = "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c11"
+	if err := s.Plans.Store(ctx, plan, &trigger.Plan{}); err != nil {
+		t.Fatal(err)
+	}
+	storePrices := func(url string, prices ...string) {
+		t.Helper()
+		event := &api.TriggerEvent{Plan: plan, URL: url}
+		if err := s.Results.StoreResults(ctx, event, nil, []api.TriggerResult{{Pipe: pipeKey(price), Result: prices, Scalar: nuggit.String}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storePrices("https://example.com/a", "1", "2")
+	storePrices("https://example.com/b", "5")
+	storePrices("https://example.com/a", "1", "3", "4")
+	storePrices("https://example.com/a", "1")
+
+	changes := func(filter *api.ChangeFilter) string {
+		t.Helper()
+		var got []string
+		for c, err := range s.Results.ScanChanges(ctx, filter) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, fmt.Sprintf("%d:%d:%s:%v:%v", c.Event-c.PrevEvent, c.Sequence, c.Kind, c.Old, c.New))
+		}
+		return fmt.Sprint(got)
+	}
+	for _, tc := range []struct {
+		name   string
+		filter *api.ChangeFilter
+		want   string
+	}{
+		{"all", nil, "[2:1:changed:2:3 2:2:added:<nil>:4 1:1:removed:3:<nil> 1:2:removed:4:<nil>]"},
+		{"url", &api.ChangeFilter{URL: "https://example.com/b"}, "[]"},
+		{"kind", &api.ChangeFilter{Kind: api.ChangeAdded}, "[2:2:added:<nil>:4]"},
+		{"pipe", &api.ChangeFilter{Pipe: integrity.KeyLit("price", "")}, "[2:1:changed:2:3 2:2:added:<nil>:4 1:1:removed:3:<nil> 1:2:removed:4:<nil>]"},
+		{"other pipe", &api.ChangeFilter{Pipe: integrity.KeyLit("title", "")}, "[]"},
+	} {
+		if got := changes(tc.filter); got != tc.want {
+			t.Errorf("ScanChanges(%s): got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+
+	// Values of plan pipes without results in the event are removed.
+	stock := newPipe(t, "stock", nuggit.Action{"action": "documentElement"})
+	storePipes(t, s, stock)
+	const stockPlan = "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c22"
+	exchange := trigger.PlanStep{Action: nuggit.Action{"action": "exchange", "name": stock.GetName(), "digest": stock.GetDigest()}}
+	if err := s.Plans.Store(ctx, stockPlan, &trigger.Plan{Exchanges: []int{0}, Steps: []trigger.PlanStep{exchange}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, results := range [][]api.TriggerResult{
+		{{Pipe: pipeKey(stock), Result: []string{"in stock"}, Scalar: nuggit.String}},
+		{{Pipe: pipeKey(price), Result: []string{"6"}, Scalar: nuggit.String}},
+	} {
+		if err := s.Results.StoreResults(ctx, &api.TriggerEvent{Plan: stockPlan, URL: "https://example.com/c"}, nil, results); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := changes(&api.ChangeFilter{URL: "https://example.com/c"}), "[1:0:removed:in stock:<nil>]"; got != want {
+		t.Errorf("ScanChanges(plan pipe without results): got %s, want %s", got, want)
+	}
+}
+
+func testChangesMultipleDigests(t *testing.T, s *Stores) {
+	ctx := context.Background()
+	titleA := newPipe(t, "title", nuggit.Action{"action": "documentElement"})
+	titleB := newPipe(t, "title", nuggit.Action{"action": "innerText"})
+	titleC := newPipe(t, "title", nuggit.Action{"action": "innerHTML"})
+	storePipes(t, s, titleA, titleB, titleC)
+	labels := map[string]string{pipeKey(titleA): "a", pipeKey(titleB): "b", pipeKey(titleC): "c"}
+
+	const plan = "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c11"
+	if err := s.Plans.Store(ctx, plan, &trigger.Plan{}); err != nil {
+		t.Fatal(err)
+	}
+	storeTitles := func(results ...api.TriggerResult) {
+		t.Helper()
+		event := &api.TriggerEvent{Plan: plan, URL: "https://example.com/"}
+		if err := s.Results.StoreResults(ctx, event, nil, results); err != nil {
+			t.Fatal(err)
+		}
+	}
+	title := func(p *api.Pipe, v string) api.TriggerResult {
+		return api.TriggerResult{Pipe: pipeKey(p), Result: v, Scalar: nuggit.String}
+	}
+	storeTitles(title(titleA, "x"), title(titleB, "y"))
+	storeTitles(title(titleA, "x2"), title(titleB, "y"))
+	// C replaces A and is compared with it by name.
+	storeTitles(title(titleC, "x3"), title(titleB, "y"))
+
+	var got []string
+	for c, err := range s.Results.ScanChanges(ctx, nil) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s:%d:%s:%v:%v", labels[c.Pipe], c.Sequence, c.Kind, c.Old, c.New))
+	}
+	if want := "[a:0:changed:x:x2 c:0:changed:x2:x3]"; fmt.Sprint(got) != want {
+		t.Errorf("ScanChanges(multiple digests): got %s, want %s", got, want)
+	}
+}
+
+func testRepeats(t *testing.T, s *Stores) {
+	ctx := context.Background()
+	title := newPipe(t, "title", nuggit.Action{"action": "documentElement"})
+	storePipes(t, s, title)
+
+	columns := []nuggit.ViewColumn{{Pipe: pipeKey(title), Point: nuggit.Point{Scalar: nuggit.String}}}
+	if err := s.Views.Store(ctx, "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c66", nuggit.View{Alias: "titles", Columns: columns}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Views.Store(ctx, "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c77", nuggit.View{Alias: "repeats", Columns: columns, Repeats: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	const plan = "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c11"
+	if err := s.Plans.Store(ctx, plan, &trigger.Plan{}); err != nil {
+		t.Fatal(err)
+	}
+	storeTitle := func(key string, batch int, titles ...string) {
+		t.Helper()
+		event := &api.TriggerEvent{Plan: plan, Event: key, URL: "https://example.com/"}
+		if err := s.Results.StoreResults(ctx, event, &api.TriggerBatch{Sequence: seq(batch)}, []api.TriggerResult{{Pipe: pipeKey(title), Result: titles, Scalar: nuggit.String}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storeTitle("", 0, "a")
+	storeTitle("", 0, "a") // Repeat.
+	storeTitle("", 0, "b")
+	storeTitle("k", 0, "b") // Repeat.
+	storeTitle("k", 1, "c") // Later batches keep the repeated results.
+	storeTitle("p", 0, "d")
+	storeTitle("", 0, "d")  // Repeat.
+	storeTitle("p", 1, "e") // The repeat keeps the results it repeated.
+	storeTitle("", 0, "f", "g")
+	storeTitle("m", 0, "f")
+	storeTitle("m", 1, "g") // Repeat once the batches are complete.
+
+	var a api.ViewsAPI
+	a.Init(s.Views, s.Pipes)
+	for _, tc := range []struct {
+		view string
+		want string
+	}{
+		{"titles", "[[a] [b] [b] [c] [d] [e] [d] [f] [g]]"},
+		{"repeats", "[[a] [a] [b] [b] [c] [d] [e] [d] [f] [g] [f] [g]]"},
+	} {
+		resp, err := a.QueryView(ctx, &api.QueryViewRequest{View: tc.view, Columns: []string{"title"}})
+		if err != nil {
+			t.Fatalf("QueryView(%s): %v", tc.view, err)
+		}
+		if got := fmt.Sprint(resp.Rows); got != tc.want {
+			t.Errorf("QueryView(%s): got %s, want %s", tc.view, got, tc.want)
+		}
+	}
+}
+
+func testSearch(t *testing.T, s *Stores) {
+	ctx := context.Background()
+	headline := newPipe(t, "headline", nuggit.Action{"action": "documentElement"})
+	headline.Point = nuggit.Point{Scalar: nuggit.String}
+	body := newPipe(t, "body", nuggit.Action{"action": "documentElement"})
+	body.Point = nuggit.Point{Scalar: nuggit.String}
+	html := newPipe(t, "html", nuggit.Action{"action": "documentElement"})
+	for _, p := range []*api.Pipe{headline, body} {
+		if err := integrity.SetDigest(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storePipes(t, s, headline, body, html)
+
+	const plan = "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c11"
+	if err := s.Plans.Store(ctx, plan, &trigger.Plan{}); err != nil {
+		t.Fatal(err)
+	}
+	storeResults := func(url string, results ...api.TriggerResult) {
+		t.Helper()
+		event := &api.TriggerEvent{Plan: plan, URL: url}
+		if err := s.Results.StoreResults(ctx, event, nil, results); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storeResults("https://example.com/a",
+		api.TriggerResult{Pipe: pipeKey(headline), Result: "Election results announced", Scalar: nuggit.String},
+		api.TriggerResult{Pipe: pipeKey(body), Result: "The election was close.", Scalar: nuggit.String})
+	storeResults("https://example.com/b",
+		api.TriggerResult{Pipe: pipeKey(headline), Result: "Local team wins", Scalar: nuggit.String},
+		api.TriggerResult{Pipe: pipeKey(html), Result: "<p>election</p>"})
+
+	search := func(filter *api.SearchFilter) string {
+		t.Helper()
+		var got []string
+		for h, err := range s.Results.SearchResults(ctx, filter) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(strings.ToLower(h.Snippet), strings.ToLower(filter.Query)) {
+				t.Errorf("SearchResults(%q): snippet %q does not contain the query", filter.Query, h.Snippet)
+			}
+			name, _, _ := strings.Cut(h.Pipe, "@")
+			got = append(got, fmt.Sprintf("%s:%s:%d", path.Base(h.URL), name, h.Sequence))
+		}
+		slices.Sort(got) // Relevance order is up to the store.
+		return fmt.Sprint(got)
+	}
+	for _, tc := range []struct {
+		name   string
+		filter *api.SearchFilter
+		want   string
+	}{
+		{"all", &api.SearchFilter{Query: "election"}, "[a:body:0 a:headline:0]"},
+		{"pipe", &api.SearchFilter{Query: "election", Pipe: integrity.KeyLit("headline", "")}, "[a:headline:0]"},
+		{"url", &api.SearchFilter{Query: "election", URL: "https://example.com/b"}, "[]"},
+		{"other", &api.SearchFilter{Query: "team"}, "[b:headline:0]"},
+		{"none", &api.SearchFilter{Query: "weather"}, "[]"},
+	} {
+		if got := search(tc.filter); got != tc.want {
+			t.Errorf("SearchResults(%s): got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+	// Pages split the hits in relevance order.
+	first, rest := search(&api.SearchFilter{Query: "election", Limit: 1}), search(&api.SearchFilter{Query: "election", Offset: 1})
+	pages := []string{first, rest}
+	slices.Sort(pages)
+	if fmt.Sprint(pages) != "[[a:body:0] [a:headline:0]]" {
+		t.Errorf("SearchResults(pages): got %s and %s, want one hit each", first, rest)
+	}
+
+	var a api.SearchAPI
+	a.Init(s.Results)
+	if _, err := a.SearchResults(ctx, &api.SearchResultsRequest{}); !errors.Is(err, status.ErrInvalidArgument) {
+		t.Errorf("SearchResults(empty query): got %v, want InvalidArgument", err)
+	}
+}
@@ -2,14 +2,17 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"maps"
 	"net/url"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/wenooij/nuggit"
 	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/rules"
 	"github.com/wenooij/nuggit/status"
 	"github.com/wenooij/nuggit/trigger"
 )
@@ -25,7 +28,33 @@ func ValidateRule(c nuggit.Rule) error {
 			return fmt.Errorf("url pattern is not a valid re2 (%q): %v: %w", c.URLPattern, err, status.ErrInvalidArgument)
 		}
 	}
-	// TODO: Validate hostname.
+	if c.GetPathGlob() != "" {
+		if c.GetHostname() == "" {
+			return fmt.Errorf("path glob requires a hostname to be provided: %w", status.ErrInvalidArgument)
+		}
+		if _, err := rules.CompilePathGlob(c.PathGlob); err != nil {
+			return err
+		}
+	}
+	if c.GetHostname() != "" {
+		if _, err := rules.NormalizeHostname(c.Hostname); err != nil {
+			return err
+		}
+	}
+	if c.GetScheme() != "" {
+		if _, err := rules.NormalizeScheme(c.Scheme); err != nil {
+			return err
+		}
+	}
+	if port := c.GetPort(); port < 0 || port > 65535 {
+		return fmt.Errorf("port is out of range (%d): %w", port, status.ErrInvalidArgument)
+	}
+	if err := rules.ValidatePolicy(c.GetPolicy()); err != nil {
+		return err
+	}
+	if err := rules.ValidateCanonical(c.GetCanonical()); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -33,7 +62,13 @@ type TriggerEvent struct {
 	Plan      string    `json:"plan,omitempty"`
 	Implicit  bool      `json:"implicit,omitempty"`
 	URL       string    `json:"url,omitempty"`
+	RawURL    string    `json:"raw_url,omitempty"` // Set by the server when URL is canonicalized.
 	Timestamp time.Time `json:"timestamp,omitempty"`
+	// Event is a client chosen identifier for the event which is unique within the Plan.
+	//
+	// Exchanges sharing the same Event are appended to the same stored event.
+	// When Event is empty, each exchange creates a new event.
+	Event string `json:"event,omitempty"`
 }
 
 func (e *TriggerEvent) GetPlan() string {
@@ -57,6 +92,13 @@ func (e *TriggerEvent) GetURL() string {
 	return e.URL
 }
 
+func (e *TriggerEvent) GetRawURL() string {
+	if e == nil {
+		return ""
+	}
+	return e.RawURL
+}
+
 func (e *TriggerEvent) GetTimestamp() time.Time {
 	if e == nil {
 		return time.Time{}
@@ -64,6 +106,40 @@ func (e *TriggerEvent) GetTimestamp() time.Time {
 	return e.Timestamp
 }
 
+func (e *TriggerEvent) GetEvent() string {
+	if e == nil {
+		return ""
+	}
+	return e.Event
+}
+
+// TriggerBatch identifies one batch of results exchanged for an event.
+//
+// Replaying a batch with the same Sequence and IdempotencyKey for an event,
+// or the same IdempotencyKey within a Plan, is a no-op.
+// Reusing a Sequence of an event with a different IdempotencyKey is an error.
+// Batches without a Sequence only collide on their IdempotencyKey.
+type TriggerBatch struct {
+	Sequence       *int   `json:"sequence,omitempty"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+func (b *TriggerBatch) GetSequence() int {
+	if b == nil || b.Sequence == nil {
+		return 0
+	}
+	return *b.Sequence
+}
+
+func (b *TriggerBatch) HasSequence() bool { return b != nil && b.Sequence != nil }
+
+func (b *TriggerBatch) GetIdempotencyKey() string {
+	if b == nil {
+		return ""
+	}
+	return b.IdempotencyKey
+}
+
 // TODO: Add Point to this struct.
 type TriggerResult struct {
 	Pipe   string        `json:"pipe,omitempty"`
@@ -91,15 +167,17 @@ type TriggerAPI struct {
 	plans      PlanStore
 	results    ResultStore
 	newPlanner func() TriggerPlanner
+	limiter    *rules.Limiter
 }
 
-func (a *TriggerAPI) Init(rules RuleStore, pipes PipeStore, planStore PlanStore, resultStore ResultStore, newPlanner func() TriggerPlanner) {
+func (a *TriggerAPI) Init(ruleStore RuleStore, pipes PipeStore, planStore PlanStore, resultStore ResultStore, newPlanner func() TriggerPlanner) {
 	*a = TriggerAPI{
-		rules:      rules,
+		rules:      ruleStore,
 		pipes:      pipes,
 		plans:      planStore,
 		results:    resultStore,
 		newPlanner: newPlanner,
+		limiter:    rules.NewLimiter(),
 	}
 }
 
@@ -108,11 +186,15 @@ type OpenTriggerRequest struct {
 	Implicit     bool                   `json:"implicit,omitempty"`
 	IncludePipes []integrity.NameDigest `json:"include_views,omitempty"`
 	ExcludePipes []integrity.NameDigest `json:"exclude_views,omitempty"`
+	// Explain requests a Reason in the response when the plan is empty.
+	Explain bool `json:"explain,omitempty"`
 }
 
 type OpenTriggerResponse struct {
 	Trigger *Ref          `json:"trigger,omitempty"`
 	Plan    *trigger.Plan `json:"plan,omitempty"`
+	// Reason explains an empty plan when Explain is set in the request.
+	Reason string `json:"reason,omitempty"`
 }
 
 func (a *TriggerAPI) OpenTrigger(ctx context.Context, req *OpenTriggerRequest) (*OpenTriggerResponse, error) {
@@ -124,9 +206,68 @@ func (a *TriggerAPI) OpenTrigger(ctx context.Context, req *OpenTriggerRequest) (
 		return nil, fmt.Errorf("%v: %w", err, status.ErrInvalidArgument)
 	}
 
+	// emptyPlan is returned when the plan is a no-op.
+	// Don't store the trigger and send empty response.
+	emptyPlan := func(reason string) (*OpenTriggerResponse, error) {
+		resp := &OpenTriggerResponse{}
+		if req.Explain {
+			resp.Reason = reason
+		}
+		return resp, nil
+	}
+
+	// Enforce rule policies before looking up the pipes.
+	// Allowed triggers are recorded against the policies once the plan is stored.
+	type allowedRule struct {
+		key    string
+		policy *nuggit.RulePolicy
+		url    *url.URL
+	}
+	now := time.Now()
+	var (
+		labels     []string
+		seenLabels = make(map[string]struct{})
+		reasons    []string
+		allowed    []allowedRule
+		canonicals []*nuggit.CanonicalURL
+	)
+	for rule, err := range a.rules.ScanMatchedRules(ctx, u) {
+		if err != nil {
+			return nil, err
+		}
+		key := rule.GetID()
+		if key == "" {
+			key = rules.Key(rule.GetRule())
+		}
+		cu := rules.Canonicalize(u, rule.GetCanonical())
+		if ok, reason := a.limiter.Check(key, rule.GetPolicy(), cu, now); !ok {
+			reasons = append(reasons, reason)
+			continue
+		}
+		allowed = append(allowed, allowedRule{key, rule.GetPolicy(), cu})
+		canonicals = append(canonicals, rule.GetCanonical())
+		for _, label := range rule.GetLabels() {
+			if _, found := seenLabels[label]; !found {
+				seenLabels[label] = struct{}{}
+				labels = append(labels, label)
+			}
+		}
+	}
+
+	if len(labels) == 0 {
+		switch {
+		case len(allowed) > 0:
+			return emptyPlan("matched rules have no labels")
+		case len(reasons) > 0:
+			return emptyPlan(fmt.Sprintf("matched rules were throttled: %s", strings.Join(reasons, "; ")))
+		default:
+			return emptyPlan("no rules matched the url")
+		}
+	}
+
 	pipes := make(map[integrity.NameDigest]*Pipe, 64)
 
-	for pipe, err := range a.rules.ScanMatched(ctx, u) {
+	for pipe, err := range a.rules.ScanLabeledPipes(ctx, labels) {
 		if err != nil {
 			return nil, err
 		}
@@ -134,9 +275,7 @@ func (a *TriggerAPI) OpenTrigger(ctx context.Context, req *OpenTriggerRequest) (
 	}
 
 	if len(pipes) == 0 {
-		// Plan is a no-op.
-		// Don't store the trigger and send empty response.
-		return &OpenTriggerResponse{}, nil
+		return emptyPlan("no enabled pipes are labeled by the matched rules")
 	}
 
 	tp := a.newPlanner()
@@ -162,10 +301,9 @@ func (a *TriggerAPI) OpenTrigger(ctx context.Context, req *OpenTriggerRequest) (
 
 	plan := tp.Build()
 	if len(plan.GetSteps()) == 0 {
-		// Plan is a no-op.
-		// Don't store the trigger and send empty response.
-		return &OpenTriggerResponse{}, nil
+		return emptyPlan("matched pipes have no steps")
 	}
+	plan.Canonical = rules.MergeCanonical(canonicals...)
 
 	// Store the plan and return it since is isn't a no-op.
 	planRef, err := newRef(triggersBaseURI)
@@ -176,6 +314,9 @@ func (a *TriggerAPI) OpenTrigger(ctx context.Context, req *OpenTriggerRequest) (
 	if err := a.plans.Store(ctx, planRef.ID, plan); err != nil {
 		return nil, err
 	}
+	for _, r := range allowed {
+		a.limiter.Record(r.key, r.policy, r.url, now)
+	}
 
 	return &OpenTriggerResponse{
 		Trigger: &planRef,
@@ -185,21 +326,80 @@ func (a *TriggerAPI) OpenTrigger(ctx context.Context, req *OpenTriggerRequest) (
 
 type ExchangeResultsRequest struct {
 	Trigger *TriggerEvent   `json:"trigger,omitempty"`
+	Batch   *TriggerBatch   `json:"batch,omitempty"`
 	Results []TriggerResult `json:"results,omitempty"`
 }
 
-type ExchangeResultsResponse struct{}
+type ExchangeResultsResponse struct {
+	// Replayed is set when the batch was already exchanged and nothing was stored.
+	Replayed bool `json:"replayed,omitempty"`
+}
 
 func (a *TriggerAPI) ExchangeResults(ctx context.Context, req *ExchangeResultsRequest) (*ExchangeResultsResponse, error) {
-	if err := provided("trigger", "is", req.Trigger); err != nil {
+	event, err := a.exchangeEvent(ctx, req.Trigger, req.Batch)
+	if err != nil {
+		return nil, err
+	}
+	return exchangeResponse(a.results.StoreResults(ctx, event, req.Batch, req.Results))
+}
+
+// StreamExchangeResults is like ExchangeResults but stores the results as they are decoded.
+func (a *TriggerAPI) StreamExchangeResults(ctx context.Context, req *ExchangeResultsStream) (*ExchangeResultsResponse, error) {
+	event, err := a.exchangeEvent(ctx, req.Trigger, req.Batch)
+	if err != nil {
+		return nil, err
+	}
+	return exchangeResponse(a.results.StreamResults(ctx, event, req.Batch, req.Results))
+}
+
+// exchangeEvent validates the exchange and returns the event canonicalized with the config of the plan.
+func (a *TriggerAPI) exchangeEvent(ctx context.Context, trigger *TriggerEvent, batch *TriggerBatch) (*TriggerEvent, error) {
+	if err := provided("trigger", "is", trigger); err != nil {
 		return nil, err
 	}
-	if err := a.results.StoreResults(ctx, req.Trigger, req.Results); err != nil {
+	if err := provided("plan", "is", trigger.GetPlan()); err != nil {
+		return nil, err
+	}
+	if seq := batch.GetSequence(); seq < 0 {
+		return nil, fmt.Errorf("batch sequence must not be negative (%d): %w", seq, status.ErrInvalidArgument)
+	}
+	if trigger.GetURL() == "" {
+		return canonicalEvent(trigger, nil)
+	}
+	plan, err := a.plans.Load(ctx, trigger.GetPlan())
+	if err != nil {
+		return nil, err
+	}
+	return canonicalEvent(trigger, plan.GetCanonical())
+}
+
+func exchangeResponse(err error) (*ExchangeResultsResponse, error) {
+	if err != nil {
+		if errors.Is(err, status.ErrAlreadyExists) {
+			// Replayed batches are a no-op.
+			// Stores report sequence conflicts with a different idempotency key as ErrFailedPrecondition.
+			return &ExchangeResultsResponse{Replayed: true}, nil
+		}
 		return nil, err
 	}
 	return &ExchangeResultsResponse{}, nil
 }
 
+// canonicalEvent returns a copy of the event with a canonical URL and the client URL in RawURL.
+func canonicalEvent(e *TriggerEvent, c *nuggit.CanonicalURL) (*TriggerEvent, error) {
+	event := *e
+	if event.URL == "" {
+		return &event, nil
+	}
+	u, err := url.Parse(event.URL)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, status.ErrInvalidArgument)
+	}
+	event.RawURL = event.URL
+	event.URL = rules.Canonicalize(u, c).String()
+	return &event, nil
+}
+
 type CloseTriggerRequest struct {
 	Trigger string `json:"trigger,omitempty"`
 }
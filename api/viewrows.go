@@ -0,0 +1,424 @@
+package api
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/expr"
+	"github.com/wenooij/nuggit/status"
+)
+
+// Columns every view has in addition to its pipe columns.
+const (
+	ViewTimestampColumn = "timestamp"
+	ViewURLColumn       = "url"
+)
+
+const (
+	defaultViewRowsLimit = 100
+	maxViewRowsLimit     = 1000
+)
+
+// ViewColumnName returns the name of the view column in view rows.
+func ViewColumnName(col nuggit.ViewColumn) string {
+	name := col.Alias
+	if name == "" {
+		name, _, _ = strings.Cut(col.Pipe, "@")
+	}
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// DigestColumnName returns the name of the pipe digest column of the view column in view rows.
+func DigestColumnName(col nuggit.ViewColumn) string { return ViewColumnName(col) + "_digest" }
+
+type ViewFilterOp = string
+
+const (
+	ViewFilterEq       ViewFilterOp = "eq"
+	ViewFilterNe       ViewFilterOp = "ne"
+	ViewFilterLt       ViewFilterOp = "lt"
+	ViewFilterLe       ViewFilterOp = "le"
+	ViewFilterGt       ViewFilterOp = "gt"
+	ViewFilterGe       ViewFilterOp = "ge"
+	ViewFilterContains ViewFilterOp = "contains"
+	ViewFilterNull     ViewFilterOp = "null"
+	ViewFilterNotNull  ViewFilterOp = "not_null"
+)
+
+// ViewFilter compares a column to a value.
+//
+// Null and not_null take no value. Values of other ops are converted
+// to the scalar type of the column.
+type ViewFilter struct {
+	Column string       `json:"column,omitempty"`
+	Op     ViewFilterOp `json:"op,omitempty"`
+	Value  any          `json:"value,omitempty"`
+}
+
+// Match reports whether the filter matches the column value v.
+func (f ViewFilter) Match(v any) bool {
+	switch f.Op {
+	case ViewFilterNull:
+		return v == nil
+	case ViewFilterNotNull:
+		return v != nil
+	}
+	if v == nil {
+		return false // Comparisons with NULL are never true.
+	}
+	switch c := CompareViewValues(v, f.Value); f.Op {
+	case ViewFilterEq:
+		return c == 0
+	case ViewFilterNe:
+		return c != 0
+	case ViewFilterLt:
+		return c < 0
+	case ViewFilterLe:
+		return c <= 0
+	case ViewFilterGt:
+		return c > 0
+	case ViewFilterGe:
+		return c >= 0
+	case ViewFilterContains:
+		s, ok := viewValueText(v)
+		sub, subOK := viewValueText(f.Value)
+		return ok && subOK && strings.Contains(s, sub)
+	default:
+		return false
+	}
+}
+
+// CompareViewValues compares view values in the SQLite order:
+// NULL, then numbers, then text, then blobs.
+func CompareViewValues(a, b any) int {
+	if c := cmp.Compare(viewValueClass(a), viewValueClass(b)); c != 0 {
+		return c
+	}
+	switch a := a.(type) {
+	case nil:
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	case []byte:
+		return bytes.Compare(a, b.([]byte))
+	default:
+		return cmp.Compare(viewValueFloat(a), viewValueFloat(b))
+	}
+}
+
+func viewValueClass(v any) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case string:
+		return 2
+	case []byte:
+		return 3
+	default:
+		return 1
+	}
+}
+
+func viewValueFloat(v any) float64 {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	default:
+		return 0
+	}
+}
+
+func viewValueText(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	default:
+		return "", false
+	}
+}
+
+// ViewCursor identifies the last row of a page of view rows.
+type ViewCursor struct {
+	// Value is the value of the ordered column if any.
+	Value any `json:"v,omitempty"`
+	// Bytes is set when Value is a blob.
+	Bytes    bool  `json:"b,omitempty"`
+	Event    int64 `json:"e"`
+	Sequence int   `json:"s"`
+}
+
+func encodeViewCursor(c *ViewCursor) (string, error) {
+	if b, ok := c.Value.([]byte); ok {
+		c.Value = base64.StdEncoding.EncodeToString(b)
+		c.Bytes = true
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode cursor: %v: %w", err, status.ErrInternal)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeViewCursor(s string) (*ViewCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("cursor is invalid (%q): %w", s, status.ErrInvalidArgument)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	c := new(ViewCursor)
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("cursor is invalid (%q): %w", s, status.ErrInvalidArgument)
+	}
+	switch v := c.Value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			c.Value = i
+		} else if c.Value, err = v.Float64(); err != nil {
+			return nil, fmt.Errorf("cursor is invalid (%q): %w", s, status.ErrInvalidArgument)
+		}
+	case string:
+		if c.Bytes {
+			if c.Value, err = base64.StdEncoding.DecodeString(v); err != nil {
+				return nil, fmt.Errorf("cursor is invalid (%q): %w", s, status.ErrInvalidArgument)
+			}
+		}
+	}
+	return c, nil
+}
+
+// ViewQuery is a validated query for ViewStore.ScanRows.
+type ViewQuery struct {
+	// Columns to return in each row.
+	Columns []string
+	// Filters which must all match.
+	Filters []ViewFilter
+	// Where is a bool expression over the view columns which rows must match.
+	Where *expr.Expr
+	// OrderBy is the column to order by before the event and sequence.
+	// An empty OrderBy orders by the event and sequence alone.
+	OrderBy string
+	// Desc reverses the order.
+	Desc bool
+	// After skips the rows up to and including the cursor.
+	After *ViewCursor
+	// Limit is the maximum number of rows or 0 for all rows.
+	Limit int
+}
+
+// ViewRow is a row of view values for an event and sequence.
+type ViewRow struct {
+	Event    int64
+	Sequence int
+	// Values of the query columns.
+	Values []any
+	// SortValue is the value of the OrderBy column.
+	SortValue any
+}
+
+type QueryViewRequest struct {
+	// View is the UUID or alias of the view.
+	View    string       `json:"view,omitempty"`
+	Columns []string     `json:"columns,omitempty"`
+	Filters []ViewFilter `json:"filters,omitempty"`
+	// Where is a bool expression over the view columns which rows must match.
+	Where   string `json:"where,omitempty"`
+	OrderBy string `json:"order_by,omitempty"`
+	Desc    bool   `json:"desc,omitempty"`
+	// Limit is the maximum number of rows to return.
+	// Defaults to 100 and must not exceed 1000.
+	Limit int `json:"limit,omitempty"`
+	// Cursor is the NextCursor of the previous page.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+type QueryViewResponse struct {
+	Columns []string `json:"columns,omitempty"`
+	Rows    [][]any  `json:"rows,omitempty"`
+	// NextCursor is set when more rows are available.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// QueryView returns a page of view rows.
+func (a *ViewsAPI) QueryView(ctx context.Context, req *QueryViewRequest) (*QueryViewResponse, error) {
+	if err := provided("view", "is", req.View); err != nil {
+		return nil, err
+	}
+	v, err := a.store.Load(ctx, req.View)
+	if err != nil {
+		return nil, err
+	}
+
+	// Index the points of all columns.
+	columns, columnPoints := ViewRowColumns(&v.View)
+	points := make(map[string]nuggit.Point, len(columns))
+	for i, name := range columns {
+		points[name] = columnPoints[i]
+	}
+	checkColumn := func(name string) error {
+		if _, found := points[name]; !found {
+			return fmt.Errorf("column not found in view (%q): %w", name, status.ErrInvalidArgument)
+		}
+		return nil
+	}
+
+	q := &ViewQuery{
+		Columns: columns,
+		OrderBy: req.OrderBy,
+		Desc:    req.Desc,
+	}
+	if len(req.Columns) > 0 {
+		for _, name := range req.Columns {
+			if err := checkColumn(name); err != nil {
+				return nil, err
+			}
+		}
+		q.Columns = req.Columns
+	}
+	for _, f := range req.Filters {
+		if err := checkColumn(f.Column); err != nil {
+			return nil, err
+		}
+		switch f.Op {
+		case ViewFilterNull, ViewFilterNotNull:
+			f.Value = nil
+		case ViewFilterEq, ViewFilterNe, ViewFilterLt, ViewFilterLe, ViewFilterGt, ViewFilterGe, ViewFilterContains:
+			if f.Value, err = convertViewValue(points[f.Column], f.Value); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("filter op is not supported (%q): %w", f.Op, status.ErrInvalidArgument)
+		}
+		q.Filters = append(q.Filters, f)
+	}
+	if req.Where != "" {
+		if q.Where, err = expr.ParseBool(req.Where, points); err != nil {
+			return nil, err
+		}
+	}
+	if q.OrderBy != "" {
+		if err := checkColumn(q.OrderBy); err != nil {
+			return nil, err
+		}
+	}
+	limit := req.Limit
+	switch {
+	case limit == 0:
+		limit = defaultViewRowsLimit
+	case limit < 0 || limit > maxViewRowsLimit:
+		return nil, fmt.Errorf("limit must be between 1 and %d (%d): %w", maxViewRowsLimit, limit, status.ErrInvalidArgument)
+	}
+	if req.Cursor != "" {
+		if q.After, err = decodeViewCursor(req.Cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	// Scan one more row than the limit to know whether another page exists.
+	q.Limit = limit + 1
+
+	resp := &QueryViewResponse{Columns: q.Columns}
+	var last *ViewRow
+	for r, err := range a.store.ScanRows(ctx, v.GetID(), q) {
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Rows) == limit {
+			// Another row exists so the next page starts after the last row.
+			if resp.NextCursor, err = encodeViewCursor(&ViewCursor{Value: last.SortValue, Event: last.Event, Sequence: last.Sequence}); err != nil {
+				return nil, err
+			}
+			break
+		}
+		row := make([]any, len(r.Values))
+		for i, value := range r.Values {
+			row[i] = viewValue(points[q.Columns[i]], value)
+		}
+		resp.Rows = append(resp.Rows, row)
+		last = r
+	}
+	return resp, nil
+}
+
+// convertViewValue converts a filter value to the scalar type of the point.
+func convertViewValue(p nuggit.Point, v any) (any, error) {
+	s, isString := v.(string)
+	switch p.Scalar {
+	case nuggit.Bool:
+		if isString {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, fmt.Errorf("value is not a bool (%q): %w", s, status.ErrInvalidArgument)
+			}
+			v = b
+		}
+		if b, ok := v.(bool); ok {
+			if b {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		}
+	case nuggit.Int:
+		if isString {
+			i, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("value is not an int (%q): %w", s, status.ErrInvalidArgument)
+			}
+			return i, nil
+		}
+		if f, ok := v.(float64); ok && f == float64(int64(f)) {
+			return int64(f), nil
+		}
+	case nuggit.Float:
+		if isString {
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("value is not a float (%q): %w", s, status.ErrInvalidArgument)
+			}
+			return f, nil
+		}
+		if f, ok := v.(float64); ok {
+			return f, nil
+		}
+	case nuggit.String:
+		if isString {
+			return s, nil
+		}
+	default: // "", nuggit.Bytes:
+		if isString {
+			return []byte(s), nil
+		}
+	}
+	return nil, fmt.Errorf("value has the wrong type for %s (%v): %w", p, v, status.ErrInvalidArgument)
+}
+
+// viewValue converts a stored view value to its JSON representation.
+func viewValue(p nuggit.Point, v any) any {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case int64:
+		if p.Scalar == nuggit.Bool {
+			return v != 0
+		}
+	}
+	return v
+}
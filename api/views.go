@@ -3,32 +3,324 @@ package api
 import (
 	"context"
 	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/expr"
 	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/pipes"
 	"github.com/wenooij/nuggit/status"
+	"github.com/wenooij/nuggit/views"
 )
 
 const viewsBaseURI = "/api/views"
 
+type View struct {
+	ID          string `json:"id,omitempty"`
+	Digest      string `json:"digest,omitempty"`
+	nuggit.View `json:",omitempty"`
+}
+
+func (v *View) GetID() string {
+	if v == nil {
+		return ""
+	}
+	return v.ID
+}
+
+func (v *View) GetDigest() string {
+	if v == nil {
+		return ""
+	}
+	return v.Digest
+}
+
+func (v *View) GetView() nuggit.View {
+	if v == nil {
+		return nuggit.View{}
+	}
+	return v.View
+}
+
 func ValidateView(v *nuggit.View) error {
 	if v == nil {
 		return fmt.Errorf("view is required: %w", status.ErrInvalidArgument)
 	}
 	seen := make(map[integrity.NameDigest]struct{}, len(v.GetColumns()))
 	for _, col := range v.GetColumns() {
+		if col.Expr != "" {
+			if col.Pipe != "" || col.WithDigest || col.Floating {
+				return fmt.Errorf("column must have either a pipe or an expr (%q): %w", col.Pipe, status.ErrInvalidArgument)
+			}
+			if col.Alias == "" {
+				return fmt.Errorf("computed column requires an alias (%q): %w", col.Expr, status.ErrInvalidArgument)
+			}
+			continue
+		}
 		key, err := integrity.ParseNameDigest(col.Pipe)
 		if err != nil {
 			return err
 		}
+		if floating := key.GetDigest() == ""; floating != col.Floating {
+			if floating {
+				return fmt.Errorf("column pipe requires a digest unless the column is floating (%q): %w", col.Pipe, status.ErrInvalidArgument)
+			}
+			return fmt.Errorf("floating column must not have a digest (%q): %w", col.Pipe, status.ErrInvalidArgument)
+		}
 		if _, found := seen[key]; found {
 			return fmt.Errorf("found duplicate column in view (%q; columns should be unique): %w", key, status.ErrInvalidArgument)
 		}
 		seen[key] = struct{}{}
 	}
+	switch groupBy := v.GetGroupBy(); groupBy {
+	case nuggit.GroupByNone, nuggit.GroupByEvent, nuggit.GroupByURL:
+	default:
+		return fmt.Errorf("group by is not supported (%q): %w", groupBy, status.ErrInvalidArgument)
+	}
+	// Check that expressions and aggregates refer to row columns with suitable types.
+	points := map[string]nuggit.Point{
+		ViewTimestampColumn: {Scalar: nuggit.String},
+		ViewURLColumn:       {Scalar: nuggit.String},
+	}
+	for _, col := range ViewBaseColumns(v) {
+		name := ViewColumnName(col)
+		if _, found := points[name]; found {
+			return fmt.Errorf("found duplicate column name in view (%q): %w", name, status.ErrInvalidArgument)
+		}
+		points[name] = col.Point
+		if col.WithDigest {
+			points[DigestColumnName(col)] = digestPoint
+		}
+	}
+	for _, col := range v.GetColumns() {
+		if col.Expr != "" {
+			if _, err := expr.Parse(col.Expr, points); err != nil {
+				return err
+			}
+		}
+	}
+	if filter := v.GetFilter(); filter != "" {
+		if _, err := expr.ParseBool(filter, points); err != nil {
+			return err
+		}
+	}
+	for _, col := range v.GetAggColumns() {
+		switch {
+		case col.WithDigest:
+			return fmt.Errorf("aggregate must not have a digest column (%q): %w", col.Pipe, status.ErrInvalidArgument)
+		case col.Pipe != "" && col.Expr != "":
+			return fmt.Errorf("aggregate must have either a pipe or an expr (%q): %w", col.Pipe, status.ErrInvalidArgument)
+		case col.Pipe != "":
+			if _, err := integrity.ParseNameDigest(col.Pipe); err != nil {
+				return err
+			}
+			// Aggregates of view columns use the point of the view column.
+			col.Point = points[BaseColumnName(v, col)]
+		case col.Expr != "":
+			if col.Alias == "" {
+				return fmt.Errorf("computed aggregate requires an alias (%q): %w", col.Expr, status.ErrInvalidArgument)
+			}
+			e, err := expr.Parse(col.Expr, points)
+			if err != nil {
+				return err
+			}
+			col.Point = e.Point()
+		}
+		if err := validateAggColumn(col, points); err != nil {
+			return err
+		}
+	}
+	names, _ := ViewRowColumns(v)
+	seenNames := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if _, found := seenNames[name]; found {
+			return fmt.Errorf("found duplicate column name in view (%q): %w", name, status.ErrInvalidArgument)
+		}
+		seenNames[name] = struct{}{}
+	}
 	return nil
 }
 
+func validateAggColumn(col nuggit.AggColumn, points map[string]nuggit.Point) error {
+	hasInput := col.Pipe != "" || col.Expr != ""
+	if !hasInput && col.Op != nuggit.AggOpCount {
+		return fmt.Errorf("pipe or expr is required for aggregate (%q): %w", col.Op, status.ErrInvalidArgument)
+	}
+	if !hasInput && col.Distinct {
+		return fmt.Errorf("pipe or expr is required for distinct aggregate (%q): %w", col.Op, status.ErrInvalidArgument)
+	}
+	if err := ValidatePoint(col.Point); err != nil {
+		return err
+	}
+	switch scalar := col.Point.Scalar; col.Op {
+	case nuggit.AggOpCount, nuggit.AggOpMin, nuggit.AggOpMax:
+	case nuggit.AggOpSum, nuggit.AggOpAvg:
+		if scalar != nuggit.Int && scalar != nuggit.Float {
+			return fmt.Errorf("aggregate requires an int or float column (%q): %w", col.Op, status.ErrInvalidArgument)
+		}
+	case nuggit.AggOpStringAgg:
+		if scalar != nuggit.String {
+			return fmt.Errorf("aggregate requires a string column (%q): %w", col.Op, status.ErrInvalidArgument)
+		}
+		if col.Distinct && col.Arg != "" && col.Arg != "," {
+			return fmt.Errorf("distinct string_agg does not support a separator (%q): %w", col.Arg, status.ErrInvalidArgument)
+		}
+	default:
+		return fmt.Errorf("aggregate op is not supported (%q): %w", col.Op, status.ErrInvalidArgument)
+	}
+	if col.Arg != "" && col.Op != nuggit.AggOpStringAgg {
+		return fmt.Errorf("arg is only supported by string_agg (%q): %w", col.Op, status.ErrInvalidArgument)
+	}
+	if col.Filter != "" {
+		if _, err := expr.ParseBool(col.Filter, points); err != nil {
+			return err
+		}
+	}
+	if col.OrderBy != "" {
+		if col.Op != nuggit.AggOpStringAgg {
+			return fmt.Errorf("order by is only supported by string_agg (%q): %w", col.Op, status.ErrInvalidArgument)
+		}
+		name, _ := AggOrderBy(col)
+		if _, found := points[name]; !found {
+			return fmt.Errorf("order by column not found in view (%q): %w", name, status.ErrInvalidArgument)
+		}
+	}
+	return nil
+}
+
+// ViewBaseColumns returns the pipe columns of view rows before aggregation.
+//
+// These are the view pipe columns followed by the pipes of aggregate columns
+// which are not already view columns.
+func ViewBaseColumns(v *nuggit.View) []nuggit.ViewColumn {
+	cols := slices.DeleteFunc(slices.Clone(v.GetColumns()), func(col nuggit.ViewColumn) bool { return col.Pipe == "" })
+	for _, agg := range v.GetAggColumns() {
+		if agg.Pipe == "" || slices.ContainsFunc(cols, func(col nuggit.ViewColumn) bool { return col.Pipe == agg.Pipe }) {
+			continue
+		}
+		cols = append(cols, nuggit.ViewColumn{Pipe: agg.Pipe, Point: agg.Point})
+	}
+	return cols
+}
+
+// ViewExprColumns returns the points of the columns available to view expressions.
+//
+// These are the timestamp, the URL and the pipe columns of view rows.
+func ViewExprColumns(v *nuggit.View) map[string]nuggit.Point {
+	points := map[string]nuggit.Point{
+		ViewTimestampColumn: {Scalar: nuggit.String},
+		ViewURLColumn:       {Scalar: nuggit.String},
+	}
+	for _, col := range ViewBaseColumns(v) {
+		points[ViewColumnName(col)] = col.Point
+		if col.WithDigest {
+			points[DigestColumnName(col)] = digestPoint
+		}
+	}
+	return points
+}
+
+// digestPoint is the point of pipe digest columns.
+var digestPoint = nuggit.Point{Scalar: nuggit.String, Nullable: true}
+
+// ViewColumnPoint returns the point of the column values.
+//
+// The point of a computed column is the point of its expression.
+func ViewColumnPoint(v *nuggit.View, col nuggit.ViewColumn) nuggit.Point {
+	if col.Expr == "" {
+		return col.Point
+	}
+	e, err := expr.Parse(col.Expr, ViewExprColumns(v))
+	if err != nil {
+		return col.Point
+	}
+	return e.Point()
+}
+
+// BaseColumnName returns the name of the row column which holds the pipe values of the aggregate.
+func BaseColumnName(v *nuggit.View, col nuggit.AggColumn) string {
+	for _, c := range v.GetColumns() {
+		if c.Pipe == col.Pipe {
+			return ViewColumnName(c)
+		}
+	}
+	return ViewColumnName(nuggit.ViewColumn{Pipe: col.Pipe})
+}
+
+// AggColumnName returns the name of the aggregate column in view rows.
+//
+// Aggregates are named op_pipe unless they have an alias.
+func AggColumnName(col nuggit.AggColumn) string {
+	if col.Alias != "" {
+		return ViewColumnName(col.ViewColumn)
+	}
+	if col.Pipe == "" {
+		return col.Op
+	}
+	return col.Op + "_" + ViewColumnName(col.ViewColumn)
+}
+
+// AggOrderBy returns the column name and direction of the aggregate OrderBy.
+func AggOrderBy(col nuggit.AggColumn) (name string, desc bool) {
+	name, desc = strings.CutSuffix(col.OrderBy, " desc")
+	if !desc {
+		name, desc = strings.CutSuffix(name, " DESC")
+	}
+	return name, desc
+}
+
+// AggPoint returns the point of the aggregate values.
+func AggPoint(v *nuggit.View, col nuggit.AggColumn) nuggit.Point {
+	if col.Expr != "" {
+		col.Point = ViewColumnPoint(v, col.ViewColumn)
+	}
+	for _, c := range v.GetColumns() {
+		if col.Pipe != "" && c.Pipe == col.Pipe {
+			col.Point = c.Point
+		}
+	}
+	switch col.Op {
+	case nuggit.AggOpCount:
+		return nuggit.Point{Scalar: nuggit.Int}
+	case nuggit.AggOpAvg:
+		return nuggit.Point{Scalar: nuggit.Float, Nullable: true}
+	case nuggit.AggOpStringAgg:
+		return nuggit.Point{Scalar: nuggit.String, Nullable: true}
+	default:
+		return col.Point.AsNullable()
+	}
+}
+
+// ViewRowColumns returns the names and points of the columns of view rows.
+func ViewRowColumns(v *nuggit.View) ([]string, []nuggit.Point) {
+	var (
+		names  []string
+		points []nuggit.Point
+	)
+	add := func(name string, p nuggit.Point) {
+		names = append(names, name)
+		points = append(points, p)
+	}
+	for _, col := range v.GetColumns() {
+		add(ViewColumnName(col), ViewColumnPoint(v, col))
+		if col.WithDigest {
+			add(DigestColumnName(col), digestPoint)
+		}
+	}
+	aggs := v.GetAggColumns()
+	if len(aggs) == 0 || v.GetGroupBy() == nuggit.GroupByEvent {
+		add(ViewTimestampColumn, nuggit.Point{Scalar: nuggit.String})
+	}
+	if len(aggs) == 0 || v.GetGroupBy() != nuggit.GroupByNone {
+		add(ViewURLColumn, nuggit.Point{Scalar: nuggit.String})
+	}
+	for _, col := range aggs {
+		add(AggColumnName(col), AggPoint(v, col))
+	}
+	return names, points
+}
+
 type ViewsAPI struct {
 	store ViewStore
 	pipes PipeStore
@@ -53,17 +345,137 @@ func (a *ViewsAPI) CreateView(ctx context.Context, req *CreateViewRequest) (*Cre
 	if err := provided("view", "is", req.View); err != nil {
 		return nil, err
 	}
-	if err := ValidateView(req.View); err != nil {
+	view, err := a.qualifyView(ctx, req.View)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateView(view); err != nil {
 		return nil, err
 	}
 	ref, err := newRef(viewsBaseURI)
 	if err != nil {
 		return nil, err
 	}
-	if err := a.store.Store(ctx, ref.ID, *req.View); err != nil {
+	if err := a.store.Store(ctx, ref.ID, *view); err != nil {
 		return nil, err
 	}
 	return &CreateViewResponse{
 		View: &ref,
 	}, nil
 }
+
+// qualifyView returns a copy of the view with the name-only pipes of columns
+// which are not floating pinned to the unique digest of the stored pipe.
+func (a *ViewsAPI) qualifyView(ctx context.Context, v *nuggit.View) (*nuggit.View, error) {
+	if !slices.ContainsFunc(v.GetColumns(), func(col nuggit.ViewColumn) bool {
+		return col.Pipe != "" && !col.Floating && !strings.Contains(col.Pipe, "@")
+	}) {
+		return v, nil
+	}
+	var idx pipes.Index
+	for name, err := range a.pipes.ScanNames(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		idx.Add(name.GetName(), name.GetDigest(), nuggit.Pipe{})
+	}
+	qualified, err := views.Qualify(&idx, *v)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, status.ErrInvalidArgument)
+	}
+	return &qualified, nil
+}
+
+type ListViewsRequest struct{}
+
+type ListViewsResponse struct {
+	Views []*View `json:"views,omitempty"`
+}
+
+func (a *ViewsAPI) ListViews(ctx context.Context, _ *ListViewsRequest) (*ListViewsResponse, error) {
+	var views []*View
+	for v, err := range a.store.Scan(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, v)
+	}
+	return &ListViewsResponse{Views: views}, nil
+}
+
+type GetViewRequest struct {
+	// View is the UUID or alias of the view.
+	View string `json:"view,omitempty"`
+}
+
+type GetViewResponse struct {
+	View *View `json:"view,omitempty"`
+}
+
+func (a *ViewsAPI) GetView(ctx context.Context, req *GetViewRequest) (*GetViewResponse, error) {
+	if err := provided("view", "is", req.View); err != nil {
+		return nil, err
+	}
+	v, err := a.store.Load(ctx, req.View)
+	if err != nil {
+		return nil, err
+	}
+	return &GetViewResponse{View: v}, nil
+}
+
+type UpdateViewRequest struct {
+	// View is the UUID or alias of the view.
+	View string       `json:"view,omitempty"`
+	Spec *nuggit.View `json:"spec,omitempty"`
+}
+
+type UpdateViewResponse struct {
+	View *Ref `json:"view,omitempty"`
+}
+
+// UpdateView replaces the view and recreates its rows.
+func (a *ViewsAPI) UpdateView(ctx context.Context, req *UpdateViewRequest) (*UpdateViewResponse, error) {
+	if err := provided("view", "is", req.View); err != nil {
+		return nil, err
+	}
+	if err := provided("spec", "is", req.Spec); err != nil {
+		return nil, err
+	}
+	spec, err := a.qualifyView(ctx, req.Spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateView(spec); err != nil {
+		return nil, err
+	}
+	v, err := a.store.Load(ctx, req.View)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.store.Update(ctx, v.GetID(), *spec); err != nil {
+		return nil, err
+	}
+	ref := newRefID(viewsBaseURI, v.GetID())
+	return &UpdateViewResponse{View: &ref}, nil
+}
+
+type DeleteViewRequest struct {
+	// View is the UUID or alias of the view.
+	View string `json:"view,omitempty"`
+}
+
+type DeleteViewResponse struct{}
+
+func (a *ViewsAPI) DeleteView(ctx context.Context, req *DeleteViewRequest) (*DeleteViewResponse, error) {
+	if err := provided("view", "is", req.View); err != nil {
+		return nil, err
+	}
+	v, err := a.store.Load(ctx, req.View)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.store.Delete(ctx, v.GetID()); err != nil {
+		return nil, err
+	}
+	return &DeleteViewResponse{}, nil
+}
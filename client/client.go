@@ -100,7 +100,62 @@ func (c *Client) handleError(httpStatus string, body io.ReadCloser) error {
 }
 
 func (c *Client) CreateResource(r *api.Resource) error {
-	return c.doRequestResponse("POST", "/api/resources", api.CreateResourceRequest{
+	return c.doRequest("POST", "/api/resources", api.CreateResourceRequest{
 		Resource: r,
-	})
+	}, new(api.CreateResourceResponse))
+}
+
+// doRequest sends the payload and decodes the response into resp.
+func (c *Client) doRequest(method, path string, payload, resp any) error {
+	req, err := c.newRequest(method, path, payload)
+	if err != nil {
+		return err
+	}
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return c.handleError(r.Status, r.Body)
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+func (c *Client) LookupResource(req *api.LookupResourceRequest) ([]*api.Resource, error) {
+	resp := new(api.LookupResourceResponse)
+	if err := c.doRequest("POST", "/api/resources/lookup", req, resp); err != nil {
+		return nil, err
+	}
+	return resp.Resources, nil
+}
+
+func (c *Client) ListResources(filter *api.ResourceFilter) ([]*api.Resource, error) {
+	q := make(url.Values)
+	for k, v := range map[string]string{
+		"kind":   string(filter.GetKind()),
+		"name":   filter.GetName(),
+		"digest": filter.GetDigest(),
+		"uuid":   filter.GetUUID(),
+	} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	for _, label := range filter.GetLabels() {
+		q.Add("label", label)
+	}
+	path := "/api/resources"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	resp := new(api.ListResourcesResponse)
+	if err := c.doRequest("GET", path, nil, resp); err != nil {
+		return nil, err
+	}
+	return resp.Resources, nil
+}
+
+func (c *Client) DeleteResource(req *api.DeleteResourceRequest) error {
+	return c.doRequest("DELETE", "/api/resources", req, new(api.DeleteResourceResponse))
 }
@@ -0,0 +1,334 @@
+// Package expr implements the expressions of computed view columns and filters.
+//
+// Expressions are typed and compile to SQLite SQL. They support:
+//
+//   - Literals: 1, 2.5, "text", 'text', true, false and null.
+//   - Columns by name.
+//   - Arithmetic: + - * / % and string concatenation with +.
+//   - Comparisons: == != < <= > >=.
+//   - Logic: && || ! or and, or, not.
+//   - Functions: lower, upper, trim, length, substr, replace, contains,
+//     starts_with, matches, coalesce, if, abs, round, int, float and string.
+//
+// Anything else, such as an unknown column or function, is rejected.
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/status"
+)
+
+// maxLen limits the length of expression sources.
+const maxLen = 4096
+
+// Expr is a parsed and type checked expression.
+type Expr struct {
+	src  string
+	root *node
+}
+
+// Parse parses the expression src over the columns.
+func Parse(src string, columns map[string]nuggit.Point) (*Expr, error) {
+	if len(src) > maxLen {
+		return nil, fmt.Errorf("expression is too long (%d > %d): %w", len(src), maxLen, status.ErrInvalidArgument)
+	}
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, columns: columns}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, unexpected(t)
+	}
+	if root.typ == null {
+		return nil, fmt.Errorf("expression has no type (%q): %w", src, status.ErrInvalidArgument)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// ParseBool parses an expression which must have a bool type.
+func ParseBool(src string, columns map[string]nuggit.Point) (*Expr, error) {
+	e, err := Parse(src, columns)
+	if err != nil {
+		return nil, err
+	}
+	if e.root.typ != nuggit.Bool {
+		return nil, fmt.Errorf("expression must be a bool (%q): %w", src, status.ErrInvalidArgument)
+	}
+	return e, nil
+}
+
+func (e *Expr) String() string {
+	if e == nil {
+		return ""
+	}
+	return e.src
+}
+
+// Point returns the point of the expression values.
+//
+// Expressions are always nullable since columns may be NULL.
+func (e *Expr) Point() nuggit.Point {
+	return nuggit.Point{Scalar: e.root.typ, Nullable: true}
+}
+
+// SQL returns parameterized SQL for the expression.
+//
+// The column function returns the SQL for a column name.
+func (e *Expr) SQL(column func(name string) string) (string, []any) {
+	w := &sqlWriter{column: column}
+	w.write(e.root)
+	return w.sb.String(), w.args
+}
+
+// InlineSQL returns SQL for the expression with literal values inlined.
+//
+// InlineSQL is used where parameters are not allowed such as in CREATE VIEW.
+func (e *Expr) InlineSQL(column func(name string) string) string {
+	w := &sqlWriter{column: column, inline: true}
+	w.write(e.root)
+	return w.sb.String()
+}
+
+type function struct {
+	minArgs, maxArgs int
+	// check returns the type of the call.
+	check func(pos int, args []*node) (nuggit.Scalar, error)
+}
+
+func argTypes(args []*node) []nuggit.Scalar {
+	types := make([]nuggit.Scalar, len(args))
+	for i, a := range args {
+		types[i] = a.typ
+	}
+	return types
+}
+
+// returns checks that args have the given types and returns typ.
+func returns(typ nuggit.Scalar, argTypes ...nuggit.Scalar) func(int, []*node) (nuggit.Scalar, error) {
+	return func(pos int, args []*node) (nuggit.Scalar, error) {
+		for i, a := range args {
+			if want := argTypes[min(i, len(argTypes)-1)]; a.typ != want && a.typ != null && !(want == nuggit.Float && isNumeric(a.typ)) {
+				return "", fmt.Errorf("argument %d has the wrong type in expression at %d (%s; want %s): %w", i+1, pos, a.typ, want, status.ErrInvalidArgument)
+			}
+		}
+		return typ, nil
+	}
+}
+
+func unifyArgs(pos int, args []*node) (nuggit.Scalar, error) {
+	typ := null
+	for _, a := range args {
+		var ok bool
+		if typ, ok = unify(typ, a.typ); !ok {
+			return "", fmt.Errorf("arguments have mixed types in expression at %d (%v): %w", pos, argTypes(args), status.ErrInvalidArgument)
+		}
+	}
+	return typ, nil
+}
+
+func anyArg(typ nuggit.Scalar) func(int, []*node) (nuggit.Scalar, error) {
+	return func(int, []*node) (nuggit.Scalar, error) { return typ, nil }
+}
+
+var functions = map[string]function{
+	"lower":       {1, 1, returns(nuggit.String, nuggit.String)},
+	"upper":       {1, 1, returns(nuggit.String, nuggit.String)},
+	"trim":        {1, 1, returns(nuggit.String, nuggit.String)},
+	"length":      {1, 1, returns(nuggit.Int, nuggit.String)},
+	"substr":      {2, 3, returns(nuggit.String, nuggit.String, nuggit.Int)},
+	"replace":     {3, 3, returns(nuggit.String, nuggit.String)},
+	"contains":    {2, 2, returns(nuggit.Bool, nuggit.String)},
+	"starts_with": {2, 2, returns(nuggit.Bool, nuggit.String)},
+	"matches": {2, 2, func(pos int, args []*node) (nuggit.Scalar, error) {
+		if _, err := returns(nuggit.Bool, nuggit.String)(pos, args); err != nil {
+			return "", err
+		}
+		pattern, ok := args[1].value.(string)
+		if args[1].kind != nodeLit || !ok {
+			return "", fmt.Errorf("matches requires a literal pattern in expression at %d: %w", pos, status.ErrInvalidArgument)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return "", fmt.Errorf("invalid pattern in expression at %d (%q): %w", pos, pattern, status.ErrInvalidArgument)
+		}
+		return nuggit.Bool, nil
+	}},
+	"coalesce": {2, -1, unifyArgs},
+	"if": {3, 3, func(pos int, args []*node) (nuggit.Scalar, error) {
+		if _, err := returns(nuggit.Bool, nuggit.Bool)(pos, args[:1]); err != nil {
+			return "", err
+		}
+		return unifyArgs(pos, args[1:])
+	}},
+	"abs": {1, 1, func(pos int, args []*node) (nuggit.Scalar, error) {
+		if !isNumeric(args[0].typ) {
+			return "", typeError(pos, "abs", args[0].typ)
+		}
+		return args[0].typ, nil
+	}},
+	"round":  {1, 2, returns(nuggit.Float, nuggit.Float, nuggit.Int)},
+	"int":    {1, 1, anyArg(nuggit.Int)},
+	"float":  {1, 1, anyArg(nuggit.Float)},
+	"string": {1, 1, anyArg(nuggit.String)},
+}
+
+func checkCall(pos int, name string, args []*node) (*node, error) {
+	fn, found := functions[name]
+	if !found {
+		return nil, fmt.Errorf("function not found in expression at %d (%q): %w", pos, name, status.ErrInvalidArgument)
+	}
+	if len(args) < fn.minArgs || fn.maxArgs >= 0 && len(args) > fn.maxArgs {
+		return nil, fmt.Errorf("wrong number of arguments to %s in expression at %d (%d): %w", name, pos, len(args), status.ErrInvalidArgument)
+	}
+	typ, err := fn.check(pos, args)
+	if err != nil {
+		return nil, err
+	}
+	return &node{kind: nodeCall, pos: pos, op: name, args: args, typ: typ}, nil
+}
+
+type sqlWriter struct {
+	sb     strings.Builder
+	args   []any
+	inline bool
+	column func(string) string
+}
+
+var sqlOps = map[string]string{
+	"&&": "AND",
+	"||": "OR",
+	"==": "=",
+	"!=": "<>",
+	"!":  "NOT ",
+}
+
+var sqlCasts = map[string]string{
+	"int":    "INTEGER",
+	"float":  "REAL",
+	"string": "TEXT",
+}
+
+func (w *sqlWriter) write(n *node) {
+	switch n.kind {
+	case nodeLit:
+		w.writeLit(n.value)
+	case nodeColumn:
+		w.sb.WriteString(w.column(n.name))
+	case nodeUnary:
+		op := n.op
+		if s, found := sqlOps[op]; found {
+			op = s
+		}
+		fmt.Fprintf(&w.sb, "(%s", op)
+		w.write(n.args[0])
+		w.sb.WriteByte(')')
+	case nodeBinary:
+		x, y := n.args[0], n.args[1]
+		op := n.op
+		switch {
+		case op == "==" && (x.typ == null || y.typ == null):
+			op = "IS"
+		case op == "!=" && (x.typ == null || y.typ == null):
+			op = "IS NOT"
+		case op == "+" && n.typ == nuggit.String:
+			op = "||"
+		default:
+			if s, found := sqlOps[op]; found {
+				op = s
+			}
+		}
+		w.sb.WriteByte('(')
+		w.write(x)
+		fmt.Fprintf(&w.sb, " %s ", op)
+		w.write(y)
+		w.sb.WriteByte(')')
+	case nodeCall:
+		w.writeCall(n)
+	}
+}
+
+func (w *sqlWriter) writeCall(n *node) {
+	switch n.op {
+	case "contains":
+		w.writeFunc("(instr", n.args)
+		w.sb.WriteString(" > 0)")
+	case "starts_with":
+		w.writeFunc("(instr", n.args)
+		w.sb.WriteString(" = 1)")
+	case "matches":
+		// REGEXP is registered by the storage package.
+		w.writeFunc("regexp", []*node{n.args[1], n.args[0]})
+	case "if":
+		w.sb.WriteString("(CASE WHEN ")
+		w.write(n.args[0])
+		w.sb.WriteString(" THEN ")
+		w.write(n.args[1])
+		w.sb.WriteString(" ELSE ")
+		w.write(n.args[2])
+		w.sb.WriteString(" END)")
+	case "int", "float", "string":
+		w.sb.WriteString("CAST(")
+		w.write(n.args[0])
+		fmt.Fprintf(&w.sb, " AS %s)", sqlCasts[n.op])
+	case "round":
+		// Round to a float as SQLite does when the digits are given.
+		w.sb.WriteString("CAST(")
+		w.writeFunc("round", n.args)
+		w.sb.WriteString(" AS REAL)")
+	default:
+		w.writeFunc(n.op, n.args)
+	}
+}
+
+func (w *sqlWriter) writeFunc(name string, args []*node) {
+	w.sb.WriteString(name)
+	w.sb.WriteByte('(')
+	for i, a := range args {
+		if i > 0 {
+			w.sb.WriteString(", ")
+		}
+		w.write(a)
+	}
+	w.sb.WriteByte(')')
+}
+
+func (w *sqlWriter) writeLit(v any) {
+	switch v := v.(type) {
+	case nil:
+		w.sb.WriteString("NULL")
+		return
+	case bool:
+		if v {
+			w.sb.WriteString("TRUE")
+		} else {
+			w.sb.WriteString("FALSE")
+		}
+		return
+	}
+	if !w.inline {
+		w.sb.WriteByte('?')
+		w.args = append(w.args, v)
+		return
+	}
+	switch v := v.(type) {
+	case int64:
+		w.sb.WriteString(strconv.FormatInt(v, 10))
+	case float64:
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0" // Keep the value a float.
+		}
+		w.sb.WriteString(s)
+	case string:
+		w.sb.WriteString("'" + strings.ReplaceAll(v, "'", "''") + "'")
+	}
+}
@@ -0,0 +1,108 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/status"
+)
+
+var testColumns = map[string]nuggit.Point{
+	"title":   {Scalar: nuggit.String},
+	"price":   {Scalar: nuggit.Float},
+	"qty":     {Scalar: nuggit.Int},
+	"instock": {Scalar: nuggit.Bool},
+}
+
+func testColumn(name string) string { return fmt.Sprintf("b.%q", name) }
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		src        string
+		wantSQL    string
+		wantArgs   []any
+		wantInline string
+		wantType   nuggit.Scalar
+	}{{
+		src:        "price * qty",
+		wantSQL:    `(b."price" * b."qty")`,
+		wantInline: `(b."price" * b."qty")`,
+		wantType:   nuggit.Float,
+	}, {
+		src:        "qty % 2 == 0 && instock",
+		wantSQL:    `(((b."qty" % ?) = ?) AND b."instock")`,
+		wantArgs:   []any{int64(2), int64(0)},
+		wantInline: `(((b."qty" % 2) = 0) AND b."instock")`,
+		wantType:   nuggit.Bool,
+	}, {
+		src:        `lower(title) + 'it\'s' + "\"x\""`,
+		wantSQL:    `((lower(b."title") || ?) || ?)`,
+		wantArgs:   []any{"it's", `"x"`},
+		wantInline: `((lower(b."title") || 'it''s') || '"x"')`,
+		wantType:   nuggit.String,
+	}, {
+		src:        `coalesce(price, 0) >= 1.5 or not contains(title, 'sale')`,
+		wantSQL:    `((coalesce(b."price", ?) >= ?) OR (NOT (instr(b."title", ?) > 0)))`,
+		wantArgs:   []any{int64(0), 1.5, "sale"},
+		wantInline: `((coalesce(b."price", 0) >= 1.5) OR (NOT (instr(b."title", 'sale') > 0)))`,
+		wantType:   nuggit.Bool,
+	}, {
+		src:        `matches(title, '^[A-Z]') and price != null`,
+		wantSQL:    `(regexp(?, b."title") AND (b."price" IS NOT NULL))`,
+		wantArgs:   []any{"^[A-Z]"},
+		wantInline: `(regexp('^[A-Z]', b."title") AND (b."price" IS NOT NULL))`,
+		wantType:   nuggit.Bool,
+	}, {
+		src:        `if(instock, float(qty), -1.0)`,
+		wantSQL:    `(CASE WHEN b."instock" THEN CAST(b."qty" AS REAL) ELSE (-?) END)`,
+		wantArgs:   []any{1.0},
+		wantInline: `(CASE WHEN b."instock" THEN CAST(b."qty" AS REAL) ELSE (-1.0) END)`,
+		wantType:   nuggit.Float,
+	}} {
+		t.Run(tc.src, func(t *testing.T) {
+			e, err := Parse(tc.src, testColumns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotSQL, gotArgs := e.SQL(testColumn)
+			if gotSQL != tc.wantSQL || fmt.Sprint(gotArgs) != fmt.Sprint(tc.wantArgs) {
+				t.Errorf("SQL(): got %s %v, want %s %v", gotSQL, gotArgs, tc.wantSQL, tc.wantArgs)
+			}
+			if got := e.InlineSQL(testColumn); got != tc.wantInline {
+				t.Errorf("InlineSQL(): got %s, want %s", got, tc.wantInline)
+			}
+			if got := e.Point().Scalar; got != tc.wantType {
+				t.Errorf("Point(): got %s, want %s", got, tc.wantType)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"price +",
+		"missing",
+		"title; DROP TABLE Results",
+		"sqlite_version()",
+		"title + 1",
+		"price < qty < 2",
+		"matches(title, title)",
+		"matches(title, '(')",
+		"lower(title, title)",
+		"null",
+		"'unterminated",
+		"'adjacent' 'strings'",
+	} {
+		t.Run(src, func(t *testing.T) {
+			if _, err := Parse(src, testColumns); !errors.Is(err, status.ErrInvalidArgument) {
+				t.Errorf("Parse(%q): got err %v, want invalid argument", src, err)
+			}
+		})
+	}
+	if _, err := ParseBool("price", testColumns); !errors.Is(err, status.ErrInvalidArgument) {
+		t.Errorf("ParseBool(): got err %v, want invalid argument", err)
+	}
+}
@@ -0,0 +1,149 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/wenooij/nuggit/status"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenInt
+	tokenFloat
+	tokenString
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	pos  int
+	// text is the source text of the token or the unquoted value of strings.
+	text string
+}
+
+// operators are ordered so that longer operators match first.
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "+", "-", "*", "/", "%", "!", "(", ")", ","}
+
+func lex(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		r, size := utf8.DecodeRuneInString(src[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '_' || unicode.IsLetter(r):
+			j := i
+			for j < len(src) {
+				r, size := utf8.DecodeRuneInString(src[j:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				j += size
+			}
+			tokens = append(tokens, token{tokenIdent, i, src[i:j]})
+			i = j
+		case '0' <= r && r <= '9' || r == '.' && i+1 < len(src) && '0' <= src[i+1] && src[i+1] <= '9':
+			t, err := lexNumber(src, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, t)
+			i += len(t.text)
+		case r == '"' || r == '\'':
+			t, n, err := lexString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, t)
+			i += n
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character in expression at %d (%q): %w", i, r, status.ErrInvalidArgument)
+			}
+			tokens = append(tokens, token{tokenOp, i, op})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{tokenEOF, len(src), ""}), nil
+}
+
+func lexNumber(src string, i int) (token, error) {
+	j, kind := i, tokenInt
+	for j < len(src) {
+		c := src[j]
+		switch {
+		case '0' <= c && c <= '9':
+		case c == '.' || c == 'e' || c == 'E':
+			kind = tokenFloat
+		case (c == '+' || c == '-') && (src[j-1] == 'e' || src[j-1] == 'E'):
+		default:
+			goto done
+		}
+		j++
+	}
+done:
+	text := src[i:j]
+	var err error
+	if kind == tokenInt {
+		_, err = strconv.ParseInt(text, 10, 64)
+	} else {
+		_, err = strconv.ParseFloat(text, 64)
+	}
+	if err != nil {
+		return token{}, fmt.Errorf("invalid number in expression at %d (%q): %w", i, text, status.ErrInvalidArgument)
+	}
+	return token{kind, i, text}, nil
+}
+
+// lexString scans a single or double quoted string with Go escapes.
+func lexString(src string, i int) (token, int, error) {
+	quote := src[i]
+	j := i + 1
+	for ; j < len(src) && src[j] != quote; j++ {
+		if src[j] == '\\' {
+			j++
+		}
+	}
+	if j >= len(src) {
+		return token{}, 0, fmt.Errorf("unterminated string in expression at %d: %w", i, status.ErrInvalidArgument)
+	}
+	body := src[i+1 : j]
+	if quote == '\'' {
+		// Convert to a double quoted string for strconv.Unquote.
+		var sb strings.Builder
+		for k := 0; k < len(body); k++ {
+			switch c := body[k]; {
+			case c == '\\' && k+1 < len(body):
+				k++
+				if body[k] != '\'' {
+					sb.WriteByte(c)
+				}
+				sb.WriteByte(body[k])
+			case c == '"':
+				sb.WriteString(`\"`)
+			default:
+				sb.WriteByte(c)
+			}
+		}
+		body = sb.String()
+	}
+	s, err := strconv.Unquote(`"` + body + `"`)
+	if err != nil || strings.ContainsRune(s, 0) {
+		return token{}, 0, fmt.Errorf("invalid string in expression at %d (%q): %w", i, src[i:j+1], status.ErrInvalidArgument)
+	}
+	return token{tokenString, i, s}, j + 1 - i, nil
+}
@@ -0,0 +1,289 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/status"
+)
+
+// maxDepth limits the nesting of expressions.
+const maxDepth = 64
+
+type nodeKind int
+
+const (
+	nodeLit nodeKind = iota
+	nodeColumn
+	nodeUnary
+	nodeBinary
+	nodeCall
+)
+
+// null is the type of the null literal which is compatible with every type.
+const null nuggit.Scalar = "null"
+
+type node struct {
+	kind nodeKind
+	pos  int
+	// op is the operator or function name.
+	op string
+	// name is the column name.
+	name  string
+	value any
+	args  []*node
+	// typ is the scalar type of the node values.
+	typ nuggit.Scalar
+}
+
+type parser struct {
+	tokens  []token
+	i       int
+	depth   int
+	columns map[string]nuggit.Point
+}
+
+func (p *parser) peek() token { return p.tokens[p.i] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokenEOF {
+		p.i++
+	}
+	return t
+}
+
+// accept consumes the next token if it is one of the ops or keywords.
+func (p *parser) accept(ops ...string) (token, bool) {
+	t := p.peek()
+	if t.kind != tokenOp && t.kind != tokenIdent {
+		return t, false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return p.next(), true
+		}
+	}
+	return t, false
+}
+
+func (p *parser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		return unexpected(p.peek())
+	}
+	return nil
+}
+
+func unexpected(t token) error {
+	if t.kind == tokenEOF {
+		return fmt.Errorf("unexpected end of expression at %d: %w", t.pos, status.ErrInvalidArgument)
+	}
+	return fmt.Errorf("unexpected token in expression at %d (%q): %w", t.pos, t.text, status.ErrInvalidArgument)
+}
+
+// Precedence from lowest to highest.
+var binaryOps = [][]string{
+	{"||", "or"},
+	{"&&", "and"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+var canonicalOps = map[string]string{"or": "||", "and": "&&", "not": "!"}
+
+func (p *parser) parseExpr() (*node, error) { return p.parseBinary(0) }
+
+func (p *parser) parseBinary(level int) (*node, error) {
+	if level == len(binaryOps) {
+		return p.parseUnary()
+	}
+	x, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.accept(binaryOps[level]...)
+		if !ok {
+			return x, nil
+		}
+		y, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		op := t.text
+		if c, found := canonicalOps[op]; found {
+			op = c
+		}
+		if x, err = checkBinary(t.pos, op, x, y); err != nil {
+			return nil, err
+		}
+		if level == 2 {
+			// Comparisons do not chain.
+			if t, ok := p.accept(binaryOps[level]...); ok {
+				return nil, unexpected(t)
+			}
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) parseUnary() (*node, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return nil, fmt.Errorf("expression is nested too deeply at %d: %w", p.peek().pos, status.ErrInvalidArgument)
+	}
+	if t, ok := p.accept("!", "not", "-"); ok {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		op := t.text
+		if c, found := canonicalOps[op]; found {
+			op = c
+		}
+		return checkUnary(t.pos, op, x)
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (*node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenInt:
+		v, _ := strconv.ParseInt(t.text, 10, 64)
+		return &node{kind: nodeLit, pos: t.pos, value: v, typ: nuggit.Int}, nil
+	case tokenFloat:
+		v, _ := strconv.ParseFloat(t.text, 64)
+		return &node{kind: nodeLit, pos: t.pos, value: v, typ: nuggit.Float}, nil
+	case tokenString:
+		return &node{kind: nodeLit, pos: t.pos, value: t.text, typ: nuggit.String}, nil
+	case tokenOp:
+		if t.text != "(" {
+			return nil, unexpected(t)
+		}
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return x, nil
+	case tokenIdent:
+		switch t.text {
+		case "true", "false":
+			return &node{kind: nodeLit, pos: t.pos, value: t.text == "true", typ: nuggit.Bool}, nil
+		case "null":
+			return &node{kind: nodeLit, pos: t.pos, typ: null}, nil
+		}
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(t)
+		}
+		point, found := p.columns[t.text]
+		if !found {
+			return nil, fmt.Errorf("column not found in expression at %d (%q): %w", t.pos, t.text, status.ErrInvalidArgument)
+		}
+		typ := point.Scalar
+		if typ == "" {
+			typ = nuggit.Bytes
+		}
+		return &node{kind: nodeColumn, pos: t.pos, name: t.text, typ: typ}, nil
+	default:
+		return nil, unexpected(t)
+	}
+}
+
+func (p *parser) parseCall(name token) (*node, error) {
+	var args []*node
+	if _, ok := p.accept(")"); !ok {
+		for {
+			x, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, x)
+			if _, ok := p.accept(","); !ok {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+	return checkCall(name.pos, name.text, args)
+}
+
+func isNumeric(t nuggit.Scalar) bool { return t == nuggit.Int || t == nuggit.Float || t == null }
+
+// unify returns the common type of x and y.
+func unify(x, y nuggit.Scalar) (nuggit.Scalar, bool) {
+	switch {
+	case x == null:
+		return y, true
+	case y == null || x == y:
+		return x, true
+	case isNumeric(x) && isNumeric(y):
+		return nuggit.Float, true
+	default:
+		return "", false
+	}
+}
+
+func typeError(pos int, op string, types ...nuggit.Scalar) error {
+	return fmt.Errorf("invalid operand types for %s in expression at %d (%v): %w", op, pos, types, status.ErrInvalidArgument)
+}
+
+func checkUnary(pos int, op string, x *node) (*node, error) {
+	n := &node{kind: nodeUnary, pos: pos, op: op, args: []*node{x}, typ: x.typ}
+	switch op {
+	case "!":
+		if x.typ != nuggit.Bool && x.typ != null {
+			return nil, typeError(pos, op, x.typ)
+		}
+		n.typ = nuggit.Bool
+	case "-":
+		if !isNumeric(x.typ) {
+			return nil, typeError(pos, op, x.typ)
+		}
+	}
+	return n, nil
+}
+
+func checkBinary(pos int, op string, x, y *node) (*node, error) {
+	n := &node{kind: nodeBinary, pos: pos, op: op, args: []*node{x, y}}
+	typ, ok := unify(x.typ, y.typ)
+	switch op {
+	case "||", "&&":
+		if typ != nuggit.Bool && typ != null {
+			return nil, typeError(pos, op, x.typ, y.typ)
+		}
+		n.typ = nuggit.Bool
+	case "==", "!=", "<", "<=", ">", ">=":
+		if !ok {
+			return nil, typeError(pos, op, x.typ, y.typ)
+		}
+		if (x.typ == null || y.typ == null) && op != "==" && op != "!=" {
+			return nil, typeError(pos, op, x.typ, y.typ)
+		}
+		n.typ = nuggit.Bool
+	case "+":
+		if !ok || !isNumeric(typ) && typ != nuggit.String {
+			return nil, typeError(pos, op, x.typ, y.typ)
+		}
+		n.typ = typ
+	case "%":
+		if typ != nuggit.Int && typ != null {
+			return nil, typeError(pos, op, x.typ, y.typ)
+		}
+		n.typ = typ
+	default: // "-", "*", "/":
+		if !ok || !isNumeric(typ) {
+			return nil, typeError(pos, op, x.typ, y.typ)
+		}
+		n.typ = typ
+	}
+	return n, nil
+}
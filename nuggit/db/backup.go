@@ -0,0 +1,58 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+	"github.com/wenooij/nuggit/status"
+	"github.com/wenooij/nuggit/storage"
+)
+
+var backupCmd = &cli.Command{
+	Name:      "backup",
+	Usage:     "Writes a consistent copy of the database to a new file",
+	ArgsUsage: "PATH",
+	Description: `Backs up the database using VACUUM INTO.
+The backup is safe to take while a server is using the database.`,
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return fmt.Errorf("expected a single backup path (%q): %w", c.Args().Slice(), status.ErrInvalidArgument)
+		}
+		db, err := sql.Open("sqlite", c.String("database_path"))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		if err := storage.Backup(c.Context, db, c.Args().First()); err != nil {
+			return err
+		}
+		fmt.Printf("Backed up the database to %s\n", c.Args().First())
+		return nil
+	},
+}
+
+var restoreCmd = &cli.Command{
+	Name:      "restore",
+	Usage:     "Replaces the database with a backup",
+	ArgsUsage: "PATH",
+	Description: `Checks the backup, migrates it to the latest schema and moves it into place.
+Stop servers using the database before restoring it.`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "Replace an existing database",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return fmt.Errorf("expected a single backup path (%q): %w", c.Args().Slice(), status.ErrInvalidArgument)
+		}
+		if err := storage.Restore(c.Context, c.Args().First(), c.String("database_path"), c.Bool("force")); err != nil {
+			return err
+		}
+		fmt.Printf("Restored the database from %s\n", c.Args().First())
+		return nil
+	},
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/urfave/cli/v2"
+	"github.com/wenooij/nuggit/storage"
+)
+
+var exportCmd = &cli.Command{
+	Name:  "export",
+	Usage: "Exports pipes, views and rules as a portable bundle",
+	Description: `Writes a JSON Lines bundle of all pipes, views and rules with their
+resource metadata and labels. Use --results to include events and results.`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "results",
+			Usage: "Include all events and their results",
+		},
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Value:   "-",
+			Usage:   "Bundle file to write (- writes to stdout)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		db, err := sql.Open("sqlite", c.String("database_path"))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		var out io.Writer = os.Stdout
+		if path := c.String("output"); path != "-" {
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		w := bufio.NewWriter(out)
+		report, err := storage.ExportBundle(c.Context, db, w, c.Bool("results"))
+		if err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d pipes, %d views, %d rules and %d events\n", report.Pipes, report.Views, report.Rules, report.Events)
+		return nil
+	},
+}
+
+var importCmd = &cli.Command{
+	Name:      "import",
+	Usage:     "Imports a bundle into the database",
+	ArgsUsage: "[BUNDLE]",
+	Description: `Migrates the database and imports the bundle read from the file or stdin.
+Objects which are already stored are skipped. Pipe digests are checked
+against their specs. Import bundles with results into a fresh database.`,
+	Action: func(c *cli.Context) error {
+		var in io.Reader = os.Stdin
+		if path := c.Args().First(); path != "" && path != "-" {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+
+		db, err := sql.Open("sqlite", c.String("database_path"))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		if err := storage.InitDB(c.Context, db); err != nil {
+			return err
+		}
+		report, err := storage.ImportBundle(c.Context, db, bufio.NewReader(in))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d pipes, %d views, %d rules and %d events\n", report.Pipes, report.Views, report.Rules, report.Events)
+		return nil
+	},
+}
@@ -0,0 +1,31 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+)
+
+var Cmd = &cli.Command{
+	Name:  "db",
+	Usage: "Manages a local Nuggit database",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:        "database_path",
+			Aliases:     []string{"db"},
+			Value:       filepath.Join(os.Getenv("HOME"), ".nuggit", "nuggit.sqlite"),
+			DefaultText: "~/.nuggit/nuggit.sqlite",
+		},
+	},
+	Subcommands: []*cli.Command{
+		migrateCmd,
+		gcCmd,
+		rebuildCmd,
+		indexCmd,
+		backupCmd,
+		restoreCmd,
+		exportCmd,
+		importCmd,
+	},
+}
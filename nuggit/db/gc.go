@@ -0,0 +1,60 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/wenooij/nuggit/storage"
+)
+
+var gcCmd = &cli.Command{
+	Name:  "gc",
+	Usage: "Deletes the plans, events and results which are not retained by the retention policy",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "dry_run",
+			Aliases: []string{"dry-run"},
+			Usage:   "Report what would be deleted without deleting anything",
+		},
+		&cli.StringFlag{
+			Name:  "retention",
+			Usage: "Retention policy JSON file (defaults to dropping unexchanged plans after 24h)",
+		},
+		&cli.BoolFlag{
+			Name:  "vacuum",
+			Usage: "Run VACUUM after deleting when the database does not use incremental auto vacuum",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		policy := storage.DefaultRetentionPolicy()
+		if path := c.String("retention"); path != "" {
+			var err error
+			if policy, err = storage.LoadRetentionPolicy(path); err != nil {
+				return err
+			}
+		}
+
+		db, err := sql.Open("sqlite", c.String("database_path"))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		dryRun := c.Bool("dry_run")
+		report, err := storage.CollectGarbage(c.Context, db, policy, time.Now(), dryRun, c.Bool("vacuum"))
+		if err != nil {
+			return err
+		}
+		verb := "Deleted"
+		if dryRun {
+			verb = "Would delete"
+		}
+		fmt.Printf("%s %d results, %d events and %d plans\n", verb, report.Results, report.Events, report.Plans)
+		if report.Vacuumed {
+			fmt.Println("Vacuumed the database")
+		}
+		return nil
+	},
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"github.com/wenooij/nuggit/status"
+	"github.com/wenooij/nuggit/storage"
+)
+
+var indexCmd = &cli.Command{
+	Name:      "index",
+	Usage:     "Chooses the pipes whose string results are indexed for search",
+	ArgsUsage: "[PIPE...]",
+	Description: `Indexes the string results of the given pipes by name and rebuilds the search index.
+Use --all to index all string results, which is the default.
+Without arguments, prints the pipes which are indexed.`,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "all",
+			Usage: "Index the string results of all pipes",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		db, err := sql.Open("sqlite", c.String("database_path"))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		pipes := c.Args().Slice()
+		switch {
+		case c.Bool("all") && len(pipes) > 0:
+			return fmt.Errorf("pipes cannot be given with --all (%q): %w", pipes, status.ErrInvalidArgument)
+		case c.Bool("all") || len(pipes) > 0:
+			if err := storage.SetSearchPipes(c.Context, db, pipes); err != nil {
+				return err
+			}
+			fmt.Println("Rebuilt the search index")
+			return nil
+		}
+		indexed, err := storage.SearchPipes(c.Context, db)
+		if err != nil {
+			return err
+		}
+		if len(indexed) == 0 {
+			fmt.Println("Indexing all string results")
+			return nil
+		}
+		fmt.Printf("Indexing string results of %s\n", strings.Join(indexed, ", "))
+		return nil
+	},
+}
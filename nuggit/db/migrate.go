@@ -0,0 +1,57 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+	"github.com/wenooij/nuggit/storage"
+)
+
+var migrateCmd = &cli.Command{
+	Name:  "migrate",
+	Usage: "Migrates the database to the latest schema version",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "dry_run",
+			Aliases: []string{"dry-run"},
+			Usage:   "Check the pending migrations without applying them",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		db, err := sql.Open("sqlite", c.String("database_path"))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		ctx := c.Context
+		version, err := storage.SchemaVersion(ctx, db)
+		if err != nil {
+			return err
+		}
+		dryRun := c.Bool("dry_run")
+		migrations, err := storage.Migrate(ctx, db, dryRun)
+		for _, m := range migrations {
+			if dryRun {
+				fmt.Printf("Pending migration %04d_%s\n", m.Version, m.Name)
+			} else {
+				fmt.Printf("Applied migration %04d_%s\n", m.Version, m.Name)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if len(migrations) == 0 {
+			fmt.Printf("Database is up to date at version %d\n", version)
+			return nil
+		}
+		if !dryRun {
+			if err := storage.NewViewStore(db).RebuildViews(ctx); err != nil {
+				return err
+			}
+			fmt.Println("Rebuilt views")
+		}
+		return nil
+	},
+}
@@ -0,0 +1,42 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+	"github.com/wenooij/nuggit/storage"
+)
+
+var rebuildCmd = &cli.Command{
+	Name:      "rebuild",
+	Usage:     "Drops and recreates views against the current schema",
+	ArgsUsage: "[VIEW...]",
+	Description: `Rebuilds the given views by UUID or alias.
+When no views are given, all views are rebuilt.
+The tables of materialized views are refilled from the stored results.`,
+	Action: func(c *cli.Context) error {
+		db, err := sql.Open("sqlite", c.String("database_path"))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		store := storage.NewViewStore(db)
+		views := c.Args().Slice()
+		if len(views) == 0 {
+			if err := store.RebuildViews(c.Context); err != nil {
+				return err
+			}
+			fmt.Println("Rebuilt all views")
+			return nil
+		}
+		for _, view := range views {
+			if err := store.Rebuild(c.Context, view); err != nil {
+				return err
+			}
+			fmt.Printf("Rebuilt view %s\n", view)
+		}
+		return nil
+	},
+}
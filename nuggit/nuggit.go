@@ -6,6 +6,7 @@ import (
 	"os"
 
 	"github.com/urfave/cli/v2"
+	"github.com/wenooij/nuggit/nuggit/db"
 	"github.com/wenooij/nuggit/nuggit/pipes"
 	"github.com/wenooij/nuggit/nuggit/resources"
 	"github.com/wenooij/nuggit/nuggit/results"
@@ -26,6 +27,7 @@ func main() {
 			},
 		},
 		Commands: []*cli.Command{
+			db.Cmd,
 			pipes.Cmd,
 			resources.Cmd,
 			results.Cmd,
@@ -0,0 +1,109 @@
+package resources
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli/v2"
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/client"
+	"github.com/wenooij/nuggit/resources"
+	"github.com/wenooij/nuggit/status"
+)
+
+var applyCmd = &cli.Command{
+	Name:    "apply",
+	Aliases: []string{"a"},
+	Usage:   "Makes the resources on the server match the resources in --dirs",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "dry-run",
+			Aliases: []string{"n"},
+			Usage:   "Print the diff without applying it",
+		},
+		&cli.BoolFlag{
+			Name:  "prune",
+			Usage: "Delete server resources whose name is missing from --dirs (older digests of names in --dirs are kept)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		dir := c.String("dirs")
+		if dir == "" {
+			return fmt.Errorf("--dirs is required")
+		}
+		idx := new(resources.Index)
+		if err := idx.AddFS(os.DirFS(dir)); err != nil {
+			return err
+		}
+		qualified, err := idx.Qualified()
+		if err != nil {
+			return err
+		}
+
+		cli := client.NewClient(c.String("backend_addr"))
+		remote, err := cli.ListResources(nil)
+		if err != nil {
+			return err
+		}
+		changes, err := qualified.Diff(remote)
+		if err != nil {
+			return err
+		}
+
+		prune := c.Bool("prune")
+		counts := make(map[resources.ChangeType]int)
+		for _, ch := range changes {
+			counts[ch.Type]++
+			fmt.Println(formatChange(ch, prune))
+		}
+		fmt.Printf("%d to create, %d to update, %d unchanged, %d kept, %d to prune\n",
+			counts[resources.Create], counts[resources.Update], counts[resources.Unchanged], counts[resources.Kept], counts[resources.Prune])
+		if c.Bool("dry-run") {
+			return nil
+		}
+
+		for _, ch := range changes {
+			r := ch.Resource
+			switch ch.Type {
+			case resources.Create, resources.Update:
+				if err := cli.CreateResource(r); err != nil && !errors.Is(err, status.ErrAlreadyExists) {
+					return fmt.Errorf("failed to apply %s %s@%s: %w", r.GetKind(), r.GetName(), r.GetDigest(), err)
+				}
+			case resources.Prune:
+				if !prune {
+					continue
+				}
+				req := &api.DeleteResourceRequest{Kind: r.GetKind(), UUID: r.GetMetadata().GetUUID()}
+				if req.UUID == "" {
+					// Pipes are identified by name and digest.
+					req.Name, req.Digest = r.GetName(), r.GetDigest()
+				}
+				if err := cli.DeleteResource(req); err != nil && !errors.Is(err, status.ErrNotFound) {
+					return fmt.Errorf("failed to prune %s %s@%s: %w", r.GetKind(), r.GetName(), r.GetDigest(), err)
+				}
+			}
+		}
+		return nil
+	},
+}
+
+func formatChange(ch resources.Change, prune bool) string {
+	r := ch.Resource
+	line := fmt.Sprintf("%s %s@%s", r.GetKind(), r.GetName(), r.GetDigest())
+	switch ch.Type {
+	case resources.Create:
+		return "+ " + line
+	case resources.Update:
+		return fmt.Sprintf("~ %s (replaces %q)", line, ch.Replaces)
+	case resources.Prune:
+		if !prune {
+			return "- " + line + " (kept without --prune)"
+		}
+		return "- " + line
+	case resources.Kept:
+		return fmt.Sprintf("  %s (kept: %s)", line, ch.Reason)
+	default:
+		return "  " + line
+	}
+}
@@ -1,33 +1,33 @@
 package resources
 
 import (
+	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
-	"net/url"
 
 	"github.com/urfave/cli/v2"
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/client"
 )
 
 var lookupCmd = &cli.Command{
 	Name:    "lookup",
 	Aliases: []string{"l"},
-	Usage:   "Gets resources from the server",
+	Usage:   "Gets resources from the server by name or UUID",
 	Flags: []cli.Flag{
 		&cli.StringFlag{
 			Name:    "name",
 			Aliases: []string{"n"},
-			Usage:   "Name of the pipe",
+			Usage:   "Name or name@digest of the resource",
 		},
 		&cli.StringFlag{
 			Name:    "digest",
 			Aliases: []string{"d"},
-			Usage:   "Digest of the pipe",
+			Usage:   "Digest of the resource",
 		},
 		&cli.StringFlag{
 			Name:    "uuid",
 			Aliases: []string{"id", "u"},
-			Usage:   "UUID of the resource",
+			Usage:   "UUID of the view or rule",
 		},
 		&cli.StringFlag{
 			Name:    "kind",
@@ -35,18 +35,97 @@ var lookupCmd = &cli.Command{
 		},
 	},
 	Action: func(c *cli.Context) error {
-		u, err := url.JoinPath(c.String("backend_addr"), "/api/resources/lookup")
-		req, err := http.NewRequestWithContext(c.Context, "POST", u, nil)
+		cli := client.NewClient(c.String("backend_addr"))
+		rs, err := cli.LookupResource(&api.LookupResourceRequest{
+			Kind:   api.Kind(c.String("kind")),
+			Name:   c.String("name"),
+			Digest: c.String("digest"),
+			UUID:   c.String("uuid"),
+		})
 		if err != nil {
 			return err
 		}
-		resp, err := http.DefaultClient.Do(req)
+		return printResources(rs)
+	},
+}
+
+var listCmd = &cli.Command{
+	Name:    "list",
+	Aliases: []string{"ls"},
+	Usage:   "Lists resources on the server",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "kind",
+			Aliases: []string{"k"},
+		},
+		&cli.StringFlag{
+			Name:    "name",
+			Aliases: []string{"n"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "label",
+			Aliases: []string{"l"},
+			Usage:   "Labels which must all be present on the resource",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		cli := client.NewClient(c.String("backend_addr"))
+		rs, err := cli.ListResources(&api.ResourceFilter{
+			Kind:   api.Kind(c.String("kind")),
+			Name:   c.String("name"),
+			Labels: c.StringSlice("label"),
+		})
 		if err != nil {
 			return err
 		}
-		body, err := io.ReadAll(resp.Body)
-		defer resp.Body.Close()
-		fmt.Println(string(body))
-		return nil
+		return printResources(rs)
 	},
 }
+
+var deleteCmd = &cli.Command{
+	Name:    "delete",
+	Aliases: []string{"rm"},
+	Usage:   "Deletes a single resource from the server by name or UUID",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "name",
+			Aliases: []string{"n"},
+			Usage:   "Name or name@digest of the resource",
+		},
+		&cli.StringFlag{
+			Name:    "digest",
+			Aliases: []string{"d"},
+			Usage:   "Digest of the resource",
+		},
+		&cli.StringFlag{
+			Name:    "uuid",
+			Aliases: []string{"id", "u"},
+			Usage:   "UUID of the view or rule",
+		},
+		&cli.StringFlag{
+			Name:    "kind",
+			Aliases: []string{"k"},
+		},
+	},
+	Action: func(c *cli.Context) error {
+		cli := client.NewClient(c.String("backend_addr"))
+		return cli.DeleteResource(&api.DeleteResourceRequest{
+			Kind:   api.Kind(c.String("kind")),
+			Name:   c.String("name"),
+			Digest: c.String("digest"),
+			UUID:   c.String("uuid"),
+		})
+	},
+}
+
+func printResources(rs []*api.Resource) error {
+	if rs == nil {
+		rs = []*api.Resource{}
+	}
+	data, err := json.MarshalIndent(rs, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -24,9 +24,13 @@ var Cmd = &cli.Command{
 		},
 	},
 	Subcommands: []*cli.Command{
+		applyCmd,
 		catCmd,
+		deleteCmd,
 		digestCmd,
 		indexCmd,
+		listCmd,
+		lookupCmd,
 		putCmd,
 	},
 }
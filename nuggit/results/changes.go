@@ -0,0 +1,116 @@
+package results
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/urfave/cli/v2"
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/status"
+	"github.com/wenooij/nuggit/storage"
+)
+
+var changesCmd = &cli.Command{
+	Name:  "changes",
+	Usage: "Prints value changes between events for the same URL",
+	Description: `Changes compare the values of each pipe with the previous event
+for the same URL. Only the url, kind, after and a single pipe filter apply.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "url",
+			Usage: "Canonical URL of the changes",
+		},
+		&cli.StringFlag{
+			Name:  "kind",
+			Usage: "Kind of change (added, removed or changed)",
+		},
+		&cli.Int64Flag{
+			Name:  "after",
+			Usage: "Print changes of events after the event ID",
+		},
+		&cli.StringFlag{
+			Name:    "format",
+			Aliases: []string{"f"},
+			Value:   formatJSONL,
+			Usage:   "Output format (csv or jsonl)",
+		},
+		&cli.IntFlag{
+			Name:    "limit",
+			Aliases: []string{"n"},
+			Usage:   "Maximum number of changes to print (0 prints all)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		for _, flag := range []string{"view", "url_pattern", "since", "until"} {
+			if c.String(flag) != "" {
+				return fmt.Errorf("flag is not supported for changes (%q): %w", flag, status.ErrInvalidArgument)
+			}
+		}
+		filter := &api.ChangeFilter{
+			URL:   c.String("url"),
+			Kind:  c.String("kind"),
+			After: c.Int64("after"),
+		}
+		switch pipes := c.StringSlice("pipe"); len(pipes) {
+		case 0:
+		case 1:
+			pipe, err := integrity.ParseNameDigest(pipes[0])
+			if err != nil {
+				return err
+			}
+			filter.Pipe = pipe
+		default:
+			return fmt.Errorf("changes support a single pipe filter (%q): %w", pipes, status.ErrInvalidArgument)
+		}
+		format := c.String("format")
+		if format != formatCSV && format != formatJSONL {
+			return fmt.Errorf("unsupported format (%q): %w", format, status.ErrInvalidArgument)
+		}
+
+		db, err := sql.Open("sqlite", c.String("database_path"))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		w := bufio.NewWriter(os.Stdout)
+		defer w.Flush()
+		cw := csv.NewWriter(w)
+		enc := json.NewEncoder(w)
+		if format == formatCSV {
+			cw.Write([]string{"event", "prev_event", "url", "received_at", "pipe", "sequence", "kind", "old", "new"})
+		}
+		n, limit := 0, c.Int("limit")
+		for change, err := range storage.NewResultStore(db).ScanChanges(c.Context, filter) {
+			if err != nil {
+				return err
+			}
+			if format == formatCSV {
+				cw.Write([]string{
+					strconv.FormatInt(change.Event, 10),
+					strconv.FormatInt(change.PrevEvent, 10),
+					change.URL,
+					formatTime(change.ReceivedAt),
+					change.Pipe,
+					strconv.Itoa(change.Sequence),
+					change.Kind,
+					formatValue(change.Old),
+					formatValue(change.New),
+				})
+			} else if err := enc.Encode(change); err != nil {
+				return err
+			}
+			if n++; limit > 0 && n >= limit {
+				break
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	},
+}
@@ -0,0 +1,61 @@
+package results
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+	"github.com/wenooij/nuggit/status"
+)
+
+var exportCmd = &cli.Command{
+	Name:  "export",
+	Usage: "Exports matching results to a CSV, JSON Lines or Parquet file",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:        "output",
+			Aliases:     []string{"o"},
+			Value:       "-",
+			DefaultText: "stdout",
+		},
+		&cli.StringFlag{
+			Name:    "format",
+			Aliases: []string{"f"},
+			Usage:   "Output format (csv, jsonl or parquet; defaults to the output extension or jsonl)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		output := c.String("output")
+		format := c.String("format")
+		if format == "" {
+			format = formatFromExt(output)
+		}
+		if _, ok := newWriters[format]; !ok {
+			return fmt.Errorf("unsupported format (%q): %w", format, status.ErrInvalidArgument)
+		}
+
+		var w io.Writer = os.Stdout
+		if output != "-" {
+			f, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return writeResults(c, w, format, 0)
+	},
+}
+
+func formatFromExt(path string) string {
+	switch filepath.Ext(path) {
+	case ".csv":
+		return formatCSV
+	case ".parquet":
+		return formatParquet
+	default:
+		return formatJSONL
+	}
+}
@@ -1,7 +1,101 @@
 package results
 
-import "github.com/urfave/cli/v2"
+import (
+	"database/sql"
+	"fmt"
+	"iter"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/status"
+	"github.com/wenooij/nuggit/storage"
+)
 
 var Cmd = &cli.Command{
-	Name: "results",
+	Name:  "results",
+	Usage: "Reads results from a local Nuggit database",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:        "database_path",
+			Aliases:     []string{"db"},
+			Value:       filepath.Join(os.Getenv("HOME"), ".nuggit", "nuggit.sqlite"),
+			DefaultText: "~/.nuggit/nuggit.sqlite",
+		},
+		&cli.StringSliceFlag{
+			Name:    "pipe",
+			Aliases: []string{"p"},
+			Usage:   "Pipe name@digest to include (the digest is optional)",
+		},
+		&cli.StringFlag{
+			Name:    "view",
+			Aliases: []string{"v"},
+			Usage:   "View name or UUID whose pipes to include",
+		},
+		&cli.StringFlag{
+			Name:    "url_pattern",
+			Aliases: []string{"pattern", "u"},
+			Usage:   "RE2 pattern matched against event URLs",
+		},
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "Include results received at or after the RFC 3339 time or duration ago",
+		},
+		&cli.StringFlag{
+			Name:  "until",
+			Usage: "Include results received before the RFC 3339 time or duration ago",
+		},
+	},
+	Subcommands: []*cli.Command{
+		changesCmd,
+		exportCmd,
+		scanCmd,
+		searchCmd,
+	},
+}
+
+// scanResults opens the database and scans the results matching the command filters.
+func scanResults(c *cli.Context) (iter.Seq2[*storage.ResultRow, error], func() error, error) {
+	filter := &storage.ResultFilter{
+		View:       c.String("view"),
+		URLPattern: c.String("url_pattern"),
+	}
+	for _, pipe := range c.StringSlice("pipe") {
+		nameDigest, err := integrity.ParseNameDigest(pipe)
+		if err != nil {
+			return nil, nil, err
+		}
+		filter.Pipes = append(filter.Pipes, nameDigest)
+	}
+	now := time.Now()
+	var err error
+	if filter.Since, err = parseTime(c.String("since"), now); err != nil {
+		return nil, nil, err
+	}
+	if filter.Until, err = parseTime(c.String("until"), now); err != nil {
+		return nil, nil, err
+	}
+
+	db, err := sql.Open("sqlite", c.String("database_path"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return storage.NewResultStore(db).ScanResults(c.Context, filter), db.Close, nil
+}
+
+// parseTime parses an RFC 3339 time or a duration before now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("time must be RFC 3339 or a duration (%q): %w", s, status.ErrInvalidArgument)
+	}
+	return t, nil
 }
@@ -1,7 +1,28 @@
 package results
 
-import "github.com/urfave/cli/v2"
+import (
+	"os"
+
+	"github.com/urfave/cli/v2"
+)
 
 var scanCmd = &cli.Command{
-	Name: "scan",
+	Name:  "scan",
+	Usage: "Prints matching results to stdout",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "format",
+			Aliases: []string{"f"},
+			Value:   formatJSONL,
+			Usage:   "Output format (csv or jsonl)",
+		},
+		&cli.IntFlag{
+			Name:    "limit",
+			Aliases: []string{"n"},
+			Usage:   "Maximum number of results to print (0 prints all)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		return writeResults(c, os.Stdout, c.String("format"), c.Int("limit"))
+	},
 }
@@ -0,0 +1,108 @@
+package results
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/status"
+	"github.com/wenooij/nuggit/storage"
+)
+
+var searchCmd = &cli.Command{
+	Name:      "search",
+	Usage:     "Searches string results and prints matching snippets",
+	ArgsUsage: "QUERY...",
+	Description: `The query uses the SQLite FTS5 syntax, for example '"breaking news" OR election'.
+Hits are printed by relevance. Only the url and a single pipe filter apply.`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "url",
+			Usage: "Canonical URL of the results",
+		},
+		&cli.StringFlag{
+			Name:    "format",
+			Aliases: []string{"f"},
+			Value:   formatJSONL,
+			Usage:   "Output format (csv or jsonl)",
+		},
+		&cli.IntFlag{
+			Name:    "limit",
+			Aliases: []string{"n"},
+			Value:   20,
+			Usage:   "Maximum number of hits to print (0 prints all)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		for _, flag := range []string{"view", "url_pattern", "since", "until"} {
+			if c.String(flag) != "" {
+				return fmt.Errorf("flag is not supported for search (%q): %w", flag, status.ErrInvalidArgument)
+			}
+		}
+		filter := &api.SearchFilter{
+			Query: strings.Join(c.Args().Slice(), " "),
+			URL:   c.String("url"),
+			Limit: c.Int("limit"),
+		}
+		if filter.Query == "" {
+			return fmt.Errorf("query is required: %w", status.ErrInvalidArgument)
+		}
+		switch pipes := c.StringSlice("pipe"); len(pipes) {
+		case 0:
+		case 1:
+			pipe, err := integrity.ParseNameDigest(pipes[0])
+			if err != nil {
+				return err
+			}
+			filter.Pipe = pipe
+		default:
+			return fmt.Errorf("search supports a single pipe filter (%q): %w", pipes, status.ErrInvalidArgument)
+		}
+		format := c.String("format")
+		if format != formatCSV && format != formatJSONL {
+			return fmt.Errorf("unsupported format (%q): %w", format, status.ErrInvalidArgument)
+		}
+
+		db, err := sql.Open("sqlite", c.String("database_path"))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		w := bufio.NewWriter(os.Stdout)
+		defer w.Flush()
+		cw := csv.NewWriter(w)
+		enc := json.NewEncoder(w)
+		if format == formatCSV {
+			cw.Write([]string{"event", "url", "timestamp", "received_at", "pipe", "sequence", "snippet"})
+		}
+		for hit, err := range storage.NewResultStore(db).SearchResults(c.Context, filter) {
+			if err != nil {
+				return err
+			}
+			if format == formatCSV {
+				cw.Write([]string{
+					strconv.FormatInt(hit.Event, 10),
+					hit.URL,
+					formatTime(hit.Timestamp),
+					formatTime(hit.ReceivedAt),
+					hit.Pipe,
+					strconv.Itoa(hit.Sequence),
+					hit.Snippet,
+				})
+			} else if err := enc.Encode(hit); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	},
+}
@@ -0,0 +1,216 @@
+package results
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/status"
+	"github.com/wenooij/nuggit/storage"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	formatCSV     = "csv"
+	formatJSONL   = "jsonl"
+	formatParquet = "parquet"
+)
+
+// rowWriter writes result rows in an output format.
+//
+// Close flushes any buffered rows but does not close the underlying writer.
+type rowWriter interface {
+	Write(*storage.ResultRow) error
+	Close() error
+}
+
+var newWriters = map[string]func(io.Writer) (rowWriter, error){
+	formatCSV:     newCSVWriter,
+	formatJSONL:   newJSONLWriter,
+	formatParquet: newParquetWriter,
+}
+
+// writeResults writes up to limit of the matching results to w.
+func writeResults(c *cli.Context, w io.Writer, format string, limit int) error {
+	newWriter, ok := newWriters[format]
+	if !ok {
+		return fmt.Errorf("unsupported format (%q): %w", format, status.ErrInvalidArgument)
+	}
+	results, closeDB, err := scanResults(c)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	rw, err := newWriter(w)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for r, err := range results {
+		if err != nil {
+			return err
+		}
+		if err := rw.Write(r); err != nil {
+			return err
+		}
+		if n++; limit > 0 && n >= limit {
+			break
+		}
+	}
+	return rw.Close()
+}
+
+var header = []string{"plan", "event", "url", "timestamp", "received_at", "pipe", "sequence", "value"}
+
+type csvWriter struct{ w *csv.Writer }
+
+func newCSVWriter(w io.Writer) (rowWriter, error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return nil, err
+	}
+	return &csvWriter{cw}, nil
+}
+
+func (w *csvWriter) Write(r *storage.ResultRow) error {
+	return w.w.Write([]string{
+		r.Plan,
+		strconv.FormatInt(r.Event, 10),
+		r.URL,
+		formatTime(r.Timestamp),
+		formatTime(r.ReceivedAt),
+		r.Pipe,
+		strconv.Itoa(r.Sequence),
+		formatValue(r.Value),
+	})
+}
+
+func (w *csvWriter) Close() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type jsonlWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func newJSONLWriter(w io.Writer) (rowWriter, error) {
+	bw := bufio.NewWriter(w)
+	return &jsonlWriter{bw, json.NewEncoder(bw)}, nil
+}
+
+func (w *jsonlWriter) Write(r *storage.ResultRow) error {
+	value := r.Value
+	if b, ok := value.([]byte); ok {
+		value = string(b)
+	}
+	return w.enc.Encode(struct {
+		Plan       string `json:"plan"`
+		Event      int64  `json:"event"`
+		URL        string `json:"url,omitempty"`
+		Timestamp  string `json:"timestamp,omitempty"`
+		ReceivedAt string `json:"received_at,omitempty"`
+		Pipe       string `json:"pipe"`
+		Sequence   int    `json:"sequence"`
+		Value      any    `json:"value"`
+	}{r.Plan, r.Event, r.URL, formatTime(r.Timestamp), formatTime(r.ReceivedAt), r.Pipe, r.Sequence, value})
+}
+
+func (w *jsonlWriter) Close() error { return w.w.Flush() }
+
+// parquetRow stores values in the column matching their point type.
+type parquetRow struct {
+	Plan        string   `parquet:"name=plan, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Event       int64    `parquet:"name=event, type=INT64"`
+	URL         *string  `parquet:"name=url, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Timestamp   *int64   `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL"`
+	ReceivedAt  *int64   `parquet:"name=received_at, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL"`
+	Pipe        string   `parquet:"name=pipe, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Sequence    int32    `parquet:"name=sequence, type=INT32"`
+	BytesValue  *string  `parquet:"name=bytes_value, type=BYTE_ARRAY, repetitiontype=OPTIONAL"`
+	StringValue *string  `parquet:"name=string_value, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	BoolValue   *bool    `parquet:"name=bool_value, type=BOOLEAN, repetitiontype=OPTIONAL"`
+	IntValue    *int64   `parquet:"name=int_value, type=INT64, repetitiontype=OPTIONAL"`
+	FloatValue  *float64 `parquet:"name=float_value, type=DOUBLE, repetitiontype=OPTIONAL"`
+}
+
+type parquetWriter struct{ w *writer.ParquetWriter }
+
+func newParquetWriter(w io.Writer) (rowWriter, error) {
+	pw, err := writer.NewParquetWriterFromWriter(w, new(parquetRow), 1)
+	if err != nil {
+		return nil, err
+	}
+	pw.RowGroupSize = 16 << 20 // Bounds the rows buffered in memory.
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetWriter{pw}, nil
+}
+
+func (w *parquetWriter) Write(r *storage.ResultRow) error {
+	row := &parquetRow{
+		Plan:       r.Plan,
+		Event:      r.Event,
+		URL:        optional(r.URL, r.URL != ""),
+		Timestamp:  optional(r.Timestamp.UnixMilli(), !r.Timestamp.IsZero()),
+		ReceivedAt: optional(r.ReceivedAt.UnixMilli(), !r.ReceivedAt.IsZero()),
+		Pipe:       r.Pipe,
+		Sequence:   int32(r.Sequence),
+	}
+	switch v := r.Value.(type) {
+	case []byte:
+		if r.Point.Scalar == nuggit.String {
+			row.StringValue = optional(string(v), true)
+		} else {
+			row.BytesValue = optional(string(v), true)
+		}
+	case string:
+		if r.Point.Scalar == nuggit.String {
+			row.StringValue = optional(v, true)
+		} else {
+			row.BytesValue = optional(v, true)
+		}
+	case bool:
+		row.BoolValue = optional(v, true)
+	case int64:
+		row.IntValue = optional(v, true)
+	case float64:
+		row.FloatValue = optional(v, true)
+	}
+	return w.w.Write(row)
+}
+
+func (w *parquetWriter) Close() error { return w.w.WriteStop() }
+
+func optional[T any](v T, ok bool) *T {
+	if !ok {
+		return nil
+	}
+	return &v
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,193 @@
+package resources
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+)
+
+type ChangeType int
+
+const (
+	// Unchanged resources are stored on the server with the same name and digest.
+	Unchanged ChangeType = iota
+	// Create resources have a name which is not stored on the server.
+	Create
+	// Update resources have a new digest for a name stored on the server.
+	Update
+	// Prune resources are stored on the server but their name is missing from the index.
+	Prune
+	// Kept resources are stored on the server and are not pruned although their digest
+	// is missing from the index, such as older digests of a name which is in the index.
+	// Pruning those would delete their results.
+	Kept
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case Unchanged:
+		return "unchanged"
+	case Create:
+		return "create"
+	case Update:
+		return "update"
+	case Prune:
+		return "prune"
+	case Kept:
+		return "kept"
+	default:
+		return fmt.Sprintf("ChangeType(%d)", int(t))
+	}
+}
+
+type Change struct {
+	Type     ChangeType
+	Resource *api.Resource
+	// Replaces lists the digests stored on the server for the name of an updated resource.
+	Replaces []string
+	// Reason explains why a resource is kept.
+	Reason string
+}
+
+// Diff compares the resources in the qualified index to the remote resources stored on a server.
+//
+// Resources are matched by kind and name and compared by digest.
+// Remote resources stored without a name are matched by kind and digest.
+// Resources without a digest such as rules are digested on a copy.
+// Changes to apply are ordered topologically followed by unchanged resources,
+// kept resources and then prune candidates ordered so that dependents come before their dependencies.
+//
+// Only remote resources whose name is missing from the index are pruned.
+// Older digests of a name in the index and unmatched resources without a name are kept.
+func (i *Index) Diff(remote []*api.Resource) ([]Change, error) {
+	type kindName struct{ kind, name string }
+	type kindDigest struct{ kind, digest string }
+	remoteDigests := make(map[kindName][]string)
+	remoteKeys := make(map[kindName]map[string]struct{})
+	remoteUnnamed := make(map[kindDigest]struct{})
+	for _, r := range remote {
+		if r.GetName() == "" {
+			remoteUnnamed[kindDigest{r.GetKind(), r.GetDigest()}] = struct{}{}
+			continue
+		}
+		k := kindName{r.GetKind(), r.GetName()}
+		remoteDigests[k] = append(remoteDigests[k], r.GetDigest())
+		if remoteKeys[k] == nil {
+			remoteKeys[k] = make(map[string]struct{})
+		}
+		remoteKeys[k][r.GetDigest()] = struct{}{}
+	}
+
+	var changes, unchanged []Change
+	local := make(map[kindName]map[string]struct{})
+	localDigests := make(map[kindDigest]struct{})
+	for nd, err := range i.Topo() {
+		if err != nil {
+			return nil, err
+		}
+		r, ok := i.Get(nd)
+		if !ok {
+			return nil, fmt.Errorf("failed to find resource in index (%q)", nd)
+		}
+		if r.GetDigest() == "" {
+			r = Clone(r)
+			if err := integrity.SetDigest(r); err != nil {
+				return nil, err
+			}
+		}
+		k := kindName{r.GetKind(), r.GetName()}
+		if local[k] == nil {
+			local[k] = make(map[string]struct{})
+		}
+		local[k][r.GetDigest()] = struct{}{}
+		kd := kindDigest{r.GetKind(), r.GetDigest()}
+		localDigests[kd] = struct{}{}
+		_, found := remoteKeys[k][r.GetDigest()]
+		if !found {
+			_, found = remoteUnnamed[kd]
+		}
+		switch {
+		case found:
+			unchanged = append(unchanged, Change{Type: Unchanged, Resource: r})
+		case len(remoteDigests[k]) > 0:
+			changes = append(changes, Change{Type: Update, Resource: r, Replaces: remoteDigests[k]})
+		default:
+			changes = append(changes, Change{Type: Create, Resource: r})
+		}
+	}
+	changes = append(changes, unchanged...)
+
+	var prune []*api.Resource
+	for _, r := range remote {
+		if r.GetName() == "" {
+			if _, found := localDigests[kindDigest{r.GetKind(), r.GetDigest()}]; !found {
+				changes = append(changes, Change{Type: Kept, Resource: r, Reason: "stored without a name"})
+			}
+			continue
+		}
+		k := kindName{r.GetKind(), r.GetName()}
+		if _, found := local[k][r.GetDigest()]; found {
+			continue
+		}
+		if len(local[k]) > 0 {
+			changes = append(changes, Change{Type: Kept, Resource: r, Reason: "superseded by a newer digest"})
+			continue
+		}
+		prune = append(prune, r)
+	}
+	for _, r := range pruneOrder(prune) {
+		changes = append(changes, Change{Type: Prune, Resource: r})
+	}
+	return changes, nil
+}
+
+// pruneOrder orders resources so that each resource comes before the resources it depends on.
+//
+// Dependencies on resources outside of rs are ignored.
+func pruneOrder(rs []*api.Resource) []*api.Resource {
+	var x Index
+	dependents := make(map[integrity.NameDigest]int, len(rs))
+	for _, r := range rs {
+		for dep := range x.Deps(r) {
+			dependents[integrity.Key(dep)]++
+		}
+	}
+	ordered := make([]*api.Resource, 0, len(rs))
+	done := make([]bool, len(rs))
+	for len(ordered) < len(rs) {
+		n := len(ordered)
+		for j, r := range rs {
+			if done[j] || r.GetKind() == api.KindPipe && dependents[integrity.Key(r)] > 0 {
+				continue
+			}
+			done[j] = true
+			ordered = append(ordered, r)
+			for dep := range x.Deps(r) {
+				dependents[integrity.Key(dep)]--
+			}
+		}
+		if n == len(ordered) {
+			// Cycles are left for the server to reject.
+			for j, r := range rs {
+				if !done[j] {
+					ordered = append(ordered, r)
+				}
+			}
+		}
+	}
+	// Stable kind order makes the plan easier to read.
+	slices.SortStableFunc(ordered, func(a, b *api.Resource) int {
+		return cmp.Compare(pruneRank(a.GetKind()), pruneRank(b.GetKind()))
+	})
+	return ordered
+}
+
+func pruneRank(kind api.Kind) int {
+	if kind == api.KindPipe {
+		return 1
+	}
+	return 0
+}
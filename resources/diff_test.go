@@ -0,0 +1,84 @@
+package resources
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+)
+
+func newPipeResource(name, digest string, actions ...nuggit.Action) *api.Resource {
+	return &api.Resource{
+		APIVersion: api.V1,
+		Kind:       api.KindPipe,
+		Metadata:   &api.ResourceMetadata{Name: name, Digest: digest},
+		Spec:       &nuggit.Pipe{Actions: actions},
+	}
+}
+
+func pipeAction(name, digest string) nuggit.Action {
+	return nuggit.Action{"action": "pipe", "name": name, "digest": digest}
+}
+
+func TestDiff(t *testing.T) {
+	var idx Index
+	for _, r := range []*api.Resource{
+		newPipeResource("base", "b1", nuggit.Action{"action": "documentElement"}),
+		newPipeResource("title", "t2", pipeAction("base", "b1")),
+		newPipeResource("links", "l1", pipeAction("base", "b1")),
+		{APIVersion: api.V1, Kind: api.KindRule, Metadata: &api.ResourceMetadata{Name: "example"}, Spec: &nuggit.Rule{Hostname: "example.com"}},
+	} {
+		if err := idx.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Rule resources stored before names were recorded are matched by digest.
+	rule := &api.Resource{Spec: &nuggit.Rule{Hostname: "example.com"}}
+	ruleDigest, err := integrity.GetDigest(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := []*api.Resource{
+		{APIVersion: api.V1, Kind: api.KindRule, Metadata: &api.ResourceMetadata{Digest: ruleDigest, UUID: "r1"}, Spec: &nuggit.Rule{Hostname: "example.com"}},
+		{APIVersion: api.V1, Kind: api.KindRule, Metadata: &api.ResourceMetadata{Digest: "r2", UUID: "r2"}, Spec: &nuggit.Rule{Hostname: "other.com"}},
+		newPipeResource("base", "b1", nuggit.Action{"action": "documentElement"}),
+		newPipeResource("old", "o1", pipeAction("base", "b1")),
+		newPipeResource("older", "o2", pipeAction("old", "o1")),
+		newPipeResource("title", "t1", pipeAction("base", "b1")),
+		{APIVersion: api.V1, Kind: api.KindView, Metadata: &api.ResourceMetadata{Name: "news", Digest: "n1"}, Spec: &nuggit.View{}},
+	}
+
+	changes, err := idx.Diff(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.Type.String()+" "+c.Resource.GetKind()+" "+c.Resource.GetName())
+		if c.Resource.GetDigest() == "" {
+			t.Errorf("Diff(): got no digest for %s %q", c.Resource.GetKind(), c.Resource.GetName())
+		}
+		if c.Type == Update && !slices.Equal(c.Replaces, []string{"t1"}) {
+			t.Errorf("Diff(): got replaced digests %q for %q, want [t1]", c.Replaces, c.Resource.GetName())
+		}
+	}
+	// Independent creates, updates and unchanged resources are unordered.
+	slices.Sort(got[:2])
+	slices.Sort(got[2:4])
+	want := []string{
+		"create pipe links",
+		"update pipe title",
+		"unchanged pipe base",
+		"unchanged rule example",
+		"kept rule ",
+		"kept pipe title",
+		"prune view news",
+		"prune pipe older",
+		"prune pipe old",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Diff(): got changes\n%q\nwant\n%q", got, want)
+	}
+}
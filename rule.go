@@ -1,11 +1,28 @@
 package nuggit
 
 type Rule struct {
-	Hostname      string   `json:"hostname,omitempty"`
-	URLPattern    string   `json:"url_pattern,omitempty"`
-	AlwaysTrigger bool     `json:"always_trigger,omitempty"`
-	Disable       bool     `json:"disable,omitempty"`
-	Labels        []string `json:"labels,omitempty"`
+	// Hostname matches the URL hostname exactly.
+	// A leading "*." matches any subdomain of the remaining hostname.
+	Hostname string `json:"hostname,omitempty"`
+	// URLPattern optionally matches the canonical URL with a re2 pattern.
+	// The URL is canonicalized with the Canonical config of the rule so that,
+	// by default, the pattern never sees the fragment or tracking parameters.
+	URLPattern string `json:"url_pattern,omitempty"`
+	// Scheme optionally constrains the URL scheme, such as "https".
+	Scheme string `json:"scheme,omitempty"`
+	// Port optionally constrains the URL port.
+	// URLs without an explicit port use the default port of their scheme.
+	Port int `json:"port,omitempty"`
+	// PathGlob optionally matches the URL path.
+	// "*" matches within a path segment and "**" matches across segments.
+	PathGlob      string      `json:"path_glob,omitempty"`
+	AlwaysTrigger bool        `json:"always_trigger,omitempty"`
+	Disable       bool        `json:"disable,omitempty"`
+	Labels        []string    `json:"labels,omitempty"`
+	Policy        *RulePolicy `json:"policy,omitempty"`
+	// Canonical configures how URLs are canonicalized before matching the rule
+	// and before storing the events of triggers opened by the rule.
+	Canonical *CanonicalURL `json:"canonical,omitempty"`
 }
 
 func (c *Rule) GetHostname() string {
@@ -22,6 +39,27 @@ func (c *Rule) GetURLPattern() string {
 	return c.URLPattern
 }
 
+func (c *Rule) GetScheme() string {
+	if c == nil {
+		return ""
+	}
+	return c.Scheme
+}
+
+func (c *Rule) GetPort() int {
+	if c == nil {
+		return 0
+	}
+	return c.Port
+}
+
+func (c *Rule) GetPathGlob() string {
+	if c == nil {
+		return ""
+	}
+	return c.PathGlob
+}
+
 func (c *Rule) GetAlwaysTrigger() bool {
 	if c == nil {
 		return false
@@ -35,3 +73,102 @@ func (c *Rule) GetLabels() []string {
 	}
 	return c.Labels
 }
+
+func (c *Rule) GetPolicy() *RulePolicy {
+	if c == nil {
+		return nil
+	}
+	return c.Policy
+}
+
+func (c *Rule) GetCanonical() *CanonicalURL {
+	if c == nil {
+		return nil
+	}
+	return c.Canonical
+}
+
+// RulePolicy limits how often a matching rule triggers.
+type RulePolicy struct {
+	// SampleRate is the fraction of matching page views which trigger.
+	// Zero is the same as 1 and triggers every page view.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+	// MinInterval is the minimum duration between triggers for the same URL, such as "6h".
+	MinInterval string `json:"min_interval,omitempty"`
+	// MaxPerHostHour is the maximum number of triggers per hostname in each hour.
+	MaxPerHostHour int `json:"max_per_host_hour,omitempty"`
+	// QuietHours are daily time ranges without triggers, such as "22:00-06:00".
+	QuietHours []string `json:"quiet_hours,omitempty"`
+	// TimeZone is the IANA time zone used for QuietHours, the default is UTC.
+	TimeZone string `json:"time_zone,omitempty"`
+}
+
+func (p *RulePolicy) GetSampleRate() float64 {
+	if p == nil {
+		return 0
+	}
+	return p.SampleRate
+}
+
+func (p *RulePolicy) GetMinInterval() string {
+	if p == nil {
+		return ""
+	}
+	return p.MinInterval
+}
+
+func (p *RulePolicy) GetMaxPerHostHour() int {
+	if p == nil {
+		return 0
+	}
+	return p.MaxPerHostHour
+}
+
+func (p *RulePolicy) GetQuietHours() []string {
+	if p == nil {
+		return nil
+	}
+	return p.QuietHours
+}
+
+func (p *RulePolicy) GetTimeZone() string {
+	if p == nil {
+		return ""
+	}
+	return p.TimeZone
+}
+
+// CanonicalURL configures URL canonicalization.
+//
+// Canonical URLs have a lowercase scheme and host, no default port,
+// no fragment, and sorted query parameters without tracking parameters.
+type CanonicalURL struct {
+	// StripParams are query parameters removed in addition to the default tracking parameters.
+	// A trailing "*" matches any parameter with the prefix, such as "utm_*".
+	StripParams []string `json:"strip_params,omitempty"`
+	// KeepParams are query parameters kept even when they match a strip parameter.
+	KeepParams []string `json:"keep_params,omitempty"`
+	// KeepFragment keeps the URL fragment for single page apps which route using it.
+	KeepFragment bool `json:"keep_fragment,omitempty"`
+}
+
+func (c *CanonicalURL) GetStripParams() []string {
+	if c == nil {
+		return nil
+	}
+	return c.StripParams
+}
+
+func (c *CanonicalURL) GetKeepParams() []string {
+	if c == nil {
+		return nil
+	}
+	return c.KeepParams
+}
+
+func (c *CanonicalURL) GetKeepFragment() bool {
+	if c == nil {
+		return false
+	}
+	return c.KeepFragment
+}
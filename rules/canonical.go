@@ -0,0 +1,146 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/status"
+	"golang.org/x/net/idna"
+)
+
+// DefaultStripParams are the tracking and session parameters removed from every canonical URL.
+var DefaultStripParams = []string{
+	"utm_*",
+	"gclid",
+	"dclid",
+	"fbclid",
+	"msclkid",
+	"mc_cid",
+	"mc_eid",
+	"_ga",
+	"_gl",
+	"sid",
+	"sessionid",
+	"session_id",
+	"phpsessid",
+	"jsessionid",
+}
+
+// ValidateCanonical checks that the strip and keep parameters are valid.
+func ValidateCanonical(c *nuggit.CanonicalURL) error {
+	for _, params := range [][]string{c.GetStripParams(), c.GetKeepParams()} {
+		for _, p := range params {
+			if p == "" || p == "*" || strings.Contains(strings.TrimSuffix(p, "*"), "*") {
+				return fmt.Errorf("query parameter must be a name or a prefix followed by '*' (%q): %w", p, status.ErrInvalidArgument)
+			}
+		}
+	}
+	return nil
+}
+
+// MergeCanonical returns the configuration used when several rules with canonical URL configs match.
+//
+// The strip and keep parameters are the sorted union of the configs
+// and the fragment is kept when any config keeps it.
+// MergeCanonical returns nil when all configs are nil.
+func MergeCanonical(cs ...*nuggit.CanonicalURL) *nuggit.CanonicalURL {
+	var merged *nuggit.CanonicalURL
+	for _, c := range cs {
+		if c == nil {
+			continue
+		}
+		if merged == nil {
+			merged = new(nuggit.CanonicalURL)
+		}
+		merged.StripParams = append(merged.StripParams, c.StripParams...)
+		merged.KeepParams = append(merged.KeepParams, c.KeepParams...)
+		merged.KeepFragment = merged.KeepFragment || c.KeepFragment
+	}
+	if merged != nil {
+		slices.Sort(merged.StripParams)
+		merged.StripParams = slices.Compact(merged.StripParams)
+		slices.Sort(merged.KeepParams)
+		merged.KeepParams = slices.Compact(merged.KeepParams)
+	}
+	return merged
+}
+
+// Canonicalize returns a canonical copy of the URL using the configuration c.
+//
+// The scheme and host are lowercased, the host is converted to IDNA form,
+// default ports and fragments are dropped, an empty path becomes "/",
+// and the query parameters are sorted after removing stripped parameters.
+// A nil configuration only strips DefaultStripParams.
+func Canonicalize(u *url.URL, c *nuggit.CanonicalURL) *url.URL {
+	cu := *u
+	cu.Scheme = strings.ToLower(u.Scheme)
+
+	host := u.Hostname()
+	if h, err := idna.Lookup.ToASCII(host); err == nil {
+		host = h
+	} else {
+		host = strings.ToLower(host)
+	}
+	switch port := u.Port(); {
+	case port != "" && port != strconv.Itoa(DefaultPort(cu.Scheme)):
+		host = net.JoinHostPort(host, port)
+	case strings.Contains(host, ":"): // IPv6 literal.
+		host = "[" + host + "]"
+	}
+	cu.Host = host
+
+	if cu.Path == "" && cu.Opaque == "" && cu.Host != "" {
+		cu.Path = "/"
+		cu.RawPath = ""
+	}
+	if !c.GetKeepFragment() {
+		cu.Fragment = ""
+		cu.RawFragment = ""
+	}
+	cu.RawQuery = canonicalQuery(u.RawQuery, c)
+	cu.ForceQuery = false
+	return &cu
+}
+
+// canonicalQuery removes the stripped parameters and sorts the remaining ones by name.
+//
+// Values of repeated parameters keep their relative order.
+func canonicalQuery(rawQuery string, c *nuggit.CanonicalURL) string {
+	if rawQuery == "" {
+		return ""
+	}
+	// Malformed pairs are dropped by ParseQuery.
+	values, _ := url.ParseQuery(rawQuery)
+	for k := range values {
+		if matchParam(c.GetKeepParams(), k) {
+			continue
+		}
+		if matchParam(DefaultStripParams, k) || matchParam(c.GetStripParams(), k) {
+			delete(values, k)
+		}
+	}
+	return values.Encode()
+}
+
+// matchParam reports whether the parameter name matches any of the patterns.
+//
+// Names are compared case insensitively.
+func matchParam(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if prefix, found := strings.CutSuffix(p, "*"); found {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package rules
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/wenooij/nuggit"
+)
+
+func TestCanonicalize(t *testing.T) {
+	for _, tc := range []struct {
+		url       string
+		canonical *nuggit.CanonicalURL
+		want      string
+	}{
+		{"HTTPS://Example.COM:443", nil, "https://example.com/"},
+		{"http://example.com:8080/a#top", nil, "http://example.com:8080/a"},
+		{"https://example.com/a?b=2&utm_source=x&a=1&UTM_Medium=y&fbclid=z", nil, "https://example.com/a?a=1&b=2"},
+		{"https://example.com/?q=1&ref=x&sid=1", &nuggit.CanonicalURL{StripParams: []string{"ref"}, KeepParams: []string{"sid"}}, "https://example.com/?q=1&sid=1"},
+		{"https://example.com/#/products", &nuggit.CanonicalURL{KeepFragment: true}, "https://example.com/#/products"},
+		{"https://bücher.example/", nil, "https://xn--bcher-kva.example/"},
+		{"http://[::1]:80/", nil, "http://[::1]/"},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Canonicalize(u, tc.canonical).String(); got != tc.want {
+			t.Errorf("Canonicalize(%q): got %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestMergeCanonical(t *testing.T) {
+	if got := MergeCanonical(nil, nil); got != nil {
+		t.Errorf("MergeCanonical(nil, nil): got %+v, want nil", got)
+	}
+	got := MergeCanonical(
+		&nuggit.CanonicalURL{StripParams: []string{"ref", "b"}, KeepParams: []string{"sid"}},
+		nil,
+		&nuggit.CanonicalURL{StripParams: []string{"a", "ref"}, KeepFragment: true},
+	)
+	want := &nuggit.CanonicalURL{StripParams: []string{"a", "b", "ref"}, KeepParams: []string{"sid"}, KeepFragment: true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeCanonical(): got %+v, want %+v", got, want)
+	}
+}
@@ -9,5 +9,16 @@ import (
 func Clone(r nuggit.Rule) nuggit.Rule {
 	copy := r
 	copy.Labels = slices.Clone(r.Labels)
+	if r.Policy != nil {
+		policy := *r.Policy
+		policy.QuietHours = slices.Clone(r.Policy.QuietHours)
+		copy.Policy = &policy
+	}
+	if r.Canonical != nil {
+		canonical := *r.Canonical
+		canonical.StripParams = slices.Clone(r.Canonical.StripParams)
+		canonical.KeepParams = slices.Clone(r.Canonical.KeepParams)
+		copy.Canonical = &canonical
+	}
 	return copy
 }
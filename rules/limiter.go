@@ -0,0 +1,213 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/status"
+)
+
+// Key returns a stable key for the fields which identify the rule.
+func Key(r nuggit.Rule) string {
+	data, _ := json.Marshal(struct {
+		Hostname      string `json:"hostname,omitempty"`
+		URLPattern    string `json:"url_pattern,omitempty"`
+		Scheme        string `json:"scheme,omitempty"`
+		Port          int    `json:"port,omitempty"`
+		PathGlob      string `json:"path_glob,omitempty"`
+		AlwaysTrigger bool   `json:"always_trigger,omitempty"`
+	}{r.Hostname, r.URLPattern, r.Scheme, r.Port, r.PathGlob, r.AlwaysTrigger})
+	return string(data)
+}
+
+// ValidatePolicy checks that the policy values are in range and can be parsed.
+func ValidatePolicy(p *nuggit.RulePolicy) error {
+	if p == nil {
+		return nil
+	}
+	if rate := p.SampleRate; rate < 0 || rate > 1 {
+		return fmt.Errorf("sample rate must be in the range [0, 1] (%v): %w", rate, status.ErrInvalidArgument)
+	}
+	if p.MinInterval != "" {
+		d, err := time.ParseDuration(p.MinInterval)
+		if err != nil || d < 0 {
+			return fmt.Errorf("min interval is not a valid duration (%q): %w", p.MinInterval, status.ErrInvalidArgument)
+		}
+	}
+	if p.MaxPerHostHour < 0 {
+		return fmt.Errorf("max per host hour must not be negative (%d): %w", p.MaxPerHostHour, status.ErrInvalidArgument)
+	}
+	for _, qh := range p.QuietHours {
+		if _, _, err := parseQuietHours(qh); err != nil {
+			return err
+		}
+	}
+	if _, err := time.LoadLocation(p.TimeZone); err != nil {
+		return fmt.Errorf("time zone is not valid (%q): %v: %w", p.TimeZone, err, status.ErrInvalidArgument)
+	}
+	return nil
+}
+
+// parseQuietHours parses "HH:MM-HH:MM" into minutes since midnight.
+func parseQuietHours(s string) (start, end int, err error) {
+	a, b, found := strings.Cut(s, "-")
+	if !found {
+		return 0, 0, fmt.Errorf("quiet hours must have the form HH:MM-HH:MM (%q): %w", s, status.ErrInvalidArgument)
+	}
+	if start, err = parseClock(a); err != nil {
+		return 0, 0, err
+	}
+	if end, err = parseClock(b); err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+func parseClock(s string) (int, error) {
+	h, m, found := strings.Cut(strings.TrimSpace(s), ":")
+	hour, err := strconv.Atoi(h)
+	if !found || err != nil || hour < 0 || hour > 24 {
+		return 0, fmt.Errorf("time of day must have the form HH:MM (%q): %w", s, status.ErrInvalidArgument)
+	}
+	minute, err := strconv.Atoi(m)
+	if err != nil || minute < 0 || minute > 59 || hour == 24 && minute != 0 {
+		return 0, fmt.Errorf("time of day must have the form HH:MM (%q): %w", s, status.ErrInvalidArgument)
+	}
+	return 60*hour + minute, nil
+}
+
+func inQuietHours(p *nuggit.RulePolicy, now time.Time) bool {
+	if len(p.GetQuietHours()) == 0 {
+		return false
+	}
+	loc, err := time.LoadLocation(p.GetTimeZone())
+	if err != nil {
+		loc = time.UTC
+	}
+	local := now.In(loc)
+	minute := 60*local.Hour() + local.Minute()
+	for _, qh := range p.GetQuietHours() {
+		start, end, err := parseQuietHours(qh)
+		if err != nil {
+			continue
+		}
+		if start <= end && start <= minute && minute < end ||
+			start > end && (minute >= start || minute < end) { // Wraps midnight.
+			return true
+		}
+	}
+	return false
+}
+
+// Limiter enforces rule policies for triggers.
+//
+// Limiter state is kept in memory and is reset when the server restarts.
+type Limiter struct {
+	mu       sync.Mutex
+	sample   func() float64
+	next     map[string]time.Time // Earliest next trigger per rule and URL.
+	hosts    map[string]int       // Triggers per rule, hostname and hour.
+	hour     time.Time
+	sweepLen int
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{
+		sample:   rand.Float64,
+		next:     make(map[string]time.Time),
+		hosts:    make(map[string]int),
+		sweepLen: 1024,
+	}
+}
+
+// Allow checks whether the rule identified by key may trigger for the URL at the given time
+// and records the trigger when it may.
+//
+// Otherwise Allow returns a reason the trigger was suppressed.
+func (l *Limiter) Allow(key string, p *nuggit.RulePolicy, u *url.URL, now time.Time) (bool, string) {
+	if p == nil {
+		return true, ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ok, reason := l.check(key, p, u, now); !ok {
+		return false, reason
+	}
+	l.record(key, p, u, now)
+	return true, ""
+}
+
+// Check reports whether the rule identified by key may trigger for the URL at the given time.
+//
+// Check does not count the trigger against the policy limits.
+// Call Record once the trigger is stored.
+// Otherwise Check returns a reason the trigger was suppressed.
+func (l *Limiter) Check(key string, p *nuggit.RulePolicy, u *url.URL, now time.Time) (bool, string) {
+	if p == nil {
+		return true, ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.check(key, p, u, now)
+}
+
+// Record counts a trigger allowed by Check against the policy limits.
+func (l *Limiter) Record(key string, p *nuggit.RulePolicy, u *url.URL, now time.Time) {
+	if p == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.record(key, p, u, now)
+}
+
+func (l *Limiter) check(key string, p *nuggit.RulePolicy, u *url.URL, now time.Time) (bool, string) {
+	if inQuietHours(p, now) {
+		return false, "quiet hours"
+	}
+
+	if next, found := l.next[key+" "+u.String()]; found && now.Before(next) {
+		return false, fmt.Sprintf("triggered less than %s ago", p.GetMinInterval())
+	}
+
+	if limit := p.GetMaxPerHostHour(); limit > 0 && now.Truncate(time.Hour).Equal(l.hour) && l.hosts[key+" "+u.Hostname()] >= limit {
+		return false, fmt.Sprintf("reached %d triggers per hour for %s", limit, u.Hostname())
+	}
+
+	if rate := p.GetSampleRate(); rate > 0 && rate < 1 && l.sample() >= rate {
+		return false, "sampled out"
+	}
+	return true, ""
+}
+
+func (l *Limiter) record(key string, p *nuggit.RulePolicy, u *url.URL, now time.Time) {
+	if interval, _ := time.ParseDuration(p.GetMinInterval()); interval > 0 {
+		l.next[key+" "+u.String()] = now.Add(interval)
+		l.sweep(now)
+	}
+	if hour := now.Truncate(time.Hour); !hour.Equal(l.hour) {
+		clear(l.hosts) // Start a new hour.
+		l.hour = hour
+	}
+	l.hosts[key+" "+u.Hostname()]++
+}
+
+// sweep removes expired entries once the map doubles in size.
+func (l *Limiter) sweep(now time.Time) {
+	if len(l.next) < l.sweepLen {
+		return
+	}
+	for k, next := range l.next {
+		if !now.Before(next) {
+			delete(l.next, k)
+		}
+	}
+	l.sweepLen = max(1024, 2*len(l.next))
+}
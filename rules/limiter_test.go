@@ -0,0 +1,69 @@
+package rules
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/wenooij/nuggit"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter()
+	l.sample = func() float64 { return 0.5 }
+
+	u, _ := url.Parse("https://example.com/a")
+	u2, _ := url.Parse("https://example.com/b")
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	interval := &nuggit.RulePolicy{MinInterval: "1h"}
+	if ok, reason := l.Allow("interval", interval, u, now); !ok {
+		t.Fatalf("Allow(first trigger): got reason %q, want ok", reason)
+	}
+	if ok, _ := l.Allow("interval", interval, u, now.Add(time.Minute)); ok {
+		t.Errorf("Allow(within interval): got ok, want throttled")
+	}
+	if ok, _ := l.Allow("interval", interval, u2, now.Add(time.Minute)); !ok {
+		t.Errorf("Allow(other url): got throttled, want ok")
+	}
+	if ok, _ := l.Allow("interval", interval, u, now.Add(time.Hour)); !ok {
+		t.Errorf("Allow(after interval): got throttled, want ok")
+	}
+
+	perHost := &nuggit.RulePolicy{MaxPerHostHour: 1}
+	if ok, _ := l.Allow("host", perHost, u, now); !ok {
+		t.Errorf("Allow(first host trigger): got throttled, want ok")
+	}
+	if ok, _ := l.Allow("host", perHost, u2, now); ok {
+		t.Errorf("Allow(second host trigger): got ok, want throttled")
+	}
+	if ok, _ := l.Allow("host", perHost, u2, now.Add(time.Hour)); !ok {
+		t.Errorf("Allow(next hour): got throttled, want ok")
+	}
+
+	if ok, _ := l.Allow("sampled", &nuggit.RulePolicy{SampleRate: 0.25}, u, now); ok {
+		t.Errorf("Allow(sampled out): got ok, want throttled")
+	}
+	if ok, _ := l.Allow("sampled", &nuggit.RulePolicy{SampleRate: 0.75}, u, now); !ok {
+		t.Errorf("Allow(sampled in): got throttled, want ok")
+	}
+
+	quiet := &nuggit.RulePolicy{QuietHours: []string{"22:00-06:00"}}
+	if ok, _ := l.Allow("quiet", quiet, u, time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)); ok {
+		t.Errorf("Allow(quiet hours): got ok, want throttled")
+	}
+	if ok, _ := l.Allow("quiet", quiet, u, now); !ok {
+		t.Errorf("Allow(outside quiet hours): got throttled, want ok")
+	}
+
+	checked := &nuggit.RulePolicy{MinInterval: "1h", MaxPerHostHour: 1}
+	for range 2 {
+		if ok, reason := l.Check("checked", checked, u, now); !ok {
+			t.Fatalf("Check(unrecorded trigger): got reason %q, want ok", reason)
+		}
+	}
+	l.Record("checked", checked, u, now)
+	if ok, _ := l.Check("checked", checked, u, now); ok {
+		t.Errorf("Check(recorded trigger): got ok, want throttled")
+	}
+}
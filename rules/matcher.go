@@ -0,0 +1,163 @@
+package rules
+
+import (
+	"fmt"
+	"iter"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/status"
+)
+
+// Matcher is an index of rules used to find the rules matching a URL.
+//
+// Rules are indexed by exact hostname and by wildcard suffix ("*.example.com").
+// URL patterns and path globs are compiled once when the rule is added.
+// A Matcher is safe for concurrent use once all rules have been added.
+type Matcher struct {
+	exact  map[string][]*matcherEntry
+	suffix map[string][]*matcherEntry
+	always []*matcherEntry
+}
+
+type matcherEntry struct {
+	id       string
+	rule     nuggit.Rule
+	pattern  *regexp.Regexp
+	pathGlob *regexp.Regexp
+}
+
+// match reports whether the canonical URL matches the entry.
+func (e *matcherEntry) match(u *url.URL, urlStr string) bool {
+	if e.rule.Scheme != "" && !strings.EqualFold(e.rule.Scheme, u.Scheme) {
+		return false
+	}
+	if e.rule.Port != 0 && e.rule.Port != effectivePort(u.Scheme, u.Port()) {
+		return false
+	}
+	if e.pathGlob != nil && !e.pathGlob.MatchString(u.Path) {
+		return false
+	}
+	if e.pattern != nil && !e.pattern.MatchString(urlStr) {
+		return false
+	}
+	return true
+}
+
+func NewMatcher() *Matcher {
+	return &Matcher{
+		exact:  make(map[string][]*matcherEntry),
+		suffix: make(map[string][]*matcherEntry),
+	}
+}
+
+// Add adds the rule with the given ID to the index.
+//
+// Disabled rules are skipped.
+func (m *Matcher) Add(id string, rule nuggit.Rule) error {
+	if rule.Disable {
+		return nil
+	}
+	e := &matcherEntry{id: id, rule: rule}
+	if rule.URLPattern != "" {
+		pattern, err := regexp.Compile(rule.URLPattern)
+		if err != nil {
+			return fmt.Errorf("url pattern is not a valid re2 (%q): %v: %w", rule.URLPattern, err, status.ErrInvalidArgument)
+		}
+		e.pattern = pattern
+	}
+	if rule.PathGlob != "" {
+		pathGlob, err := CompilePathGlob(rule.PathGlob)
+		if err != nil {
+			return err
+		}
+		e.pathGlob = pathGlob
+	}
+	// Rules are validated by the API, so fall back to the stored hostname here.
+	hostname := strings.ToLower(rule.Hostname)
+	if h, err := NormalizeHostname(rule.Hostname); err == nil {
+		hostname = h
+	}
+	switch {
+	case rule.AlwaysTrigger:
+		m.always = append(m.always, e)
+	case strings.HasPrefix(hostname, "*."):
+		suffix := strings.TrimPrefix(hostname, "*.")
+		m.suffix[suffix] = append(m.suffix[suffix], e)
+	case hostname == "":
+		// Rules without a hostname never match.
+	default:
+		m.exact[hostname] = append(m.exact[hostname], e)
+	}
+	return nil
+}
+
+// Match returns the IDs and rules which match the URL.
+//
+// The URL is canonicalized before matching using the canonicalization
+// configured by each rule. URL patterns are tested against the canonical URL
+// rather than the raw URL.
+//
+// Match does a constant number of lookups per hostname label
+// followed by a pattern test for each candidate rule.
+func (m *Matcher) Match(u *url.URL) iter.Seq2[string, nuggit.Rule] {
+	return func(yield func(string, nuggit.Rule) bool) {
+		canonical := Canonicalize(u, nil)
+		canonicalStr := canonical.String()
+		yieldMatched := func(es []*matcherEntry, testPattern bool) bool {
+			for _, e := range es {
+				if testPattern {
+					cu, cuStr := canonical, canonicalStr
+					if e.rule.Canonical != nil {
+						cu = Canonicalize(u, e.rule.Canonical)
+						cuStr = cu.String()
+					}
+					if !e.match(cu, cuStr) {
+						continue
+					}
+				}
+				if !yield(e.id, e.rule) {
+					return false
+				}
+			}
+			return true
+		}
+		// Always triggered rules skip the URL pattern test.
+		if !yieldMatched(m.always, false) {
+			return
+		}
+		hostname := canonical.Hostname()
+		if !yieldMatched(m.exact[hostname], true) {
+			return
+		}
+		// Wildcards match strict subdomains only.
+		for suffix := hostname; ; {
+			_, rest, found := strings.Cut(suffix, ".")
+			if !found {
+				break
+			}
+			if !yieldMatched(m.suffix[rest], true) {
+				return
+			}
+			suffix = rest
+		}
+	}
+}
+
+// MatchLabels returns the unique labels of the rules which match the URL.
+func (m *Matcher) MatchLabels(u *url.URL) []string {
+	var labels []string
+	seen := make(map[string]struct{})
+	for _, rule := range m.Match(u) {
+		for _, label := range rule.Labels {
+			if _, found := seen[label]; found {
+				continue
+			}
+			seen[label] = struct{}{}
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
@@ -0,0 +1,85 @@
+package rules
+
+import (
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/wenooij/nuggit"
+)
+
+func TestMatcher(t *testing.T) {
+	m := NewMatcher()
+	for _, r := range []nuggit.Rule{
+		{Hostname: "example.com", Labels: []string{"exact"}},
+		{Hostname: "example.com", URLPattern: `/products/`, Labels: []string{"products"}},
+		{Hostname: "*.example.com", Labels: []string{"wildcard"}},
+		{Hostname: "example.com", Disable: true, Labels: []string{"disabled"}},
+		{AlwaysTrigger: true, Labels: []string{"always"}},
+	} {
+		if err := m.Add("", r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		url  string
+		want []string
+	}{
+		{"https://example.com/", []string{"always", "exact"}},
+		{"https://EXAMPLE.com/products/1", []string{"always", "exact", "products"}},
+		{"https://www.example.com/products/1", []string{"always", "wildcard"}},
+		{"https://a.b.example.com/", []string{"always", "wildcard"}},
+		{"https://example.org/", []string{"always"}},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := m.MatchLabels(u)
+		slices.Sort(got)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("MatchLabels(%q): got %v, want %v", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestMatcherConstraints(t *testing.T) {
+	m := NewMatcher()
+	for _, r := range []nuggit.Rule{
+		{Hostname: "*.shop.example", Scheme: "https", Labels: []string{"https"}},
+		{Hostname: "*.shop.example", Port: 8080, Labels: []string{"port"}},
+		{Hostname: "*.shop.example", PathGlob: "/products/*", Labels: []string{"products"}},
+		{Hostname: "*.shop.example", PathGlob: "/blog/**", Labels: []string{"blog"}},
+		{Hostname: "bücher.example", Labels: []string{"idna"}},
+		{Hostname: "news.example", URLPattern: `^https://news\.example/\?id=1$`, Labels: []string{"canonical"}},
+	} {
+		if err := m.Add("", r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		url  string
+		want []string
+	}{
+		{"https://eu.shop.example/", []string{"https"}},
+		{"http://eu.shop.example/products/1", []string{"products"}},
+		{"http://eu.shop.example/products/1/reviews", nil},
+		{"http://eu.shop.example:8080/blog/2024/01/post", []string{"blog", "port"}},
+		{"https://eu.shop.example:443/", []string{"https"}},
+		{"https://xn--bcher-kva.example/", []string{"idna"}},
+		{"https://bücher.example/", []string{"idna"}},
+		{"https://NEWS.example?utm_source=feed&id=1#comments", []string{"canonical"}},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := m.MatchLabels(u)
+		slices.Sort(got)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("MatchLabels(%q): got %v, want %v", tc.url, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/status"
+	"golang.org/x/net/idna"
+)
+
+var schemePattern = regexp.MustCompile(`^[a-z][a-z0-9+.-]*$`)
+
+// NormalizeHostname validates the hostname and returns its lowercase IDNA (punycode) form.
+//
+// A leading "*." wildcard is preserved.
+func NormalizeHostname(hostname string) (string, error) {
+	wildcard := strings.HasPrefix(hostname, "*.")
+	h := strings.TrimPrefix(hostname, "*.")
+	if h == "" {
+		return "", fmt.Errorf("hostname must not be empty: %w", status.ErrInvalidArgument)
+	}
+	if strings.Contains(h, "*") {
+		return "", fmt.Errorf("hostname wildcard is only allowed as a leading label (%q): %w", hostname, status.ErrInvalidArgument)
+	}
+	ascii, err := idna.Lookup.ToASCII(h)
+	if err != nil {
+		return "", fmt.Errorf("hostname is not valid (%q): %v: %w", hostname, err, status.ErrInvalidArgument)
+	}
+	if wildcard {
+		if !strings.Contains(ascii, ".") {
+			return "", fmt.Errorf("hostname wildcard must not match a top level domain (%q): %w", hostname, status.ErrInvalidArgument)
+		}
+		ascii = "*." + ascii
+	}
+	return ascii, nil
+}
+
+// NormalizeScheme validates the scheme and returns it in lowercase.
+func NormalizeScheme(scheme string) (string, error) {
+	s := strings.ToLower(scheme)
+	if !schemePattern.MatchString(s) {
+		return "", fmt.Errorf("scheme is not valid (%q): %w", scheme, status.ErrInvalidArgument)
+	}
+	return s, nil
+}
+
+// Normalize returns a copy of the rule with a normalized hostname and scheme.
+func Normalize(r nuggit.Rule) (nuggit.Rule, error) {
+	r = Clone(r)
+	if r.Hostname != "" {
+		hostname, err := NormalizeHostname(r.Hostname)
+		if err != nil {
+			return nuggit.Rule{}, err
+		}
+		r.Hostname = hostname
+	}
+	if r.Scheme != "" {
+		scheme, err := NormalizeScheme(r.Scheme)
+		if err != nil {
+			return nuggit.Rule{}, err
+		}
+		r.Scheme = scheme
+	}
+	return r, nil
+}
+
+// CompilePathGlob compiles the path glob into an anchored regexp.
+//
+// "**" matches any sequence of characters, "*" matches any sequence
+// of characters except '/', and "?" matches any single character except '/'.
+func CompilePathGlob(glob string) (*regexp.Regexp, error) {
+	if !strings.HasPrefix(glob, "/") {
+		return nil, fmt.Errorf("path glob must start with '/' (%q): %w", glob, status.ErrInvalidArgument)
+	}
+	var sb strings.Builder
+	sb.Grow(2 * len(glob))
+	sb.WriteByte('^')
+	runes := []rune(glob)
+	for i := 0; i < len(runes); i++ {
+		switch c := runes[i]; c {
+		case '*':
+			if i+1 < len(runes) && runes[i+1] == '*' {
+				sb.WriteString(".*")
+				i++
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteByte('$')
+	return regexp.Compile(sb.String())
+}
+
+// DefaultPort returns the default port for well known schemes or 0.
+func DefaultPort(scheme string) int {
+	switch strings.ToLower(scheme) {
+	case "http", "ws":
+		return 80
+	case "https", "wss":
+		return 443
+	default:
+		return 0
+	}
+}
+
+// effectivePort returns the explicit port or the default port for the scheme.
+func effectivePort(scheme, port string) int {
+	if port == "" {
+		return DefaultPort(scheme)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return 0
+	}
+	return p
+}
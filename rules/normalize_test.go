@@ -0,0 +1,28 @@
+package rules
+
+import "testing"
+
+func TestNormalizeHostname(t *testing.T) {
+	for _, tc := range []struct {
+		hostname string
+		want     string
+		wantErr  bool
+	}{
+		{hostname: "Example.COM", want: "example.com"},
+		{hostname: "*.Example.com", want: "*.example.com"},
+		{hostname: "bücher.example", want: "xn--bcher-kva.example"},
+		{hostname: "*.com", wantErr: true},
+		{hostname: "a.*.example.com", wantErr: true},
+		{hostname: "exa mple.com", wantErr: true},
+		{hostname: "", wantErr: true},
+	} {
+		got, err := NormalizeHostname(tc.hostname)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("NormalizeHostname(%q): got err = %v, want err = %v", tc.hostname, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("NormalizeHostname(%q): got %q, want %q", tc.hostname, got, tc.want)
+		}
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,18 +24,30 @@ import (
 	"github.com/wenooij/nuggit/integrity"
 	"github.com/wenooij/nuggit/status"
 	"github.com/wenooij/nuggit/storage"
+	"github.com/wenooij/nuggit/storage/inmemory"
 	"github.com/wenooij/nuggit/trigger"
 	_ "modernc.org/sqlite"
 )
 
 type server struct {
 	*api.API
+	maxExchangeBytes int64
+	maxResultBytes   int64
 }
 
 type serverSettings struct {
 	port         int
 	nuggitDir    string
+	storageType  storage.Type
 	databasePath string
+	retention    string
+	gcInterval   time.Duration
+	readConns    int
+	writeQueue   int
+	writeGroup   int
+	// Size limits of the decoded exchange request and each of its results.
+	maxExchangeBytes int64
+	maxResultBytes   int64
 }
 
 func NewServer(settings *serverSettings, r *gin.Engine, db *sql.DB) (*server, error) {
@@ -43,17 +60,47 @@ func NewServer(settings *serverSettings, r *gin.Engine, db *sql.DB) (*server, er
 		return nil, fmt.Errorf("nuggit path is not a directory (%v): %w", settings.nuggitDir, status.ErrFailedPrecondition)
 	}
 
-	viewStore := storage.NewViewStore(db)
-	pipeStore := storage.NewPipeStore(db)
-	ruleStore := storage.NewRuleStore(db)
-	planStore := storage.NewPlanStore(db)
-	resultStore := storage.NewResultStore(db)
-	resourceStore := storage.NewResourceStore(db)
+	var (
+		viewStore     api.ViewStore
+		pipeStore     api.PipeStore
+		ruleStore     api.RuleStore
+		planStore     api.PlanStore
+		resultStore   api.ResultStore
+		resourceStore api.ResourceStore
+	)
+	switch settings.storageType {
+	case storage.StorageSQLite:
+		viewStore = storage.NewViewStore(db)
+		pipeStore = storage.NewPipeStore(db)
+		ruleStore = storage.NewRuleStore(db)
+		// Plans and results are written by a single writer which groups them into commits.
+		writer := storage.NewWriter(db, settings.writeQueue, settings.writeGroup)
+		go writer.Run(context.Background())
+		plans := storage.NewPlanStore(db)
+		plans.SetWriter(writer)
+		results := storage.NewResultStore(db)
+		results.SetWriter(writer)
+		planStore = plans
+		resultStore = results
+		resourceStore = storage.NewResourceStore(db)
+	case storage.StorageUndefined, storage.StorageInMemory:
+		memDB := inmemory.NewDB()
+		viewStore = inmemory.NewViewStore(memDB)
+		pipeStore = inmemory.NewPipeStore(memDB)
+		ruleStore = inmemory.NewRuleStore(memDB)
+		planStore = inmemory.NewPlanStore(memDB)
+		resultStore = inmemory.NewResultStore(memDB)
+		resourceStore = inmemory.NewResourceStore(memDB)
+	default:
+		return nil, fmt.Errorf("storage type is not supported (%q): %w", settings.storageType, status.ErrInvalidArgument)
+	}
 	newTriggerPlanner := func() api.TriggerPlanner { return new(trigger.Planner) }
 
 	api := api.NewAPI(viewStore, pipeStore, ruleStore, planStore, resultStore, resourceStore, newTriggerPlanner)
 	s := &server{
-		API: api,
+		API:              api,
+		maxExchangeBytes: settings.maxExchangeBytes,
+		maxResultBytes:   settings.maxResultBytes,
 	}
 	s.registerAPI(r)
 	return s, nil
@@ -69,6 +116,8 @@ func (s *server) registerAPI(r *gin.Engine) {
 	s.registerPipesAPI(r)
 	s.registerTriggerAPI(r)
 	s.registerRulesAPI(r)
+	s.registerChangesAPI(r)
+	s.registerSearchAPI(r)
 
 	for _, r := range r.Routes() {
 		routes = append(routes, fmt.Sprintf("%s %s", r.Method, r.Path))
@@ -85,6 +134,165 @@ func (s *server) registerViewsAPI(r *gin.Engine) {
 		resp, err := s.CreateView(c.Request.Context(), req)
 		status.WriteResponse(c, resp, err)
 	})
+	r.GET("/api/views", func(c *gin.Context) {
+		resp, err := s.ListViews(c.Request.Context(), &api.ListViewsRequest{})
+		status.WriteResponse(c, resp, err)
+	})
+	r.GET("/api/views/:id", func(c *gin.Context) {
+		resp, err := s.GetView(c.Request.Context(), &api.GetViewRequest{View: c.Param("id")})
+		status.WriteResponse(c, resp, err)
+	})
+	r.PUT("/api/views/:id", func(c *gin.Context) {
+		req := new(api.UpdateViewRequest)
+		if !status.ReadRequest(c, req) {
+			return
+		}
+		req.View = c.Param("id")
+		resp, err := s.UpdateView(c.Request.Context(), req)
+		status.WriteResponse(c, resp, err)
+	})
+	r.DELETE("/api/views/:id", func(c *gin.Context) {
+		resp, err := s.DeleteView(c.Request.Context(), &api.DeleteViewRequest{View: c.Param("id")})
+		status.WriteResponse(c, resp, err)
+	})
+	r.GET("/api/views/:id/rows", func(c *gin.Context) {
+		req, err := queryViewRequest(c)
+		if err != nil {
+			status.WriteError(c, err)
+			return
+		}
+		resp, err := s.QueryView(c.Request.Context(), req)
+		if err == nil && (c.Query("format") == "csv" || c.NegotiateFormat(gin.MIMEJSON, "text/csv") == "text/csv") {
+			writeViewRowsCSV(c, resp)
+			return
+		}
+		status.WriteResponse(c, resp, err)
+	})
+}
+
+// queryViewRequest parses the view rows query parameters:
+//
+//	columns=a,b&filter=a:gt:1&where=a*2>b&order_by=-b&limit=10&cursor=...
+//
+// Filters have the form column:op[:value] and a leading - in order_by sorts descending.
+// Where is an expression as in package expr.
+func queryViewRequest(c *gin.Context) (*api.QueryViewRequest, error) {
+	req := &api.QueryViewRequest{
+		View:    c.Param("id"),
+		Where:   c.Query("where"),
+		OrderBy: c.Query("order_by"),
+		Cursor:  c.Query("cursor"),
+	}
+	for _, arg := range c.QueryArray("columns") {
+		for _, col := range strings.Split(arg, ",") {
+			req.Columns = append(req.Columns, strings.TrimSpace(col))
+		}
+	}
+	for _, arg := range c.QueryArray("filter") {
+		parts := strings.SplitN(arg, ":", 3)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("filter must have the form column:op[:value] (%q): %w", arg, status.ErrInvalidArgument)
+		}
+		f := api.ViewFilter{Column: parts[0], Op: parts[1]}
+		if len(parts) == 3 {
+			f.Value = parts[2]
+		}
+		req.Filters = append(req.Filters, f)
+	}
+	if orderBy, found := strings.CutPrefix(req.OrderBy, "-"); found {
+		req.OrderBy = orderBy
+		req.Desc = true
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return nil, fmt.Errorf("limit is not a number (%q): %w", limit, status.ErrInvalidArgument)
+		}
+		req.Limit = n
+	}
+	return req, nil
+}
+
+// writeViewRowsCSV writes the rows as CSV with the next cursor in the Next-Cursor header.
+func writeViewRowsCSV(c *gin.Context, resp *api.QueryViewResponse) {
+	if resp.NextCursor != "" {
+		c.Header("Next-Cursor", resp.NextCursor)
+	}
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	w.Write(resp.Columns)
+	record := make([]string, len(resp.Columns))
+	for _, row := range resp.Rows {
+		for i, v := range row {
+			switch v := v.(type) {
+			case nil:
+				record[i] = ""
+			case time.Time:
+				record[i] = v.Format(time.RFC3339Nano)
+			default:
+				record[i] = fmt.Sprint(v)
+			}
+		}
+		w.Write(record)
+	}
+	w.Flush()
+}
+
+func (s *server) registerChangesAPI(r *gin.Engine) {
+	r.GET("/api/changes", func(c *gin.Context) {
+		req := &api.ListChangesRequest{
+			URL:  c.Query("url"),
+			Pipe: c.Query("pipe"),
+			Kind: c.Query("kind"),
+		}
+		if after := c.Query("after"); after != "" {
+			n, err := strconv.ParseInt(after, 10, 64)
+			if err != nil {
+				status.WriteError(c, fmt.Errorf("after is not an event ID (%q): %w", after, status.ErrInvalidArgument))
+				return
+			}
+			req.After = n
+		}
+		if limit := c.Query("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil {
+				status.WriteError(c, fmt.Errorf("limit is not a number (%q): %w", limit, status.ErrInvalidArgument))
+				return
+			}
+			req.Limit = n
+		}
+		resp, err := s.ListChanges(c.Request.Context(), req)
+		status.WriteResponse(c, resp, err)
+	})
+}
+
+func (s *server) registerSearchAPI(r *gin.Engine) {
+	r.GET("/api/search", func(c *gin.Context) {
+		req := &api.SearchResultsRequest{
+			Query: c.Query("q"),
+			Pipe:  c.Query("pipe"),
+			URL:   c.Query("url"),
+		}
+		if offset := c.Query("offset"); offset != "" {
+			n, err := strconv.Atoi(offset)
+			if err != nil {
+				status.WriteError(c, fmt.Errorf("offset is not a number (%q): %w", offset, status.ErrInvalidArgument))
+				return
+			}
+			req.Offset = n
+		}
+		if limit := c.Query("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil {
+				status.WriteError(c, fmt.Errorf("limit is not a number (%q): %w", limit, status.ErrInvalidArgument))
+				return
+			}
+			req.Limit = n
+		}
+		resp, err := s.SearchResults(c.Request.Context(), req)
+		status.WriteResponse(c, resp, err)
+	})
 }
 
 func (s *server) registerPipesAPI(r *gin.Engine) {
@@ -112,11 +320,18 @@ func (s *server) registerTriggerAPI(r *gin.Engine) {
 		status.WriteResponse(c, resp, err)
 	})
 	r.POST("/api/triggers/exchange", func(c *gin.Context) {
-		req := new(api.ExchangeResultsRequest)
-		if !status.ReadRequest(c, req) {
+		body, err := spoolBody(c, s.maxExchangeBytes)
+		if err != nil {
+			status.WriteError(c, err)
+			return
+		}
+		defer body.Close()
+		req, err := api.DecodeExchangeResults(body, s.maxResultBytes)
+		if err != nil {
+			status.WriteError(c, err)
 			return
 		}
-		resp, err := s.ExchangeResults(c.Request.Context(), req)
+		resp, err := s.StreamExchangeResults(c.Request.Context(), req)
 		status.WriteResponse(c, resp, err)
 	})
 	r.POST("/api/triggers/close", func(c *gin.Context) {
@@ -138,6 +353,33 @@ func (s *server) registerResourcesAPI(r *gin.Engine) {
 		resp, err := s.CreateResource(c.Request.Context(), req)
 		status.WriteResponse(c, resp, err)
 	})
+	r.GET("/api/resources", func(c *gin.Context) {
+		req := &api.ListResourcesRequest{Filter: &api.ResourceFilter{
+			Kind:   c.Query("kind"),
+			Name:   c.Query("name"),
+			Digest: c.Query("digest"),
+			UUID:   c.Query("uuid"),
+			Labels: c.QueryArray("label"),
+		}}
+		resp, err := s.ListResources(c.Request.Context(), req)
+		status.WriteResponse(c, resp, err)
+	})
+	r.POST("/api/resources/lookup", func(c *gin.Context) {
+		req := new(api.LookupResourceRequest)
+		if !status.ReadRequest(c, req) {
+			return
+		}
+		resp, err := s.LookupResource(c.Request.Context(), req)
+		status.WriteResponse(c, resp, err)
+	})
+	r.DELETE("/api/resources", func(c *gin.Context) {
+		req := new(api.DeleteResourceRequest)
+		if !status.ReadRequest(c, req) {
+			return
+		}
+		resp, err := s.DeleteResource(c.Request.Context(), req)
+		status.WriteResponse(c, resp, err)
+	})
 }
 
 func (s *server) registerRulesAPI(r *gin.Engine) {
@@ -157,6 +399,48 @@ func (s *server) registerRulesAPI(r *gin.Engine) {
 		resp, err := s.DeleteRule(c.Request.Context(), req)
 		status.WriteResponse(c, resp, err)
 	})
+	r.GET("/api/rules", func(c *gin.Context) {
+		req := &api.ListRulesRequest{Filter: &api.RuleFilter{
+			Hostname: c.Query("hostname"),
+			Label:    c.Query("label"),
+		}}
+		resp, err := s.ListRules(c.Request.Context(), req)
+		status.WriteResponse(c, resp, err)
+	})
+	r.GET("/api/rules/:id", func(c *gin.Context) {
+		resp, err := s.GetRule(c.Request.Context(), &api.GetRuleRequest{Rule: c.Param("id")})
+		status.WriteResponse(c, resp, err)
+	})
+	r.PUT("/api/rules/:id", func(c *gin.Context) {
+		req := new(api.UpdateRuleRequest)
+		if !status.ReadRequest(c, req) {
+			return
+		}
+		req.ID = c.Param("id")
+		resp, err := s.UpdateRule(c.Request.Context(), req)
+		status.WriteResponse(c, resp, err)
+	})
+	r.POST("/api/rules/:id/enable", func(c *gin.Context) {
+		resp, err := s.EnableRule(c.Request.Context(), &api.EnableRuleRequest{Rule: c.Param("id")})
+		status.WriteResponse(c, resp, err)
+	})
+	r.POST("/api/rules/:id/disable", func(c *gin.Context) {
+		resp, err := s.DisableRule(c.Request.Context(), &api.DisableRuleRequest{Rule: c.Param("id")})
+		status.WriteResponse(c, resp, err)
+	})
+	r.PUT("/api/rules/:id/labels", func(c *gin.Context) {
+		req := new(api.UpdateRuleLabelsRequest)
+		if !status.ReadRequest(c, req) {
+			return
+		}
+		req.Rule = c.Param("id")
+		resp, err := s.UpdateRuleLabels(c.Request.Context(), req)
+		status.WriteResponse(c, resp, err)
+	})
+	r.DELETE("/api/rules/:id", func(c *gin.Context) {
+		resp, err := s.DeleteRule(c.Request.Context(), &api.DeleteRuleRequest{ID: c.Param("id")})
+		status.WriteResponse(c, resp, err)
+	})
 }
 
 func queryName(arg string) (integrity.NameDigest, error) {
@@ -181,24 +465,122 @@ func queryNames(args []string) ([]integrity.NameDigest, error) {
 	return names, nil
 }
 
+// spoolMemory is the size of request bodies kept in memory by spoolBody.
+const spoolMemory = 1 << 20
+
+// spoolBody reads the decoded request body before it is stored
+// so that slow clients don't hold up the writer.
+//
+// Bodies larger than spoolMemory are spooled to a temporary file
+// which is removed when the returned body is closed.
+func spoolBody(c *gin.Context, limit int64) (io.ReadCloser, error) {
+	body, err := status.ReadBody(c, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, body, spoolMemory)
+	if err != nil && err != io.EOF {
+		return nil, bodyError(err)
+	}
+	if n < spoolMemory {
+		return io.NopCloser(&buf), nil
+	}
+
+	f, err := os.CreateTemp("", "nuggit-exchange-*")
+	if err != nil {
+		return nil, err
+	}
+	spool := spoolFile{f}
+	if _, err := io.Copy(f, io.MultiReader(&buf, body)); err != nil {
+		spool.Close()
+		return nil, bodyError(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		spool.Close()
+		return nil, err
+	}
+	return spool, nil
+}
+
+// bodyError returns size limit errors as is and marks other errors reading the body as invalid.
+func bodyError(err error) error {
+	if errors.Is(err, status.ErrResourceExhausted) {
+		return err
+	}
+	return fmt.Errorf("failed to read body: %v: %w", err, status.ErrInvalidArgument)
+}
+
+type spoolFile struct{ *os.File }
+
+func (f spoolFile) Close() error {
+	err := f.File.Close()
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+func collectGarbage(ctx context.Context, db *sql.DB, policy *storage.RetentionPolicy, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		report, err := storage.CollectGarbage(ctx, db, policy, time.Now(), false /* dryRun */, false /* vacuum */)
+		if err != nil {
+			log.Printf("Garbage collection failed: %v", err)
+		} else if report.Results+report.Events+report.Plans > 0 {
+			log.Printf("Garbage collection deleted %d results, %d events and %d plans", report.Results, report.Events, report.Plans)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func main() {
 	settings := &serverSettings{}
 	flag.IntVar(&settings.port, "port", 9402, "Server port")
 	flag.StringVar(&settings.nuggitDir, "nuggit_dir", filepath.Join(os.Getenv("HOME"), ".nuggit"), "Location of the Nuggit directory")
+	flag.StringVar(&settings.storageType, "storage", storage.StorageSQLite, "Storage backend (sqlite or inmemory)")
 	flag.StringVar(&settings.databasePath, "database_path", filepath.Join(os.Getenv("HOME"), ".nuggit", "nuggit.sqlite"), "Sqllite database path")
+	flag.StringVar(&settings.retention, "retention", "", "Retention policy JSON file (defaults to dropping unexchanged plans after 24h)")
+	flag.DurationVar(&settings.gcInterval, "gc_interval", time.Hour, "Interval between garbage collections of the sqlite database (0 disables GC)")
+	flag.IntVar(&settings.readConns, "read_conns", 8, "Maximum number of open sqlite connections")
+	flag.IntVar(&settings.writeQueue, "write_queue", 256, "Number of queued sqlite writes before exchanges wait for the writer")
+	flag.IntVar(&settings.writeGroup, "write_group", 64, "Maximum number of sqlite writes committed in a single transaction")
+	flag.Int64Var(&settings.maxExchangeBytes, "max_exchange_bytes", 64<<20, "Maximum decoded size of an exchange request body (0 disables the limit). Bodies are read in full, spooling to a temporary file past 1MiB, before results are stored so that slow clients don't hold up the sqlite writer")
+	flag.Int64Var(&settings.maxResultBytes, "max_result_bytes", 16<<20, "Maximum encoded size of each exchanged result (0 disables the limit). Larger results fail while they are decoded")
 	flag.Parse()
 
-	ctx := context.Background()
-	db, err := sql.Open("sqlite", settings.databasePath)
-	if err != nil {
-		log.Printf("Failed to open sqlite database: %v", err)
-		os.Exit(1)
-	}
-	if err := storage.InitDB(ctx, db); err != nil {
-		log.Printf("Failed to initialized sqlite DB: %v", err)
-		os.Exit(3)
+	var db *sql.DB
+	if settings.storageType == storage.StorageSQLite {
+		ctx := context.Background()
+		var err error
+		db, err = storage.OpenDB(settings.databasePath, settings.readConns)
+		if err != nil {
+			log.Printf("Failed to open sqlite database: %v", err)
+			os.Exit(1)
+		}
+		if err := storage.InitDB(ctx, db); err != nil {
+			log.Printf("Failed to initialized sqlite DB: %v", err)
+			os.Exit(3)
+		}
+		defer db.Close()
+		if settings.gcInterval > 0 {
+			policy := storage.DefaultRetentionPolicy()
+			if settings.retention != "" {
+				if policy, err = storage.LoadRetentionPolicy(settings.retention); err != nil {
+					log.Printf("Failed to load retention policy: %v", err)
+					os.Exit(2)
+				}
+			}
+			go collectGarbage(ctx, db, policy, settings.gcInterval)
+		}
 	}
-	db.SetMaxOpenConns(1) // https://pkg.go.dev/modernc.org/sqlite#section-readme
 
 	r := gin.Default()
 	r.Use(cors.New(cors.Config{
@@ -213,6 +595,5 @@ func main() {
 		log.Printf("Initializing server failed: %v", err)
 		os.Exit(4)
 	}
-	defer db.Close()
 	r.Run(fmt.Sprint(":", settings.port))
 }
@@ -0,0 +1,80 @@
+package status
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ReadBody returns the request body decoded according to its Content-Encoding.
+//
+// The gzip and zstd encodings are supported. Reading more than limit bytes
+// of the encoded or decoded body fails with ErrResourceExhausted.
+// A non-positive limit disables the limit.
+func ReadBody(c *gin.Context, limit int64) (io.ReadCloser, error) {
+	body := limitReader(c.Request.Body, limit)
+	switch encoding := strings.ToLower(strings.TrimSpace(c.GetHeader("Content-Encoding"))); encoding {
+	case "", "identity":
+		return io.NopCloser(body), nil
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(body)
+		if err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("body is required: %w", ErrInvalidArgument)
+			}
+			return nil, fmt.Errorf("%v: %w", err, ErrInvalidArgument)
+		}
+		return readCloser{limitReader(r, limit), r}, nil
+	case "zstd":
+		// Windows are limited to 8 MiB as required for the zstd content encoding (RFC 8878).
+		r, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(8<<20))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", err, ErrInvalidArgument)
+		}
+		rc := r.IOReadCloser()
+		return readCloser{limitReader(rc, limit), rc}, nil
+	default:
+		return nil, fmt.Errorf("content encoding is not supported (%q): %w", encoding, ErrInvalidArgument)
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func limitReader(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &limitedReader{r: r, n: limit, limit: limit}
+}
+
+// limitedReader is like io.LimitedReader but fails when the limit is exceeded.
+type limitedReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Check for more data past the limit.
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			return 0, fmt.Errorf("request body is too large (> %d bytes): %w", l.limit, ErrResourceExhausted)
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
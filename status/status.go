@@ -158,7 +158,13 @@ func WriteResponseStatusCode[E any](c *gin.Context, successStatusCode int, e E,
 }
 
 func ReadRequest[T *E, E any](c *gin.Context, req T) bool {
-	d := json.NewDecoder(c.Request.Body)
+	body, err := ReadBody(c, 0)
+	if err != nil {
+		WriteError(c, err)
+		return false
+	}
+	defer body.Close()
+	d := json.NewDecoder(body)
 	if err := d.Decode(req); err != nil {
 		if err == io.EOF {
 			WriteError(c, fmt.Errorf("body is required: %w", ErrInvalidArgument))
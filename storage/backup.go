@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/wenooij/nuggit/status"
+)
+
+// Backup writes a consistent copy of the database to path using VACUUM INTO.
+//
+// Backup is safe to use on the database of a live server
+// as it only needs a read transaction. The path must not exist.
+func Backup(ctx context.Context, db *sql.DB, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("backup file already exists (%q): %w", path, status.ErrAlreadyExists)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "VACUUM INTO ?", path)
+	return err
+}
+
+// Restore replaces the database at dbPath with the backup at backupPath
+// and migrates it to the latest schema version.
+//
+// The backup is checked and copied to a temporary file next to the database
+// which is renamed into place, so a failed restore leaves the database untouched.
+// Servers using the database must be stopped before it is restored.
+// Unless force is set, Restore fails when the database already exists.
+func Restore(ctx context.Context, backupPath, dbPath string, force bool) error {
+	if _, err := os.Stat(backupPath); err != nil {
+		return fmt.Errorf("failed to read backup (%q): %w", backupPath, err)
+	}
+	if _, err := os.Stat(dbPath); err == nil && !force {
+		return fmt.Errorf("database already exists (%q): %w", dbPath, status.ErrAlreadyExists)
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	backup, err := sql.Open("sqlite", "file:"+backupPath+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	var check string
+	if err := backup.QueryRowContext(ctx, "PRAGMA integrity_check").Scan(&check); err != nil {
+		return fmt.Errorf("failed to check backup (%q): %v: %w", backupPath, err, status.ErrInvalidArgument)
+	}
+	if check != "ok" {
+		return fmt.Errorf("backup failed the integrity check (%q): %s: %w", backupPath, check, status.ErrInvalidArgument)
+	}
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	if version, err := SchemaVersion(ctx, backup); err != nil {
+		return err
+	} else if version > len(migrations) {
+		return fmt.Errorf("backup schema version is newer than supported (%d > %d): %w", version, len(migrations), status.ErrFailedPrecondition)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dbPath), filepath.Base(dbPath)+".restore-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+	// VACUUM INTO needs an empty file.
+	if err := os.Remove(tmpPath); err != nil {
+		return err
+	}
+	if _, err := backup.ExecContext(ctx, "VACUUM INTO ?", tmpPath); err != nil {
+		return err
+	}
+
+	restored, err := sql.Open("sqlite", tmpPath)
+	if err != nil {
+		return err
+	}
+	err = InitDB(ctx, restored)
+	if closeErr := restored.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// Move the old database and its journal files aside before renaming the restored file
+	// into place so they can be put back if the rename fails.
+	// Stale journal files of the old database must not be applied to the restored one.
+	var moved []string
+	putBack := func() {
+		for _, suffix := range moved {
+			os.Rename(tmpPath+".old"+suffix, dbPath+suffix)
+		}
+	}
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		if err := os.Rename(dbPath+suffix, tmpPath+".old"+suffix); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			putBack()
+			return err
+		}
+		moved = append(moved, suffix)
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		putBack()
+		return err
+	}
+	for _, suffix := range moved {
+		if err := os.Remove(tmpPath + ".old" + suffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,492 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/status"
+)
+
+// BundleVersion is the version of the bundle format written by ExportBundle.
+const BundleVersion = 1
+
+// BundleRecord is a line of a bundle.
+//
+// A bundle is a JSON Lines file starting with a header followed by
+// pipe, view and rule resources and optionally events with their results.
+type BundleRecord struct {
+	Header *BundleHeader `json:"header,omitempty"`
+	// Resource is a pipe, view or rule.
+	//
+	// The metadata UUID is the ID of a view or rule.
+	Resource *api.Resource `json:"resource,omitempty"`
+	// Bare is set for objects created without a resource
+	// which have no resource metadata or labels.
+	Bare  bool         `json:"bare,omitempty"`
+	Event *BundleEvent `json:"event,omitempty"`
+}
+
+type BundleHeader struct {
+	Version       int       `json:"version,omitempty"`
+	SchemaVersion int       `json:"schema_version,omitempty"`
+	CreatedAt     time.Time `json:"created_at,omitempty"`
+}
+
+func (h *BundleHeader) GetVersion() int {
+	if h == nil {
+		return 0
+	}
+	return h.Version
+}
+
+// BundleEvent is an event along with its result values.
+//
+// Repeat events carry the results of the earlier event
+// and are detected again when imported.
+type BundleEvent struct {
+	Plan       string    `json:"plan,omitempty"`
+	Implicit   bool      `json:"implicit,omitempty"`
+	URL        string    `json:"url,omitempty"`
+	RawURL     string    `json:"raw_url,omitempty"`
+	Timestamp  time.Time `json:"timestamp,omitempty"`
+	ReceivedAt time.Time `json:"received_at,omitempty"`
+	Event      string    `json:"event,omitempty"`
+	// Results hold the values of each pipe in sequence order.
+	Results []api.TriggerResult `json:"results,omitempty"`
+}
+
+// BundleReport counts the objects written to or read from a bundle.
+type BundleReport struct {
+	Pipes  int `json:"pipes,omitempty"`
+	Views  int `json:"views,omitempty"`
+	Rules  int `json:"rules,omitempty"`
+	Events int `json:"events,omitempty"`
+}
+
+// ExportBundle writes all pipes, views and rules along with their resource metadata
+// and labels to w. When results is set, all events and their results are written too.
+//
+// Objects are read in separate transactions, so use a backup of a live database
+// to export a consistent bundle.
+func ExportBundle(ctx context.Context, db *sql.DB, w io.Writer, results bool) (*BundleReport, error) {
+	version, err := SchemaVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(BundleRecord{Header: &BundleHeader{
+		Version:       BundleVersion,
+		SchemaVersion: version,
+		CreatedAt:     time.Now().UTC(),
+	}}); err != nil {
+		return nil, err
+	}
+
+	// Objects are read before their resources so that a single connection suffices.
+	var records []*BundleRecord
+	// Pipes are written in the order they were stored so that
+	// older versions are disabled by newer ones when imported.
+	pipes, err := db.QueryContext(ctx, "SELECT Name, Digest, Spec FROM Pipes ORDER BY ID")
+	if err != nil {
+		return nil, err
+	}
+	defer pipes.Close()
+	for pipes.Next() {
+		var name, digest string
+		var spec sql.NullString
+		if err := pipes.Scan(&name, &digest, &spec); err != nil {
+			return nil, err
+		}
+		p := new(nuggit.Pipe)
+		if err := unmarshalNullableJSONString(spec, p); err != nil {
+			return nil, err
+		}
+		records = append(records, &BundleRecord{Resource: &api.Resource{
+			Kind:     api.KindPipe,
+			Metadata: &api.ResourceMetadata{Name: name, Digest: digest},
+			Spec:     p,
+		}})
+	}
+	if err := pipes.Err(); err != nil {
+		return nil, err
+	}
+	pipes.Close()
+	for v, err := range NewViewStore(db).Scan(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, &BundleRecord{Resource: &api.Resource{
+			Kind:     api.KindView,
+			Metadata: &api.ResourceMetadata{UUID: v.ID},
+			Spec:     &v.View,
+		}})
+	}
+	for rule, err := range NewRuleStore(db).ScanRules(ctx, nil) {
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, &BundleRecord{Resource: &api.Resource{
+			Kind:     api.KindRule,
+			Metadata: &api.ResourceMetadata{UUID: rule.ID},
+			Spec:     &rule.Rule,
+		}})
+	}
+
+	report := new(BundleReport)
+	for _, r := range records {
+		if err := setBundleResource(ctx, db, r); err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(r); err != nil {
+			return nil, err
+		}
+		switch r.Resource.Kind {
+		case api.KindPipe:
+			report.Pipes++
+		case api.KindView:
+			report.Views++
+		case api.KindRule:
+			report.Rules++
+		}
+	}
+
+	if results {
+		if err := exportEvents(ctx, db, enc, report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// setBundleResource sets the metadata of the first resource stored for the object
+// and the labels of all of its resources. The record is bare when the object has no resources.
+func setBundleResource(ctx context.Context, db *sql.DB, r *BundleRecord) error {
+	var (
+		column, idQuery string
+		args            []any
+	)
+	switch m := r.Resource.Metadata; r.Resource.Kind {
+	case api.KindPipe:
+		column, idQuery, args = "PipeID", "SELECT ID FROM Pipes WHERE Name = ? AND Digest = ?", []any{m.Name, m.Digest}
+	case api.KindView:
+		column, idQuery, args = "ViewID", "SELECT ID FROM Views WHERE UUID = ?", []any{m.UUID}
+	default:
+		column, idQuery, args = "RuleID", "SELECT ID FROM Rules WHERE UUID = ?", []any{m.UUID}
+	}
+	var (
+		apiVersion, version, description, name, digest sql.NullString
+		labels                                         string
+	)
+	err := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT
+    r.APIVersion,
+    r.Version,
+    r.Description,
+    r.Name,
+    r.Digest,
+    (
+        SELECT json_group_array(DISTINCT l.Label)
+        FROM ResourceLabels AS l
+        JOIN Resources AS r2 ON l.ResourceID = r2.ID
+        WHERE r2.%[1]s = r.%[1]s
+    )
+FROM Resources AS r
+WHERE r.%[1]s = (%[2]s)
+ORDER BY r.ID
+LIMIT 1`, column, idQuery), args...).Scan(&apiVersion, &version, &description, &name, &digest, &labels)
+	if errors.Is(err, sql.ErrNoRows) {
+		r.Resource.APIVersion = api.V1
+		r.Bare = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.Resource.APIVersion = apiVersion.String
+	r.Resource.Metadata.Version = version.String
+	r.Resource.Metadata.Description = description.String
+	// Pipes are already named by their spec.
+	if r.Resource.Kind != api.KindPipe {
+		r.Resource.Metadata.Name = name.String
+		r.Resource.Metadata.Digest = digest.String
+	}
+	return json.Unmarshal([]byte(labels), &r.Resource.Metadata.Labels)
+}
+
+func exportEvents(ctx context.Context, db *sql.DB, enc *json.Encoder, report *BundleReport) error {
+	rows, err := db.QueryContext(ctx, `SELECT
+    e.ID,
+    pl.UUID,
+    e.Implicit,
+    e.URL,
+    e.RawURL,
+    e.Timestamp,
+    e.ReceivedAt,
+    e.EventKey,
+    p.Name,
+    p.Digest,
+    p.TypeNumber,
+    r.Result
+FROM Events AS e
+JOIN Plans AS pl ON e.PlanID = pl.ID
+LEFT JOIN Results AS r ON r.EventID = COALESCE(e.RepeatOf, e.ID)
+LEFT JOIN Pipes AS p ON r.PipeID = p.ID
+ORDER BY e.ID, p.Name, p.Digest, r.SequenceID`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var (
+		lastID int64
+		event  *BundleEvent
+	)
+	flush := func() error {
+		if event == nil {
+			return nil
+		}
+		report.Events++
+		return enc.Encode(BundleRecord{Event: event})
+	}
+	for rows.Next() {
+		var (
+			id               int64
+			implicit         sql.NullBool
+			url, rawURL, key sql.NullString
+			timestamp        sql.NullTime
+			receivedAt       sql.NullInt64
+			name, digest     sql.NullString
+			typeNumber       sql.NullInt64
+			value            any
+			plan             string
+		)
+		if err := rows.Scan(&id, &plan, &implicit, &url, &rawURL, &timestamp, &receivedAt, &key, &name, &digest, &typeNumber, &value); err != nil {
+			return err
+		}
+		if event == nil || id != lastID {
+			if err := flush(); err != nil {
+				return err
+			}
+			lastID = id
+			event = &BundleEvent{
+				Plan:      plan,
+				Implicit:  implicit.Bool,
+				URL:       url.String,
+				RawURL:    rawURL.String,
+				Timestamp: timestamp.Time,
+				Event:     key.String,
+			}
+			if receivedAt.Valid {
+				event.ReceivedAt = time.Unix(receivedAt.Int64, 0).UTC()
+			}
+		}
+		if !name.Valid || value == nil {
+			continue
+		}
+		point := nuggit.NewPointFromNumber(int(typeNumber.Int64))
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+		value = resultValue(point, value)
+		pipe := fmt.Sprint(integrity.KeyLit(name.String, digest.String))
+		if n := len(event.Results); n > 0 && event.Results[n-1].Pipe == pipe {
+			event.Results[n-1].Result = append(event.Results[n-1].Result.([]any), value)
+			continue
+		}
+		event.Results = append(event.Results, api.TriggerResult{Pipe: pipe, Scalar: point.Scalar, Result: []any{value}})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// ImportBundle stores the pipes, views, rules and events of the bundle read from r.
+//
+// Pipe digests are checked against their specs so imported pipes keep their digests.
+// Objects which are already stored are skipped, so the database should be fresh
+// when the bundle has events. Events keep their received time and go through
+// the same change tracking and repeat detection as newly stored results.
+func ImportBundle(ctx context.Context, db *sql.DB, r io.Reader) (*BundleReport, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	var header BundleRecord
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("failed to read bundle header: %v: %w", err, status.ErrInvalidArgument)
+	}
+	if header.Header == nil || header.Header.Version != BundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version (%d): %w", header.Header.GetVersion(), status.ErrInvalidArgument)
+	}
+
+	var (
+		pipes     = NewPipeStore(db)
+		views     = NewViewStore(db)
+		rules     = NewRuleStore(db)
+		resources = NewResourceStore(db)
+		results   = NewResultStore(db)
+		report    = new(BundleReport)
+	)
+	for line := 2; ; line++ {
+		var rec BundleRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return report, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read bundle record (line %d): %v: %w", line, err, status.ErrInvalidArgument)
+		}
+		switch {
+		case rec.Resource != nil:
+			created, err := importResource(ctx, pipes, views, rules, resources, &rec)
+			if err != nil {
+				return nil, fmt.Errorf("failed to import %s (line %d): %w", rec.Resource.GetKind(), line, err)
+			}
+			if !created {
+				continue
+			}
+			switch rec.Resource.GetKind() {
+			case api.KindPipe:
+				report.Pipes++
+			case api.KindView:
+				report.Views++
+			case api.KindRule:
+				report.Rules++
+			}
+		case rec.Event != nil:
+			if err := importEvent(ctx, db, results, rec.Event); err != nil {
+				return nil, fmt.Errorf("failed to import event (line %d): %w", line, err)
+			}
+			report.Events++
+		default:
+			return nil, fmt.Errorf("unexpected bundle record (line %d): %w", line, status.ErrInvalidArgument)
+		}
+	}
+}
+
+// importResource stores the resource and reports whether it was created.
+func importResource(ctx context.Context, pipes *PipeStore, views *ViewStore, rules *RuleStore, resources *ResourceStore, rec *BundleRecord) (bool, error) {
+	res := rec.Resource
+	var err error
+	switch res.GetKind() {
+	case api.KindPipe:
+		if res.GetDigest() == "" {
+			return false, fmt.Errorf("pipe digest is required (%q): %w", res.GetName(), status.ErrInvalidArgument)
+		}
+		p := new(api.Pipe)
+		if spec := res.GetPipe(); spec != nil {
+			p.Pipe = *spec
+		}
+		if err := integrity.SetCheckNameDigest(p, res.GetName(), res.GetDigest()); err != nil {
+			return false, fmt.Errorf("failed to check digest (%q): %v: %w", res.GetName(), err, status.ErrInvalidArgument)
+		}
+		if err := pipes.Store(ctx, p); err != nil {
+			return false, ignoreAlreadyExists(err)
+		}
+		if !rec.Bare {
+			err = resources.StorePipeResource(ctx, res, p)
+		}
+	case api.KindView:
+		view := res.GetView()
+		if view == nil || res.GetMetadata().GetUUID() == "" {
+			return false, fmt.Errorf("view and UUID are required: %w", status.ErrInvalidArgument)
+		}
+		if err := views.Store(ctx, res.GetMetadata().GetUUID(), *view); err != nil {
+			return false, ignoreAlreadyExists(err)
+		}
+		if !rec.Bare {
+			err = resources.StoreViewResource(ctx, res, res.GetMetadata().GetUUID())
+		}
+	case api.KindRule:
+		rule := res.GetRule()
+		if rule == nil || res.GetMetadata().GetUUID() == "" {
+			return false, fmt.Errorf("rule and UUID are required: %w", status.ErrInvalidArgument)
+		}
+		r := &api.Rule{ID: res.GetMetadata().GetUUID(), Rule: *rule}
+		if err := rules.StoreRule(ctx, r); err != nil {
+			return false, err
+		}
+		if r.ID != res.GetMetadata().GetUUID() {
+			return false, nil // Already stored with another ID.
+		}
+		if !rec.Bare {
+			err = resources.StoreRuleResource(ctx, res, r)
+		}
+	default:
+		return false, fmt.Errorf("unsupported resource kind (%q): %w", res.GetKind(), status.ErrInvalidArgument)
+	}
+	if err != nil {
+		return false, ignoreAlreadyExists(err)
+	}
+	return true, nil
+}
+
+func ignoreAlreadyExists(err error) error {
+	if errors.Is(err, status.ErrAlreadyExists) {
+		return nil
+	}
+	return err
+}
+
+func importEvent(ctx context.Context, db *sql.DB, results *ResultStore, e *BundleEvent) error {
+	if _, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO Plans (UUID, Finished) VALUES (?, TRUE)", e.Plan); err != nil {
+		return err
+	}
+	triggerResults := make([]api.TriggerResult, 0, len(e.Results))
+	for _, r := range e.Results {
+		values, ok := r.Result.([]any)
+		if !ok {
+			return fmt.Errorf("result values must be a list (%q): %w", r.Pipe, status.ErrInvalidArgument)
+		}
+		for i, v := range values {
+			v, err := bundleValue(r.Scalar, v)
+			if err != nil {
+				return fmt.Errorf("failed to read result value (%q): %w", r.Pipe, err)
+			}
+			values[i] = v
+		}
+		triggerResults = append(triggerResults, api.TriggerResult{Pipe: r.Pipe, Scalar: r.Scalar, Result: values})
+	}
+	event := &api.TriggerEvent{
+		Plan:      e.Plan,
+		Implicit:  e.Implicit,
+		URL:       e.URL,
+		RawURL:    e.RawURL,
+		Timestamp: e.Timestamp,
+		Event:     e.Event,
+	}
+	receivedAt := e.ReceivedAt
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
+	return results.storeResults(ctx, event, nil, sliceResults(triggerResults), receivedAt)
+}
+
+// bundleValue converts a JSON decoded value to the Go type of the scalar.
+func bundleValue(scalar nuggit.Scalar, v any) (any, error) {
+	switch v := v.(type) {
+	case json.Number:
+		switch scalar {
+		case nuggit.Int:
+			return v.Int64()
+		case nuggit.Float:
+			return v.Float64()
+		}
+	case string:
+		switch scalar {
+		case "", nuggit.Bytes, nuggit.String:
+			return v, nil
+		}
+	case bool:
+		if scalar == nuggit.Bool {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("value had unexpected type for %s (%T): %w", cmp.Or(scalar, nuggit.Bytes), v, status.ErrInvalidArgument)
+}
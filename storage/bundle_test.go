@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/status"
+	"github.com/wenooij/nuggit/trigger"
+)
+
+func openTestDB(t *testing.T, path string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+	if err := InitDB(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// exportTestBundle exports the bundle without its header.
+func exportTestBundle(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := ExportBundle(context.Background(), db, &buf, true); err != nil {
+		t.Fatal(err)
+	}
+	_, records, _ := strings.Cut(buf.String(), "\n")
+	return records
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := openTestDB(t, ":memory:")
+
+	title := &api.Pipe{Name: "title", Pipe: nuggit.Pipe{
+		Actions: []nuggit.Action{{"action": "documentElement"}},
+		Point:   nuggit.Point{Scalar: nuggit.String},
+	}}
+	count := &api.Pipe{Name: "count", Pipe: nuggit.Pipe{
+		Actions: []nuggit.Action{{"action": "documentElement"}},
+		Point:   nuggit.Point{Scalar: nuggit.Int},
+	}}
+	for _, p := range []*api.Pipe{title, count} {
+		if err := integrity.SetDigest(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := NewPipeStore(src).Store(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := NewResourceStore(src).StorePipeResource(ctx, &api.Resource{
+		APIVersion: api.V1,
+		Kind:       api.KindPipe,
+		Metadata:   &api.ResourceMetadata{Version: "1.0", Labels: []string{"news"}},
+	}, title); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewViewStore(src).Store(ctx, "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c66", nuggit.View{
+		Alias:   "titles",
+		Columns: []nuggit.ViewColumn{{Pipe: fmt.Sprint(integrity.Key(title)), Point: nuggit.Point{Scalar: nuggit.String}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rule := &api.Rule{
+		ID:   "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c77",
+		Rule: nuggit.Rule{Hostname: "example.com", Labels: []string{"news"}},
+	}
+	if err := NewRuleStore(src).StoreRule(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewResourceStore(src).StoreRuleResource(ctx, &api.Resource{
+		APIVersion: api.V1,
+		Kind:       api.KindRule,
+		Metadata:   &api.ResourceMetadata{Name: "example", Digest: "abc123"},
+	}, rule); err != nil {
+		t.Fatal(err)
+	}
+
+	const plan = "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c11"
+	if err := NewPlanStore(src).Store(ctx, plan, &trigger.Plan{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"a", "a", "b"} { // The second event is a repeat.
+		if err := NewResultStore(src).StoreResults(ctx, &api.TriggerEvent{Plan: plan, URL: "https://example.com/"}, nil, []api.TriggerResult{
+			{Pipe: fmt.Sprint(integrity.Key(title)), Scalar: nuggit.String, Result: v},
+			{Pipe: fmt.Sprint(integrity.Key(count)), Scalar: nuggit.Int, Result: []int{1 << 60, 2}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := exportTestBundle(t, src)
+	var buf bytes.Buffer
+	if _, err := ExportBundle(ctx, src, &buf, true); err != nil {
+		t.Fatal(err)
+	}
+	dst := openTestDB(t, ":memory:")
+	report, err := ImportBundle(ctx, dst, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := *report; got != (BundleReport{Pipes: 2, Views: 1, Rules: 1, Events: 3}) {
+		t.Errorf("ImportBundle(): got report %+v", got)
+	}
+	if got := exportTestBundle(t, dst); got != want {
+		t.Errorf("ExportBundle() after import:\ngot  %s\nwant %s", got, want)
+	}
+	for r, err := range NewResourceStore(dst).ScanResources(ctx, &api.ResourceFilter{Kind: api.KindRule}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.GetName() != "example" || r.GetDigest() != "abc123" {
+			t.Errorf("ImportBundle(): got rule resource %s@%s, want example@abc123", r.GetName(), r.GetDigest())
+		}
+	}
+	var repeats int
+	if err := dst.QueryRowContext(ctx, "SELECT COUNT(*) FROM Events WHERE RepeatOf IS NOT NULL").Scan(&repeats); err != nil || repeats != 1 {
+		t.Errorf("ImportBundle(): got %d repeat events, want 1 (%v)", repeats, err)
+	}
+
+	tampered := strings.Replace(want, title.GetDigest(), strings.Repeat("0", len(title.GetDigest())), 1)
+	if _, err := ImportBundle(ctx, openTestDB(t, ":memory:"), strings.NewReader(`{"header":{"version":1}}`+"\n"+tampered)); !errors.Is(err, status.ErrInvalidArgument) {
+		t.Errorf("ImportBundle(tampered digest): got %v, want InvalidArgument", err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	db := openTestDB(t, filepath.Join(dir, "nuggit.sqlite"))
+	if err := NewRuleStore(db).StoreRule(ctx, &api.Rule{
+		ID:   "0192d5c1-5f1a-7c3e-9a9b-2b0f3f6b8c77",
+		Rule: nuggit.Rule{Hostname: "example.com"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	backup := filepath.Join(dir, "backup.sqlite")
+	if err := Backup(ctx, db, backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := Backup(ctx, db, backup); !errors.Is(err, status.ErrAlreadyExists) {
+		t.Errorf("Backup(existing file): got %v, want AlreadyExists", err)
+	}
+
+	restored := filepath.Join(dir, "restored.sqlite")
+	if err := Restore(ctx, backup, restored, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(ctx, backup, restored, false); !errors.Is(err, status.ErrAlreadyExists) {
+		t.Errorf("Restore(existing database): got %v, want AlreadyExists", err)
+	}
+	// Stale journal files of the old database are removed.
+	if err := os.WriteFile(restored+"-wal", []byte("stale"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(ctx, backup, restored, true); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if name := e.Name(); name == "restored.sqlite-wal" || strings.Contains(name, ".restore-") {
+			t.Errorf("Restore(): got leftover file %q", name)
+		}
+	}
+	if got, want := exportTestBundle(t, openTestDB(t, restored)), exportTestBundle(t, db); got != want {
+		t.Errorf("Restore(): got %s, want %s", got, want)
+	}
+}
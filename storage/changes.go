@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"iter"
+	"strings"
+	"time"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+)
+
+// recordChangesTx records the changes of the event values from the previous event
+// for the same URL with results for each pipe name.
+//
+// The pipes of the event plan are compared along with the pipes with results
+// so that values of plan pipes without results in the event are removed.
+// Values are paired by pipe digest. When a single digest of a pipe name replaces
+// a single digest from the previous event, their values are paired by name.
+// Changes of the event are recomputed when later batches are stored.
+// Events without a URL or a previous event and repeat events have no changes.
+func recordChangesTx(ctx context.Context, tx *sql.Tx, eventID int64) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM Changes WHERE EventID = ?", eventID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `WITH
+    Cur AS (
+        SELECT p.Name, r.PipeID, r.SequenceID, r.TypeNumber, r.Result
+        FROM Results AS r
+        JOIN Pipes AS p ON r.PipeID = p.ID
+        WHERE r.EventID = ?1
+    ),
+    EventPipes AS (
+        SELECT p.Name, p.ID AS PipeID
+        FROM Events AS e
+        JOIN PlanPipes AS pp ON pp.PlanID = e.PlanID
+        JOIN Pipes AS p ON pp.PipeID = p.ID
+        WHERE e.ID = ?1 AND e.RepeatOf IS NULL
+        UNION
+        SELECT Name, PipeID FROM Cur
+    ),
+    PrevEvents AS (
+        SELECT n.Name, (
+            SELECT MAX(e2.ID)
+            FROM Events AS e2
+            JOIN Results AS r2 ON r2.EventID = e2.ID
+            JOIN Pipes AS p2 ON r2.PipeID = p2.ID
+            WHERE e2.URL = e.URL AND e2.ID < e.ID AND p2.Name = n.Name
+        ) AS PrevEventID
+        FROM (SELECT DISTINCT Name FROM EventPipes) AS n, Events AS e
+        WHERE e.ID = ?1 AND e.URL IS NOT NULL AND e.URL != ''
+    ),
+    Prev AS (
+        SELECT p.Name, r.PipeID, r.SequenceID, r.TypeNumber, r.Result, pe.PrevEventID
+        FROM PrevEvents AS pe
+        JOIN Results AS r ON r.EventID = pe.PrevEventID
+        JOIN Pipes AS p ON r.PipeID = p.ID AND p.Name = pe.Name
+    ),
+    CurPipes AS (
+        SELECT Name, PipeID
+        FROM EventPipes
+        WHERE Name IN (SELECT Name FROM PrevEvents WHERE PrevEventID IS NOT NULL)
+    ),
+    PrevPipes AS (SELECT DISTINCT Name, PipeID FROM Prev),
+    Pairs AS (
+        SELECT PipeID AS CurPipeID, PipeID AS PrevPipeID
+        FROM CurPipes
+        WHERE PipeID IN (SELECT PipeID FROM PrevPipes)
+        UNION ALL
+        SELECT c.PipeID, o.PipeID
+        FROM (
+            SELECT Name, MIN(PipeID) AS PipeID
+            FROM CurPipes
+            WHERE PipeID NOT IN (SELECT PipeID FROM PrevPipes)
+            GROUP BY Name
+            HAVING COUNT(*) = 1
+        ) AS c
+        JOIN (
+            SELECT Name, MIN(PipeID) AS PipeID
+            FROM PrevPipes
+            WHERE PipeID NOT IN (SELECT PipeID FROM CurPipes)
+            GROUP BY Name
+            HAVING COUNT(*) = 1
+        ) AS o ON c.Name = o.Name
+    ),
+    CurPaired AS (
+        SELECT c.*, pr.PrevPipeID
+        FROM Cur AS c
+        LEFT JOIN Pairs AS pr ON pr.CurPipeID = c.PipeID
+        WHERE c.PipeID IN (SELECT PipeID FROM CurPipes)
+    ),
+    PrevPaired AS (
+        SELECT o.*, pr.CurPipeID
+        FROM Prev AS o
+        JOIN Pairs AS pr ON pr.PrevPipeID = o.PipeID
+    )
+INSERT INTO Changes (EventID, PrevEventID, URL, ReceivedAt, PipeID, SequenceID, Kind, TypeNumber, OldValue, NewValue)
+SELECT
+    e.ID,
+    pe.PrevEventID,
+    e.URL,
+    e.ReceivedAt,
+    COALESCE(c.PipeID, o.PipeID),
+    COALESCE(c.SequenceID, o.SequenceID),
+    CASE
+        WHEN o.SequenceID IS NULL THEN 'added'
+        WHEN c.SequenceID IS NULL THEN 'removed'
+        ELSE 'changed'
+    END,
+    COALESCE(c.TypeNumber, o.TypeNumber),
+    o.Result,
+    c.Result
+FROM CurPaired AS c
+FULL JOIN PrevPaired AS o ON c.PipeID = o.CurPipeID AND c.SequenceID = o.SequenceID
+JOIN PrevEvents AS pe ON pe.Name = COALESCE(c.Name, o.Name)
+JOIN Events AS e ON e.ID = ?1
+WHERE c.SequenceID IS NULL OR o.SequenceID IS NULL OR c.Result IS NOT o.Result`, eventID)
+	return err
+}
+
+// ScanChanges returns the changes matching the filter ordered by event, pipe and sequence.
+func (s *ResultStore) ScanChanges(ctx context.Context, filter *api.ChangeFilter) iter.Seq2[*api.Change, error] {
+	if filter == nil {
+		filter = new(api.ChangeFilter)
+	}
+	if err := api.ValidateChangeKind(filter.Kind); err != nil {
+		return seq2Error[*api.Change](err)
+	}
+	var (
+		where []string
+		args  []any
+	)
+	if filter.URL != "" {
+		where = append(where, "c.URL = ?")
+		args = append(args, filter.URL)
+	}
+	if filter.Pipe != nil {
+		where = append(where, "p.Name = ? AND (? = '' OR p.Digest = ?)")
+		args = append(args, filter.Pipe.GetName(), filter.Pipe.GetDigest(), filter.Pipe.GetDigest())
+	}
+	if filter.Kind != "" {
+		where = append(where, "c.Kind = ?")
+		args = append(args, filter.Kind)
+	}
+	if filter.After != 0 {
+		where = append(where, "c.EventID > ?")
+		args = append(args, filter.After)
+	}
+	query := `SELECT
+    c.EventID,
+    c.PrevEventID,
+    c.URL,
+    c.ReceivedAt,
+    p.Name,
+    p.Digest,
+    c.SequenceID,
+    c.Kind,
+    c.TypeNumber,
+    c.OldValue,
+    c.NewValue
+FROM Changes AS c
+JOIN Pipes AS p ON c.PipeID = p.ID
+`
+	if len(where) > 0 {
+		query += "WHERE " + strings.Join(where, " AND ") + "\n"
+	}
+	query += "ORDER BY c.EventID, p.Name, p.Digest, c.SequenceID"
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return seq2Error[*api.Change](err)
+	}
+
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		conn.Close()
+		return seq2Error[*api.Change](err)
+	}
+
+	return func(yield func(*api.Change, error) bool) {
+		defer conn.Close()
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				prevEvent    sql.NullInt64
+				receivedAt   sql.NullInt64
+				name, digest string
+				typeNumber   sql.NullInt64
+				oldValue     any
+				newValue     any
+			)
+			c := new(api.Change)
+			if err := rows.Scan(&c.Event, &prevEvent, &c.URL, &receivedAt, &name, &digest, &c.Sequence, &c.Kind, &typeNumber, &oldValue, &newValue); err != nil {
+				yield(nil, err)
+				return
+			}
+			c.PrevEvent = prevEvent.Int64
+			if receivedAt.Valid {
+				c.ReceivedAt = time.Unix(receivedAt.Int64, 0)
+			}
+			c.Pipe = fmt.Sprint(integrity.KeyLit(name, digest))
+			point := nuggit.NewPointFromNumber(int(typeNumber.Int64))
+			c.Old = resultValue(point, oldValue)
+			c.New = resultValue(point, newValue)
+			if !yield(c, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Package inmemory implements the api stores without a database.
+//
+// Stores created from the same DB share their state just as the SQLite
+// stores share a database. State is lost when the process exits.
+package inmemory
+
+import (
+	"encoding/json"
+	"fmt"
+	"iter"
+	"sync"
+	"time"
+
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/rules"
+	"github.com/wenooij/nuggit/status"
+)
+
+// DB holds the state shared by the in-memory stores.
+type DB struct {
+	mu sync.Mutex
+
+	pipes     []*pipeRow // In insertion order.
+	pipeIndex map[integrity.NameDigest]*pipeRow
+	resources []*resourceRow
+	rules     []*ruleRow
+	matcher   *rules.Matcher // Built lazily and invalidated on rule updates.
+	plans     map[string]*planRow
+	views     map[string]*viewRow
+	changes   []*api.Change
+
+	lastEventID int64 // Orders events like the Events.ID column.
+	lastViewID  int64
+}
+
+func NewDB() *DB {
+	return &DB{
+		pipeIndex: make(map[integrity.NameDigest]*pipeRow),
+		plans:     make(map[string]*planRow),
+		views:     make(map[string]*viewRow),
+	}
+}
+
+type pipeRow struct {
+	name       string
+	digest     string
+	typeNumber int
+	spec       []byte
+	deps       []*pipeRow
+}
+
+type resourceRow struct {
+	apiVersion  string
+	kind        string
+	name        string
+	digest      string
+	version     string
+	description string
+	pipe        *pipeRow
+	viewUUID    string
+	rule        *ruleRow
+	labels      []string
+}
+
+func (r *resourceRow) hasLabel(label string) bool {
+	for _, l := range r.labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *resourceRow) addLabel(label string) {
+	if !r.hasLabel(label) {
+		r.labels = append(r.labels, label)
+	}
+}
+
+func (r *resourceRow) removeLabel(label string) {
+	for i, l := range r.labels {
+		if l == label {
+			r.labels = append(r.labels[:i], r.labels[i+1:]...)
+			return
+		}
+	}
+}
+
+type ruleRow struct {
+	rule api.Rule
+}
+
+type planRow struct {
+	spec            []byte
+	finished        bool
+	pipes           []integrity.NameDigest
+	events          []*eventRow
+	eventKeys       map[string]*eventRow
+	idempotencyKeys map[string]struct{}
+}
+
+type eventRow struct {
+	id        int64
+	implicit  bool
+	url       string
+	rawURL    string
+	timestamp time.Time
+	key       string
+	sequences map[int]string // Idempotency keys by batch sequence.
+	results   []*resultRow
+	// repeatOf is the earlier event with the results of a repeat event.
+	repeatOf    *eventRow
+	contentHash string
+}
+
+type resultRow struct {
+	pipe       *pipeRow
+	sequenceID int
+	typeNumber int
+	value      any
+}
+
+type viewRow struct {
+	id     int64
+	uuid   string
+	name   string
+	digest string
+	spec   []byte
+	pipes  []*pipeRow
+}
+
+func alreadyExistsError(object string, key integrity.NameDigest) error {
+	return fmt.Errorf("failed to store %s (%q): %w", object, integrity.Key(key), status.ErrAlreadyExists)
+}
+
+func seq2Error[E any](err error) iter.Seq2[E, error] {
+	return func(yield func(E, error) bool) {
+		var zero E
+		yield(zero, err)
+	}
+}
+
+// seq2Slice yields the elements of a snapshot taken while holding the lock.
+//
+// Stores must not be called while holding the lock so the snapshot
+// lets callers use the stores while iterating.
+func seq2Slice[E any](es []E) iter.Seq2[E, error] {
+	return func(yield func(E, error) bool) {
+		for _, e := range es {
+			if !yield(e, nil) {
+				return
+			}
+		}
+	}
+}
+
+func marshalSpec(x any) ([]byte, error) {
+	return json.Marshal(x)
+}
+
+// decodePipe returns a new pipe from the stored spec and checks its digest.
+func decodePipe(row *pipeRow) (*api.Pipe, error) {
+	pipe := new(api.Pipe)
+	if err := json.Unmarshal(row.spec, pipe); err != nil {
+		return nil, err
+	}
+	if err := integrity.SetCheckNameDigest(pipe, row.name, row.digest); err != nil {
+		return nil, fmt.Errorf("failed to set digest (%q): %w", row.name, err)
+	}
+	return pipe, nil
+}
@@ -0,0 +1,21 @@
+package inmemory
+
+import (
+	"testing"
+
+	"github.com/wenooij/nuggit/api/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) *storetest.Stores {
+		db := NewDB()
+		return &storetest.Stores{
+			Pipes:     NewPipeStore(db),
+			Rules:     NewRuleStore(db),
+			Plans:     NewPlanStore(db),
+			Results:   NewResultStore(db),
+			Resources: NewResourceStore(db),
+			Views:     NewViewStore(db),
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package inmemory
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"slices"
+	"strings"
+
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/pipes"
+	"github.com/wenooij/nuggit/status"
+)
+
+type PipeStore struct {
+	db *DB
+}
+
+func NewPipeStore(db *DB) *PipeStore {
+	return &PipeStore{db: db}
+}
+
+// Delete deletes the pipe along with its results and resources.
+//
+// Delete returns ErrFailedPrecondition when other pipes or views depend on the pipe.
+func (s *PipeStore) Delete(ctx context.Context, name integrity.NameDigest) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row, found := s.db.pipeIndex[integrity.Key(name)]
+	if !found {
+		return fmt.Errorf("pipe not found (%q): %w", integrity.Key(name), status.ErrNotFound)
+	}
+	var dependents []string
+	for _, p := range s.db.pipes {
+		if slices.Contains(p.deps, row) {
+			dependents = append(dependents, fmt.Sprint("pipe ", integrity.KeyLit(p.name, p.digest)))
+		}
+	}
+	for _, v := range s.db.views {
+		if slices.Contains(v.pipes, row) {
+			dependents = append(dependents, "view "+v.uuid)
+		}
+	}
+	if len(dependents) > 0 {
+		slices.Sort(dependents)
+		return fmt.Errorf("pipe has dependents (%q): %s: %w", integrity.Key(name), strings.Join(dependents, ", "), status.ErrFailedPrecondition)
+	}
+	key := fmt.Sprint(integrity.Key(name))
+	for _, plan := range s.db.plans {
+		plan.pipes = slices.DeleteFunc(plan.pipes, func(nd integrity.NameDigest) bool { return integrity.Key(nd) == integrity.Key(name) })
+		for _, e := range plan.events {
+			e.results = slices.DeleteFunc(e.results, func(r *resultRow) bool { return r.pipe == row })
+		}
+	}
+	s.db.changes = slices.DeleteFunc(s.db.changes, func(c *api.Change) bool { return c.Pipe == key })
+	s.deleteLocked([]integrity.NameDigest{name})
+	return nil
+}
+
+func (s *PipeStore) DeleteBatch(ctx context.Context, names []integrity.NameDigest) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	s.deleteLocked(names)
+	return nil
+}
+
+func (s *PipeStore) deleteLocked(names []integrity.NameDigest) {
+	deleted := make(map[*pipeRow]struct{}, len(names))
+	for _, name := range names {
+		if row, found := s.db.pipeIndex[integrity.Key(name)]; found {
+			deleted[row] = struct{}{}
+			delete(s.db.pipeIndex, integrity.Key(name))
+		}
+	}
+	if len(deleted) == 0 {
+		return
+	}
+	isDeleted := func(row *pipeRow) bool { _, found := deleted[row]; return found }
+	s.db.pipes = slices.DeleteFunc(s.db.pipes, isDeleted)
+	for _, row := range s.db.pipes {
+		row.deps = slices.DeleteFunc(row.deps, isDeleted)
+	}
+	// Resources cascade on delete.
+	s.db.resources = slices.DeleteFunc(s.db.resources, func(r *resourceRow) bool { return r.pipe != nil && isDeleted(r.pipe) })
+}
+
+func (s *PipeStore) Load(ctx context.Context, name integrity.NameDigest) (*api.Pipe, error) {
+	s.db.mu.Lock()
+	row, found := s.db.pipeIndex[integrity.Key(name)]
+	s.db.mu.Unlock()
+	if !found {
+		return nil, status.ErrNotFound
+	}
+	return decodePipe(row)
+}
+
+func (s *PipeStore) LoadBatch(ctx context.Context, names []integrity.NameDigest) iter.Seq2[*api.Pipe, error] {
+	s.db.mu.Lock()
+	rows := make([]*pipeRow, 0, len(names))
+	for _, name := range names {
+		if row, found := s.db.pipeIndex[integrity.Key(name)]; found {
+			rows = append(rows, row) // Missing names are skipped.
+		}
+	}
+	s.db.mu.Unlock()
+	return scanPipeRows(rows)
+}
+
+func (s *PipeStore) Store(ctx context.Context, pipe *api.Pipe) error {
+	spec, err := marshalSpec(pipe.GetSpec())
+	if err != nil {
+		return err
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	key := integrity.Key(pipe)
+	if _, found := s.db.pipeIndex[key]; found {
+		return alreadyExistsError("pipe", pipe)
+	}
+
+	// Disable old pipes by name.
+	for _, r := range s.db.resources {
+		if r.pipe != nil && r.pipe.name == pipe.GetName() {
+			r.addLabel("disabled")
+		}
+	}
+
+	row := &pipeRow{
+		name:       pipe.GetName(),
+		digest:     pipe.GetDigest(),
+		typeNumber: pipe.GetPoint().AsNumber(),
+		spec:       spec,
+	}
+	// Dependencies are recorded when the referenced pipe is already stored.
+	for dep := range pipes.Deps(pipe.GetPipe()) {
+		if depRow, found := s.db.pipeIndex[integrity.Key(dep)]; found {
+			row.deps = append(row.deps, depRow)
+		}
+	}
+	s.db.pipes = append(s.db.pipes, row)
+	s.db.pipeIndex[key] = row
+	return nil
+}
+
+func (s *PipeStore) StoreBatch(ctx context.Context, objects []*api.Pipe) error {
+	for _, o := range objects {
+		if err := s.Store(ctx, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *PipeStore) Scan(ctx context.Context) iter.Seq2[*api.Pipe, error] {
+	s.db.mu.Lock()
+	rows := append([]*pipeRow(nil), s.db.pipes...)
+	s.db.mu.Unlock()
+	return scanPipeRows(rows)
+}
+
+func (s *PipeStore) ScanNames(ctx context.Context) iter.Seq2[integrity.NameDigest, error] {
+	s.db.mu.Lock()
+	names := make([]integrity.NameDigest, 0, len(s.db.pipes))
+	for _, row := range s.db.pipes {
+		names = append(names, integrity.KeyLit(row.name, row.digest))
+	}
+	s.db.mu.Unlock()
+	return seq2Slice(names)
+}
+
+func (s *PipeStore) ScanDependencies(ctx context.Context, pipe integrity.NameDigest) iter.Seq2[*api.Pipe, error] {
+	s.db.mu.Lock()
+	var rows []*pipeRow
+	if root, found := s.db.pipeIndex[integrity.Key(pipe)]; found {
+		queue := []*pipeRow{root}
+		seen := make(map[*pipeRow]struct{}, 16)
+		for len(queue) > 0 {
+			row := queue[0]
+			queue = queue[1:]
+			for _, dep := range row.deps {
+				rows = append(rows, dep)
+				if _, ok := seen[dep]; !ok {
+					queue = append(queue, dep)
+					// Ignore cycles, but this is technically an invalid condition.
+				}
+				seen[dep] = struct{}{}
+			}
+		}
+	}
+	s.db.mu.Unlock()
+	return scanPipeRows(rows)
+}
+
+func scanPipeRows(rows []*pipeRow) iter.Seq2[*api.Pipe, error] {
+	return func(yield func(*api.Pipe, error) bool) {
+		for _, row := range rows {
+			pipe, err := decodePipe(row)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(pipe, nil) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package inmemory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/status"
+	"github.com/wenooij/nuggit/trigger"
+)
+
+type PlanStore struct {
+	db *DB
+}
+
+func NewPlanStore(db *DB) *PlanStore {
+	return &PlanStore{db: db}
+}
+
+func (s *PlanStore) Store(ctx context.Context, uuid string, plan *trigger.Plan) error {
+	spec, err := marshalSpec(plan)
+	if err != nil {
+		return err
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row := &planRow{
+		spec:            spec,
+		eventKeys:       make(map[string]*eventRow),
+		idempotencyKeys: make(map[string]struct{}),
+	}
+	for _, i := range plan.GetExchanges() {
+		exchange := plan.Steps[i]
+		key := integrity.KeyLit(exchange.GetOrDefaultArg("name"), exchange.GetOrDefaultArg("digest"))
+		if _, found := s.db.pipeIndex[key]; found {
+			row.pipes = append(row.pipes, key)
+		}
+	}
+	// We don't bother to handle AlreadyExists.
+	// No conflict should be possible here thanks to the UUID.
+	s.db.plans[uuid] = row
+	return nil
+}
+
+func (s *PlanStore) Load(ctx context.Context, uuid string) (*trigger.Plan, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row, found := s.db.plans[uuid]
+	if !found {
+		return nil, fmt.Errorf("plan not found (%q): %w", uuid, status.ErrNotFound)
+	}
+	plan := new(trigger.Plan)
+	if err := json.Unmarshal(row.spec, plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func (s *PlanStore) Finish(ctx context.Context, uuid string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if row, found := s.db.plans[uuid]; found {
+		row.finished = true
+	}
+	return nil
+}
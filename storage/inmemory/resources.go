@@ -0,0 +1,160 @@
+package inmemory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"slices"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/status"
+)
+
+type ResourceStore struct {
+	db *DB
+}
+
+func NewResourceStore(db *DB) *ResourceStore {
+	return &ResourceStore{db}
+}
+
+func newResourceRow(resource *api.Resource) *resourceRow {
+	r := &resourceRow{
+		apiVersion:  resource.GetAPIVersion(),
+		kind:        resource.GetKind(),
+		name:        resource.GetName(),
+		digest:      resource.GetDigest(),
+		version:     resource.GetMetadata().GetVersion(),
+		description: resource.GetMetadata().GetDescription(),
+	}
+	for _, label := range resource.GetMetadata().GetLabels() {
+		r.addLabel(label)
+	}
+	return r
+}
+
+func (s *ResourceStore) StorePipeResource(ctx context.Context, resource *api.Resource, pipe *api.Pipe) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row, found := s.db.pipeIndex[integrity.Key(pipe)]
+	if !found {
+		return fmt.Errorf("pipe not found (%q): %w", integrity.Key(pipe), status.ErrNotFound)
+	}
+	if slices.ContainsFunc(s.db.resources, func(r *resourceRow) bool { return r.pipe == row }) {
+		return alreadyExistsError("pipe", pipe)
+	}
+	r := newResourceRow(resource)
+	r.name, r.digest = row.name, row.digest
+	r.pipe = row
+	s.db.resources = append(s.db.resources, r)
+	return nil
+}
+
+func (s *ResourceStore) StoreViewResource(ctx context.Context, resource *api.Resource, viewUUID string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if _, found := s.db.views[viewUUID]; !found {
+		return fmt.Errorf("view not found (%q): %w", viewUUID, status.ErrNotFound)
+	}
+	r := newResourceRow(resource)
+	r.viewUUID = viewUUID
+	s.db.resources = append(s.db.resources, r)
+	return nil
+}
+
+func (s *ResourceStore) StoreRuleResource(ctx context.Context, resource *api.Resource, rule *api.Rule) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row := s.db.findRuleByID(rule.GetID())
+	if row == nil {
+		return fmt.Errorf("rule not found (%q): %w", rule.GetID(), status.ErrNotFound)
+	}
+	if slices.ContainsFunc(s.db.resources, func(r *resourceRow) bool { return r.rule == row }) {
+		return fmt.Errorf("failed to store rule (%q): %w", rule.GetID(), status.ErrAlreadyExists)
+	}
+	r := newResourceRow(resource)
+	r.rule = row
+	s.db.resources = append(s.db.resources, r)
+	return nil
+}
+
+func (s *ResourceStore) ScanResources(ctx context.Context, filter *api.ResourceFilter) iter.Seq2[*api.Resource, error] {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	var rs []*api.Resource
+	for _, row := range s.db.resources {
+		r := &api.Resource{
+			APIVersion: row.apiVersion,
+			Kind:       row.kind,
+			Metadata: &api.ResourceMetadata{
+				Name:        row.name,
+				Digest:      row.digest,
+				Version:     row.version,
+				Description: row.description,
+				Labels:      slices.Clone(row.labels),
+			},
+		}
+		switch {
+		case row.pipe != nil:
+			pipe := new(nuggit.Pipe)
+			if err := json.Unmarshal(row.pipe.spec, pipe); err != nil {
+				return seq2Error[*api.Resource](err)
+			}
+			r.Spec = pipe
+		case row.viewUUID != "":
+			v, found := s.db.views[row.viewUUID]
+			if !found {
+				continue
+			}
+			view := new(nuggit.View)
+			if err := json.Unmarshal(v.spec, view); err != nil {
+				return seq2Error[*api.Resource](err)
+			}
+			r.Metadata.UUID = v.uuid
+			r.Spec = view
+		case row.rule != nil:
+			rule := row.rule.rule.Rule
+			rule.Labels = slices.Clone(rule.Labels)
+			r.Metadata.UUID = row.rule.rule.ID
+			r.Spec = &rule
+		}
+		if matchResource(filter, r) {
+			rs = append(rs, r)
+		}
+	}
+	return func(yield func(*api.Resource, error) bool) {
+		for _, r := range rs {
+			if !yield(r, nil) {
+				return
+			}
+		}
+	}
+}
+
+func matchResource(filter *api.ResourceFilter, r *api.Resource) bool {
+	if kind := filter.GetKind(); kind != "" && r.GetKind() != kind {
+		return false
+	}
+	if name := filter.GetName(); name != "" && r.GetName() != name {
+		return false
+	}
+	if digest := filter.GetDigest(); digest != "" && r.GetDigest() != digest {
+		return false
+	}
+	if uuid := filter.GetUUID(); uuid != "" && r.GetMetadata().GetUUID() != uuid {
+		return false
+	}
+	for _, label := range filter.GetLabels() {
+		if !slices.Contains(r.GetMetadata().GetLabels(), label) {
+			return false
+		}
+	}
+	return true
+}
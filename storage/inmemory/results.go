@@ -0,0 +1,341 @@
+package inmemory
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"reflect"
+	"slices"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/points"
+	"github.com/wenooij/nuggit/status"
+)
+
+type ResultStore struct {
+	db *DB
+}
+
+func NewResultStore(db *DB) *ResultStore {
+	return &ResultStore{db: db}
+}
+
+func (s *ResultStore) StoreResults(ctx context.Context, event *api.TriggerEvent, batch *api.TriggerBatch, results []api.TriggerResult) error {
+	return s.StreamResults(ctx, event, batch, func(yield func(api.TriggerResult, error) bool) {
+		for _, res := range results {
+			if !yield(res, nil) {
+				return
+			}
+		}
+	})
+}
+
+func (s *ResultStore) StreamResults(ctx context.Context, event *api.TriggerEvent, batch *api.TriggerBatch, results iter.Seq2[api.TriggerResult, error]) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	plan, found := s.db.plans[event.GetPlan()]
+	if !found {
+		return fmt.Errorf("plan not found (%q): %w", event.GetPlan(), status.ErrNotFound)
+	}
+
+	key := batch.GetIdempotencyKey()
+	if key != "" {
+		if _, found := plan.idempotencyKeys[key]; found {
+			return fmt.Errorf("batch already exchanged (%q): %w", key, status.ErrAlreadyExists)
+		}
+	}
+
+	e := plan.eventKeys[event.GetEvent()]
+	created := e == nil || event.GetEvent() == ""
+	if created {
+		e = &eventRow{
+			implicit:  event.GetImplicit(),
+			url:       event.GetURL(),
+			rawURL:    event.GetRawURL(),
+			timestamp: event.GetTimestamp(),
+			key:       event.GetEvent(),
+			sequences: make(map[int]string),
+		}
+	}
+	if batch.HasSequence() {
+		if storedKey, found := e.sequences[batch.GetSequence()]; found {
+			if storedKey != key {
+				return fmt.Errorf("batch sequence was exchanged with a different idempotency key (%d): %w", batch.GetSequence(), status.ErrFailedPrecondition)
+			}
+			return fmt.Errorf("batch already exchanged (%d): %w", batch.GetSequence(), status.ErrAlreadyExists)
+		}
+	}
+
+	// Convert all results before changing any state.
+	var newResults []*resultRow
+	nextSeq := make(map[*pipeRow]int)
+	prevResults := e.results
+	if e.repeatOf != nil {
+		// Later batches of a repeat event need its own copy of the results.
+		prevResults = e.repeatOf.results
+	}
+	for _, r := range prevResults {
+		nextSeq[r.pipe] = max(nextSeq[r.pipe], r.sequenceID+1)
+	}
+	for res, err := range results {
+		if err != nil {
+			return err
+		}
+		nameDigest, err := integrity.ParseNameDigest(res.Pipe)
+		if err != nil {
+			return err
+		}
+		pipe := s.db.pipeIndex[integrity.Key(nameDigest)]
+		var p nuggit.Point
+		p.Scalar = res.Scalar
+		for v, err := range points.Values(p, res.Result) {
+			if err != nil {
+				return err
+			}
+			if pipe == nil {
+				continue // Results for unknown pipes are not stored.
+			}
+			newResults = append(newResults, &resultRow{
+				pipe:       pipe,
+				sequenceID: nextSeq[pipe],
+				typeNumber: pipe.typeNumber,
+				value:      v,
+			})
+			nextSeq[pipe]++
+		}
+	}
+
+	if e.key == "" || plan.eventKeys[e.key] == nil {
+		s.db.lastEventID++
+		e.id = s.db.lastEventID
+		plan.events = append(plan.events, e)
+		if e.key != "" {
+			plan.eventKeys[e.key] = e
+		}
+	}
+	if key != "" {
+		plan.idempotencyKeys[key] = struct{}{}
+	}
+	if batch.HasSequence() {
+		e.sequences[batch.GetSequence()] = key
+	}
+	if e.repeatOf != nil {
+		e.results = slices.Clone(e.repeatOf.results)
+		e.repeatOf = nil
+	}
+	if !created {
+		// Repeats of the event keep the results they repeated before this batch.
+		for _, p := range s.db.plans {
+			for _, re := range p.events {
+				if re.repeatOf == e {
+					re.results = slices.Clone(e.results)
+					re.repeatOf = nil
+				}
+			}
+		}
+	}
+	e.results = append(e.results, newResults...)
+	s.dedupeEventLocked(e, len(newResults) > 0)
+	s.recordChangesLocked(plan, e)
+	return nil
+}
+
+// dedupeEventLocked drops the results of the event when they are identical
+// to the previous event for the URL like the SQLite ResultStore.
+func (s *ResultStore) dedupeEventLocked(e *eventRow, dedupe bool) {
+	e.contentHash = contentHash(e.results)
+	if !dedupe || e.url == "" {
+		return
+	}
+	var prev *eventRow
+	for _, plan := range s.db.plans {
+		for _, pe := range plan.events {
+			if pe.url == e.url && pe.id < e.id && (prev == nil || pe.id > prev.id) {
+				prev = pe
+			}
+		}
+	}
+	if prev != nil && prev.contentHash == e.contentHash {
+		e.results = nil
+		e.repeatOf = cmp.Or(prev.repeatOf, prev)
+	}
+}
+
+// contentHash returns a hash of the pipes and values of the results.
+func contentHash(results []*resultRow) string {
+	results = slices.Clone(results)
+	slices.SortFunc(results, func(a, b *resultRow) int {
+		return cmp.Or(cmp.Compare(a.pipe.name, b.pipe.name), cmp.Compare(a.pipe.digest, b.pipe.digest), cmp.Compare(a.sequenceID, b.sequenceID))
+	})
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	for _, r := range results {
+		enc.Encode([]any{r.pipe.name, r.pipe.digest, r.sequenceID, r.typeNumber, r.value})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordChangesLocked records the changes of the event values like the SQLite ResultStore.
+func (s *ResultStore) recordChangesLocked(plan *planRow, e *eventRow) {
+	s.db.changes = slices.DeleteFunc(s.db.changes, func(c *api.Change) bool { return c.Event == e.id })
+	if e.url == "" {
+		return
+	}
+	type key struct {
+		pipe     *pipeRow
+		sequence int
+	}
+	values := func(e *eventRow, name string, pipes []*pipeRow) (map[key]*resultRow, []*pipeRow) {
+		vs := make(map[key]*resultRow)
+		for _, r := range e.results {
+			if r.pipe.name != name {
+				continue
+			}
+			if !slices.Contains(pipes, r.pipe) {
+				pipes = append(pipes, r.pipe)
+			}
+			vs[key{r.pipe, r.sequenceID}] = r
+		}
+		return vs, pipes
+	}
+	// Plan pipes without results in the event are compared too.
+	var planPipes []*pipeRow
+	if e.repeatOf == nil {
+		for _, key := range plan.pipes {
+			if p := s.db.pipeIndex[key]; p != nil {
+				planPipes = append(planPipes, p)
+			}
+		}
+	}
+	var names []string
+	for _, p := range planPipes {
+		if !slices.Contains(names, p.name) {
+			names = append(names, p.name)
+		}
+	}
+	for _, r := range e.results {
+		if !slices.Contains(names, r.pipe.name) {
+			names = append(names, r.pipe.name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		// Find the previous event for the URL with results for the pipe.
+		var prev *eventRow
+		for _, plan := range s.db.plans {
+			for _, pe := range plan.events {
+				if pe.url == e.url && pe.id < e.id && (prev == nil || pe.id > prev.id) && slices.ContainsFunc(pe.results, func(r *resultRow) bool { return r.pipe.name == name }) {
+					prev = pe
+				}
+			}
+		}
+		if prev == nil {
+			continue
+		}
+		var namePipes []*pipeRow
+		for _, p := range planPipes {
+			if p.name == name {
+				namePipes = append(namePipes, p)
+			}
+		}
+		cur, curPipes := values(e, name, namePipes)
+		old, oldPipes := values(prev, name, nil)
+		// Pair pipes by digest or by name when a single digest replaced another.
+		pairs := make(map[*pipeRow]*pipeRow, len(curPipes))
+		var added, missing []*pipeRow
+		for _, p := range curPipes {
+			if slices.Contains(oldPipes, p) {
+				pairs[p] = p
+			} else {
+				added = append(added, p)
+			}
+		}
+		for _, p := range oldPipes {
+			if !slices.Contains(curPipes, p) {
+				missing = append(missing, p)
+			}
+		}
+		if len(added) == 1 && len(missing) == 1 {
+			pairs[added[0]] = missing[0]
+		}
+		var changes []*api.Change
+		add := func(seq int, kind api.ChangeKind, o, c *resultRow) {
+			r := cmp.Or(c, o)
+			change := &api.Change{
+				Event:     e.id,
+				PrevEvent: prev.id,
+				URL:       e.url,
+				Pipe:      fmt.Sprint(integrity.KeyLit(r.pipe.name, r.pipe.digest)),
+				Sequence:  seq,
+				Kind:      kind,
+			}
+			if o != nil {
+				change.Old = o.value
+			}
+			if c != nil {
+				change.New = c.value
+			}
+			changes = append(changes, change)
+		}
+		for k, c := range cur {
+			o, found := old[key{pairs[k.pipe], k.sequence}]
+			switch {
+			case !found:
+				add(k.sequence, api.ChangeAdded, nil, c)
+			case !reflect.DeepEqual(o.value, c.value):
+				add(k.sequence, api.ChangeChanged, o, c)
+			}
+		}
+		for cp, op := range pairs {
+			for k, o := range old {
+				if _, found := cur[key{cp, k.sequence}]; k.pipe == op && !found {
+					add(k.sequence, api.ChangeRemoved, o, nil)
+				}
+			}
+		}
+		slices.SortFunc(changes, func(a, b *api.Change) int {
+			return cmp.Or(cmp.Compare(a.Pipe, b.Pipe), cmp.Compare(a.Sequence, b.Sequence))
+		})
+		s.db.changes = append(s.db.changes, changes...)
+	}
+}
+
+func (s *ResultStore) ScanChanges(ctx context.Context, filter *api.ChangeFilter) iter.Seq2[*api.Change, error] {
+	if filter == nil {
+		filter = new(api.ChangeFilter)
+	}
+	if err := api.ValidateChangeKind(filter.Kind); err != nil {
+		return seq2Error[*api.Change](err)
+	}
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	var changes []*api.Change
+	for _, c := range s.db.changes {
+		if filter.URL != "" && c.URL != filter.URL ||
+			filter.Kind != "" && c.Kind != filter.Kind ||
+			c.Event <= filter.After {
+			continue
+		}
+		if filter.Pipe != nil {
+			pipe, err := integrity.ParseNameDigest(c.Pipe)
+			if err != nil {
+				return seq2Error[*api.Change](err)
+			}
+			if pipe.GetName() != filter.Pipe.GetName() || filter.Pipe.GetDigest() != "" && pipe.GetDigest() != filter.Pipe.GetDigest() {
+				continue
+			}
+		}
+		change := *c
+		changes = append(changes, &change)
+	}
+	slices.SortStableFunc(changes, func(a, b *api.Change) int { return cmp.Compare(a.Event, b.Event) })
+	return seq2Slice(changes)
+}
@@ -0,0 +1,259 @@
+package inmemory
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"log"
+	"net/url"
+	"slices"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/rules"
+	"github.com/wenooij/nuggit/status"
+)
+
+type RuleStore struct {
+	db *DB
+}
+
+func NewRuleStore(db *DB) *RuleStore {
+	return &RuleStore{db: db}
+}
+
+// sameRuleKey reports whether the rules have the same identifying fields.
+//
+// The fields match the UNIQUE constraint on the Rules table.
+func sameRuleKey(a, b nuggit.Rule) bool {
+	return a.Hostname == b.Hostname &&
+		a.URLPattern == b.URLPattern &&
+		a.Scheme == b.Scheme &&
+		a.Port == b.Port &&
+		a.PathGlob == b.PathGlob &&
+		a.AlwaysTrigger == b.AlwaysTrigger
+}
+
+func (db *DB) findRuleByKey(rule nuggit.Rule) *ruleRow {
+	for _, row := range db.rules {
+		if sameRuleKey(row.rule.Rule, rule) {
+			return row
+		}
+	}
+	return nil
+}
+
+func (db *DB) findRuleByID(id string) *ruleRow {
+	for _, row := range db.rules {
+		if row.rule.ID == id {
+			return row
+		}
+	}
+	return nil
+}
+
+func cloneRule(r *api.Rule) *api.Rule {
+	return &api.Rule{ID: r.GetID(), Rule: rules.Clone(r.GetRule())}
+}
+
+func (s *RuleStore) StoreRule(ctx context.Context, rule *api.Rule) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	// Use the ID of the existing rule when the rule was already stored.
+	if row := s.db.findRuleByKey(rule.Rule); row != nil {
+		rule.ID = row.rule.ID
+		row.rule.Labels = slices.Clone(rule.Labels)
+		row.rule.Policy = rules.Clone(rule.Rule).Policy
+		row.rule.Canonical = rules.Clone(rule.Rule).Canonical
+		row.rule.Disable = rule.Disable
+		// The resource of a stored rule is replaced when the rule is stored again.
+		s.db.resources = slices.DeleteFunc(s.db.resources, func(r *resourceRow) bool { return r.rule == row })
+		s.db.matcher = nil
+		return nil
+	}
+	if s.db.findRuleByID(rule.GetID()) != nil {
+		return fmt.Errorf("failed to store rule (%q): %w", rule.GetID(), status.ErrAlreadyExists)
+	}
+	s.db.rules = append(s.db.rules, &ruleRow{rule: *cloneRule(rule)})
+	s.db.matcher = nil
+	return nil
+}
+
+func (s *RuleStore) LoadRule(ctx context.Context, id string) (*api.Rule, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row := s.db.findRuleByID(id)
+	if row == nil {
+		return nil, fmt.Errorf("rule not found (%q): %w", id, status.ErrNotFound)
+	}
+	return cloneRule(&row.rule), nil
+}
+
+func (s *RuleStore) ScanRules(ctx context.Context, filter *api.RuleFilter) iter.Seq2[*api.Rule, error] {
+	s.db.mu.Lock()
+	var rs []*api.Rule
+	for _, row := range s.db.rules {
+		if hostname := filter.GetHostname(); hostname != "" && row.rule.Hostname != hostname {
+			continue
+		}
+		if label := filter.GetLabel(); label != "" && !slices.Contains(row.rule.Labels, label) {
+			continue
+		}
+		rs = append(rs, cloneRule(&row.rule))
+	}
+	s.db.mu.Unlock()
+	return seq2Slice(rs)
+}
+
+func (s *RuleStore) UpdateRule(ctx context.Context, rule *api.Rule) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row := s.db.findRuleByID(rule.GetID())
+	if row == nil {
+		return fmt.Errorf("rule not found (%q): %w", rule.GetID(), status.ErrNotFound)
+	}
+	if other := s.db.findRuleByKey(rule.Rule); other != nil && other != row {
+		return fmt.Errorf("failed to update rule (%q): the same rule is already stored: %w", rule.GetID(), status.ErrAlreadyExists)
+	}
+	row.rule = *cloneRule(rule)
+	s.db.matcher = nil
+	return nil
+}
+
+func (s *RuleStore) UpdateRuleFunc(ctx context.Context, id string, update func(*nuggit.Rule)) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row := s.db.findRuleByID(id)
+	if row == nil {
+		return fmt.Errorf("rule not found (%q): %w", id, status.ErrNotFound)
+	}
+	rule := cloneRule(&row.rule)
+	update(&rule.Rule)
+	if other := s.db.findRuleByKey(rule.Rule); other != nil && other != row {
+		return fmt.Errorf("failed to update rule (%q): the same rule is already stored: %w", id, status.ErrAlreadyExists)
+	}
+	row.rule = *rule
+	s.db.matcher = nil
+	return nil
+}
+
+// DeleteRule deletes the rule matching all fields of the given rule.
+//
+// When labels are provided they must match the labels of the stored rule.
+func (s *RuleStore) DeleteRule(ctx context.Context, rule nuggit.Rule) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row := s.db.findRuleByKey(rule)
+	if row == nil {
+		return fmt.Errorf("rule not found: %w", status.ErrNotFound)
+	}
+	if len(rule.Labels) > 0 && !sameLabels(row.rule.Labels, rule.Labels) {
+		return fmt.Errorf("rule labels do not match the stored rule (%q): %w", row.rule.Labels, status.ErrFailedPrecondition)
+	}
+	s.db.deleteRule(row)
+	return nil
+}
+
+func (s *RuleStore) DeleteRuleByID(ctx context.Context, id string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row := s.db.findRuleByID(id)
+	if row == nil {
+		return fmt.Errorf("rule not found (%q): %w", id, status.ErrNotFound)
+	}
+	s.db.deleteRule(row)
+	return nil
+}
+
+func (db *DB) deleteRule(row *ruleRow) {
+	db.rules = slices.DeleteFunc(db.rules, func(r *ruleRow) bool { return r == row })
+	// Resources cascade on delete.
+	db.resources = slices.DeleteFunc(db.resources, func(r *resourceRow) bool { return r.rule == row })
+	db.matcher = nil
+}
+
+func sameLabels(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(slices.Compact(a), slices.Compact(b))
+}
+
+// loadMatcher returns the cached rule matcher or builds a new one.
+func (s *RuleStore) loadMatcher() (*rules.Matcher, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if s.db.matcher != nil {
+		return s.db.matcher, nil
+	}
+	m := rules.NewMatcher()
+	for _, row := range s.db.rules {
+		if err := m.Add(row.rule.ID, rules.Clone(row.rule.Rule)); err != nil {
+			// Don't let one bad rule stop every other rule from matching.
+			log.Printf("Skipping rule %q: %v", row.rule.ID, err)
+		}
+	}
+	s.db.matcher = m
+	return m, nil
+}
+
+func (s *RuleStore) ScanMatchedRules(ctx context.Context, u *url.URL) iter.Seq2[*api.Rule, error] {
+	m, err := s.loadMatcher()
+	if err != nil {
+		return seq2Error[*api.Rule](err)
+	}
+	return func(yield func(*api.Rule, error) bool) {
+		for id, rule := range m.Match(u) {
+			if !yield(&api.Rule{ID: id, Rule: rules.Clone(rule)}, nil) {
+				break
+			}
+		}
+	}
+}
+
+func (s *RuleStore) ScanMatched(ctx context.Context, u *url.URL) iter.Seq2[*api.Pipe, error] {
+	m, err := s.loadMatcher()
+	if err != nil {
+		return seq2Error[*api.Pipe](err)
+	}
+	return s.ScanLabeledPipes(ctx, m.MatchLabels(u))
+}
+
+// ScanLabeledPipes returns the unique pipes of resources which carry any of the labels
+// and are not labeled as disabled or with a label of a disabled rule.
+func (s *RuleStore) ScanLabeledPipes(ctx context.Context, labels []string) iter.Seq2[*api.Pipe, error] {
+	if len(labels) == 0 {
+		return func(func(*api.Pipe, error) bool) {}
+	}
+
+	s.db.mu.Lock()
+	var disabledLabels []string
+	for _, row := range s.db.rules {
+		if row.rule.Disable {
+			disabledLabels = append(disabledLabels, row.rule.Labels...)
+		}
+	}
+	var rows []*pipeRow
+	seen := make(map[*pipeRow]struct{})
+	for _, r := range s.db.resources {
+		if r.pipe == nil || r.hasLabel("disabled") || slices.ContainsFunc(disabledLabels, r.hasLabel) {
+			continue
+		}
+		if _, found := seen[r.pipe]; found {
+			continue
+		}
+		if slices.ContainsFunc(labels, r.hasLabel) {
+			seen[r.pipe] = struct{}{}
+			rows = append(rows, r.pipe)
+		}
+	}
+	s.db.mu.Unlock()
+	return scanPipeRows(rows)
+}
@@ -0,0 +1,82 @@
+package inmemory
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"iter"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/status"
+)
+
+// SearchResults returns the string results containing every term of the query.
+//
+// Unlike the SQLite ResultStore, query operators are not supported
+// and hits are ordered by event instead of relevance.
+func (s *ResultStore) SearchResults(ctx context.Context, filter *api.SearchFilter) iter.Seq2[*api.SearchHit, error] {
+	if filter == nil || filter.Query == "" {
+		return seq2Error[*api.SearchHit](fmt.Errorf("query is required: %w", status.ErrInvalidArgument))
+	}
+	terms := searchTerms(filter.Query)
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	var hits []*api.SearchHit
+	for _, plan := range s.db.plans {
+		for _, e := range plan.events {
+			if filter.URL != "" && e.url != filter.URL {
+				continue
+			}
+			for _, r := range e.results {
+				if nuggit.NewPointFromNumber(r.typeNumber).Scalar != nuggit.String {
+					continue
+				}
+				if filter.Pipe != nil && !matchPipe(filter.Pipe, r.pipe) {
+					continue
+				}
+				text, _ := r.value.(string)
+				if !containsTerms(text, terms) {
+					continue
+				}
+				hits = append(hits, &api.SearchHit{
+					Event:     e.id,
+					URL:       e.url,
+					Timestamp: e.timestamp,
+					Pipe:      fmt.Sprint(integrity.KeyLit(r.pipe.name, r.pipe.digest)),
+					Sequence:  r.sequenceID,
+					Snippet:   text,
+				})
+			}
+		}
+	}
+	slices.SortStableFunc(hits, func(a, b *api.SearchHit) int {
+		return cmp.Or(cmp.Compare(b.Event, a.Event), cmp.Compare(a.Sequence, b.Sequence))
+	})
+	hits = hits[min(max(filter.Offset, 0), len(hits)):]
+	if filter.Limit > 0 && len(hits) > filter.Limit {
+		hits = hits[:filter.Limit]
+	}
+	return seq2Slice(hits)
+}
+
+func searchTerms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func containsTerms(text string, terms []string) bool {
+	tokens := searchTerms(text)
+	for _, term := range terms {
+		if !slices.Contains(tokens, term) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,293 @@
+package inmemory
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"slices"
+	"time"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/status"
+)
+
+type ViewStore struct{ db *DB }
+
+func NewViewStore(db *DB) *ViewStore {
+	return &ViewStore{db: db}
+}
+
+// Store stores the view.
+//
+// Unlike the SQLite ViewStore, no SQL view is created for the results
+// and materialized views are computed on read like other views.
+func (s *ViewStore) Store(ctx context.Context, uuid string, view nuggit.View) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row, err := s.newViewRowLocked(uuid, view)
+	if err != nil {
+		return err
+	}
+	s.db.lastViewID++
+	row.id = s.db.lastViewID
+	s.db.views[uuid] = row
+	return nil
+}
+
+func (s *ViewStore) Update(ctx context.Context, uuid string, view nuggit.View) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	old, found := s.db.views[uuid]
+	if !found {
+		return fmt.Errorf("view not found (%q): %w", uuid, status.ErrNotFound)
+	}
+	row, err := s.newViewRowLocked(uuid, view)
+	if err != nil {
+		return err
+	}
+	row.id = old.id
+	s.db.views[uuid] = row
+	return nil
+}
+
+func (s *ViewStore) Delete(ctx context.Context, uuid string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if _, found := s.db.views[uuid]; !found {
+		return fmt.Errorf("view not found (%q): %w", uuid, status.ErrNotFound)
+	}
+	delete(s.db.views, uuid)
+	// Resources cascade on delete.
+	s.db.resources = slices.DeleteFunc(s.db.resources, func(r *resourceRow) bool { return r.viewUUID == uuid })
+	return nil
+}
+
+// newViewRowLocked returns a row for the view which must not have the digest of another view.
+func (s *ViewStore) newViewRowLocked(uuid string, view nuggit.View) (*viewRow, error) {
+	spec, err := marshalSpec(view.GetSpec())
+	if err != nil {
+		return nil, err
+	}
+	digest, err := integrity.GetDigest(&view)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range s.db.views {
+		if r.digest == digest && r.uuid != uuid {
+			return nil, fmt.Errorf("view already exists (%q): %w", r.uuid, status.ErrAlreadyExists)
+		}
+	}
+
+	row := &viewRow{
+		uuid:   uuid,
+		name:   view.Alias,
+		digest: digest,
+		spec:   spec,
+	}
+	for _, col := range api.ViewBaseColumns(&view) {
+		pipe, err := integrity.ParseNameDigest(col.Pipe)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range s.db.pipes {
+			if matchPipe(pipe, p) && !slices.Contains(row.pipes, p) {
+				row.pipes = append(row.pipes, p)
+			}
+		}
+	}
+	return row, nil
+}
+
+// matchPipe reports whether the pipe row is the pipe or a version of it when the pipe has no digest.
+func matchPipe(pipe integrity.NameDigest, row *pipeRow) bool {
+	return row.name == pipe.GetName() && (pipe.GetDigest() == "" || row.digest == pipe.GetDigest())
+}
+
+func decodeView(row *viewRow) (*api.View, error) {
+	v := &api.View{ID: row.uuid, Digest: row.digest}
+	if err := json.Unmarshal(row.spec, &v.View); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (s *ViewStore) Load(ctx context.Context, view string) (*api.View, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row, found := s.db.views[view]
+	if !found {
+		// Find the latest view with the alias.
+		for _, r := range s.db.views {
+			if r.name == view && (row == nil || r.id > row.id) {
+				row = r
+			}
+		}
+	}
+	if row == nil {
+		return nil, fmt.Errorf("view not found (%q): %w", view, status.ErrNotFound)
+	}
+	return decodeView(row)
+}
+
+func (s *ViewStore) Scan(ctx context.Context) iter.Seq2[*api.View, error] {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	rows := make([]*viewRow, 0, len(s.db.views))
+	for _, row := range s.db.views {
+		rows = append(rows, row)
+	}
+	slices.SortFunc(rows, func(a, b *viewRow) int { return cmp.Compare(a.id, b.id) })
+
+	var views []*api.View
+	for _, row := range rows {
+		v, err := decodeView(row)
+		if err != nil {
+			return seq2Error[*api.View](err)
+		}
+		views = append(views, v)
+	}
+	return seq2Slice(views)
+}
+
+// ScanRows computes the rows of the view from the stored results.
+//
+// Rows match the SQLite views: one row for each event and sequence
+// with results for the view pipes.
+func (s *ViewStore) ScanRows(ctx context.Context, uuid string, query *api.ViewQuery) iter.Seq2[*api.ViewRow, error] {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	row, found := s.db.views[uuid]
+	if !found {
+		return seq2Error[*api.ViewRow](fmt.Errorf("view not found (%q): %w", uuid, status.ErrNotFound))
+	}
+	view, err := decodeView(row)
+	if err != nil {
+		return seq2Error[*api.ViewRow](err)
+	}
+	if len(view.GetAggColumns()) > 0 {
+		return seq2Error[*api.ViewRow](fmt.Errorf("aggregated view rows are not supported in memory (%q): %w", uuid, status.ErrUnimplemented))
+	}
+	if view.GetFilter() != "" || query.Where != nil || slices.ContainsFunc(view.GetColumns(), func(col nuggit.ViewColumn) bool { return col.Expr != "" }) {
+		return seq2Error[*api.ViewRow](fmt.Errorf("view expressions are not supported in memory (%q): %w", uuid, status.ErrUnimplemented))
+	}
+	// Find the column of each view pipe.
+	pipeColumns := make(map[*pipeRow]nuggit.ViewColumn)
+	pipeOrder := make(map[*pipeRow]int)
+	for _, col := range view.GetColumns() {
+		pipe, err := integrity.ParseNameDigest(col.Pipe)
+		if err != nil {
+			return seq2Error[*api.ViewRow](err)
+		}
+		for i, p := range s.db.pipes {
+			if matchPipe(pipe, p) {
+				pipeColumns[p] = col
+				pipeOrder[p] = i
+			}
+		}
+	}
+
+	type key struct {
+		event    int64
+		sequence int
+	}
+	type keyColumn struct {
+		key
+		column string
+	}
+	var (
+		keys   []key
+		values = make(map[key]map[string]any)
+		// Floating columns have the value of the newest version like in SQLite.
+		valuePipes = make(map[keyColumn]*pipeRow)
+	)
+	for _, plan := range s.db.plans {
+		for _, e := range plan.events {
+			results := e.results
+			if e.repeatOf != nil && view.GetRepeats() {
+				results = e.repeatOf.results
+			}
+			for _, r := range results {
+				col, found := pipeColumns[r.pipe]
+				if !found {
+					continue
+				}
+				k := key{e.id, r.sequenceID}
+				vs, found := values[k]
+				if !found {
+					vs = map[string]any{api.ViewURLColumn: e.url}
+					if !e.timestamp.IsZero() {
+						vs[api.ViewTimestampColumn] = e.timestamp.Format(time.RFC3339Nano)
+					}
+					values[k] = vs
+					keys = append(keys, k)
+				}
+				kc := keyColumn{k, api.ViewColumnName(col)}
+				if p, found := valuePipes[kc]; found && pipeOrder[p] > pipeOrder[r.pipe] {
+					continue
+				}
+				valuePipes[kc] = r.pipe
+				value := r.value
+				if s, ok := value.(string); ok && (col.Point.Scalar == "" || col.Point.Scalar == nuggit.Bytes) {
+					value = []byte(s) // Bytes columns hold blobs like in SQLite.
+				}
+				vs[api.ViewColumnName(col)] = value
+				if col.WithDigest {
+					vs[api.DigestColumnName(col)] = r.pipe.digest
+				}
+			}
+		}
+	}
+
+	var rows []*api.ViewRow
+next:
+	for _, k := range keys {
+		vs := values[k]
+		for _, f := range query.Filters {
+			if !f.Match(vs[f.Column]) {
+				continue next
+			}
+		}
+		r := &api.ViewRow{Event: k.event, Sequence: k.sequence}
+		for _, col := range query.Columns {
+			r.Values = append(r.Values, vs[col])
+		}
+		if query.OrderBy != "" {
+			r.SortValue = vs[query.OrderBy]
+		}
+		rows = append(rows, r)
+	}
+
+	compare := func(a, b *api.ViewRow) int {
+		c := api.CompareViewValues(a.SortValue, b.SortValue)
+		if c == 0 {
+			c = cmp.Or(cmp.Compare(a.Event, b.Event), cmp.Compare(a.Sequence, b.Sequence))
+		}
+		if query.Desc {
+			return -c
+		}
+		return c
+	}
+	slices.SortFunc(rows, compare)
+	if c := query.After; c != nil {
+		after := &api.ViewRow{Event: c.Event, Sequence: c.Sequence, SortValue: c.Value}
+		i, _ := slices.BinarySearchFunc(rows, after, compare)
+		for i < len(rows) && compare(rows[i], after) <= 0 {
+			i++
+		}
+		rows = rows[i:]
+	}
+	if query.Limit > 0 && len(rows) > query.Limit {
+		rows = rows[:query.Limit]
+	}
+	return seq2Slice(rows)
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/wenooij/nuggit/status"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// Migration is a numbered schema change.
+//
+// Migrations are applied in order and the database schema version
+// is tracked using PRAGMA user_version.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Migrations returns the embedded migrations ordered by version.
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationsFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]Migration, 0, len(entries))
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".sql")
+		v, rest, found := strings.Cut(name, "_")
+		version, err := strconv.Atoi(v)
+		if !found || err != nil {
+			return nil, fmt.Errorf("migration name must have the form NNNN_name.sql (%q)", e.Name())
+		}
+		if version != len(migrations)+1 {
+			return nil, fmt.Errorf("migration version is out of sequence (%q): want %d", e.Name(), len(migrations)+1)
+		}
+		data, err := migrationsFS.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: rest, SQL: string(data)})
+	}
+	return migrations, nil
+}
+
+// SchemaVersion returns the version of the last migration applied to the database.
+func SchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Migrate applies pending migrations to the database and returns them.
+//
+// Each migration is applied in its own transaction along with the new schema version.
+// When dryRun is set, the pending migrations are applied and rolled back
+// to check that they succeed without changing the database.
+func Migrate(ctx context.Context, db *sql.DB, dryRun bool) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var version int
+	if err := conn.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return nil, err
+	}
+	if version > len(migrations) {
+		return nil, fmt.Errorf("database schema version is newer than supported (%d > %d): %w", version, len(migrations), status.ErrFailedPrecondition)
+	}
+	pending := migrations[version:]
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	// Foreign keys are disabled while tables are rebuilt.
+	// Foreign key enforcement cannot be changed inside of a transaction.
+	var foreignKeys bool
+	if err := conn.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&foreignKeys); err != nil {
+		return nil, err
+	}
+	if foreignKeys {
+		if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+			return nil, err
+		}
+		defer conn.ExecContext(context.Background(), "PRAGMA foreign_keys = ON")
+	}
+
+	if dryRun {
+		// Apply all pending migrations in one transaction to check them and roll back.
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		for _, m := range pending {
+			if err := applyMigration(ctx, tx, m); err != nil {
+				return nil, fmt.Errorf("failed to apply migration %04d_%s: %w", m.Version, m.Name, err)
+			}
+		}
+		return pending, nil
+	}
+
+	var applied []Migration
+	for _, m := range pending {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return applied, err
+		}
+		if err := applyMigration(ctx, tx, m); err != nil {
+			tx.Rollback()
+			return applied, fmt.Errorf("failed to apply migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return applied, err
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+func applyMigration(ctx context.Context, tx *sql.Tx, m Migration) error {
+	if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", m.Version))
+	return err
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+)
+
+func TestMigrateBaseline(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Databases created before migrations have the baseline schema and user_version 0.
+	if _, err := db.ExecContext(ctx, migrations[0].SQL); err != nil {
+		t.Fatal(err)
+	}
+	// Rules which only differ by Disable are merged.
+	if _, err := db.ExecContext(ctx, "INSERT INTO Rules (Hostname, URLPattern, AlwaysTrigger, Disable) VALUES ('example.com', '', FALSE, TRUE), ('example.com', '', FALSE, FALSE)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO RuleLabels (RuleID, Label) VALUES (1, 'a'), (2, 'b')"); err != nil {
+		t.Fatal(err)
+	}
+	// Rule resources had no name or digest.
+	if _, err := db.ExecContext(ctx, "INSERT INTO Resources (APIVersion, Kind, RuleID) VALUES ('v1', 'rule', 1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Events received before ReceivedAt are backfilled from their client timestamp.
+	timestamp := time.Date(2024, 1, 2, 3, 4, 5, 6, time.FixedZone("", 3600))
+	if _, err := db.ExecContext(ctx, "INSERT INTO Events (PlanID, URL, Timestamp) VALUES (1, 'https://example.com/', ?), (1, 'https://example.com/', NULL)", timestamp); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := Migrate(ctx, db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != len(migrations) {
+		t.Errorf("Migrate(dryRun): got %d pending migrations, want %d", len(pending), len(migrations))
+	}
+	if v, err := SchemaVersion(ctx, db); err != nil || v != 0 {
+		t.Errorf("SchemaVersion(after dry run): got %d, %v, want 0", v, err)
+	}
+
+	if _, err := Migrate(ctx, db, false); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := SchemaVersion(ctx, db); err != nil || v != len(migrations) {
+		t.Errorf("SchemaVersion: got %d, %v, want %d", v, err, len(migrations))
+	}
+
+	var (
+		uuid, hostname, labels string
+		disable                bool
+		count                  int
+	)
+	if err := db.QueryRowContext(ctx, `SELECT UUID, Hostname, Disable, (SELECT group_concat(Label) FROM RuleLabels WHERE RuleID = Rules.ID), (SELECT COUNT(*) FROM Rules) FROM Rules`).Scan(&uuid, &hostname, &disable, &labels, &count); err != nil {
+		t.Fatal(err)
+	}
+	if len(uuid) != 36 || hostname != "example.com" || disable || labels != "a,b" || count != 1 {
+		t.Errorf("migrated rule: got (%q, %q, %v, %q) of %d rules, want one enabled rule with labels a,b", uuid, hostname, disable, labels, count)
+	}
+
+	var receivedAt, fallback int64
+	if err := db.QueryRowContext(ctx, "SELECT MIN(ReceivedAt), MAX(ReceivedAt) FROM Events").Scan(&receivedAt, &fallback); err != nil {
+		t.Fatal(err)
+	}
+	if receivedAt != timestamp.Unix() || fallback < time.Now().Add(-time.Hour).Unix() {
+		t.Errorf("event received at: got (%d, %d), want (%d, now)", receivedAt, fallback, timestamp.Unix())
+	}
+
+	// Rule resource digests are backfilled from the stored rule.
+	if err := InitDB(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	rule, err := NewRuleStore(db).LoadRule(ctx, uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := integrity.GetDigest(&api.Resource{Spec: &rule.Rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var digest sql.NullString
+	if err := db.QueryRowContext(ctx, "SELECT Digest FROM Resources WHERE Kind = 'rule'").Scan(&digest); err != nil || digest.String != want {
+		t.Errorf("rule resource digest: got %q, %v, want %q", digest.String, err, want)
+	}
+
+	if applied, err := Migrate(ctx, db, false); err != nil || len(applied) != 0 {
+		t.Errorf("Migrate(again): got %d applied, %v, want none", len(applied), err)
+	}
+}
@@ -0,0 +1,18 @@
+ALTER TABLE Events
+ADD COLUMN EventKey TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS EventsByKey ON Events (PlanID, EventKey);
+
+CREATE TABLE
+    IF NOT EXISTS EventBatches (
+        ID INTEGER NOT NULL,
+        PlanID INTEGER NOT NULL,
+        EventID INTEGER NOT NULL,
+        Sequence INTEGER,
+        IdempotencyKey TEXT,
+        UNIQUE (EventID, Sequence),
+        UNIQUE (PlanID, IdempotencyKey),
+        FOREIGN KEY (PlanID) REFERENCES Plans (ID) ON UPDATE CASCADE ON DELETE CASCADE,
+        FOREIGN KEY (EventID) REFERENCES Events (ID) ON UPDATE CASCADE ON DELETE CASCADE,
+        PRIMARY KEY (ID AUTOINCREMENT)
+    );
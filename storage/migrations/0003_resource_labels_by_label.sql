@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS ResourceLabelsByLabel ON ResourceLabels (Label);
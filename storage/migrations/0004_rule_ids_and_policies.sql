@@ -0,0 +1,53 @@
+-- Rules gains new key columns which requires rebuilding the table to change its UNIQUE constraint.
+CREATE TABLE
+    RulesNew (
+        ID INTEGER NOT NULL,
+        UUID TEXT NOT NULL,
+        Hostname TEXT,
+        URLPattern TEXT,
+        Scheme TEXT,
+        Port INTEGER,
+        PathGlob TEXT,
+        AlwaysTrigger BOOLEAN,
+        Disable BOOLEAN,
+        Policy TEXT CHECK (
+            Policy IS NULL
+            OR (
+                json_valid (Policy)
+                AND json_type (Policy) = 'object'
+            )
+        ),
+        Canonical TEXT CHECK (
+            Canonical IS NULL
+            OR (
+                json_valid (Canonical)
+                AND json_type (Canonical) = 'object'
+            )
+        ),
+        UNIQUE (UUID),
+        UNIQUE (Hostname, URLPattern, Scheme, Port, PathGlob, AlwaysTrigger, Disable),
+        PRIMARY KEY (ID AUTOINCREMENT)
+    );
+
+-- Existing rules are assigned random version 4 UUIDs.
+INSERT INTO
+    RulesNew (ID, UUID, Hostname, URLPattern, Scheme, Port, PathGlob, AlwaysTrigger, Disable)
+SELECT
+    r.ID,
+    lower(
+        hex (randomblob (4)) || '-' || hex (randomblob (2)) || '-4' || substr (hex (randomblob (2)), 2) || '-' || substr ('89ab', 1 + (abs(random()) % 4), 1) || substr (hex (randomblob (2)), 2) || '-' || hex (randomblob (6))
+    ),
+    COALESCE(r.Hostname, ''),
+    COALESCE(r.URLPattern, ''),
+    '',
+    0,
+    '',
+    COALESCE(r.AlwaysTrigger, FALSE),
+    COALESCE(r.Disable, FALSE)
+FROM
+    Rules AS r;
+
+DROP TABLE Rules;
+
+ALTER TABLE RulesNew
+RENAME TO Rules;
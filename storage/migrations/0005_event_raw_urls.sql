@@ -0,0 +1,2 @@
+ALTER TABLE Events
+ADD COLUMN RawURL TEXT;
@@ -0,0 +1,28 @@
+-- Server side timestamps in Unix seconds used by retention policies.
+-- Existing events use their client timestamp when it can be parsed.
+-- Other existing rows are treated as created when the migration runs.
+ALTER TABLE Plans
+ADD COLUMN CreatedAt INTEGER;
+
+UPDATE Plans
+SET
+    CreatedAt = CAST(strftime ('%s', 'now') AS INTEGER);
+
+ALTER TABLE Events
+ADD COLUMN ReceivedAt INTEGER;
+
+UPDATE Events
+SET
+    ReceivedAt = COALESCE(
+        -- Go time strings such as "2006-01-02 15:04:05.999999999 -0700 MST".
+        CAST(
+            strftime (
+                '%s',
+                substr (Timestamp, 1, 19) || substr (substr (Timestamp, 20 + instr (substr (Timestamp, 20), ' '), 5), 1, 3) || ':' || substr (substr (Timestamp, 20 + instr (substr (Timestamp, 20), ' '), 5), 4, 2)
+            ) AS INTEGER
+        ),
+        CAST(strftime ('%s', Timestamp) AS INTEGER),
+        CAST(strftime ('%s', 'now') AS INTEGER)
+    );
+
+CREATE INDEX IF NOT EXISTS EventsByURL ON Events (URL, ReceivedAt);
@@ -0,0 +1,22 @@
+-- Value level changes between consecutive events for the same URL.
+-- Changes are kept as history when their events are garbage collected
+-- so they copy the URL and time of the event.
+CREATE TABLE
+    IF NOT EXISTS Changes (
+        ID INTEGER NOT NULL,
+        EventID INTEGER NOT NULL,
+        PrevEventID INTEGER,
+        URL TEXT NOT NULL,
+        ReceivedAt INTEGER,
+        PipeID INTEGER NOT NULL,
+        SequenceID INTEGER NOT NULL,
+        Kind TEXT NOT NULL CHECK (Kind IN ('added', 'removed', 'changed')),
+        TypeNumber INTEGER,
+        OldValue BLOB,
+        NewValue BLOB,
+        UNIQUE (EventID, PipeID, SequenceID),
+        FOREIGN KEY (PipeID) REFERENCES Pipes (ID) ON UPDATE CASCADE ON DELETE CASCADE,
+        PRIMARY KEY (ID AUTOINCREMENT)
+    );
+
+CREATE INDEX IF NOT EXISTS ChangesByURL ON Changes (URL, EventID);
@@ -0,0 +1,9 @@
+-- Events whose results are identical to the previous event for the URL
+-- store no results and refer to the earlier event with the results.
+ALTER TABLE Events
+ADD COLUMN ContentHash TEXT;
+
+ALTER TABLE Events
+ADD COLUMN RepeatOf INTEGER REFERENCES Events (ID);
+
+CREATE INDEX IF NOT EXISTS EventsByRepeatOf ON Events (RepeatOf);
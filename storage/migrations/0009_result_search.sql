@@ -0,0 +1,39 @@
+-- Full-text index over string results keyed by the result ID.
+-- The index keeps its own copy of the text so results can be
+-- deleted without knowing whether they were indexed.
+CREATE VIRTUAL TABLE IF NOT EXISTS ResultsSearch USING fts5 (Result, tokenize = 'unicode61');
+
+-- Names of the pipes whose results are indexed.
+-- All string results are indexed when no pipes are chosen.
+CREATE TABLE
+    IF NOT EXISTS SearchPipes (Name TEXT NOT NULL, PRIMARY KEY (Name));
+
+CREATE TRIGGER IF NOT EXISTS ResultsSearchInsert AFTER INSERT ON Results
+WHEN (NEW.TypeNumber & 7) = 1
+AND (
+    NOT EXISTS (
+        SELECT 1
+        FROM SearchPipes
+    )
+    OR EXISTS (
+        SELECT 1
+        FROM SearchPipes AS s
+        JOIN Pipes AS p ON s.Name = p.Name
+        WHERE p.ID = NEW.PipeID
+    )
+) BEGIN
+INSERT INTO ResultsSearch (rowid, Result)
+VALUES (NEW.ID, NEW.Result);
+
+END;
+
+CREATE TRIGGER IF NOT EXISTS ResultsSearchDelete AFTER DELETE ON Results BEGIN
+DELETE FROM ResultsSearch
+WHERE rowid = OLD.ID;
+
+END;
+
+INSERT INTO ResultsSearch (rowid, Result)
+SELECT ID, Result
+FROM Results
+WHERE (TypeNumber & 7) = 1;
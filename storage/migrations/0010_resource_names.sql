@@ -0,0 +1,27 @@
+-- Resources keep the name and digest they were created with
+-- so that resources of every kind can be looked up by name.
+ALTER TABLE Resources
+ADD COLUMN Name TEXT;
+
+ALTER TABLE Resources
+ADD COLUMN Digest TEXT;
+
+UPDATE Resources
+SET
+    Name = p.Name,
+    Digest = p.Digest
+FROM
+    Pipes AS p
+WHERE
+    Resources.PipeID = p.ID;
+
+UPDATE Resources
+SET
+    Name = v.Name,
+    Digest = v.Digest
+FROM
+    Views AS v
+WHERE
+    Resources.ViewID = v.ID;
+
+CREATE INDEX IF NOT EXISTS ResourcesByName ON Resources (Name, Digest);
@@ -0,0 +1,164 @@
+-- Disable is no longer part of the identity of a rule since rules are enabled and disabled in place.
+-- Rules which only differ by Disable are merged into the first stored rule
+-- which stays enabled when any of the merged rules were enabled.
+CREATE TEMP TABLE RuleMerges AS
+SELECT
+    r.ID AS FromID,
+    NOT r.Disable AS Enabled,
+    (
+        SELECT
+            MIN(r2.ID)
+        FROM
+            Rules AS r2
+        WHERE
+            r2.Hostname IS r.Hostname
+            AND r2.URLPattern IS r.URLPattern
+            AND r2.Scheme IS r.Scheme
+            AND r2.Port IS r.Port
+            AND r2.PathGlob IS r.PathGlob
+            AND r2.AlwaysTrigger IS r.AlwaysTrigger
+    ) AS ToID
+FROM
+    Rules AS r;
+
+DELETE FROM RuleMerges
+WHERE
+    FromID = ToID;
+
+INSERT OR IGNORE INTO
+    RuleLabels (RuleID, Label)
+SELECT
+    m.ToID,
+    l.Label
+FROM
+    RuleLabels AS l
+    JOIN RuleMerges AS m ON l.RuleID = m.FromID;
+
+DELETE FROM RuleLabels
+WHERE
+    RuleID IN (
+        SELECT
+            FromID
+        FROM
+            RuleMerges
+    );
+
+-- Rules have at most one resource so the resources of merged rules are kept only when the first rule has none.
+UPDATE OR IGNORE Resources
+SET
+    RuleID = (
+        SELECT
+            ToID
+        FROM
+            RuleMerges
+        WHERE
+            FromID = Resources.RuleID
+    )
+WHERE
+    RuleID IN (
+        SELECT
+            FromID
+        FROM
+            RuleMerges
+    );
+
+DELETE FROM ResourceLabels
+WHERE
+    ResourceID IN (
+        SELECT
+            ID
+        FROM
+            Resources
+        WHERE
+            RuleID IN (
+                SELECT
+                    FromID
+                FROM
+                    RuleMerges
+            )
+    );
+
+DELETE FROM Resources
+WHERE
+    RuleID IN (
+        SELECT
+            FromID
+        FROM
+            RuleMerges
+    );
+
+DELETE FROM Rules
+WHERE
+    ID IN (
+        SELECT
+            FromID
+        FROM
+            RuleMerges
+    );
+
+UPDATE Rules
+SET
+    Disable = FALSE
+WHERE
+    ID IN (
+        SELECT
+            ToID
+        FROM
+            RuleMerges
+        WHERE
+            Enabled
+    );
+
+DROP TABLE RuleMerges;
+
+CREATE TABLE
+    RulesNew (
+        ID INTEGER NOT NULL,
+        UUID TEXT NOT NULL,
+        Hostname TEXT,
+        URLPattern TEXT,
+        Scheme TEXT,
+        Port INTEGER,
+        PathGlob TEXT,
+        AlwaysTrigger BOOLEAN,
+        Disable BOOLEAN,
+        Policy TEXT CHECK (
+            Policy IS NULL
+            OR (
+                json_valid (Policy)
+                AND json_type (Policy) = 'object'
+            )
+        ),
+        Canonical TEXT CHECK (
+            Canonical IS NULL
+            OR (
+                json_valid (Canonical)
+                AND json_type (Canonical) = 'object'
+            )
+        ),
+        UNIQUE (UUID),
+        UNIQUE (Hostname, URLPattern, Scheme, Port, PathGlob, AlwaysTrigger),
+        PRIMARY KEY (ID AUTOINCREMENT)
+    );
+
+INSERT INTO
+    RulesNew (ID, UUID, Hostname, URLPattern, Scheme, Port, PathGlob, AlwaysTrigger, Disable, Policy, Canonical)
+SELECT
+    ID,
+    UUID,
+    Hostname,
+    URLPattern,
+    Scheme,
+    Port,
+    PathGlob,
+    AlwaysTrigger,
+    Disable,
+    Policy,
+    Canonical
+FROM
+    Rules;
+
+DROP TABLE Rules;
+
+ALTER TABLE RulesNew
+RENAME TO Rules;
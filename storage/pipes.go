@@ -3,12 +3,14 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"iter"
 
 	"github.com/wenooij/nuggit/api"
 	"github.com/wenooij/nuggit/integrity"
 	"github.com/wenooij/nuggit/pipes"
+	"github.com/wenooij/nuggit/status"
 )
 
 type PipeStore struct {
@@ -19,8 +21,62 @@ func NewPipeStore(db *sql.DB) *PipeStore {
 	return &PipeStore{db: db}
 }
 
+// Delete deletes the pipe along with its results and resources.
+//
+// Delete returns ErrFailedPrecondition when other pipes or views depend on the pipe.
 func (s *PipeStore) Delete(ctx context.Context, name integrity.NameDigest) error {
-	return deleteSpec(ctx, s.db, "Pipes", name)
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var pipeID int64
+	if err := tx.QueryRowContext(ctx, "SELECT ID FROM Pipes WHERE Name = ? AND Digest = ? LIMIT 1", name.GetName(), name.GetDigest()).Scan(&pipeID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("pipe not found (%q): %w", integrity.Key(name), status.ErrNotFound)
+		}
+		return err
+	}
+
+	var dependents sql.NullString
+	if err := tx.QueryRowContext(ctx, `SELECT group_concat(Dependent, ', ')
+FROM (
+    SELECT 'pipe ' || p.Name || '@' || p.Digest AS Dependent
+    FROM PipeDependencies AS d
+    JOIN Pipes AS p ON d.PipeID = p.ID
+    WHERE d.ReferencedID = ?1
+    UNION ALL
+    SELECT 'view ' || v.UUID
+    FROM ViewPipes AS vp
+    JOIN Views AS v ON vp.ViewID = v.ID
+    WHERE vp.PipeID = ?1
+)`, pipeID).Scan(&dependents); err != nil {
+		return err
+	}
+	if dependents.Valid {
+		return fmt.Errorf("pipe has dependents (%q): %s: %w", integrity.Key(name), dependents.String, status.ErrFailedPrecondition)
+	}
+
+	// Foreign keys are not enforced so the cascades are deleted here.
+	for _, table := range []string{"Results", "Changes", "PlanPipes", "PipeDependencies"} {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE PipeID = ?", table), pipeID); err != nil {
+			return err
+		}
+	}
+	if err := deleteResourcesTx(ctx, tx, "PipeID", pipeID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM Pipes WHERE ID = ?", pipeID); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (s *PipeStore) DeleteBatch(ctx context.Context, names []integrity.NameDigest) error {
@@ -85,6 +141,23 @@ WHERE p.Name = ?`, pipe.GetName()); err != nil {
 		return err
 	}
 
+	// Add the new version to views with floating columns of the pipe.
+	if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO ViewPipes (ViewID, PipeID)
+SELECT v.ID, p.ID
+FROM Views AS v
+JOIN Pipes AS p ON p.Name = ? AND p.Digest = ?
+WHERE EXISTS (
+    SELECT 1
+    FROM json_each(v.Spec, '$.columns') AS c
+    WHERE json_extract(c.value, '$.pipe') = p.Name
+) OR EXISTS (
+    SELECT 1
+    FROM json_each(v.Spec, '$.agg_columns') AS c
+    WHERE json_extract(c.value, '$.pipe') = p.Name
+)`, pipe.GetName(), pipe.GetDigest()); err != nil {
+		return err
+	}
+
 	// Update disabled on new pipe by name@digest.
 	if _, err := tx.ExecContext(ctx, `DELETE FROM ResourceLabels WHERE ID IN (
 	SELECT rl.ID
@@ -3,31 +3,38 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"time"
 
+	"github.com/wenooij/nuggit/status"
 	"github.com/wenooij/nuggit/trigger"
 )
 
 type PlanStore struct {
-	db *sql.DB
+	db     *sql.DB
+	writer *Writer
 }
 
 func NewPlanStore(db *sql.DB) *PlanStore {
 	return &PlanStore{db: db}
 }
 
-func (s *PlanStore) Store(ctx context.Context, uuid string, plan *trigger.Plan) error {
-	conn, err := s.db.Conn(ctx)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
+// SetWriter queues the writes of the store on the writer.
+func (s *PlanStore) SetWriter(w *Writer) { s.writer = w }
 
+func (s *PlanStore) Store(ctx context.Context, uuid string, plan *trigger.Plan) error {
 	spec, err := marshalNullableJSONString(plan)
 	if err != nil {
 		return err
 	}
+	return writeTx(ctx, s.db, s.writer, func(ctx context.Context, tx *sql.Tx) error {
+		return storePlanTx(ctx, tx, uuid, spec, plan)
+	})
+}
 
-	planResult, err := conn.ExecContext(ctx, "INSERT INTO Plans (UUID, Plan) VALUES (?, ?)", uuid, spec)
+func storePlanTx(ctx context.Context, tx *sql.Tx, uuid string, spec sql.NullString, plan *trigger.Plan) error {
+	planResult, err := tx.ExecContext(ctx, "INSERT INTO Plans (UUID, Plan, CreatedAt) VALUES (?, ?, ?)", uuid, spec, time.Now().Unix())
 	if err != nil {
 		// We don't bother to handle AlreadyExists.
 		// No conflict should be possible here thanks to the UUID.
@@ -38,7 +45,7 @@ func (s *PlanStore) Store(ctx context.Context, uuid string, plan *trigger.Plan)
 		return err
 	}
 
-	prep, err := conn.PrepareContext(ctx, `INSERT OR IGNORE INTO PlanPipes (PlanID, PipeID)
+	prep, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO PlanPipes (PlanID, PipeID)
 SELECT ?, p.ID
 FROM Pipes AS p
 WHERE p.Name = ? AND p.Digest = ? LIMIT 1`)
@@ -61,16 +68,24 @@ WHERE p.Name = ? AND p.Digest = ? LIMIT 1`)
 	return nil
 }
 
-func (s *PlanStore) Finish(ctx context.Context, uuid string) error {
-	conn, err := s.db.Conn(ctx)
-	if err != nil {
-		return err
+func (s *PlanStore) Load(ctx context.Context, uuid string) (*trigger.Plan, error) {
+	var spec sql.NullString
+	if err := s.db.QueryRowContext(ctx, "SELECT Plan FROM Plans WHERE UUID = ? LIMIT 1", uuid).Scan(&spec); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("plan not found (%q): %w", uuid, status.ErrNotFound)
+		}
+		return nil, err
 	}
-	defer conn.Close()
-
-	if _, err := conn.ExecContext(ctx, "UPDATE Plans SET Finished = true WHERE UUID = ?", uuid); err != nil {
-		return err
+	plan := new(trigger.Plan)
+	if err := unmarshalNullableJSONString(spec, plan); err != nil {
+		return nil, err
 	}
+	return plan, nil
+}
 
-	return nil
+func (s *PlanStore) Finish(ctx context.Context, uuid string) error {
+	return writeTx(ctx, s.db, s.writer, func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE Plans SET Finished = true WHERE UUID = ?", uuid)
+		return err
+	})
 }
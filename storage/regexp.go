@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"container/list"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"modernc.org/sqlite"
+)
+
+// regexpCacheSize bounds the number of compiled patterns in regexpCache.
+const regexpCacheSize = 256
+
+// regexpCache holds the most recently used compiled patterns of regexp calls.
+//
+// Patterns come from user queries such as where= so the cache must be bounded.
+var regexpCache = newRegexpLRU(regexpCacheSize)
+
+// regexpLRU is a least recently used cache of compiled patterns.
+type regexpLRU struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List // Of *regexp.Regexp, most recently used first.
+	items map[string]*list.Element
+}
+
+func newRegexpLRU(size int) *regexpLRU {
+	return &regexpLRU{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element, size),
+	}
+}
+
+// Compile returns the cached pattern or compiles and caches it,
+// evicting the least recently used pattern when the cache is full.
+func (c *regexpLRU) Compile(pattern string) (*regexp.Regexp, error) {
+	if re, found := c.get(pattern); found {
+		return re, nil
+	}
+	// Compile without holding the lock.
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, found := c.items[pattern]; found {
+		c.order.MoveToFront(e)
+		return e.Value.(*regexp.Regexp), nil
+	}
+	c.items[pattern] = c.order.PushFront(re)
+	if c.order.Len() > c.size {
+		last := c.order.Remove(c.order.Back()).(*regexp.Regexp)
+		delete(c.items, last.String())
+	}
+	return re, nil
+}
+
+func (c *regexpLRU) get(pattern string) (*regexp.Regexp, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, found := c.items[pattern]
+	if !found {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*regexp.Regexp), true
+}
+
+func (c *regexpLRU) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func init() {
+	// Register regexp(pattern, s) which is used for X REGEXP Y and view expressions.
+	sqlite.MustRegisterDeterministicScalarFunction("regexp", 2, sqliteRegexp)
+}
+
+func sqliteRegexp(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	pattern, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("regexp pattern must be text")
+	}
+	var s string
+	switch v := args[1].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		s = fmt.Sprint(v)
+	}
+	re, err := regexpCache.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString(s), nil
+}
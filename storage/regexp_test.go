@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRegexpLRU(t *testing.T) {
+	c := newRegexpLRU(2)
+	for _, pattern := range []string{"a", "b", "a", "c"} {
+		if _, err := c.Compile(pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := c.Len(); got != 2 {
+		t.Errorf("Len(): got %d, want 2", got)
+	}
+	// The least recently used pattern b was evicted.
+	for pattern, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, found := c.get(pattern); found != want {
+			t.Errorf("get(%q): got found %v, want %v", pattern, found, want)
+		}
+	}
+	if _, err := c.Compile("("); err == nil {
+		t.Errorf("Compile(invalid): want error")
+	}
+
+	for i := range 2 * regexpCacheSize {
+		if _, err := regexpCache.Compile(fmt.Sprintf("^%d$", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := regexpCache.Len(); got > regexpCacheSize {
+		t.Errorf("regexpCache.Len(): got %d, want at most %d", got, regexpCacheSize)
+	}
+}
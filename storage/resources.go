@@ -3,9 +3,13 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"strings"
 
-	"github.com/wenooij/nuggit"
 	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
 )
 
 type ResourceStore struct {
@@ -29,8 +33,8 @@ func (s *ResourceStore) StorePipeResource(ctx context.Context, resource *api.Res
 	}
 	defer tx.Rollback()
 
-	resourceResult, err := tx.ExecContext(ctx, `INSERT INTO Resources (APIVersion, Kind, Version, Description, PipeID)
-SELECT ?, ?, ?, ?, p.ID
+	resourceResult, err := tx.ExecContext(ctx, `INSERT INTO Resources (APIVersion, Kind, Version, Description, Name, Digest, PipeID)
+SELECT ?, ?, ?, ?, p.Name, p.Digest, p.ID
 FROM Pipes AS p
 WHERE p.Name = ? AND p.Digest = ?
 LIMIT 1`,
@@ -73,8 +77,8 @@ func (s *ResourceStore) StoreViewResource(ctx context.Context, resource *api.Res
 	}
 	defer tx.Rollback()
 
-	resourceResult, err := tx.ExecContext(ctx, `INSERT INTO Resources (APIVersion, Kind, Version, Description, ViewID)
-SELECT ?, ?, ?, ?, v.ID
+	resourceResult, err := tx.ExecContext(ctx, `INSERT INTO Resources (APIVersion, Kind, Version, Description, Name, Digest, ViewID)
+SELECT ?, ?, ?, ?, ?, ?, v.ID
 FROM Views AS v
 WHERE v.UUID = ?
 LIMIT 1`,
@@ -82,6 +86,8 @@ LIMIT 1`,
 		resource.GetKind(),
 		resource.GetMetadata().GetVersion(),
 		resource.GetMetadata().GetDescription(),
+		sql.NullString{String: resource.GetName(), Valid: resource.GetName() != ""},
+		sql.NullString{String: resource.GetDigest(), Valid: resource.GetDigest() != ""},
 		viewUUID,
 	)
 	if err != nil {
@@ -120,7 +126,7 @@ func (s *ResourceStore) storeResourceLabels(ctx context.Context, tx *sql.Tx, res
 	return nil
 }
 
-func (s *ResourceStore) StoreRuleResource(ctx context.Context, resource *api.Resource, rule nuggit.Rule) error {
+func (s *ResourceStore) StoreRuleResource(ctx context.Context, resource *api.Resource, rule *api.Rule) error {
 	conn, err := s.db.Conn(ctx)
 	if err != nil {
 		return err
@@ -133,17 +139,18 @@ func (s *ResourceStore) StoreRuleResource(ctx context.Context, resource *api.Res
 	}
 	defer tx.Rollback()
 
-	resourceResult, err := tx.ExecContext(ctx, `INSERT INTO Resources (APIVersion, Kind, Version, Description, RuleID)
-SELECT ?, ?, ?, ?, r.ID
+	resourceResult, err := tx.ExecContext(ctx, `INSERT INTO Resources (APIVersion, Kind, Version, Description, Name, Digest, RuleID)
+SELECT ?, ?, ?, ?, ?, ?, r.ID
 FROM Rules AS r
-WHERE r.Hostname = ? AND r.URLPattern = ?
+WHERE r.UUID = ?
 LIMIT 1`,
 		resource.GetAPIVersion(),
 		resource.GetKind(),
 		resource.GetMetadata().GetVersion(),
 		resource.GetMetadata().GetDescription(),
-		rule.Hostname,
-		rule.URLPattern,
+		sql.NullString{String: resource.GetName(), Valid: resource.GetName() != ""},
+		sql.NullString{String: resource.GetDigest(), Valid: resource.GetDigest() != ""},
+		rule.GetID(),
 	)
 	if err != nil {
 		return handleExecErrors(err, alreadyExistsFunc("rule", resource))
@@ -163,3 +170,171 @@ LIMIT 1`,
 
 	return nil
 }
+
+// ScanResources returns the resources matching the filter in the order they were stored.
+//
+// Resources are read before they are returned since rule specs are loaded separately.
+func (s *ResourceStore) ScanResources(ctx context.Context, filter *api.ResourceFilter) iter.Seq2[*api.Resource, error] {
+	where := []string{"COALESCE(p.ID, v.ID, ru.ID) IS NOT NULL"}
+	var args []any
+	if kind := filter.GetKind(); kind != "" {
+		where = append(where, "r.Kind = ?")
+		args = append(args, kind)
+	}
+	if name := filter.GetName(); name != "" {
+		where = append(where, "COALESCE(p.Name, r.Name) = ?")
+		args = append(args, name)
+	}
+	if digest := filter.GetDigest(); digest != "" {
+		where = append(where, "COALESCE(p.Digest, r.Digest) = ?")
+		args = append(args, digest)
+	}
+	if uuid := filter.GetUUID(); uuid != "" {
+		where = append(where, "COALESCE(v.UUID, ru.UUID) = ?")
+		args = append(args, uuid)
+	}
+	for _, label := range filter.GetLabels() {
+		where = append(where, "EXISTS (SELECT 1 FROM ResourceLabels AS l WHERE l.ResourceID = r.ID AND l.Label = ?)")
+		args = append(args, label)
+	}
+
+	return func(yield func(*api.Resource, error) bool) {
+		rs, err := s.scanResources(ctx, strings.Join(where, " AND "), args)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		rules := NewRuleStore(s.db)
+		for _, r := range rs {
+			if r.Kind == api.KindRule {
+				rule, err := rules.LoadRule(ctx, r.Metadata.UUID)
+				if err != nil {
+					yield(nil, err)
+					return
+				}
+				r.Spec = &rule.Rule
+			}
+			if !yield(r, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (s *ResourceStore) scanResources(ctx context.Context, where string, args []any) ([]*api.Resource, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT
+    r.APIVersion,
+    r.Kind,
+    r.Version,
+    r.Description,
+    COALESCE(p.Name, r.Name),
+    COALESCE(p.Digest, r.Digest),
+    COALESCE(v.UUID, ru.UUID),
+    (SELECT json_group_array(l.Label) FROM ResourceLabels AS l WHERE l.ResourceID = r.ID),
+    COALESCE(p.Spec, v.Spec)
+FROM Resources AS r
+LEFT JOIN Pipes AS p ON r.PipeID = p.ID
+LEFT JOIN Views AS v ON r.ViewID = v.ID
+LEFT JOIN Rules AS ru ON r.RuleID = ru.ID
+WHERE `+where+`
+ORDER BY r.ID`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rs []*api.Resource
+	for rows.Next() {
+		var (
+			apiVersion, version, description, name, digest, uuid, spec sql.NullString
+			kind, labels                                               string
+		)
+		if err := rows.Scan(&apiVersion, &kind, &version, &description, &name, &digest, &uuid, &labels, &spec); err != nil {
+			return nil, err
+		}
+		r := &api.Resource{
+			APIVersion: apiVersion.String,
+			Kind:       kind,
+			Metadata: &api.ResourceMetadata{
+				Name:        name.String,
+				Digest:      digest.String,
+				UUID:        uuid.String,
+				Version:     version.String,
+				Description: description.String,
+			},
+		}
+		if err := json.Unmarshal([]byte(labels), &r.Metadata.Labels); err != nil {
+			return nil, err
+		}
+		if kind != api.KindRule {
+			if r.Spec, err = api.NewResourceSpec(kind); err != nil {
+				return nil, err
+			}
+			if err := unmarshalNullableJSONString(spec, r.Spec); err != nil {
+				return nil, err
+			}
+		}
+		rs = append(rs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// deleteResourcesTx deletes the resources of the pipe, view or rule in the column
+// since Resources and ResourceLabels are not deleted by foreign keys.
+func deleteResourcesTx(ctx context.Context, tx *sql.Tx, column string, id int64) error {
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM ResourceLabels WHERE ResourceID IN (SELECT ID FROM Resources WHERE %s = ?)", column), id); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM Resources WHERE %s = ?", column), id)
+	return err
+}
+
+// backfillRuleResourceDigests sets the digest of rule resources stored without one,
+// such as the rule resources of databases created before resources had a digest.
+//
+// The digest is computed from the stored rule like clients digest rule resources.
+func backfillRuleResourceDigests(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `SELECT r.ID, ru.UUID
+FROM Resources AS r
+JOIN Rules AS ru ON r.RuleID = ru.ID
+WHERE r.Digest IS NULL`)
+	if err != nil {
+		return err
+	}
+	type resourceRule struct {
+		id   int64
+		uuid string
+	}
+	var rs []resourceRule
+	for rows.Next() {
+		var r resourceRule
+		if err := rows.Scan(&r.id, &r.uuid); err != nil {
+			rows.Close()
+			return err
+		}
+		rs = append(rs, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rules := NewRuleStore(db)
+	for _, r := range rs {
+		rule, err := rules.LoadRule(ctx, r.uuid)
+		if err != nil {
+			return err
+		}
+		digest, err := integrity.GetDigest(&api.Resource{Spec: &rule.Rule})
+		if err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, "UPDATE Resources SET Digest = ? WHERE ID = ?", digest, r.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,57 +2,123 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/wenooij/nuggit"
 	"github.com/wenooij/nuggit/api"
 	"github.com/wenooij/nuggit/integrity"
 	"github.com/wenooij/nuggit/points"
+	"github.com/wenooij/nuggit/status"
 )
 
 type ResultStore struct {
-	db *sql.DB
+	db     *sql.DB
+	writer *Writer
 }
 
 func NewResultStore(db *sql.DB) *ResultStore {
 	return &ResultStore{db: db}
 }
 
+// SetWriter queues the writes of the store on the writer.
+func (s *ResultStore) SetWriter(w *Writer) { s.writer = w }
+
 type nextStop struct {
 	next func() (any, error, bool)
 	stop func()
 }
 
-func (s *ResultStore) StoreResults(ctx context.Context, event *api.TriggerEvent, results []api.TriggerResult) error {
-	conn, err := s.db.Conn(ctx)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
+func (s *ResultStore) StoreResults(ctx context.Context, event *api.TriggerEvent, batch *api.TriggerBatch, results []api.TriggerResult) error {
+	return s.storeResults(ctx, event, batch, sliceResults(results), time.Now())
+}
 
-	tx, err := conn.BeginTx(ctx, nil)
-	if err != nil {
-		return err
+// StreamResults stores the results as they are read from the iterator
+// in the same transaction as the event.
+func (s *ResultStore) StreamResults(ctx context.Context, event *api.TriggerEvent, batch *api.TriggerBatch, results iter.Seq2[api.TriggerResult, error]) error {
+	return s.storeResults(ctx, event, batch, results, time.Now())
+}
+
+// storeResults stores the results for the trigger event received at the given time.
+func (s *ResultStore) storeResults(ctx context.Context, event *api.TriggerEvent, batch *api.TriggerBatch, results iter.Seq2[api.TriggerResult, error], receivedAt time.Time) error {
+	return writeTx(ctx, s.db, s.writer, func(ctx context.Context, tx *sql.Tx) error {
+		return s.storeResultsTx(ctx, tx, event, batch, results, receivedAt)
+	})
+}
+
+func sliceResults(results []api.TriggerResult) iter.Seq2[api.TriggerResult, error] {
+	return func(yield func(api.TriggerResult, error) bool) {
+		for _, res := range results {
+			if !yield(res, nil) {
+				return
+			}
+		}
 	}
-	defer tx.Rollback()
+}
 
+func (s *ResultStore) storeResultsTx(ctx context.Context, tx *sql.Tx, event *api.TriggerEvent, batch *api.TriggerBatch, results iter.Seq2[api.TriggerResult, error], receivedAt time.Time) error {
 	var planID int64
-	if err := tx.QueryRowContext(ctx, "SELECT ID FROM Plans WHERE UUID = ? LIMIT 1", event.Plan).Scan(&planID); err != nil {
+	if err := tx.QueryRowContext(ctx, "SELECT ID FROM Plans WHERE UUID = ? LIMIT 1", event.GetPlan()).Scan(&planID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("plan not found (%q): %w", event.GetPlan(), status.ErrNotFound)
+		}
 		return err
 	}
 
-	triggerResult, err := tx.ExecContext(ctx, `INSERT INTO Events (PlanID, Implicit, URL, Timestamp) VALUES (?, ?, ?, ?)`,
-		planID,
-		event.GetImplicit(),
-		event.GetURL(),
-		event.GetTimestamp())
+	if key := batch.GetIdempotencyKey(); key != "" {
+		var found bool
+		if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM EventBatches WHERE PlanID = ? AND IdempotencyKey = ?)", planID, key).Scan(&found); err != nil {
+			return err
+		}
+		if found {
+			return fmt.Errorf("batch already exchanged (%q): %w", key, status.ErrAlreadyExists)
+		}
+	}
+
+	eventID, created, err := s.storeEventTx(ctx, tx, planID, event, receivedAt)
 	if err != nil {
-		return err // No unique columns or AlreadyExists to handle here.
+		return err
 	}
-	eventID, err := triggerResult.LastInsertId()
+	if !created {
+		// Later batches of a repeat event need its own copy of the results.
+		if err := unrepeatEventTx(ctx, tx, eventID); err != nil {
+			return err
+		}
+		// Repeats of the event keep the results they repeated before this batch.
+		if err := snapshotRepeatsTx(ctx, tx, eventID); err != nil {
+			return err
+		}
+	}
+
+	if batch != nil {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO EventBatches (PlanID, EventID, Sequence, IdempotencyKey) VALUES (?, ?, ?, ?)",
+			planID,
+			eventID,
+			sql.NullInt64{Int64: int64(batch.GetSequence()), Valid: batch.HasSequence()},
+			sql.NullString{String: batch.GetIdempotencyKey(), Valid: batch.GetIdempotencyKey() != ""},
+		); err != nil {
+			return handleExecErrors(err, func(error) error {
+				return sequenceConflictTx(ctx, tx, eventID, batch)
+			})
+		}
+	}
+
+	nextSeq, err := tx.PrepareContext(ctx, `SELECT COALESCE(MAX(r.SequenceID) + 1, 0)
+FROM Results AS r
+JOIN Pipes AS p ON r.PipeID = p.ID
+WHERE r.EventID = ? AND p.Name = ? AND p.Digest = ?`)
 	if err != nil {
 		return err
 	}
+	defer nextSeq.Close()
 
 	prep, err := tx.PrepareContext(ctx, `INSERT INTO Results (EventID, PipeID, SequenceID, TypeNumber, Result)
 SELECT ?, p.ID, ?, p.TypeNumber, ?
@@ -63,34 +129,353 @@ LIMIT 1`)
 	}
 	defer prep.Close()
 
-	for _, res := range results {
+	var n int64 // Stored results.
+	for res, err := range results {
+		if err != nil {
+			return err
+		}
+		nameDigest, err := integrity.ParseNameDigest(res.Pipe)
+		if err != nil {
+			return err
+		}
+		// Later batches append to the results already stored for the event.
+		var seq int
+		if err := nextSeq.QueryRowContext(ctx, eventID, nameDigest.GetName(), nameDigest.GetDigest()).Scan(&seq); err != nil {
+			return err
+		}
 		var p nuggit.Point
 		p.Scalar = res.Scalar
-		var seq int
 		for v, err := range points.Values(p, res.Result) {
 			if err != nil {
 				return err
 			}
-			nameDigest, err := integrity.ParseNameDigest(res.Pipe)
-			if err != nil {
-				return err
-			}
-			if _, err := prep.ExecContext(ctx,
+			r, err := prep.ExecContext(ctx,
 				eventID,
 				seq,
 				v,
 				nameDigest.GetName(),
 				nameDigest.GetDigest(),
-			); err != nil {
+			)
+			if err != nil {
 				return err
 			}
+			stored, err := r.RowsAffected()
+			if err != nil {
+				return err
+			}
+			n += stored // Results for unknown pipes are not stored.
 			seq++
 		}
 	}
 
-	if err := tx.Commit(); err != nil {
+	// Every batch which stores results may complete the event so dedupe is checked again.
+	if err := dedupeEventTx(ctx, tx, eventID, n > 0); err != nil {
+		return err
+	}
+
+	if err := recordChangesTx(ctx, tx, eventID); err != nil {
 		return err
 	}
 
-	return nil
+	return refreshMaterializedViewsTx(ctx, tx, "?1", eventID)
+}
+
+// storeEventTx returns the ID of the event identified by the event key or inserts a new one.
+func (s *ResultStore) storeEventTx(ctx context.Context, tx *sql.Tx, planID int64, event *api.TriggerEvent, receivedAt time.Time) (eventID int64, created bool, err error) {
+	if key := event.GetEvent(); key != "" {
+		err := tx.QueryRowContext(ctx, "SELECT ID FROM Events WHERE PlanID = ? AND EventKey = ? LIMIT 1", planID, key).Scan(&eventID)
+		if err == nil {
+			return eventID, false, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, false, err
+		}
+	}
+
+	eventResult, err := tx.ExecContext(ctx, `INSERT INTO Events (PlanID, Implicit, URL, RawURL, Timestamp, ReceivedAt, EventKey) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		planID,
+		event.GetImplicit(),
+		event.GetURL(),
+		event.GetRawURL(),
+		event.GetTimestamp(),
+		receivedAt.Unix(),
+		sql.NullString{String: event.GetEvent(), Valid: event.GetEvent() != ""})
+	if err != nil {
+		return 0, false, err // Existing event keys were handled above.
+	}
+	eventID, err = eventResult.LastInsertId()
+	return eventID, err == nil, err
+}
+
+// dedupeEventTx stores the content hash of the event results.
+//
+// When dedupe is set and the results are identical to the previous event for the URL,
+// the results are deleted and the event refers to the earlier event with the results.
+func dedupeEventTx(ctx context.Context, tx *sql.Tx, eventID int64, dedupe bool) error {
+	hash, err := contentHashTx(ctx, tx, eventID)
+	if err != nil {
+		return err
+	}
+	if dedupe {
+		var (
+			prevID       int64
+			prevHash     sql.NullString
+			prevRepeatOf sql.NullInt64
+		)
+		err := tx.QueryRowContext(ctx, `SELECT e2.ID, e2.ContentHash, e2.RepeatOf
+FROM Events AS e
+JOIN Events AS e2 ON e2.URL = e.URL AND e2.ID < e.ID
+WHERE e.ID = ? AND e.URL != ''
+ORDER BY e2.ID DESC
+LIMIT 1`, eventID).Scan(&prevID, &prevHash, &prevRepeatOf)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err == nil && prevHash.String == hash {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM Results WHERE EventID = ?", eventID); err != nil {
+				return err
+			}
+			repeatOf := prevID
+			if prevRepeatOf.Valid {
+				repeatOf = prevRepeatOf.Int64
+			}
+			_, err := tx.ExecContext(ctx, "UPDATE Events SET ContentHash = ?, RepeatOf = ? WHERE ID = ?", hash, repeatOf, eventID)
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE Events SET ContentHash = ? WHERE ID = ?", hash, eventID)
+	return err
+}
+
+// contentHashTx returns a hash of the pipes and values of the event results.
+func contentHashTx(ctx context.Context, tx *sql.Tx, eventID int64) (string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT p.Name, p.Digest, r.SequenceID, r.TypeNumber, r.Result
+FROM Results AS r
+JOIN Pipes AS p ON r.PipeID = p.ID
+WHERE r.EventID = ?
+ORDER BY p.Name, p.Digest, r.SequenceID`, eventID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	for rows.Next() {
+		var (
+			name, digest string
+			sequence     int
+			typeNumber   sql.NullInt64
+			value        any
+		)
+		if err := rows.Scan(&name, &digest, &sequence, &typeNumber, &value); err != nil {
+			return "", err
+		}
+		if err := enc.Encode([]any{name, digest, sequence, typeNumber.Int64, value}); err != nil {
+			return "", err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sequenceConflictTx returns the error for a batch whose sequence was already stored for the event.
+//
+// It is a replay when the idempotency keys match.
+func sequenceConflictTx(ctx context.Context, tx *sql.Tx, eventID int64, batch *api.TriggerBatch) error {
+	var storedKey sql.NullString
+	if err := tx.QueryRowContext(ctx, "SELECT IdempotencyKey FROM EventBatches WHERE EventID = ? AND Sequence = ? LIMIT 1", eventID, batch.GetSequence()).Scan(&storedKey); err != nil {
+		return err
+	}
+	if storedKey.String != batch.GetIdempotencyKey() {
+		return fmt.Errorf("batch sequence was exchanged with a different idempotency key (%d): %w", batch.GetSequence(), status.ErrFailedPrecondition)
+	}
+	return fmt.Errorf("batch already exchanged (%d): %w", batch.GetSequence(), status.ErrAlreadyExists)
+}
+
+// unrepeatEventTx copies the results of the earlier event to a repeat event
+// so that later batches append to the results.
+func unrepeatEventTx(ctx context.Context, tx *sql.Tx, eventID int64) error {
+	if _, err := tx.ExecContext(ctx, `INSERT INTO Results (EventID, PipeID, SequenceID, TypeNumber, Result)
+SELECT e.ID, r.PipeID, r.SequenceID, r.TypeNumber, r.Result
+FROM Events AS e
+JOIN Results AS r ON r.EventID = e.RepeatOf
+WHERE e.ID = ?`, eventID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "UPDATE Events SET RepeatOf = NULL WHERE ID = ?", eventID)
+	return err
+}
+
+// snapshotRepeatsTx copies the results of the event to the events which repeat it
+// so that they no longer see the results of later batches of the event.
+func snapshotRepeatsTx(ctx context.Context, tx *sql.Tx, eventID int64) error {
+	if _, err := tx.ExecContext(ctx, `INSERT INTO Results (EventID, PipeID, SequenceID, TypeNumber, Result)
+SELECT e.ID, r.PipeID, r.SequenceID, r.TypeNumber, r.Result
+FROM Events AS e
+JOIN Results AS r ON r.EventID = e.RepeatOf
+WHERE e.RepeatOf = ?`, eventID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "UPDATE Events SET RepeatOf = NULL WHERE RepeatOf = ?", eventID)
+	return err
+}
+
+// ResultFilter selects the results returned by ScanResults.
+//
+// Empty fields match all results.
+type ResultFilter struct {
+	// Pipes matches results by pipe name and optional digest.
+	Pipes []integrity.NameDigest
+	// View matches results for the pipes in the view by name or UUID.
+	View string
+	// URLPattern is an RE2 pattern matched against the event URL.
+	URLPattern string
+	// Since and Until match results received in [Since, Until).
+	Since, Until time.Time
+}
+
+// ResultRow is a single result value along with its pipe and event.
+type ResultRow struct {
+	Plan       string
+	Event      int64
+	URL        string
+	Timestamp  time.Time
+	ReceivedAt time.Time
+	Pipe       string
+	Point      nuggit.Point
+	Sequence   int
+	Value      any
+}
+
+// ScanResults returns an iterator over the result values matching the filter
+// ordered by event and pipe. Rows are read incrementally from the database.
+func (s *ResultStore) ScanResults(ctx context.Context, filter *ResultFilter) iter.Seq2[*ResultRow, error] {
+	if filter == nil {
+		filter = new(ResultFilter)
+	}
+	var urlPattern *regexp.Regexp
+	if filter.URLPattern != "" {
+		var err error
+		if urlPattern, err = regexp.Compile(filter.URLPattern); err != nil {
+			return seq2Error[*ResultRow](fmt.Errorf("url pattern is not a valid re2 (%q): %v: %w", filter.URLPattern, err, status.ErrInvalidArgument))
+		}
+	}
+
+	var (
+		where []string
+		args  []any
+	)
+	if len(filter.Pipes) > 0 {
+		var pipes []string
+		for _, pipe := range filter.Pipes {
+			pipes = append(pipes, "(p.Name = ? AND (? = '' OR p.Digest = ?))")
+			args = append(args, pipe.GetName(), pipe.GetDigest(), pipe.GetDigest())
+		}
+		where = append(where, "("+strings.Join(pipes, " OR ")+")")
+	}
+	if filter.View != "" {
+		where = append(where, `r.PipeID IN (
+    SELECT vp.PipeID
+    FROM ViewPipes AS vp
+    JOIN Views AS v ON vp.ViewID = v.ID
+    WHERE v.Name = ? OR v.UUID = ?
+)`)
+		args = append(args, filter.View, filter.View)
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "e.ReceivedAt >= ?")
+		args = append(args, filter.Since.Unix())
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "e.ReceivedAt < ?")
+		args = append(args, filter.Until.Unix())
+	}
+	query := `SELECT
+    pl.UUID,
+    e.ID,
+    e.URL,
+    e.Timestamp,
+    e.ReceivedAt,
+    p.Name,
+    p.Digest,
+    r.TypeNumber,
+    r.SequenceID,
+    r.Result
+FROM Results AS r
+JOIN Events AS e ON r.EventID = e.ID
+JOIN Plans AS pl ON e.PlanID = pl.ID
+JOIN Pipes AS p ON r.PipeID = p.ID
+`
+	if len(where) > 0 {
+		query += "WHERE " + strings.Join(where, " AND ") + "\n"
+	}
+	query += "ORDER BY e.ID, p.Name, p.Digest, r.SequenceID"
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return seq2Error[*ResultRow](err)
+	}
+
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		conn.Close()
+		return seq2Error[*ResultRow](err)
+	}
+
+	return func(yield func(*ResultRow, error) bool) {
+		defer conn.Close()
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				plan, name, digest sql.NullString
+				u                  sql.NullString
+				timestamp          sql.NullTime
+				receivedAt         sql.NullInt64
+				typeNumber         sql.NullInt64
+				value              any
+			)
+			r := new(ResultRow)
+			if err := rows.Scan(&plan, &r.Event, &u, &timestamp, &receivedAt, &name, &digest, &typeNumber, &r.Sequence, &value); err != nil {
+				yield(nil, err)
+				return
+			}
+			if urlPattern != nil && !urlPattern.MatchString(u.String) {
+				continue
+			}
+			r.Plan = plan.String
+			r.URL = u.String
+			r.Timestamp = timestamp.Time
+			if receivedAt.Valid {
+				r.ReceivedAt = time.Unix(receivedAt.Int64, 0)
+			}
+			r.Pipe = fmt.Sprint(integrity.KeyLit(name.String, digest.String))
+			r.Point = nuggit.NewPointFromNumber(int(typeNumber.Int64))
+			r.Value = resultValue(r.Point, value)
+			if !yield(r, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// resultValue converts the stored result to the Go type for the point.
+func resultValue(p nuggit.Point, value any) any {
+	switch v := value.(type) {
+	case int64:
+		if p.Scalar == nuggit.Bool {
+			return v != 0
+		}
+	case []byte:
+		if p.Scalar == nuggit.String {
+			return string(v)
+		}
+	}
+	return value
 }
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/wenooij/nuggit/integrity"
+)
+
+func TestScanResults(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if err := InitDB(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	if _, err := db.ExecContext(ctx, `INSERT INTO Pipes (ID, Name, Digest, TypeNumber) VALUES (1, 'title', 'ab', 1), (2, 'instock', 'cd', 2);
+INSERT INTO Plans (ID, UUID) VALUES (1, '00000000-0000-0000-0000-000000000001');
+INSERT INTO Events (ID, PlanID, URL, ReceivedAt) VALUES (1, 1, 'https://a.example/', ?), (2, 1, 'https://b.example/', ?);
+INSERT INTO Results (EventID, PipeID, SequenceID, TypeNumber, Result) VALUES (1, 1, 0, 1, 'A'), (1, 2, 0, 2, TRUE), (2, 1, 0, 1, 'B');`,
+		now.Add(-time.Hour).Unix(), now.Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		filter *ResultFilter
+		want   []any
+	}{
+		{"all", nil, []any{true, "A", "B"}},
+		{"pipe", &ResultFilter{Pipes: []integrity.NameDigest{integrity.KeyLit("title", "")}}, []any{"A", "B"}},
+		{"url pattern", &ResultFilter{URLPattern: `b\.example`}, []any{"B"}},
+		{"since", &ResultFilter{Since: now.Add(-time.Minute)}, []any{"B"}},
+		{"until", &ResultFilter{Until: now.Add(-time.Minute)}, []any{true, "A"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []any
+			for r, err := range NewResultStore(db).ScanResults(ctx, tc.filter) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, r.Value)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("ScanResults(): got %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("ScanResults(): got %v, want %v", got, tc.want)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,396 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/wenooij/nuggit/status"
+)
+
+// RetentionPolicy configures which plans, events and results are garbage collected.
+//
+// Durations use the time.ParseDuration format, such as "720h".
+// Empty durations and zero counts keep data indefinitely.
+type RetentionPolicy struct {
+	// MaxAge is the maximum age of results for pipes without a specific max age.
+	MaxAge string `json:"max_age,omitempty"`
+	// PipeMaxAge is the maximum age of results by pipe name.
+	PipeMaxAge map[string]string `json:"pipe_max_age,omitempty"`
+	// ViewMaxAge is the maximum age of results for the pipes in a view by view name or UUID.
+	//
+	// When a pipe has several specific max ages, the longest one is used.
+	ViewMaxAge map[string]string `json:"view_max_age,omitempty"`
+	// UnexchangedPlanAge is the age after which plans without any events are dropped.
+	UnexchangedPlanAge string `json:"unexchanged_plan_age,omitempty"`
+	// MaxEventsPerURL keeps only the latest events for each canonical URL.
+	MaxEventsPerURL int `json:"max_events_per_url,omitempty"`
+}
+
+// DefaultRetentionPolicy drops plans which are not exchanged within a day
+// and keeps everything else.
+func DefaultRetentionPolicy() *RetentionPolicy {
+	return &RetentionPolicy{UnexchangedPlanAge: "24h"}
+}
+
+// LoadRetentionPolicy reads a JSON retention policy from the file.
+func LoadRetentionPolicy(path string) (*RetentionPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := new(RetentionPolicy)
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("failed to parse retention policy (%q): %v: %w", path, err, status.ErrInvalidArgument)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *RetentionPolicy) Validate() error {
+	if _, err := parseRetentionAge(p.MaxAge); err != nil {
+		return err
+	}
+	for _, ages := range []map[string]string{p.PipeMaxAge, p.ViewMaxAge} {
+		for _, age := range ages {
+			if _, err := parseRetentionAge(age); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := parseRetentionAge(p.UnexchangedPlanAge); err != nil {
+		return err
+	}
+	if p.MaxEventsPerURL < 0 {
+		return fmt.Errorf("max events per url must not be negative (%d): %w", p.MaxEventsPerURL, status.ErrInvalidArgument)
+	}
+	return nil
+}
+
+func parseRetentionAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("retention age must be a positive duration (%q): %w", s, status.ErrInvalidArgument)
+	}
+	return d, nil
+}
+
+// GCReport counts the rows deleted by garbage collection.
+type GCReport struct {
+	Results  int64 `json:"results,omitempty"`
+	Events   int64 `json:"events,omitempty"`
+	Plans    int64 `json:"plans,omitempty"`
+	Vacuumed bool  `json:"vacuumed,omitempty"`
+}
+
+// CollectGarbage deletes the data which is not retained by the policy at the given time.
+//
+// Results older than the max age of their pipe are deleted first.
+// Events without results are deleted once they are older than the max age of every pipe,
+// unless they repeat an event which is still stored.
+// Only the latest MaxEventsPerURL events are kept for each URL.
+// Finally, plans without events older than UnexchangedPlanAge are deleted.
+// The rows of materialized views are refreshed for the events of deleted results.
+//
+// When dryRun is set, the deletions are rolled back and only reported.
+// Otherwise free pages are reclaimed using PRAGMA incremental_vacuum
+// when the database uses incremental auto vacuum, or VACUUM when vacuum is set.
+func CollectGarbage(ctx context.Context, db *sql.DB, policy *RetentionPolicy, now time.Time, dryRun, vacuum bool) (*GCReport, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer conn.ExecContext(ctx, "DROP TRIGGER IF EXISTS temp.GCRefreshResults")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Track the events of deleted results to refresh materialized views.
+	if _, err := tx.ExecContext(ctx, `CREATE TEMP TABLE IF NOT EXISTS GCRefresh (ID INTEGER PRIMARY KEY);
+CREATE TEMP TRIGGER IF NOT EXISTS GCRefreshResults AFTER DELETE ON Results BEGIN
+    INSERT OR IGNORE INTO GCRefresh (ID) VALUES (OLD.EventID);
+END;`); err != nil {
+		return nil, err
+	}
+
+	report := new(GCReport)
+	eventAge, err := deleteExpiredResultsTx(ctx, tx, policy, now, report)
+	if err != nil {
+		return nil, err
+	}
+	if eventAge > 0 {
+		if err := deleteEventsTx(ctx, tx, `SELECT e.ID
+FROM Events AS e
+WHERE e.ReceivedAt < ? AND NOT EXISTS (
+    SELECT 1
+    FROM Results AS r
+    WHERE r.EventID = e.ID
+) AND NOT EXISTS (
+    SELECT 1
+    FROM Events AS t
+    WHERE t.ID = e.RepeatOf
+)`, report, now.Add(-eventAge).Unix()); err != nil {
+			return nil, err
+		}
+	}
+	if n := policy.MaxEventsPerURL; n > 0 {
+		if err := deleteEventsTx(ctx, tx, `SELECT e.ID
+FROM (
+    SELECT
+        ID,
+        ROW_NUMBER() OVER (
+            PARTITION BY URL
+            ORDER BY ReceivedAt DESC, ID DESC
+        ) AS N
+    FROM Events
+    WHERE URL IS NOT NULL
+) AS e
+WHERE e.N > ?`, report, n); err != nil {
+			return nil, err
+		}
+	}
+	if age, _ := parseRetentionAge(policy.UnexchangedPlanAge); age > 0 {
+		if err := deletePlansTx(ctx, tx, now.Add(-age).Unix(), report); err != nil {
+			return nil, err
+		}
+	}
+	if err := refreshMaterializedViewsTx(ctx, tx, "SELECT ID FROM GCRefresh"); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM GCRefresh"); err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	var autoVacuum int
+	if err := conn.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&autoVacuum); err != nil {
+		return nil, err
+	}
+	switch {
+	case autoVacuum == 2: // Incremental.
+		if _, err := conn.ExecContext(ctx, "PRAGMA incremental_vacuum"); err != nil {
+			return nil, err
+		}
+		report.Vacuumed = true
+	case vacuum:
+		if _, err := conn.ExecContext(ctx, "VACUUM"); err != nil {
+			return nil, err
+		}
+		report.Vacuumed = true
+	}
+	return report, nil
+}
+
+// deleteExpiredResultsTx deletes the results older than the max age of their pipe
+// and returns the longest max age of any pipe.
+//
+// It returns 0 when the results of some pipes are kept indefinitely.
+func deleteExpiredResultsTx(ctx context.Context, tx *sql.Tx, policy *RetentionPolicy, now time.Time, report *GCReport) (time.Duration, error) {
+	// Find the specific max age for each pipe ID.
+	maxAges := make(map[int64]time.Duration)
+	setAge := func(query, key, age string) error {
+		d, _ := parseRetentionAge(age)
+		rows, err := tx.QueryContext(ctx, query, key, key)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var pipeID int64
+			if err := rows.Scan(&pipeID); err != nil {
+				return err
+			}
+			maxAges[pipeID] = max(maxAges[pipeID], d)
+		}
+		return rows.Err()
+	}
+	for name, age := range policy.PipeMaxAge {
+		if err := setAge("SELECT ID FROM Pipes WHERE Name = ? OR Name = ?", name, age); err != nil {
+			return 0, err
+		}
+	}
+	for view, age := range policy.ViewMaxAge {
+		if err := setAge(`SELECT vp.PipeID
+FROM ViewPipes AS vp
+JOIN Views AS v ON vp.ViewID = v.ID
+WHERE v.Name = ? OR v.UUID = ?`, view, age); err != nil {
+			return 0, err
+		}
+	}
+
+	prep, err := tx.PrepareContext(ctx, `DELETE FROM Results
+WHERE PipeID = ? AND EventID IN (
+    SELECT ID
+    FROM Events
+    WHERE ReceivedAt < ?
+)`)
+	if err != nil {
+		return 0, err
+	}
+	defer prep.Close()
+
+	for pipeID, age := range maxAges {
+		res, err := prep.ExecContext(ctx, pipeID, now.Add(-age).Unix())
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		report.Results += n
+	}
+
+	pipeIDs := make([]any, 0, len(maxAges))
+	for pipeID := range maxAges {
+		pipeIDs = append(pipeIDs, pipeID)
+	}
+	maxAge, _ := parseRetentionAge(policy.MaxAge)
+	for _, age := range maxAges {
+		maxAge = max(maxAge, age)
+	}
+	if age, _ := parseRetentionAge(policy.MaxAge); age > 0 {
+		res, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM Results
+WHERE PipeID NOT IN (%s) AND EventID IN (
+    SELECT ID
+    FROM Events
+    WHERE ReceivedAt < ?
+)`, placeholders(len(pipeIDs))), append(pipeIDs, now.Add(-age).Unix())...)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		report.Results += n
+	} else {
+		// Pipes without a specific max age keep their results.
+		var unlimited bool
+		if err := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM Pipes WHERE ID NOT IN (%s))", placeholders(len(pipeIDs))), pipeIDs...).Scan(&unlimited); err != nil {
+			return 0, err
+		}
+		if unlimited {
+			return 0, nil
+		}
+	}
+	return maxAge, nil
+}
+
+// deleteEventsTx deletes the events selected by the query along with their results and batches.
+func deleteEventsTx(ctx context.Context, tx *sql.Tx, query string, report *GCReport, args ...any) error {
+	// Foreign keys may not be enforced so delete dependent rows explicitly.
+	if _, err := tx.ExecContext(ctx, "CREATE TEMP TABLE IF NOT EXISTS GCEvents (ID INTEGER PRIMARY KEY)"); err != nil {
+		return err
+	}
+	defer tx.ExecContext(ctx, "DELETE FROM GCEvents")
+	if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO GCEvents (ID) "+query, args...); err != nil {
+		return err
+	}
+
+	if err := promoteRepeatsTx(ctx, tx); err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM Results WHERE EventID IN (SELECT ID FROM GCEvents)")
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	report.Results += n
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM EventBatches WHERE EventID IN (SELECT ID FROM GCEvents)"); err != nil {
+		return err
+	}
+
+	res, err = tx.ExecContext(ctx, "DELETE FROM Events WHERE ID IN (SELECT ID FROM GCEvents)")
+	if err != nil {
+		return err
+	}
+	if n, err = res.RowsAffected(); err != nil {
+		return err
+	}
+	report.Events += n
+	return nil
+}
+
+// promoteRepeatsTx moves the results of deleted events to their first remaining repeat event
+// which becomes the event referred to by later repeats.
+//
+// Promoted events are added to GCRefresh to refresh materialized views.
+func promoteRepeatsTx(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, "CREATE TEMP TABLE IF NOT EXISTS GCPromoted (OldID INTEGER PRIMARY KEY, NewID INTEGER NOT NULL)"); err != nil {
+		return err
+	}
+	defer tx.ExecContext(ctx, "DELETE FROM GCPromoted")
+	_, err := tx.ExecContext(ctx, `INSERT INTO GCPromoted (OldID, NewID)
+SELECT e.RepeatOf, MIN(e.ID)
+FROM Events AS e
+WHERE e.RepeatOf IN (SELECT ID FROM GCEvents) AND e.ID NOT IN (SELECT ID FROM GCEvents)
+GROUP BY e.RepeatOf;
+UPDATE Results
+SET EventID = (SELECT NewID FROM GCPromoted WHERE OldID = Results.EventID)
+WHERE EventID IN (SELECT OldID FROM GCPromoted);
+UPDATE Events
+SET RepeatOf = (SELECT NewID FROM GCPromoted WHERE OldID = Events.RepeatOf)
+WHERE RepeatOf IN (SELECT OldID FROM GCPromoted);
+UPDATE Events
+SET RepeatOf = NULL
+WHERE ID IN (SELECT NewID FROM GCPromoted);
+INSERT OR IGNORE INTO GCRefresh (ID)
+SELECT OldID FROM GCPromoted
+UNION
+SELECT NewID FROM GCPromoted;`)
+	return err
+}
+
+func deletePlansTx(ctx context.Context, tx *sql.Tx, before int64, report *GCReport) error {
+	const unexchanged = `SELECT p.ID
+FROM Plans AS p
+WHERE p.CreatedAt < ? AND NOT EXISTS (
+    SELECT 1
+    FROM Events AS e
+    WHERE e.PlanID = p.ID
+)`
+	if _, err := tx.ExecContext(ctx, "DELETE FROM PlanPipes WHERE PlanID IN ("+unexchanged+")", before); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM EventBatches WHERE PlanID IN ("+unexchanged+")", before); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM Plans WHERE ID IN ("+unexchanged+")", before)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	report.Plans += n
+	return nil
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if err := InitDB(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	ago := func(d time.Duration) int64 { return now.Add(-d).Unix() }
+	for _, stmt := range []struct {
+		query string
+		args  []any
+	}{
+		{"INSERT INTO Pipes (ID, Name, Digest) VALUES (1, 'short', 'ab'), (2, 'long', 'cd')", nil},
+		{"INSERT INTO Plans (ID, UUID, CreatedAt) VALUES (1, '00000000-0000-0000-0000-000000000001', ?), (2, '00000000-0000-0000-0000-000000000002', ?), (3, '00000000-0000-0000-0000-000000000003', ?)",
+			[]any{ago(72 * time.Hour), ago(72 * time.Hour), now.Unix()}},
+		{"INSERT INTO PlanPipes (PlanID, PipeID) VALUES (1, 1), (2, 1)", nil},
+		{"INSERT INTO Events (ID, PlanID, URL, ReceivedAt) VALUES (1, 1, 'https://a/', ?), (2, 1, 'https://a/', ?), (3, 1, 'https://a/', ?), (4, 1, 'https://a/', ?)",
+			[]any{ago(30 * time.Hour), ago(72 * time.Hour), ago(10 * time.Minute), ago(5 * time.Minute)}},
+		{"INSERT INTO Results (EventID, PipeID, SequenceID) VALUES (1, 1, 0), (1, 2, 0), (2, 2, 0), (3, 1, 0), (4, 1, 0)", nil},
+		// Event 5 repeats event 4 and event 6 is within the max age of the long pipe.
+		{"INSERT INTO Events (ID, PlanID, URL, ReceivedAt, RepeatOf) VALUES (5, 1, 'https://b/', ?, 4), (6, 1, 'https://c/', ?, NULL)",
+			[]any{ago(72 * time.Hour), ago(30 * time.Hour)}},
+	} {
+		if _, err := db.ExecContext(ctx, stmt.query, stmt.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policy := &RetentionPolicy{
+		MaxAge:             "1h",
+		PipeMaxAge:         map[string]string{"long": "48h"},
+		UnexchangedPlanAge: "24h",
+		MaxEventsPerURL:    2,
+	}
+	// Event 2 expires with its only result and event 1 is past the latest 2 events for the URL.
+	want := GCReport{Results: 3, Events: 2, Plans: 1}
+
+	count := func(table string) int {
+		var n int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	report, err := CollectGarbage(ctx, db, policy, now, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *report != want {
+		t.Errorf("CollectGarbage(dryRun): got %+v, want %+v", *report, want)
+	}
+	if n := count("Results"); n != 5 {
+		t.Errorf("CollectGarbage(dryRun): got %d results after, want 5", n)
+	}
+
+	report, err = CollectGarbage(ctx, db, policy, now, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *report != want {
+		t.Errorf("CollectGarbage: got %+v, want %+v", *report, want)
+	}
+	for table, want := range map[string]int{"Results": 2, "Events": 4, "Plans": 2, "PlanPipes": 1} {
+		if n := count(table); n != want {
+			t.Errorf("CollectGarbage: got %d rows in %s, want %d", n, table, want)
+		}
+	}
+}
@@ -3,25 +3,34 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"iter"
+	"log"
 	"net/url"
-	"regexp"
+	"slices"
+	"sync"
 
 	"github.com/wenooij/nuggit"
 	"github.com/wenooij/nuggit/api"
 	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/rules"
+	"github.com/wenooij/nuggit/status"
 )
 
 type RuleStore struct {
 	db *sql.DB
+
+	mu      sync.Mutex
+	matcher *rules.Matcher // Built lazily and invalidated on rule updates.
+	gen     int64
 }
 
 func NewRuleStore(db *sql.DB) *RuleStore {
-	return &RuleStore{db}
+	return &RuleStore{db: db}
 }
 
-func (s *RuleStore) StoreRule(ctx context.Context, rule nuggit.Rule) error {
+func (s *RuleStore) StoreRule(ctx context.Context, rule *api.Rule) error {
 	conn, err := s.db.Conn(ctx)
 	if err != nil {
 		return err
@@ -34,44 +43,282 @@ func (s *RuleStore) StoreRule(ctx context.Context, rule nuggit.Rule) error {
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO Rules (Hostname, URLPattern, AlwaysTrigger, Disable) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING",
-		rule.Hostname,
-		rule.URLPattern,
-		rule.AlwaysTrigger,
-		rule.Disable); err != nil {
+	if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO Rules (UUID, Hostname, URLPattern, Scheme, Port, PathGlob, AlwaysTrigger, Disable) VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+		append(append([]any{rule.GetID()}, ruleKeyArgs(rule.Rule)...), rule.Disable)...); err != nil {
 		return err
 	}
 
-	if _, err := tx.ExecContext(ctx, `DELETE FROM RuleLabels WHERE RuleID IN (
-	SELECT r.ID
-	FROM Rules AS r
-	WHERE r.Hostname = ? AND r.URLPattern = ? AND r.AlwaysTrigger = ? AND Disable = ?
-)`, rule.Hostname, rule.URLPattern, rule.AlwaysTrigger, rule.Disable); err != nil {
+	// Use the ID of the existing rule when the rule was already stored.
+	var ruleID int64
+	var uuid string
+	if err := tx.QueryRowContext(ctx, "SELECT r.ID, r.UUID FROM Rules AS r WHERE "+ruleKeyWhere+" LIMIT 1",
+		ruleKeyArgs(rule.Rule)...).Scan(&ruleID, &uuid); err != nil {
 		return err
 	}
+	rule.ID = uuid
 
-	prep, err := conn.PrepareContext(ctx, `INSERT INTO RuleLabels (RuleID, Label)
-SELECT r.ID, ?
-FROM Rules AS r
-WHERE r.Hostname = ? AND r.URLPattern = ? AND r.AlwaysTrigger = ? AND Disable = ?
-LIMIT 1`)
+	// The resource of a stored rule is replaced when the rule is stored again.
+	if err := deleteResourcesTx(ctx, tx, "RuleID", ruleID); err != nil {
+		return err
+	}
+	if err := updateRuleTx(ctx, tx, ruleID, rule.Rule); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.invalidateMatcher()
+	return nil
+}
+
+func (s *RuleStore) UpdateRule(ctx context.Context, rule *api.Rule) error {
+	conn, err := s.db.Conn(ctx)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	for _, label := range rule.Labels {
-		if _, err := prep.ExecContext(ctx, label, rule.Hostname, rule.URLPattern, rule.AlwaysTrigger, rule.Disable); err != nil {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRuleTx(ctx, tx, rule); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.invalidateMatcher()
+	return nil
+}
+
+// UpdateRuleFunc loads the rule, applies update and replaces the stored rule in one transaction.
+func (s *RuleStore) UpdateRuleFunc(ctx context.Context, id string, update func(*nuggit.Rule)) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, ruleQuery+"WHERE r.UUID = ? LIMIT 1", id)
+	if err != nil {
+		return err
+	}
+	var rule *api.Rule
+	for r, err := range scanRuleRows(rows) {
+		if err != nil {
 			return err
 		}
+		rule = r
+	}
+	if rule == nil {
+		return fmt.Errorf("rule not found (%q): %w", id, status.ErrNotFound)
+	}
+
+	update(&rule.Rule)
+	if err := replaceRuleTx(ctx, tx, rule); err != nil {
+		return err
 	}
 
 	if err := tx.Commit(); err != nil {
 		return err
 	}
 
+	s.invalidateMatcher()
+	return nil
+}
+
+// replaceRuleTx replaces the stored rule and its labels in place.
+func replaceRuleTx(ctx context.Context, tx *sql.Tx, rule *api.Rule) error {
+	ruleID, err := lookupRuleID(ctx, tx, rule.GetID())
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE Rules
+SET Hostname = ?, URLPattern = ?, Scheme = ?, Port = ?, PathGlob = ?, AlwaysTrigger = ?, Disable = ?
+WHERE ID = ?`, append(ruleKeyArgs(rule.Rule), rule.Disable, ruleID)...); err != nil {
+		return handleExecErrors(err, func(error) error {
+			return fmt.Errorf("failed to update rule (%q): the same rule is already stored: %w", rule.GetID(), status.ErrAlreadyExists)
+		})
+	}
+
+	return updateRuleTx(ctx, tx, ruleID, rule.Rule)
+}
+
+func lookupRuleID(ctx context.Context, tx *sql.Tx, id string) (int64, error) {
+	var ruleID int64
+	if err := tx.QueryRowContext(ctx, "SELECT ID FROM Rules WHERE UUID = ? LIMIT 1", id).Scan(&ruleID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("rule not found (%q): %w", id, status.ErrNotFound)
+		}
+		return 0, err
+	}
+	return ruleID, nil
+}
+
+// updateRuleTx replaces the policy, canonicalization, enabled state and labels of the stored rule.
+func updateRuleTx(ctx context.Context, tx *sql.Tx, ruleID int64, rule nuggit.Rule) error {
+	policy, err := marshalNullableJSONString(rule.Policy)
+	if err != nil {
+		return err
+	}
+	canonical, err := marshalNullableJSONString(rule.Canonical)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE Rules SET Policy = ?, Canonical = ?, Disable = ? WHERE ID = ?", policy, canonical, rule.Disable, ruleID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM RuleLabels WHERE RuleID = ?", ruleID); err != nil {
+		return err
+	}
+
+	prep, err := tx.PrepareContext(ctx, "INSERT OR IGNORE INTO RuleLabels (RuleID, Label) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer prep.Close()
+
+	for _, label := range rule.Labels {
+		if _, err := prep.ExecContext(ctx, ruleID, label); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func (s *RuleStore) LoadRule(ctx context.Context, id string) (*api.Rule, error) {
+	for r, err := range s.scanRules(ctx, "WHERE r.UUID = ? LIMIT 1", id) {
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("rule not found (%q): %w", id, status.ErrNotFound)
+}
+
+func (s *RuleStore) ScanRules(ctx context.Context, filter *api.RuleFilter) iter.Seq2[*api.Rule, error] {
+	return s.scanRules(ctx, `WHERE (? = '' OR r.Hostname = ?) AND (? = '' OR EXISTS (
+    SELECT 1
+    FROM RuleLabels AS ul
+    WHERE ul.RuleID = r.ID AND ul.Label = ?
+))
+ORDER BY r.ID`,
+		filter.GetHostname(), filter.GetHostname(),
+		filter.GetLabel(), filter.GetLabel())
+}
+
+// ruleQuery selects the rules scanned by scanRuleRows.
+const ruleQuery = `SELECT
+    r.UUID,
+    r.Hostname,
+    r.URLPattern,
+    r.Scheme,
+    r.Port,
+    r.PathGlob,
+    r.AlwaysTrigger,
+    r.Disable,
+    r.Policy,
+    r.Canonical,
+    (SELECT json_group_array(ul.Label) FROM RuleLabels AS ul WHERE ul.RuleID = r.ID) AS Labels
+FROM Rules AS r
+`
+
+func (s *RuleStore) scanRules(ctx context.Context, where string, args ...any) iter.Seq2[*api.Rule, error] {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return seq2Error[*api.Rule](err)
+	}
+
+	rows, err := conn.QueryContext(ctx, ruleQuery+where, args...)
+	if err != nil {
+		conn.Close()
+		return seq2Error[*api.Rule](err)
+	}
+
+	return func(yield func(*api.Rule, error) bool) {
+		defer conn.Close()
+		for r, err := range scanRuleRows(rows) {
+			if !yield(r, err) {
+				return
+			}
+		}
+	}
+}
+
+// scanRuleRows scans the rows of a ruleQuery and closes them.
+func scanRuleRows(rows *sql.Rows) iter.Seq2[*api.Rule, error] {
+	return func(yield func(*api.Rule, error) bool) {
+		defer rows.Close()
+
+		for rows.Next() {
+			var uuid, hostname, urlPattern, scheme, pathGlob, policy, canonical, labels sql.NullString
+			var port sql.NullInt64
+			var alwaysTrigger, disable sql.NullBool
+			if err := rows.Scan(&uuid, &hostname, &urlPattern, &scheme, &port, &pathGlob, &alwaysTrigger, &disable, &policy, &canonical, &labels); err != nil {
+				yield(nil, err)
+				return
+			}
+			r := &api.Rule{
+				ID: uuid.String,
+				Rule: nuggit.Rule{
+					Hostname:      hostname.String,
+					URLPattern:    urlPattern.String,
+					Scheme:        scheme.String,
+					Port:          int(port.Int64),
+					PathGlob:      pathGlob.String,
+					AlwaysTrigger: alwaysTrigger.Bool,
+					Disable:       disable.Bool,
+				},
+			}
+			if policy.Valid {
+				r.Policy = new(nuggit.RulePolicy)
+				if err := unmarshalNullableJSONString(policy, r.Policy); err != nil {
+					yield(nil, err)
+					return
+				}
+			}
+			if canonical.Valid {
+				r.Canonical = new(nuggit.CanonicalURL)
+				if err := unmarshalNullableJSONString(canonical, r.Canonical); err != nil {
+					yield(nil, err)
+					return
+				}
+			}
+			if err := unmarshalNullableJSONString(labels, &r.Labels); err != nil {
+				yield(nil, err)
+				return
+			}
+			if len(r.Labels) == 0 {
+				r.Labels = nil
+			}
+			if !yield(r, nil) {
+				break
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+// DeleteRule deletes the rule matching all fields of the given rule.
+//
+// When labels are provided they must match the labels of the stored rule.
 func (s *RuleStore) DeleteRule(ctx context.Context, rule nuggit.Rule) error {
 	conn, err := s.db.Conn(ctx)
 	if err != nil {
@@ -79,66 +326,224 @@ func (s *RuleStore) DeleteRule(ctx context.Context, rule nuggit.Rule) error {
 	}
 	defer conn.Close()
 
-	if _, err := conn.ExecContext(ctx, `DELETE FROM Rules AS r
-WHERE r.Hostname = ? AND r.URLPattern = ? AND r.AlwaysTrigger = ?
-LIMIT 1`,
-		rule.Hostname,
-		rule.URLPattern,
-		rule.AlwaysTrigger); err != nil {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
+	var ruleID int64
+	var labelsJSON sql.NullString
+	if err := tx.QueryRowContext(ctx, `SELECT
+    r.ID,
+    (SELECT json_group_array(ul.Label) FROM RuleLabels AS ul WHERE ul.RuleID = r.ID)
+FROM Rules AS r
+WHERE `+ruleKeyWhere+`
+LIMIT 1`, ruleKeyArgs(rule)...).Scan(&ruleID, &labelsJSON); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("rule not found: %w", status.ErrNotFound)
+		}
+		return err
+	}
+
+	if len(rule.Labels) > 0 {
+		var labels []string
+		if err := unmarshalNullableJSONString(labelsJSON, &labels); err != nil {
+			return err
+		}
+		if !sameLabels(labels, rule.Labels) {
+			return fmt.Errorf("rule labels do not match the stored rule (%q): %w", labels, status.ErrFailedPrecondition)
+		}
+	}
+
+	if err := deleteRuleTx(ctx, tx, ruleID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.invalidateMatcher()
 	return nil
 }
 
-const triggerQuery = `SELECT 
+func (s *RuleStore) DeleteRuleByID(ctx context.Context, id string) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ruleID, err := lookupRuleID(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := deleteRuleTx(ctx, tx, ruleID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.invalidateMatcher()
+	return nil
+}
+
+func deleteRuleTx(ctx context.Context, tx *sql.Tx, ruleID int64) error {
+	// RuleLabels does not reference Rules with a cascading foreign key.
+	if _, err := tx.ExecContext(ctx, "DELETE FROM RuleLabels WHERE RuleID = ?", ruleID); err != nil {
+		return err
+	}
+	if err := deleteResourcesTx(ctx, tx, "RuleID", ruleID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM Rules WHERE ID = ?", ruleID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func sameLabels(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(slices.Compact(a), slices.Compact(b))
+}
+
+// ruleKeyWhere matches the Rules row with the same fields as ruleKeyArgs.
+const ruleKeyWhere = `r.Hostname = ? AND r.URLPattern = ? AND r.Scheme = ? AND r.Port = ? AND r.PathGlob = ? AND r.AlwaysTrigger = ?`
+
+func ruleKeyArgs(rule nuggit.Rule) []any {
+	return []any{
+		rule.Hostname,
+		rule.URLPattern,
+		rule.Scheme,
+		rule.Port,
+		rule.PathGlob,
+		rule.AlwaysTrigger,
+	}
+}
+
+// loadMatcher returns the cached rule matcher or builds a new one from the Rules tables.
+func (s *RuleStore) loadMatcher(ctx context.Context) (*rules.Matcher, error) {
+	s.mu.Lock()
+	m, gen := s.matcher, s.gen
+	s.mu.Unlock()
+	if m != nil {
+		return m, nil
+	}
+
+	m, err := s.buildMatcher(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gen == gen { // Don't cache a matcher built concurrently with a rule update.
+		s.matcher = m
+	}
+	return m, nil
+}
+
+func (s *RuleStore) invalidateMatcher() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.matcher = nil
+	s.gen++
+}
+
+func (s *RuleStore) buildMatcher(ctx context.Context) (*rules.Matcher, error) {
+	m := rules.NewMatcher()
+	for r, err := range s.scanRules(ctx, "ORDER BY r.ID") {
+		if err != nil {
+			return nil, err
+		}
+		if err := m.Add(r.ID, r.Rule); err != nil {
+			// Don't let one bad rule stop every other rule from matching.
+			log.Printf("Skipping rule %q: %v", r.ID, err)
+		}
+	}
+	return m, nil
+}
+
+const labeledPipesQuery = `SELECT DISTINCT
     p.Name,
     p.Digest,
-    p.Spec,
-    MAX(u.URLPattern) AS URLPattern,
-    COALESCE(MAX(u.AlwaysTrigger), FALSE) AS AlwaysTrigger
+    p.Spec
 FROM Pipes AS p
 JOIN Resources AS r ON p.ID = r.PipeID
 JOIN ResourceLabels AS rl ON r.ID = rl.ResourceID
-JOIN RuleLabels AS ul ON rl.Label = ul.Label
-JOIN Rules AS u ON ul.RuleID = u.ID
-WHERE NOT r.ID IN (
-    SELECT r.ID
-    FROM Resources AS r
-    JOIN ResourceLabels AS rl ON r.ID = rl.ResourceID
-    WHERE rl.Label = 'disabled'
-)
-GROUP BY p.Name, p.Digest, p.Spec
-HAVING NOT COALESCE(MAX(u.Disable), FALSE) AND (MAX(u.AlwaysTrigger) OR MAX(u.Hostname) = ?)`
+WHERE rl.Label IN (%s) AND NOT EXISTS (
+    SELECT 1
+    FROM ResourceLabels AS d
+    WHERE d.ResourceID = r.ID AND d.Label = 'disabled'
+) AND NOT EXISTS (
+    SELECT 1
+    FROM ResourceLabels AS dl
+    JOIN RuleLabels AS ul ON dl.Label = ul.Label
+    JOIN Rules AS u ON ul.RuleID = u.ID
+    WHERE dl.ResourceID = r.ID AND u.Disable
+)`
+
+func (s *RuleStore) ScanMatchedRules(ctx context.Context, u *url.URL) iter.Seq2[*api.Rule, error] {
+	m, err := s.loadMatcher(ctx)
+	if err != nil {
+		return seq2Error[*api.Rule](err)
+	}
+	return func(yield func(*api.Rule, error) bool) {
+		for id, rule := range m.Match(u) {
+			if !yield(&api.Rule{ID: id, Rule: rules.Clone(rule)}, nil) {
+				break
+			}
+		}
+	}
+}
 
 func (s *RuleStore) ScanMatched(ctx context.Context, u *url.URL) iter.Seq2[*api.Pipe, error] {
-	conn, err := s.db.Conn(ctx)
+	m, err := s.loadMatcher(ctx)
 	if err != nil {
 		return seq2Error[*api.Pipe](err)
 	}
+	return s.ScanLabeledPipes(ctx, m.MatchLabels(u))
+}
+
+func (s *RuleStore) ScanLabeledPipes(ctx context.Context, labels []string) iter.Seq2[*api.Pipe, error] {
+	if len(labels) == 0 {
+		return func(func(*api.Pipe, error) bool) {}
+	}
 
-	prep, err := conn.PrepareContext(ctx, triggerQuery)
+	conn, err := s.db.Conn(ctx)
 	if err != nil {
 		return seq2Error[*api.Pipe](err)
 	}
 
-	hostname := u.Hostname()
-	rows, err := prep.QueryContext(ctx, hostname)
+	args := make([]any, len(labels))
+	for i, label := range labels {
+		args[i] = label
+	}
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf(labeledPipesQuery, placeholders(len(labels))), args...)
 	if err != nil {
+		conn.Close()
 		return seq2Error[*api.Pipe](err)
 	}
 
-	urlStr := u.String()
-
 	return func(yield func(*api.Pipe, error) bool) {
 		defer conn.Close()
-		defer prep.Close()
 		defer rows.Close()
 
 		for rows.Next() {
-			var name, digest, spec, urlPattern sql.NullString
-			var alwaysTrigger sql.NullBool
-			if err := rows.Scan(&name, &digest, &spec, &urlPattern, &alwaysTrigger); err != nil {
+			var name, digest, spec sql.NullString
+			if err := rows.Scan(&name, &digest, &spec); err != nil {
 				yield(nil, err)
 				return
 			}
@@ -156,18 +561,6 @@ func (s *RuleStore) ScanMatched(ctx context.Context, u *url.URL) iter.Seq2[*api.
 				return
 			}
 
-			if !alwaysTrigger.Bool && urlPattern.String != "" {
-				// Test URL pattern since its not empty.
-				match, err := regexp.MatchString(urlPattern.String, urlStr)
-				if err != nil {
-					yield(nil, err)
-					return
-				}
-				if !match {
-					continue // This rule failed to match the URL.
-				}
-			}
-
 			// Pipe has been triggered either by AlwaysTrigger
 			// Or a matching Hostname and URL pattern.
 			if !yield(pipe, nil) {
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"iter"
+	"strings"
+	"time"
+
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/status"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SearchResults returns the string results matching the search query ordered by relevance.
+//
+// Results are indexed by triggers on the Results table as they are stored.
+// Repeat events store no results so hits refer to the earliest event with the value.
+func (s *ResultStore) SearchResults(ctx context.Context, filter *api.SearchFilter) iter.Seq2[*api.SearchHit, error] {
+	if filter == nil || filter.Query == "" {
+		return seq2Error[*api.SearchHit](fmt.Errorf("query is required: %w", status.ErrInvalidArgument))
+	}
+	where := []string{"ResultsSearch MATCH ?"}
+	args := []any{filter.Query}
+	if filter.Pipe != nil {
+		where = append(where, "p.Name = ? AND (? = '' OR p.Digest = ?)")
+		args = append(args, filter.Pipe.GetName(), filter.Pipe.GetDigest(), filter.Pipe.GetDigest())
+	}
+	if filter.URL != "" {
+		where = append(where, "e.URL = ?")
+		args = append(args, filter.URL)
+	}
+	query := `SELECT
+    r.EventID,
+    e.URL,
+    e.Timestamp,
+    e.ReceivedAt,
+    p.Name,
+    p.Digest,
+    r.SequenceID,
+    snippet(ResultsSearch, 0, '[', ']', '...', 16)
+FROM ResultsSearch
+JOIN Results AS r ON r.ID = ResultsSearch.rowid
+JOIN Events AS e ON r.EventID = e.ID
+JOIN Pipes AS p ON r.PipeID = p.ID
+WHERE ` + strings.Join(where, " AND ") + `
+ORDER BY ResultsSearch.rank, r.EventID DESC, r.SequenceID
+LIMIT ? OFFSET ?`
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1 // No limit.
+	}
+	args = append(args, limit, max(filter.Offset, 0))
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return seq2Error[*api.SearchHit](err)
+	}
+
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		conn.Close()
+		return seq2Error[*api.SearchHit](searchQueryError(filter.Query, err))
+	}
+
+	return func(yield func(*api.SearchHit, error) bool) {
+		defer conn.Close()
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				url          sql.NullString
+				timestamp    sql.NullTime
+				receivedAt   sql.NullInt64
+				name, digest string
+			)
+			h := new(api.SearchHit)
+			if err := rows.Scan(&h.Event, &url, &timestamp, &receivedAt, &name, &digest, &h.Sequence, &h.Snippet); err != nil {
+				yield(nil, err)
+				return
+			}
+			h.URL = url.String
+			h.Timestamp = timestamp.Time
+			if receivedAt.Valid {
+				h.ReceivedAt = time.Unix(receivedAt.Int64, 0)
+			}
+			h.Pipe = fmt.Sprint(integrity.KeyLit(name, digest))
+			if !yield(h, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, searchQueryError(filter.Query, err))
+		}
+	}
+}
+
+// searchQueryError reports FTS5 query syntax errors as invalid arguments.
+//
+// The rest of the statement is fixed so generic SQLite errors come from the query.
+func searchQueryError(query string, err error) error {
+	if err, ok := err.(*sqlite.Error); ok && err.Code() == sqlite3.SQLITE_ERROR {
+		return fmt.Errorf("invalid search query (%q): %v: %w", query, err, status.ErrInvalidArgument)
+	}
+	return err
+}
+
+// SetSearchPipes chooses the pipes by name whose string results are indexed
+// for search and rebuilds the index. When no pipes are given, all string results are indexed.
+func SetSearchPipes(ctx context.Context, db *sql.DB, names []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM SearchPipes"); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO SearchPipes (Name) VALUES (?)", name); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM ResultsSearch"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO ResultsSearch (rowid, Result)
+SELECT r.ID, r.Result
+FROM Results AS r
+JOIN Pipes AS p ON r.PipeID = p.ID
+WHERE (r.TypeNumber & 7) = 1 AND (
+    NOT EXISTS (SELECT 1 FROM SearchPipes)
+    OR p.Name IN (SELECT Name FROM SearchPipes)
+)`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SearchPipes returns the names of the pipes chosen for search.
+//
+// An empty list means all string results are indexed.
+func SearchPipes(ctx context.Context, db *sql.DB) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT Name FROM SearchPipes ORDER BY Name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/status"
+)
+
+func TestSearchPipes(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if err := InitDB(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.ExecContext(ctx, `INSERT INTO Pipes (ID, Name, Digest, TypeNumber) VALUES (1, 'title', 'ab', 1), (2, 'body', 'cd', 1), (3, 'html', 'ef', 0);
+INSERT INTO Plans (ID, UUID) VALUES (1, '00000000-0000-0000-0000-000000000001');
+INSERT INTO Events (ID, PlanID, URL) VALUES (1, 1, 'https://a.example/');
+INSERT INTO Results (EventID, PipeID, SequenceID, TypeNumber, Result) VALUES (1, 1, 0, 1, 'Rain today'), (1, 2, 0, 1, 'Heavy rain expected'), (1, 3, 0, 0, 'rain');`); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewResultStore(db)
+	search := func(query string) (string, error) {
+		var got []string
+		for h, err := range store.SearchResults(ctx, &api.SearchFilter{Query: query}) {
+			if err != nil {
+				return "", err
+			}
+			got = append(got, h.Snippet)
+		}
+		return fmt.Sprint(got), nil
+	}
+
+	if got, err := search("rain"); err != nil || got != "[[Rain] today Heavy [rain] expected]" {
+		t.Errorf("SearchResults(all pipes): got %s, %v", got, err)
+	}
+	if err := SetSearchPipes(ctx, db, []string{"body"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO Results (EventID, PipeID, SequenceID, TypeNumber, Result) VALUES (1, 1, 1, 1, 'More rain'), (1, 2, 1, 1, 'Rain again')"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := search("rain"); err != nil || got != "[[Rain] again Heavy [rain] expected]" {
+		t.Errorf("SearchResults(body): got %s, %v", got, err)
+	}
+	if got, err := SearchPipes(ctx, db); err != nil || fmt.Sprint(got) != "[body]" {
+		t.Errorf("SearchPipes(): got %v, %v", got, err)
+	}
+	if _, err := search(`"rain`); !errors.Is(err, status.ErrInvalidArgument) {
+		t.Errorf("SearchResults(syntax error): got %v, want InvalidArgument", err)
+	}
+}
@@ -3,7 +3,6 @@ package storage
 import (
 	"context"
 	"database/sql"
-	_ "embed"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -23,6 +22,7 @@ type Type = string
 const (
 	StorageUndefined Type = "" // Same as in memory.
 	StorageInMemory  Type = "inmemory"
+	StorageSQLite    Type = "sqlite"
 )
 
 type OpStatus = string
@@ -38,19 +38,25 @@ type UUID interface{ UUID() string }
 
 var ErrStopScan = errors.New("stop scan")
 
-//go:embed schema.sql
-var schema string
-
+// InitDB migrates the database to the latest schema version.
 func InitDB(ctx context.Context, db *sql.DB) error {
-	log.Printf("Initializing DB...\n======== BEGIN SCHEMA ========\n%s\n======== END SCHEMA ========\n", schema)
-	conn, err := db.Conn(ctx)
+	log.Printf("Initializing DB...")
+	applied, err := Migrate(ctx, db, false)
+	for _, m := range applied {
+		log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+	}
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-	if _, err := conn.ExecContext(ctx, schema); err != nil {
+	if err := backfillRuleResourceDigests(ctx, db); err != nil {
 		return err
 	}
+	if len(applied) > 0 {
+		// Recreate the views against the migrated schema.
+		if err := NewViewStore(db).RebuildViews(ctx); err != nil {
+			log.Printf("Failed to rebuild views: %v", err)
+		}
+	}
 	return nil
 }
 
@@ -111,6 +117,7 @@ func convertNamesToAnySlice(es []integrity.NameDigest) []any {
 }
 
 var validTableNames = map[string]struct{}{
+	"EventBatches":     {},
 	"Events":           {},
 	"PipeDependencies": {},
 	"Pipes":            {},
@@ -163,25 +170,6 @@ func loadSpec[E integrity.CheckDigestable](ctx context.Context, db *sql.DB, tabl
 	return nil
 }
 
-func deleteSpec(ctx context.Context, db *sql.DB, tableName string, nameDigest integrity.NameDigest) error {
-	conn, err := db.Conn(ctx)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	prep, err := conn.PrepareContext(ctx, fmt.Sprintf("DELETE FROM %s AS t WHERE t.Name = ? AND t.Digest = ?", safeTableName(tableName)))
-	if err != nil {
-		return err
-	}
-	defer prep.Close()
-
-	if _, err := prep.ExecContext(ctx, nameDigest.GetName(), nameDigest.GetDigest()); err != nil {
-		return err
-	}
-	return nil
-}
-
 func deleteBatch(ctx context.Context, db *sql.DB, tableName string, names []integrity.NameDigest) error {
 	conn, err := db.Conn(ctx)
 	if err != nil {
@@ -350,7 +338,7 @@ func handleExecErrors(err error, alreadyExistsFn func(err error) error) error {
 		}
 		return err
 	}
-	return nil
+	return err
 }
 
 func alreadyExistsFunc(object string, key integrity.NameDigest) func(error) error {
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/wenooij/nuggit/api/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) *storetest.Stores {
+		db, err := sql.Open("sqlite", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		db.SetMaxOpenConns(1) // Each connection opens a separate in-memory database.
+		if err := InitDB(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+		return &storetest.Stores{
+			Pipes:     NewPipeStore(db),
+			Rules:     NewRuleStore(db),
+			Plans:     NewPlanStore(db),
+			Results:   NewResultStore(db),
+			Resources: NewResourceStore(db),
+			Views:     NewViewStore(db),
+		}
+	})
+}
@@ -3,9 +3,15 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"iter"
+	"strings"
 
 	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/api"
 	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/status"
 	"github.com/wenooij/nuggit/table"
 )
 
@@ -16,27 +22,30 @@ func NewViewStore(db *sql.DB) *ViewStore {
 }
 
 func (s *ViewStore) Store(ctx context.Context, uuid string, view nuggit.View) error {
-	conn, err := s.db.Conn(ctx)
+	spec, err := marshalNullableJSONString(view.GetSpec())
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-
-	tx, err := conn.BeginTx(ctx, nil)
+	digest, err := integrity.GetDigest(&view)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
 
-	spec, err := marshalNullableJSONString(view.GetSpec())
+	conn, err := s.db.Conn(ctx)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	digest, err := integrity.GetDigest(&view)
+	tx, err := conn.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	if err := checkViewDigestTx(ctx, tx, uuid, digest); err != nil {
+		return err
+	}
 
 	viewResult, err := tx.ExecContext(ctx, "INSERT INTO Views (Name, Digest, UUID, Spec) VALUES (?, ?, ?, ?)",
 		view.Alias,
@@ -45,58 +54,562 @@ func (s *ViewStore) Store(ctx context.Context, uuid string, view nuggit.View) er
 		spec,
 	)
 	if err != nil {
-		return err // We do not expect AlwaysExists here.
+		return err
 	}
 	viewID, err := viewResult.LastInsertId()
 	if err != nil {
 		return err
 	}
 
-	prep, err := conn.PrepareContext(ctx, `INSERT OR IGNORE INTO ViewPipes (ViewID, PipeID)
+	if err := storeViewPipesTx(ctx, tx, viewID, &view); err != nil {
+		return err
+	}
+
+	if err := s.createViewTx(ctx, tx, uuid, view); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Update replaces the stored view and recreates its SQL view in place.
+func (s *ViewStore) Update(ctx context.Context, uuid string, view nuggit.View) error {
+	spec, err := marshalNullableJSONString(view.GetSpec())
+	if err != nil {
+		return err
+	}
+	digest, err := integrity.GetDigest(&view)
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	viewID, alias, err := lookupViewTx(ctx, tx, uuid)
+	if err != nil {
+		return err
+	}
+	if err := checkViewDigestTx(ctx, tx, uuid, digest); err != nil {
+		return err
+	}
+	if err := dropViewTx(ctx, tx, uuid, alias); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE Views SET Name = ?, Digest = ?, Spec = ? WHERE ID = ?", view.Alias, digest, spec, viewID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM ViewPipes WHERE ViewID = ?", viewID); err != nil {
+		return err
+	}
+	if err := storeViewPipesTx(ctx, tx, viewID, &view); err != nil {
+		return err
+	}
+	if err := s.createViewTx(ctx, tx, uuid, view); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete deletes the view along with its SQL view and table.
+func (s *ViewStore) Delete(ctx context.Context, uuid string) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	viewID, alias, err := lookupViewTx(ctx, tx, uuid)
+	if err != nil {
+		return err
+	}
+	if err := dropViewTx(ctx, tx, uuid, alias); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM ViewPipes WHERE ViewID = ?", viewID); err != nil {
+		return err
+	}
+	if err := deleteResourcesTx(ctx, tx, "ViewID", viewID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM Views WHERE ID = ?", viewID); err != nil {
+		return err
+	}
+	// Point the alias at the latest view which remains.
+	if alias != "" {
+		var latest string
+		err := tx.QueryRowContext(ctx, "SELECT UUID FROM Views WHERE Name = ? ORDER BY ID DESC LIMIT 1", alias).Scan(&latest)
+		switch {
+		case err == nil:
+			var vb table.ViewBuilder
+			if err := vb.SetView(latest, alias); err != nil {
+				return err
+			}
+			viewName, err := vb.ViewName()
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE VIEW IF NOT EXISTS %q AS SELECT * FROM %q", vb.AliasName(), viewName)); err != nil {
+				return err
+			}
+		case !errors.Is(err, sql.ErrNoRows):
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// checkViewDigestTx returns AlreadyExists when another view with the digest is stored.
+func checkViewDigestTx(ctx context.Context, tx *sql.Tx, uuid, digest string) error {
+	var existing string
+	err := tx.QueryRowContext(ctx, "SELECT UUID FROM Views WHERE Digest = ? AND UUID != ? LIMIT 1", digest, uuid).Scan(&existing)
+	switch {
+	case err == nil:
+		return fmt.Errorf("view already exists (%q): %w", existing, status.ErrAlreadyExists)
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	default:
+		return err
+	}
+}
+
+func lookupViewTx(ctx context.Context, tx *sql.Tx, uuid string) (viewID int64, alias string, err error) {
+	if err := tx.QueryRowContext(ctx, "SELECT ID, Name FROM Views WHERE UUID = ? LIMIT 1", uuid).Scan(&viewID, &alias); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, "", fmt.Errorf("view not found (%q): %w", uuid, status.ErrNotFound)
+		}
+		return 0, "", err
+	}
+	return viewID, alias, nil
+}
+
+func storeViewPipesTx(ctx context.Context, tx *sql.Tx, viewID int64, view *nuggit.View) error {
+	prep, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO ViewPipes (ViewID, PipeID)
 SELECT ?, p.ID
 FROM Pipes AS p
-WHERE p.Name = ? AND p.Digest = ? LIMIT 1`)
+WHERE p.Name = ? AND (? = '' OR p.Digest = ?)`)
 	if err != nil {
 		return err
 	}
 	defer prep.Close()
 
-	for _, p := range view.GetColumns() {
+	for _, p := range api.ViewBaseColumns(view) {
 		pipe, err := integrity.ParseNameDigest(p.Pipe)
 		if err != nil {
 			return err
 		}
-		if _, err := prep.ExecContext(ctx, viewID, pipe.GetName(), pipe.GetDigest()); err != nil {
+		if _, err := prep.ExecContext(ctx, viewID, pipe.GetName(), pipe.GetDigest(), pipe.GetDigest()); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	if err := s.createViewTx(ctx, tx, uuid, view); err != nil {
+// dropViewTx drops the SQL view and table of the view
+// and its alias view when the alias refers to it.
+func dropViewTx(ctx context.Context, tx *sql.Tx, uuid, alias string) error {
+	var vb table.ViewBuilder
+	if err := vb.SetView(uuid, alias); err != nil {
 		return err
 	}
+	viewName, err := vb.ViewName()
+	if err != nil {
+		return err
+	}
+	tableName, err := vb.TableName()
+	if err != nil {
+		return err
+	}
+	if err := dropAliasViewTx(ctx, tx, vb.AliasName(), viewName); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DROP VIEW IF EXISTS %q; DROP TABLE IF EXISTS %q;", viewName, tableName))
+	return err
+}
 
-	if err := tx.Commit(); err != nil {
+// dropAliasViewTx drops the alias view if it refers to the view name
+// or to any view when the view name is empty.
+func dropAliasViewTx(ctx context.Context, tx *sql.Tx, aliasName, viewName string) error {
+	if aliasName == "" {
+		return nil
+	}
+	var aliasSQL string
+	err := tx.QueryRowContext(ctx, "SELECT sql FROM sqlite_schema WHERE type = 'view' AND name = ?", aliasName).Scan(&aliasSQL)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	case err != nil:
 		return err
+	case viewName != "" && !strings.Contains(aliasSQL, fmt.Sprintf("%q", viewName)):
+		return nil
 	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DROP VIEW IF EXISTS %q", aliasName))
+	return err
+}
 
+// createViewTx creates the SQL view and checks it against the current schema.
+//
+// The alias view is replaced to refer to the new view.
+func (s *ViewStore) createViewTx(ctx context.Context, tx *sql.Tx, uuid string, view nuggit.View) error {
+	vb, err := newViewBuilder(uuid, &view)
+	if err != nil {
+		return err
+	}
+	createViewsExpr, err := vb.Build()
+	if err != nil {
+		return err
+	}
+	viewName, err := vb.ViewName()
+	if err != nil {
+		return err
+	}
+	if err := dropAliasViewTx(ctx, tx, vb.AliasName(), ""); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, createViewsExpr); err != nil {
+		return err
+	}
+	// SQLite only resolves the tables and columns of views when they are used.
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %q LIMIT 0", viewName))
+	if err != nil {
+		return fmt.Errorf("view does not match the database schema (%q): %v: %w", uuid, err, status.ErrFailedPrecondition)
+	}
+	rows.Close()
+	if view.GetMaterialized() {
+		// Backfill the rows of existing results.
+		return refreshViewTx(ctx, tx, vb, "")
+	}
 	return nil
 }
 
-func (s *ViewStore) createViewTx(ctx context.Context, tx *sql.Tx, uuid string, view nuggit.View) error {
-	var vb table.ViewBuilder
-	vb.Reset()
+func newViewBuilder(uuid string, view *nuggit.View) (*table.ViewBuilder, error) {
+	vb := new(table.ViewBuilder)
 	if err := vb.SetView(uuid, view.GetAlias()); err != nil {
-		return err
+		return nil, err
 	}
 	for _, col := range view.GetColumns() {
-		vb.AddViewColumn(col)
+		if err := vb.AddViewColumn(col); err != nil {
+			return nil, err
+		}
 	}
-	createViewsExpr, err := vb.Build()
+	for _, col := range view.GetAggColumns() {
+		if err := vb.AddAggColumn(col); err != nil {
+			return nil, err
+		}
+	}
+	vb.SetGroupBy(view.GetGroupBy())
+	vb.SetFilter(view.GetFilter())
+	vb.SetMaterialized(view.GetMaterialized())
+	vb.SetRepeats(view.GetRepeats())
+	return vb, nil
+}
+
+// refreshViewTx recomputes the rows of a materialized view for the events query.
+func refreshViewTx(ctx context.Context, tx *sql.Tx, vb *table.ViewBuilder, events string, args ...any) error {
+	stmts, err := vb.BuildRefresh(events)
 	if err != nil {
 		return err
 	}
-	if _, err := tx.ExecContext(ctx, createViewsExpr); err != nil {
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshMaterializedViewsTx recomputes the rows of all materialized views for the events query.
+func refreshMaterializedViewsTx(ctx context.Context, tx *sql.Tx, events string, args ...any) error {
+	rows, err := tx.QueryContext(ctx, "SELECT UUID, Spec FROM Views WHERE json_extract(Spec, '$.materialized')")
+	if err != nil {
 		return err
 	}
+	var builders []*table.ViewBuilder
+	for rows.Next() {
+		var (
+			uuid string
+			spec sql.NullString
+			view nuggit.View
+		)
+		if err := rows.Scan(&uuid, &spec); err != nil {
+			rows.Close()
+			return err
+		}
+		if err := unmarshalNullableJSONString(spec, &view); err != nil {
+			rows.Close()
+			return err
+		}
+		vb, err := newViewBuilder(uuid, &view)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		builders = append(builders, vb)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, vb := range builders {
+		if err := refreshViewTx(ctx, tx, vb, events, args...); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// Rebuild drops and recreates the SQL view against the current schema.
+//
+// The tables of materialized views are refilled from the stored results.
+func (s *ViewStore) Rebuild(ctx context.Context, view string) error {
+	v, err := s.Load(ctx, view)
+	if err != nil {
+		return err
+	}
+	return s.rebuildViews(ctx, []*api.View{v})
+}
+
+// RebuildViews drops and recreates all SQL views against the current schema.
+//
+// RebuildViews is run after migrations so that views refer to the migrated tables.
+func (s *ViewStore) RebuildViews(ctx context.Context) error {
+	var views []*api.View
+	for v, err := range s.Scan(ctx) {
+		if err != nil {
+			return err
+		}
+		views = append(views, v)
+	}
+	return s.rebuildViews(ctx, views)
+}
+
+func (s *ViewStore) rebuildViews(ctx context.Context, views []*api.View) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, v := range views {
+		if err := dropViewTx(ctx, tx, v.GetID(), v.GetAlias()); err != nil {
+			return err
+		}
+		if err := s.createViewTx(ctx, tx, v.GetID(), v.View); err != nil {
+			return fmt.Errorf("failed to rebuild view (%q): %w", v.GetID(), err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *ViewStore) Load(ctx context.Context, view string) (*api.View, error) {
+	for v, err := range s.scanViews(ctx, "WHERE v.UUID = ? OR v.Name = ? ORDER BY v.UUID = ? DESC, v.ID DESC LIMIT 1", view, view, view) {
+		return v, err
+	}
+	return nil, fmt.Errorf("view not found (%q): %w", view, status.ErrNotFound)
+}
+
+func (s *ViewStore) Scan(ctx context.Context) iter.Seq2[*api.View, error] {
+	return s.scanViews(ctx, "ORDER BY v.ID")
+}
+
+func (s *ViewStore) scanViews(ctx context.Context, where string, args ...any) iter.Seq2[*api.View, error] {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return seq2Error[*api.View](err)
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT v.UUID, v.Digest, v.Spec FROM Views AS v "+where, args...)
+	if err != nil {
+		conn.Close()
+		return seq2Error[*api.View](err)
+	}
+
+	return func(yield func(*api.View, error) bool) {
+		defer conn.Close()
+		defer rows.Close()
+
+		for rows.Next() {
+			var uuid, digest, spec sql.NullString
+			if err := rows.Scan(&uuid, &digest, &spec); err != nil {
+				yield(nil, err)
+				return
+			}
+			v := &api.View{ID: uuid.String, Digest: digest.String}
+			if err := unmarshalNullableJSONString(spec, &v.View); err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(v, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+var viewFilterExprs = map[api.ViewFilterOp]string{
+	api.ViewFilterEq:       "%q = ?",
+	api.ViewFilterNe:       "%q != ?",
+	api.ViewFilterLt:       "%q < ?",
+	api.ViewFilterLe:       "%q <= ?",
+	api.ViewFilterGt:       "%q > ?",
+	api.ViewFilterGe:       "%q >= ?",
+	api.ViewFilterContains: "instr(%q, ?) > 0",
+	api.ViewFilterNull:     "%q IS NULL",
+	api.ViewFilterNotNull:  "%q IS NOT NULL",
+}
+
+// ScanRows queries the SQL view created for the view.
+//
+// Column names in the query must be validated by the caller.
+func (s *ViewStore) ScanRows(ctx context.Context, uuid string, query *api.ViewQuery) iter.Seq2[*api.ViewRow, error] {
+	var vb table.ViewBuilder
+	if err := vb.SetView(uuid, ""); err != nil {
+		return seq2Error[*api.ViewRow](err)
+	}
+	viewName, err := vb.ViewName()
+	if err != nil {
+		return seq2Error[*api.ViewRow](err)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("SELECT ")
+	for _, col := range query.Columns {
+		fmt.Fprintf(&sb, "%q, ", col)
+	}
+	fmt.Fprintf(&sb, "%s, %s", table.EventColumn, table.SequenceColumn)
+	if query.OrderBy == api.ViewTimestampColumn {
+		// Select the timestamp as stored rather than parsed by the driver
+		// so that cursors compare against the same text.
+		fmt.Fprintf(&sb, ", CAST(%q AS TEXT)", query.OrderBy)
+	} else if query.OrderBy != "" {
+		fmt.Fprintf(&sb, ", %q", query.OrderBy)
+	}
+	fmt.Fprintf(&sb, " FROM %q", viewName)
+
+	var (
+		where []string
+		args  []any
+	)
+	for _, f := range query.Filters {
+		expr, ok := viewFilterExprs[f.Op]
+		if !ok {
+			return seq2Error[*api.ViewRow](fmt.Errorf("filter op is not supported (%q): %w", f.Op, status.ErrInvalidArgument))
+		}
+		where = append(where, fmt.Sprintf(expr, f.Column))
+		if f.Op != api.ViewFilterNull && f.Op != api.ViewFilterNotNull {
+			args = append(args, f.Value)
+		}
+	}
+	if query.Where != nil {
+		expr, exprArgs := query.Where.SQL(func(name string) string { return fmt.Sprintf("%q", name) })
+		where = append(where, expr)
+		args = append(args, exprArgs...)
+	}
+	cmp, dir := ">", "ASC"
+	if query.Desc {
+		cmp, dir = "<", "DESC"
+	}
+	if c := query.After; c != nil {
+		// Keyset pagination: NULLs sort first in ascending order and last in descending order.
+		keys := fmt.Sprintf("(%s, %s) %s (?, ?)", table.EventColumn, table.SequenceColumn, cmp)
+		switch {
+		case query.OrderBy == "":
+			where = append(where, keys)
+			args = append(args, c.Event, c.Sequence)
+		case c.Value == nil && !query.Desc:
+			where = append(where, fmt.Sprintf("((%[1]q IS NULL AND %[2]s) OR %[1]q IS NOT NULL)", query.OrderBy, keys))
+			args = append(args, c.Event, c.Sequence)
+		case c.Value == nil:
+			where = append(where, fmt.Sprintf("(%q IS NULL AND %s)", query.OrderBy, keys))
+			args = append(args, c.Event, c.Sequence)
+		default:
+			nulls := ""
+			if query.Desc {
+				nulls = fmt.Sprintf(" OR %q IS NULL", query.OrderBy)
+			}
+			where = append(where, fmt.Sprintf("(%[1]q %[2]s ? OR (%[1]q = ? AND %[3]s)%[4]s)", query.OrderBy, cmp, keys, nulls))
+			args = append(args, c.Value, c.Value, c.Event, c.Sequence)
+		}
+	}
+	if len(where) > 0 {
+		sb.WriteString(" WHERE ")
+		sb.WriteString(strings.Join(where, " AND "))
+	}
+	sb.WriteString(" ORDER BY ")
+	if query.OrderBy != "" {
+		fmt.Fprintf(&sb, "%q %s, ", query.OrderBy, dir)
+	}
+	fmt.Fprintf(&sb, "%[1]s %[3]s, %[2]s %[3]s", table.EventColumn, table.SequenceColumn, dir)
+	if query.Limit > 0 {
+		sb.WriteString(" LIMIT ?")
+		args = append(args, query.Limit)
+	}
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return seq2Error[*api.ViewRow](err)
+	}
+
+	rows, err := conn.QueryContext(ctx, sb.String(), args...)
+	if err != nil {
+		conn.Close()
+		return seq2Error[*api.ViewRow](err)
+	}
+
+	return func(yield func(*api.ViewRow, error) bool) {
+		defer conn.Close()
+		defer rows.Close()
+
+		for rows.Next() {
+			r := &api.ViewRow{Values: make([]any, len(query.Columns))}
+			dest := make([]any, 0, len(query.Columns)+3)
+			for i := range r.Values {
+				dest = append(dest, &r.Values[i])
+			}
+			dest = append(dest, &r.Event, &r.Sequence)
+			if query.OrderBy != "" {
+				dest = append(dest, &r.SortValue)
+			}
+			if err := rows.Scan(dest...); err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(r, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/integrity"
+	"github.com/wenooij/nuggit/status"
+)
+
+// newTestViewsAPI returns a views API over title and price results for three events.
+func newTestViewsAPI(t *testing.T) (*sql.DB, *api.ViewsAPI) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+	if err := InitDB(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.ExecContext(ctx, `INSERT INTO Pipes (ID, Name, Digest, TypeNumber) VALUES (1, 'title', 'ab', 1), (2, 'price', 'cd', 3);
+INSERT INTO Plans (ID, UUID) VALUES (1, '00000000-0000-0000-0000-000000000001');
+INSERT INTO Events (ID, PlanID, URL) VALUES (1, 1, 'https://a.example/'), (2, 1, 'https://a.example/'), (3, 1, 'https://b.example/');
+INSERT INTO Results (EventID, PipeID, SequenceID, TypeNumber, Result) VALUES
+    (1, 1, 0, 1, 'x'), (1, 2, 0, 3, 1.0),
+    (2, 1, 0, 1, 'y'), (2, 2, 0, 3, 3.0),
+    (3, 1, 0, 1, 'z'), (3, 2, 0, 3, 5.0);`); err != nil {
+		t.Fatal(err)
+	}
+
+	a := new(api.ViewsAPI)
+	a.Init(NewViewStore(db), NewPipeStore(db))
+	return db, a
+}
+
+var (
+	testTitleColumn = nuggit.ViewColumn{Pipe: "title@ab", Point: nuggit.Point{Scalar: nuggit.String}}
+	testPriceColumn = nuggit.ViewColumn{Pipe: "price@cd", Point: nuggit.Point{Scalar: nuggit.Float}}
+)
+
+func TestAggregateView(t *testing.T) {
+	ctx := context.Background()
+	_, a := newTestViewsAPI(t)
+
+	view := &nuggit.View{
+		Alias: "prices",
+		AggColumns: []nuggit.AggColumn{{
+			Op: nuggit.AggOpCount,
+		}, {
+			Op:         nuggit.AggOpAvg,
+			ViewColumn: testPriceColumn,
+		}, {
+			Op:         nuggit.AggOpStringAgg,
+			ViewColumn: testTitleColumn,
+			Arg:        "|",
+			OrderBy:    "title desc",
+		}},
+		GroupBy: nuggit.GroupByURL,
+	}
+	if _, err := a.CreateView(ctx, &api.CreateViewRequest{View: view}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := a.QueryView(ctx, &api.QueryViewRequest{View: "prices"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprint(resp.Columns, resp.Rows)
+	want := "[url count avg_price string_agg_title] [[https://a.example/ 2 2 y|x] [https://b.example/ 1 5 z]]"
+	if got != want {
+		t.Errorf("QueryView(): got %s, want %s", got, want)
+	}
+}
+
+func TestComputedView(t *testing.T) {
+	ctx := context.Background()
+	_, a := newTestViewsAPI(t)
+
+	for _, tc := range []struct {
+		name  string
+		view  *nuggit.View
+		where string
+		want  string
+	}{{
+		name: "computed",
+		view: &nuggit.View{
+			Columns: []nuggit.ViewColumn{
+				testTitleColumn,
+				testPriceColumn,
+				{Alias: "label", Expr: "upper(title) + '!'"},
+				{Alias: "discount", Expr: "if(price > 2, price * 0.5, price)"},
+			},
+			Filter: "price > 1.5",
+		},
+		where: "matches(label, '^Z')",
+		want:  "[title price label discount timestamp url] [[z 5 Z! 2.5 <nil> https://b.example/]]",
+	}, {
+		name: "aggregate",
+		view: &nuggit.View{
+			AggColumns: []nuggit.AggColumn{{
+				ViewColumn: testPriceColumn,
+				Op:         nuggit.AggOpMax,
+			}, {
+				ViewColumn: nuggit.ViewColumn{Alias: "revenue", Expr: "price * 2"},
+				Op:         nuggit.AggOpSum,
+			}, {
+				ViewColumn: testTitleColumn,
+				Op:         nuggit.AggOpCount,
+				Filter:     "title != 'y' && url == 'https://a.example/'",
+			}},
+		},
+		want: "[max_price revenue count_title] [[5 18 1]]",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.view.Alias = tc.name
+			ref, err := a.CreateView(ctx, &api.CreateViewRequest{View: tc.view})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := a.QueryView(ctx, &api.QueryViewRequest{View: ref.View.ID, Where: tc.where})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(resp.Columns, resp.Rows); got != tc.want {
+				t.Errorf("QueryView(): got %s, want %s", got, tc.want)
+			}
+		})
+	}
+
+	for _, view := range []*nuggit.View{
+		{Columns: []nuggit.ViewColumn{testTitleColumn}, Filter: "title"},
+		{Columns: []nuggit.ViewColumn{testTitleColumn, {Expr: "lower(title)"}}},
+		{Columns: []nuggit.ViewColumn{testTitleColumn, {Alias: "x", Expr: "load_extension('x')"}}},
+	} {
+		if _, err := a.CreateView(ctx, &api.CreateViewRequest{View: view}); !errors.Is(err, status.ErrInvalidArgument) {
+			t.Errorf("CreateView(%v): got err %v, want invalid argument", view, err)
+		}
+	}
+}
+
+func TestMaterializedView(t *testing.T) {
+	ctx := context.Background()
+	db, a := newTestViewsAPI(t)
+
+	view := &nuggit.View{
+		Alias:        "titles",
+		Columns:      []nuggit.ViewColumn{testTitleColumn, testPriceColumn},
+		Filter:       "price > 2",
+		Materialized: true,
+	}
+	ref, err := a.CreateView(ctx, &api.CreateViewRequest{View: view})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func() string {
+		t.Helper()
+		resp, err := a.QueryView(ctx, &api.QueryViewRequest{View: "titles", Columns: []string{"title"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(resp.Rows)
+	}
+
+	// Existing results are backfilled.
+	if got, want := query(), "[[y] [z]]"; got != want {
+		t.Errorf("QueryView(): got %s, want %s", got, want)
+	}
+
+	// Stored results update the view.
+	results := []api.TriggerResult{
+		{Pipe: "title@ab", Scalar: nuggit.String, Result: "w"},
+		{Pipe: "price@cd", Scalar: nuggit.Float, Result: 7.0},
+	}
+	if err := NewResultStore(db).StoreResults(ctx, &api.TriggerEvent{Plan: "00000000-0000-0000-0000-000000000001", URL: "https://b.example/"}, nil, results); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := query(), "[[y] [z] [w]]"; got != want {
+		t.Errorf("QueryView(): got %s, want %s", got, want)
+	}
+
+	// Garbage collected results are removed from the view.
+	if _, err := CollectGarbage(ctx, db, &RetentionPolicy{MaxEventsPerURL: 1}, time.Now(), false, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := query(), "[[y] [w]]"; got != want {
+		t.Errorf("QueryView(): got %s, want %s", got, want)
+	}
+
+	// Rebuild recomputes the rows.
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %q", "viewrows_"+strings.ReplaceAll(ref.View.ID, "-", "_"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewViewStore(db).Rebuild(ctx, "titles"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := query(), "[[y] [w]]"; got != want {
+		t.Errorf("QueryView(): got %s, want %s", got, want)
+	}
+}
+
+func TestRebuildViews(t *testing.T) {
+	ctx := context.Background()
+	db, a := newTestViewsAPI(t)
+
+	view := &nuggit.View{Alias: "titles", Columns: []nuggit.ViewColumn{testTitleColumn}}
+	ref, err := a.CreateView(ctx, &api.CreateViewRequest{View: view})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.CreateView(ctx, &api.CreateViewRequest{View: view}); !errors.Is(err, status.ErrAlreadyExists) {
+		t.Errorf("CreateView(identical): got err %v, want already exists", err)
+	}
+
+	// Views created against an older schema are recreated.
+	viewName := "view_" + strings.ReplaceAll(ref.View.ID, "-", "_")
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("DROP VIEW %[1]q; CREATE VIEW %[1]q AS SELECT * FROM TriggerResults", viewName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewViewStore(db).RebuildViews(ctx); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := a.QueryView(ctx, &api.QueryViewRequest{View: "titles", Columns: []string{"title"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(resp.Rows), "[[x] [y] [z]]"; got != want {
+		t.Errorf("QueryView(): got %s, want %s", got, want)
+	}
+
+	if _, err := a.DeleteView(ctx, &api.DeleteViewRequest{View: "titles"}); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_schema WHERE name IN (?, 'titles')", viewName).Scan(&n); err != nil || n != 0 {
+		t.Errorf("DeleteView(): got %d SQL views, %v, want 0", n, err)
+	}
+}
+
+func TestCreateViewPinsPipes(t *testing.T) {
+	ctx := context.Background()
+	_, a := newTestViewsAPI(t)
+
+	view := &nuggit.View{Alias: "titles", Columns: []nuggit.ViewColumn{{Pipe: "title", Point: nuggit.Point{Scalar: nuggit.String}}}}
+	ref, err := a.CreateView(ctx, &api.CreateViewRequest{View: view})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := a.GetView(ctx, &api.GetViewRequest{View: ref.View.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pipe := got.View.Columns[0].Pipe; pipe != "title@ab" {
+		t.Errorf("CreateView(): got pipe %q, want title@ab", pipe)
+	}
+	if _, err := a.UpdateView(ctx, &api.UpdateViewRequest{View: "titles", Spec: &nuggit.View{Alias: "titles", Columns: []nuggit.ViewColumn{{Pipe: "missing"}}}}); !errors.Is(err, status.ErrInvalidArgument) {
+		t.Errorf("UpdateView(missing pipe): got error %v, want ErrInvalidArgument", err)
+	}
+}
+
+func TestFloatingViewPipes(t *testing.T) {
+	ctx := context.Background()
+	db, a := newTestViewsAPI(t)
+
+	view := &nuggit.View{Alias: "titles", Columns: []nuggit.ViewColumn{{Pipe: "title", Point: nuggit.Point{Scalar: nuggit.String}, Floating: true}}}
+	if _, err := a.CreateView(ctx, &api.CreateViewRequest{View: view}); err != nil {
+		t.Fatal(err)
+	}
+	// New versions of the pipe are added to the view pipes.
+	pipe := &api.Pipe{Name: "title", Pipe: nuggit.Pipe{Actions: []nuggit.Action{{"action": "innerText"}}}}
+	if err := integrity.SetDigest(pipe); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewPipeStore(db).Store(ctx, pipe); err != nil {
+		t.Fatal(err)
+	}
+	var results int
+	for _, err := range NewResultStore(db).ScanResults(ctx, &ResultFilter{View: "titles"}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		results++
+	}
+	if got, want := results, 3; got != want {
+		t.Errorf("ScanResults(titles): got %d results, want %d", got, want)
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM ViewPipes").Scan(&n); err != nil || n != 2 {
+		t.Errorf("ViewPipes: got %d rows, %v, want 2", n, err)
+	}
+}
+
+func TestRepeatsGarbageCollected(t *testing.T) {
+	ctx := context.Background()
+	db, a := newTestViewsAPI(t)
+
+	view := &nuggit.View{Alias: "titles", Columns: []nuggit.ViewColumn{testTitleColumn}, Materialized: true}
+	ref, err := a.CreateView(ctx, &api.CreateViewRequest{View: view})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// query returns the titles and events of the rows.
+	query := func() string {
+		t.Helper()
+		var rows []string
+		for r, err := range NewViewStore(db).ScanRows(ctx, ref.View.ID, &api.ViewQuery{Columns: []string{"title"}}) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows = append(rows, fmt.Sprintf("%v@%d", r.Values[0], r.Event))
+		}
+		return fmt.Sprint(rows)
+	}
+
+	results := []api.TriggerResult{{Pipe: "title@ab", Scalar: nuggit.String, Result: "w"}}
+	for range 2 {
+		if err := NewResultStore(db).StoreResults(ctx, &api.TriggerEvent{Plan: "00000000-0000-0000-0000-000000000001", URL: "https://c.example/"}, nil, results); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := query(), "[x@1 y@2 z@3 w@4]"; got != want {
+		t.Errorf("QueryView(): got %s, want %s", got, want)
+	}
+
+	// The results of the deleted event are moved to the repeat event.
+	if _, err := CollectGarbage(ctx, db, &RetentionPolicy{MaxEventsPerURL: 1}, time.Now(), false, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := query(), "[y@2 z@3 w@5]"; got != want {
+		t.Errorf("QueryView(after GC): got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	"github.com/wenooij/nuggit/status"
+)
+
+// OpenDB opens the SQLite database at path for concurrent use by a server.
+//
+// Connections use WAL mode so reads are not blocked by writes,
+// wait for the write lock instead of failing with SQLITE_BUSY,
+// and begin transactions with the write lock to avoid lock upgrades.
+// readConns limits the number of open connections.
+func OpenDB(path string, readConns int) (*sql.DB, error) {
+	q := url.Values{}
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "synchronous(NORMAL)")
+	q.Add("_pragma", "busy_timeout(10000)")
+	q.Set("_txlock", "immediate")
+	db, err := sql.Open("sqlite", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(readConns)
+	db.SetMaxIdleConns(readConns)
+	return db, nil
+}
+
+// Writer serializes writes through a single goroutine.
+//
+// Operations queued while a transaction is committed are grouped into
+// the next transaction, so concurrent writers share the cost of a commit.
+// Each operation runs in its own savepoint so a failed operation
+// does not affect the others in its group.
+type Writer struct {
+	db       *sql.DB
+	ops      chan *writeOp
+	maxGroup int
+	stopped  chan struct{}
+}
+
+type writeOp struct {
+	ctx  context.Context
+	fn   func(context.Context, *sql.Tx) error
+	done chan error
+}
+
+// NewWriter returns a Writer which queues up to queueSize operations
+// and commits up to maxGroup operations in each transaction.
+//
+// Run must be called to process the queue.
+func NewWriter(db *sql.DB, queueSize, maxGroup int) *Writer {
+	return &Writer{
+		db:       db,
+		ops:      make(chan *writeOp, queueSize),
+		maxGroup: max(maxGroup, 1),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Run commits the queued operations until ctx is done.
+func (w *Writer) Run(ctx context.Context) {
+	defer close(w.stopped)
+	for {
+		var op *writeOp
+		select {
+		case <-ctx.Done():
+			return
+		case op = <-w.ops:
+		}
+		group := []*writeOp{op}
+	fill:
+		for len(group) < w.maxGroup {
+			select {
+			case op := <-w.ops:
+				group = append(group, op)
+			default:
+				break fill
+			}
+		}
+		w.commit(ctx, group)
+	}
+}
+
+// Do queues fn and waits until its transaction is committed.
+//
+// Do blocks while the queue is full. When ctx is done before fn is queued,
+// Do fails with ErrResourceExhausted. fn runs with a context which is not
+// canceled by ctx since interrupting a statement rolls back the whole group.
+func (w *Writer) Do(ctx context.Context, fn func(context.Context, *sql.Tx) error) error {
+	op := &writeOp{ctx: ctx, fn: fn, done: make(chan error, 1)}
+	select {
+	case w.ops <- op:
+	case <-w.stopped:
+		return fmt.Errorf("writer is stopped: %w", status.ErrUnavailable)
+	case <-ctx.Done():
+		return fmt.Errorf("write queue is full: %v: %w", ctx.Err(), status.ErrResourceExhausted)
+	}
+	select {
+	case err := <-op.done:
+		return err
+	case <-w.stopped:
+		// Run returns after sending the results of its last group.
+		select {
+		case err := <-op.done:
+			return err
+		default:
+			return fmt.Errorf("writer is stopped: %w", status.ErrUnavailable)
+		}
+	}
+}
+
+func (w *Writer) commit(ctx context.Context, group []*writeOp) {
+	ctx = context.WithoutCancel(ctx)
+	errs := make([]error, len(group))
+	err := func() error {
+		tx, err := w.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for i, op := range group {
+			if err := op.ctx.Err(); err != nil {
+				errs[i] = err
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, "SAVEPOINT WriterOp"); err != nil {
+				return err
+			}
+			if errs[i] = op.fn(ctx, tx); errs[i] != nil {
+				if _, err := tx.ExecContext(ctx, "ROLLBACK TO WriterOp"); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.ExecContext(ctx, "RELEASE WriterOp"); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	for i, op := range group {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+		op.done <- errs[i]
+	}
+}
+
+// writeTx runs fn in a transaction through the writer
+// or directly on the database when the writer is nil.
+func writeTx(ctx context.Context, db *sql.DB, w *Writer, fn func(context.Context, *sql.Tx) error) error {
+	if w != nil {
+		return w.Do(ctx, fn)
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/status"
+	"github.com/wenooij/nuggit/trigger"
+)
+
+func TestWriter(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenDB(filepath.Join(t.TempDir(), "nuggit.sqlite"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := InitDB(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	var journalMode string
+	if err := db.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&journalMode); err != nil || journalMode != "wal" {
+		t.Errorf("OpenDB(): got journal mode %q, want wal (%v)", journalMode, err)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := NewWriter(db, 16, 8)
+	go w.Run(runCtx)
+	plans := NewPlanStore(db)
+	plans.SetWriter(w)
+	results := NewResultStore(db)
+	results.SetWriter(w)
+
+	const n = 50
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			plan := fmt.Sprintf("0192d5c1-5f1a-7c3e-9a9b-%012d", i)
+			if errs[i] = plans.Store(ctx, plan, &trigger.Plan{}); errs[i] != nil {
+				return
+			}
+			// The repeated batch fails without failing the rest of its group.
+			for range 2 {
+				errs[i] = results.StoreResults(ctx, &api.TriggerEvent{Plan: plan, Event: "e"}, &api.TriggerBatch{Sequence: new(int)}, nil)
+			}
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if !errors.Is(err, status.ErrAlreadyExists) {
+			t.Errorf("StoreResults(%d): got %v, want AlreadyExists for the repeated batch", i, err)
+		}
+	}
+	var plansCount, eventsCount int
+	if err := db.QueryRowContext(ctx, "SELECT (SELECT COUNT(*) FROM Plans), (SELECT COUNT(*) FROM Events)").Scan(&plansCount, &eventsCount); err != nil {
+		t.Fatal(err)
+	}
+	if plansCount != n || eventsCount != n {
+		t.Errorf("Writer: got %d plans and %d events, want %d", plansCount, eventsCount, n)
+	}
+}
+
+func TestWriterBackpressure(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenDB(filepath.Join(t.TempDir(), "nuggit.sqlite"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	w := NewWriter(db, 1, 1)
+	noop := func(context.Context, *sql.Tx) error { return nil }
+	queued := make(chan error)
+	go func() { queued <- w.Do(ctx, noop) }()
+	for len(w.ops) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := w.Do(timeoutCtx, noop); !errors.Is(err, status.ErrResourceExhausted) {
+		t.Errorf("Do(full queue): got %v, want ResourceExhausted", err)
+	}
+
+	runCtx, stop := context.WithCancel(ctx)
+	go w.Run(runCtx)
+	if err := <-queued; err != nil {
+		t.Errorf("Do(): got %v", err)
+	}
+	stop()
+	<-w.stopped
+	if err := w.Do(ctx, noop); !errors.Is(err, status.ErrUnavailable) {
+		t.Errorf("Do(stopped): got %v, want Unavailable", err)
+	}
+}
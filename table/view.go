@@ -3,16 +3,25 @@ package table
 import (
 	"fmt"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/wenooij/nuggit"
 	"github.com/wenooij/nuggit/api"
+	"github.com/wenooij/nuggit/expr"
 	"github.com/wenooij/nuggit/integrity"
 	"github.com/wenooij/nuggit/status"
 )
 
 var name = regexp.MustCompile(`^(?i:[a-z][a-z0-9_]*)$`)
 
+// Key columns added to every view which identify a row by its event and sequence.
+// The leading underscore keeps them distinct from column aliases.
+const (
+	EventColumn    = "_event"
+	SequenceColumn = "_sequence"
+)
+
 type ViewBuilder struct {
 	uuid  string
 	alias string
@@ -20,6 +29,12 @@ type ViewBuilder struct {
 	orderedCols []nuggit.ViewColumn
 	cols        map[integrity.NameDigest]nuggit.ViewColumn
 	colAliases  map[integrity.NameDigest]string
+	aggCols     []nuggit.AggColumn
+	groupBy     nuggit.GroupBy
+	filter      string
+	// materialized views select rows from a table instead of the results.
+	materialized bool
+	repeats      bool
 }
 
 func (b *ViewBuilder) Reset() {
@@ -28,6 +43,11 @@ func (b *ViewBuilder) Reset() {
 	b.orderedCols = make([]nuggit.ViewColumn, 0, 16)
 	b.cols = make(map[integrity.NameDigest]nuggit.ViewColumn)
 	b.colAliases = make(map[integrity.NameDigest]string)
+	b.aggCols = nil
+	b.groupBy = nuggit.GroupByNone
+	b.filter = ""
+	b.materialized = false
+	b.repeats = false
 }
 
 func (b *ViewBuilder) SetView(uuid string, alias string) error {
@@ -38,6 +58,11 @@ func (b *ViewBuilder) SetView(uuid string, alias string) error {
 }
 
 func (b *ViewBuilder) AddViewColumn(col nuggit.ViewColumn) error {
+	if col.Expr != "" {
+		// Computed columns are validated on Build.
+		b.orderedCols = append(b.orderedCols, col)
+		return nil
+	}
 	pipe := col.Pipe
 	if pipe == "" {
 		return fmt.Errorf("pipe is required: %w", status.ErrInvalidArgument)
@@ -54,6 +79,36 @@ func (b *ViewBuilder) AddViewColumn(col nuggit.ViewColumn) error {
 	return nil
 }
 
+func (b *ViewBuilder) AddAggColumn(col nuggit.AggColumn) error {
+	b.aggCols = append(b.aggCols, col)
+	return nil
+}
+
+func (b *ViewBuilder) SetGroupBy(groupBy nuggit.GroupBy) { b.groupBy = groupBy }
+
+func (b *ViewBuilder) SetFilter(filter string) { b.filter = filter }
+
+func (b *ViewBuilder) SetMaterialized(materialized bool) { b.materialized = materialized }
+
+func (b *ViewBuilder) SetRepeats(repeats bool) { b.repeats = repeats }
+
+// computed reports whether the view has computed columns or a filter.
+func (b *ViewBuilder) computed() bool {
+	return b.filter != "" || slices.ContainsFunc(b.orderedCols, func(col nuggit.ViewColumn) bool { return col.Expr != "" })
+}
+
+func (b *ViewBuilder) view() *nuggit.View {
+	return &nuggit.View{
+		Alias:        b.alias,
+		Columns:      b.orderedCols,
+		AggColumns:   b.aggCols,
+		GroupBy:      b.groupBy,
+		Filter:       b.filter,
+		Materialized: b.materialized,
+		Repeats:      b.repeats,
+	}
+}
+
 // call transformName first.
 func mustValidatedName(s string) string {
 	if err := validateName(s); err != nil {
@@ -79,7 +134,8 @@ func validateName(s string) error {
 // Use in conjunction with mustValidatedName.
 func transformName(s string) string { return strings.ReplaceAll(s, "-", "_") }
 
-func (b *ViewBuilder) viewName() (string, error) {
+// ViewName returns the name of the SQL view created for the view UUID.
+func (b *ViewBuilder) ViewName() (string, error) {
 	transformed := fmt.Sprintf("view_%s", transformName(b.uuid))
 	if err := validateName(transformed); err != nil {
 		return "", err
@@ -87,19 +143,50 @@ func (b *ViewBuilder) viewName() (string, error) {
 	return transformed, nil
 }
 
+// AliasName returns the name of the SQL view created for the view alias if any.
+func (b *ViewBuilder) AliasName() string { return transformName(b.alias) }
+
+// TableName returns the name of the table which holds the rows of a materialized view.
+func (b *ViewBuilder) TableName() (string, error) {
+	transformed := fmt.Sprintf("viewrows_%s", transformName(b.uuid))
+	if err := validateName(transformed); err != nil {
+		return "", err
+	}
+	return transformed, nil
+}
+
 func (b *ViewBuilder) validateBuild() error {
 	if b.uuid == "" {
 		return fmt.Errorf("view uuid is empty: %w", status.ErrInternal)
 	}
 	// Check view name.
-	if _, err := b.viewName(); err != nil {
+	if _, err := b.ViewName(); err != nil {
 		return nil
 	}
-	if len(b.orderedCols) == 0 {
+	if len(b.orderedCols) == 0 && len(b.aggCols) == 0 {
 		return fmt.Errorf("view must have at least one column: %w", status.ErrInvalidArgument)
 	}
+	if len(b.aggCols) > 0 || b.computed() || b.materialized {
+		view := b.view()
+		if len(api.ViewBaseColumns(view)) == 0 {
+			return fmt.Errorf("view must have at least one pipe: %w", status.ErrInvalidArgument)
+		}
+		if err := api.ValidateView(view); err != nil {
+			return err
+		}
+		// Check that the names of columns conform to naming rules.
+		names, _ := api.ViewRowColumns(view)
+		for _, name := range names {
+			if err := validateName(name); err != nil {
+				return err
+			}
+		}
+	}
 	// Check expected pipes have corresponding pipe objects.
 	for _, col := range b.orderedCols {
+		if col.Expr != "" {
+			continue
+		}
 		key, err := integrity.ParseNameDigest(col.Pipe)
 		if err != nil {
 			return err
@@ -136,32 +223,69 @@ func (b *ViewBuilder) writeSelectColExpr(sb *strings.Builder, col nuggit.ViewCol
 		alias = col.Alias
 	}
 
-	scalarType := "TEXT"
-	point := col.Point
+	scalarType := sqlType(col.Point)
+
+	if pipe.GetDigest() == "" {
+		// Floating columns take the value and digest from the same result
+		// of the newest version when several versions have results in the row.
+		latest := fmt.Sprintf(`SELECT %%s
+        FROM Results AS fr
+        JOIN Pipes AS p ON fr.PipeID = p.ID
+        WHERE fr.EventID = r.EventID AND fr.SequenceID = r.SequenceID AND %s
+        ORDER BY p.ID DESC
+        LIMIT 1`, pipeCondition(pipe))
+		fmt.Fprintf(sb, "(%s) AS %q",
+			fmt.Sprintf(latest, fmt.Sprintf("CAST(fr.Result AS %s)", scalarType)),
+			mustValidatedName(transformName(alias)))
+		if col.WithDigest {
+			fmt.Fprintf(sb, ",\n    (%s) AS %q",
+				fmt.Sprintf(latest, "p.Digest"),
+				mustValidatedName(api.DigestColumnName(col)))
+		}
+		return nil
+	}
+
+	fmt.Fprintf(sb, `MAX (CASE WHEN EXISTS (SELECT 1 FROM Pipes AS p WHERE r.PipeID = p.ID AND %s) THEN CAST(r.Result AS %s) ELSE NULL END) AS %q`,
+		pipeCondition(pipe),
+		scalarType,
+		mustValidatedName(transformName(alias)))
+
+	if col.WithDigest {
+		fmt.Fprintf(sb, ",\n    MAX ((SELECT p.Digest FROM Pipes AS p WHERE r.PipeID = p.ID AND %s)) AS %q",
+			pipeCondition(pipe),
+			mustValidatedName(api.DigestColumnName(col)))
+	}
+
+	return nil
+}
+
+// pipeCondition returns the condition on Pipes p which matches the pipe.
+//
+// Pipes without a digest match every stored version of the pipe by name.
+func pipeCondition(pipe integrity.NameDigest) string {
+	// A valid Pipe name-digest is legal to use in a single quoted string.
+	if pipe.GetDigest() == "" {
+		return fmt.Sprintf("p.Name = '%s'", pipe.GetName())
+	}
+	return fmt.Sprintf("(p.Name = '%s' AND p.Digest = '%s')", pipe.GetName(), pipe.GetDigest())
+}
 
+func sqlType(point nuggit.Point) string {
 	switch scalar := point.Scalar; scalar {
 	case "", nuggit.Bytes:
-		scalarType = "BLOB"
+		return "BLOB"
 	case nuggit.String:
-		scalarType = "TEXT"
+		return "TEXT"
 	case nuggit.Bool:
-		scalarType = "BOOLEAN"
+		return "BOOLEAN"
 	case nuggit.Int:
 		// There's no UNSIGNED, but we might add a check later in the future.
-		scalarType = "INTEGER"
+		return "INTEGER"
 	case nuggit.Float:
-		scalarType = "REAL"
+		return "REAL"
 	default: // Unknown types are simply left as TEXT.
+		return "TEXT"
 	}
-
-	// A valid Pipe name-digest is legal to use in a single quoted string.
-	fmt.Fprintf(sb, `MAX (CASE WHEN EXISTS (SELECT 1 FROM Pipes AS p WHERE r.PipeID = p.ID AND p.Name = '%s' AND p.Digest = '%s') THEN CAST(r.Result AS %s) ELSE NULL END) AS %q`,
-		pipe.GetName(),
-		pipe.GetDigest(),
-		scalarType,
-		mustValidatedName(transformName(alias)))
-
-	return nil
 }
 
 func (b *ViewBuilder) Build() (string, error) {
@@ -169,44 +293,327 @@ func (b *ViewBuilder) Build() (string, error) {
 		return "", err
 	}
 
-	viewName, err := b.viewName()
+	viewName, err := b.ViewName()
 	if err != nil {
 		return "", err
 	}
 
 	var sb strings.Builder
 	sb.Grow(256)
-	fmt.Fprintf(&sb, "CREATE VIEW IF NOT EXISTS %q AS SELECT\n", mustValidatedName(viewName))
+	view := b.view()
+	if b.materialized {
+		if err := b.writeCreateTable(&sb, view); err != nil {
+			return "", err
+		}
+	}
+	fmt.Fprintf(&sb, "CREATE VIEW IF NOT EXISTS %q AS ", mustValidatedName(viewName))
 
-	pipeTableAliases := make(map[integrity.NameDigest]string, len(b.orderedCols))
-	for i, col := range b.orderedCols {
-		key, err := integrity.ParseNameDigest(col.Pipe)
-		if err != nil {
+	switch {
+	case len(b.aggCols) > 0:
+		if err := b.writeAggSelect(&sb, view); err != nil {
+			return "", err
+		}
+	case b.computed():
+		if err := b.writeComputedSelect(&sb, view); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sb, "\nORDER BY b.%[1]s, b.%[2]s ASC;\n", EventColumn, SequenceColumn)
+	case b.materialized:
+		if err := b.writeRowsSelect(&sb, view.Columns); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sb, "\nORDER BY %s, %s ASC;\n", EventColumn, SequenceColumn)
+	default:
+		if err := b.writeRowsSelect(&sb, view.Columns); err != nil {
 			return "", err
 		}
-		pipeTableAliases[key] = fmt.Sprintf("t%d", i)
+		sb.WriteString("\nORDER BY e.ID, r.SequenceID ASC;\n")
 	}
 
-	for _, col := range b.orderedCols {
+	// Create view alias.
+	if alias := b.AliasName(); alias != "" {
+		fmt.Fprintf(&sb, "CREATE VIEW IF NOT EXISTS %q AS SELECT * FROM %q;\n", mustValidatedName(alias), viewName)
+	}
+
+	return sb.String(), nil
+}
+
+// writeCreateTable writes the table of a materialized view.
+//
+// The table has a row for each event and sequence with the values of the pipe columns.
+func (b *ViewBuilder) writeCreateTable(sb *strings.Builder, view *nuggit.View) error {
+	tableName, err := b.TableName()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(sb, "CREATE TABLE IF NOT EXISTS %q (\n", tableName)
+	for _, col := range api.ViewBaseColumns(view) {
+		fmt.Fprintf(sb, "    %q %s,\n", mustValidatedName(api.ViewColumnName(col)), sqlType(col.Point))
+		if col.WithDigest {
+			fmt.Fprintf(sb, "    %q TEXT,\n", mustValidatedName(api.DigestColumnName(col)))
+		}
+	}
+	fmt.Fprintf(sb, `    Timestamp,
+    URL TEXT,
+    %[1]s INTEGER NOT NULL,
+    %[2]s INTEGER NOT NULL,
+    PRIMARY KEY (%[1]s, %[2]s)
+) WITHOUT ROWID;
+`, EventColumn, SequenceColumn)
+	return nil
+}
+
+// BuildRefresh returns the statements which recompute the rows of a materialized view
+// for the events selected by the events query, such as "?1" or "SELECT ID FROM Events".
+// The events query may appear more than once so parameters should be numbered.
+//
+// An empty events query recomputes all rows.
+func (b *ViewBuilder) BuildRefresh(events string) ([]string, error) {
+	if err := b.validateBuild(); err != nil {
+		return nil, err
+	}
+	if !b.materialized {
+		return nil, fmt.Errorf("view is not materialized (%q): %w", b.uuid, status.ErrFailedPrecondition)
+	}
+	tableName, err := b.TableName()
+	if err != nil {
+		return nil, err
+	}
+	deleteRows := fmt.Sprintf("DELETE FROM %q", tableName)
+	if events != "" {
+		deleteRows += fmt.Sprintf(" WHERE %s IN (%s)", EventColumn, events)
+		if b.repeats {
+			deleteRows += fmt.Sprintf(" OR %s IN (SELECT ID FROM Events WHERE RepeatOf IN (%s))", EventColumn, events)
+		}
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "INSERT INTO %q ", tableName)
+	if err := b.writeResultsSelect(&sb, api.ViewBaseColumns(b.view()), events); err != nil {
+		return nil, err
+	}
+	return []string{deleteRows, sb.String()}, nil
+}
+
+// writeRowsSelect writes a select of one row per event and sequence with the values of the columns.
+//
+// Rows of materialized views are selected from their table.
+func (b *ViewBuilder) writeRowsSelect(sb *strings.Builder, cols []nuggit.ViewColumn) error {
+	if !b.materialized {
+		return b.writeResultsSelect(sb, cols, "")
+	}
+	tableName, err := b.TableName()
+	if err != nil {
+		return err
+	}
+	sb.WriteString("SELECT\n")
+	for _, col := range cols {
+		fmt.Fprintf(sb, "    %q,\n", mustValidatedName(api.ViewColumnName(col)))
+		if col.WithDigest {
+			fmt.Fprintf(sb, "    %q,\n", mustValidatedName(api.DigestColumnName(col)))
+		}
+	}
+	fmt.Fprintf(sb, `    Timestamp,
+    URL,
+    %s,
+    %s
+FROM %q`, EventColumn, SequenceColumn, tableName)
+	return nil
+}
+
+// writeResultsSelect writes a select of the rows from the results of the events query.
+// An empty events query selects all events.
+func (b *ViewBuilder) writeResultsSelect(sb *strings.Builder, cols []nuggit.ViewColumn, events string) error {
+	sb.WriteString("SELECT\n")
+	for _, col := range cols {
 		sb.WriteString("    ") // Indent.
-		if err := b.writeSelectColExpr(&sb, col); err != nil {
-			return "", fmt.Errorf("failed to format column (%q): %w", name, err)
+		if err := b.writeSelectColExpr(sb, col); err != nil {
+			return fmt.Errorf("failed to format column (%q): %w", col.Pipe, err)
 		}
 		sb.WriteString(",\n")
 	}
 
-	fmt.Fprintf(&sb, `    e.Timestamp,
-    e.URL
-FROM TriggerResults AS r
-LEFT JOIN TriggerEvents AS e ON r.EventID = e.ID
-GROUP BY e.ID, r.SequenceID
-ORDER BY e.ID, r.SequenceID ASC;
-`)
+	fmt.Fprintf(sb, `    e.Timestamp,
+    e.URL,
+    e.ID AS %s,
+    r.SequenceID AS %s
+FROM Results AS r
+JOIN Events AS e ON %s
+WHERE r.PipeID IN (SELECT p.ID FROM Pipes AS p WHERE `, EventColumn, SequenceColumn, b.eventsJoin())
+	for i, col := range cols {
+		pipe, err := integrity.ParseNameDigest(col.Pipe)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			sb.WriteString(" OR ")
+		}
+		sb.WriteString(pipeCondition(pipe))
+	}
+	sb.WriteString(")")
+	switch {
+	case events == "":
+	case b.repeats:
+		fmt.Fprintf(sb, " AND (e.ID IN (%[1]s) OR e.RepeatOf IN (%[1]s))", events)
+	default:
+		fmt.Fprintf(sb, " AND r.EventID IN (%s)", events)
+	}
+	sb.WriteString("\nGROUP BY e.ID, r.SequenceID")
+	return nil
+}
 
-	// Create view alias.
-	if alias := transformName(b.alias); alias != "" {
-		fmt.Fprintf(&sb, "CREATE VIEW IF NOT EXISTS %q AS SELECT * FROM %q;\n", mustValidatedName(alias), viewName)
+// eventsJoin returns the condition which joins results to their events.
+//
+// Repeat events have the results of the earlier event.
+func (b *ViewBuilder) eventsJoin() string {
+	if b.repeats {
+		return "(r.EventID = e.ID OR r.EventID = e.RepeatOf)"
 	}
+	return "r.EventID = e.ID"
+}
 
-	return sb.String(), nil
+// writeComputedSelect writes a select of the rows with computed columns which match the view filter.
+func (b *ViewBuilder) writeComputedSelect(sb *strings.Builder, view *nuggit.View) error {
+	columns := api.ViewExprColumns(view)
+	sb.WriteString("SELECT\n    b.*")
+	for _, col := range view.Columns {
+		if col.Expr == "" {
+			continue
+		}
+		e, err := expr.Parse(col.Expr, columns)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sb, ",\n    %s AS %q", e.InlineSQL(exprColumn), mustValidatedName(api.ViewColumnName(col)))
+	}
+	sb.WriteString("\nFROM (\n")
+	if err := b.writeRowsSelect(sb, api.ViewBaseColumns(view)); err != nil {
+		return err
+	}
+	sb.WriteString("\n) AS b")
+	if view.Filter != "" {
+		e, err := expr.ParseBool(view.Filter, columns)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sb, "\nWHERE %s", e.InlineSQL(exprColumn))
+	}
+	return nil
+}
+
+// exprColumn returns the SQL for a column of the row subquery.
+func exprColumn(name string) string { return fmt.Sprintf("b.%q", mustValidatedName(name)) }
+
+// writeAggSelect writes a select of the aggregates grouped by the view columns and scope.
+//
+// Aggregated rows are numbered by their first event and sequence
+// so they have unique keys for pagination.
+func (b *ViewBuilder) writeAggSelect(sb *strings.Builder, view *nuggit.View) error {
+	var keys []string
+	for _, col := range view.Columns {
+		keys = append(keys, fmt.Sprintf("b.%q", mustValidatedName(api.ViewColumnName(col))))
+		if col.WithDigest {
+			keys = append(keys, fmt.Sprintf("b.%q", mustValidatedName(api.DigestColumnName(col))))
+		}
+	}
+	switch view.GroupBy {
+	case nuggit.GroupByEvent:
+		keys = append(keys, "b."+EventColumn, "b.Timestamp", "b.URL")
+	case nuggit.GroupByURL:
+		keys = append(keys, "b.URL")
+	}
+
+	sb.WriteString("SELECT\n")
+	for _, key := range keys {
+		if key != "b."+EventColumn {
+			fmt.Fprintf(sb, "    %s,\n", key)
+		}
+	}
+	for _, col := range view.AggColumns {
+		sb.WriteString("    ") // Indent.
+		if err := writeAggExpr(sb, view, col); err != nil {
+			return fmt.Errorf("failed to format aggregate column (%q): %w", col.Op, err)
+		}
+		sb.WriteString(",\n")
+	}
+	fmt.Fprintf(sb, `    ROW_NUMBER() OVER (ORDER BY MIN(b.%[1]s), MIN(b.%[2]s)) AS %[1]s,
+    0 AS %[2]s
+FROM (
+`, EventColumn, SequenceColumn)
+	if b.computed() {
+		if err := b.writeComputedSelect(sb, view); err != nil {
+			return err
+		}
+	} else if err := b.writeRowsSelect(sb, api.ViewBaseColumns(view)); err != nil {
+		return err
+	}
+	sb.WriteString("\n) AS b")
+	if len(keys) > 0 {
+		fmt.Fprintf(sb, "\nGROUP BY %s", strings.Join(keys, ", "))
+	}
+	sb.WriteString(";\n")
+	return nil
+}
+
+var aggFuncs = map[nuggit.AggOp]string{
+	nuggit.AggOpCount:     "COUNT",
+	nuggit.AggOpSum:       "SUM",
+	nuggit.AggOpMin:       "MIN",
+	nuggit.AggOpMax:       "MAX",
+	nuggit.AggOpAvg:       "AVG",
+	nuggit.AggOpStringAgg: "string_agg",
+}
+
+func writeAggExpr(sb *strings.Builder, view *nuggit.View, col nuggit.AggColumn) error {
+	fn, ok := aggFuncs[col.Op]
+	if !ok {
+		return fmt.Errorf("aggregate op is not supported (%q): %w", col.Op, status.ErrInvalidArgument)
+	}
+	arg := "*"
+	switch {
+	case col.Pipe != "":
+		arg = fmt.Sprintf("b.%q", mustValidatedName(api.BaseColumnName(view, col)))
+	case col.Expr != "":
+		e, err := expr.Parse(col.Expr, api.ViewExprColumns(view))
+		if err != nil {
+			return err
+		}
+		arg = e.InlineSQL(exprColumn)
+	}
+	if col.Distinct {
+		arg = "DISTINCT " + arg
+	}
+	if col.Op == nuggit.AggOpStringAgg {
+		if col.Distinct {
+			// DISTINCT aggregates take one argument so the default separator is used.
+			fn = "group_concat"
+		} else {
+			sep := col.Arg
+			if sep == "" {
+				sep = ","
+			}
+			arg += ", " + quoteString(sep)
+		}
+	}
+	if col.OrderBy != "" {
+		name, desc := api.AggOrderBy(col)
+		arg += fmt.Sprintf(" ORDER BY b.%q", mustValidatedName(name))
+		if desc {
+			arg += " DESC"
+		}
+	}
+	fmt.Fprintf(sb, "%s(%s)", fn, arg)
+	if col.Filter != "" {
+		e, err := expr.ParseBool(col.Filter, api.ViewExprColumns(view))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sb, " FILTER (WHERE %s)", e.InlineSQL(exprColumn))
+	}
+	fmt.Fprintf(sb, " AS %q", mustValidatedName(api.AggColumnName(col)))
+	return nil
+}
+
+// quoteString returns s as a single quoted SQL string literal.
+func quoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
 }
@@ -13,6 +13,9 @@ type Plan struct {
 	Types []int `json:"types,omitempty"`
 	// Steps contains the optimal sequence of actions needed to execute the given pipelines.
 	Steps []PlanStep `json:"steps,omitempty"`
+	// Canonical configures how the URLs of exchanged events are canonicalized.
+	// It merges the configs of the matched rules with rules.MergeCanonical.
+	Canonical *nuggit.CanonicalURL `json:"canonical,omitempty"`
 }
 
 func (p *Plan) GetRoots() []int {
@@ -36,6 +39,13 @@ func (p *Plan) GetSteps() []PlanStep {
 	return p.Steps
 }
 
+func (p *Plan) GetCanonical() *nuggit.CanonicalURL {
+	if p == nil {
+		return nil
+	}
+	return p.Canonical
+}
+
 type PlanStep struct {
 	// Input is the node number representing the input to this step.
 	//
@@ -1,9 +1,27 @@
 package nuggit
 
 type View struct {
-	Alias      string       `json:"alias,omitempty"`
-	Columns    []ViewColumn `json:"columns,omitempty"`
-	AggColumns []AggColumn  `json:"agg_columns,omitempty"`
+	Alias   string       `json:"alias,omitempty"`
+	Columns []ViewColumn `json:"columns,omitempty"`
+	// AggColumns aggregate the values of pipes.
+	//
+	// Views with AggColumns have a row for each group of Columns values
+	// within the GroupBy scope.
+	AggColumns []AggColumn `json:"agg_columns,omitempty"`
+	GroupBy    GroupBy     `json:"group_by,omitempty"`
+	// Filter is a bool expression which view rows must match.
+	//
+	// Filters apply to rows before aggregation.
+	Filter string `json:"filter,omitempty"`
+	// Materialized views store their rows in a table which is updated
+	// as results are stored instead of computing them on every read.
+	Materialized bool `json:"materialized,omitempty"`
+	// Repeats includes rows for events whose results repeat the previous
+	// event for the URL. The rows have the values of the earlier event.
+	// Events with several batches are compared again after each batch with results.
+	// When the earlier event later gets more batches, its repeats keep a copy
+	// of the values they repeated and are no longer treated as repeats.
+	Repeats bool `json:"repeats,omitempty"`
 }
 
 func (v *View) GetSpec() any { return v }
@@ -22,20 +40,91 @@ func (v *View) GetColumns() []ViewColumn {
 	return v.Columns
 }
 
+func (v *View) GetAggColumns() []AggColumn {
+	if v == nil {
+		return nil
+	}
+	return v.AggColumns
+}
+
+func (v *View) GetGroupBy() GroupBy {
+	if v == nil {
+		return ""
+	}
+	return v.GroupBy
+}
+
+func (v *View) GetFilter() string {
+	if v == nil {
+		return ""
+	}
+	return v.Filter
+}
+
+func (v *View) GetMaterialized() bool {
+	if v == nil {
+		return false
+	}
+	return v.Materialized
+}
+
+func (v *View) GetRepeats() bool {
+	if v == nil {
+		return false
+	}
+	return v.Repeats
+}
+
+// GroupBy is the scope of aggregate columns.
+type GroupBy = string
+
+const (
+	// GroupByNone aggregates across all events.
+	GroupByNone  GroupBy = ""
+	GroupByEvent GroupBy = "event"
+	GroupByURL   GroupBy = "url"
+)
+
 type ViewColumn struct {
 	Alias string `json:"alias,omitempty"`
+	// Pipe is the name@digest of the pipe.
+	//
+	// Floating columns name the pipe without a digest.
 	Pipe  string `json:"pipe,omitempty"`
 	Point Point  `json:"point,omitempty"`
+	// Floating columns have the results of every stored version of the pipe
+	// so that new versions need no view updates.
+	// When several versions have a result in the same row, the newest version is used.
+	//
+	// Without Floating, a pipe without a digest is qualified to its unique digest.
+	Floating bool `json:"floating,omitempty"`
+	// WithDigest adds a column named pipe_digest after the column
+	// with the digest of the pipe which produced the value.
+	WithDigest bool `json:"with_digest,omitempty"`
+	// Expr computes the column instead of a pipe.
+	//
+	// Expressions refer to the timestamp, the url and the pipe columns
+	// of the view and its aggregates. See package expr for the syntax.
+	// Computed columns require an Alias and their point is inferred from Expr.
+	Expr string `json:"expr,omitempty"`
 }
 
+// AggColumn aggregates the values of a pipe.
+//
+// Alias names the aggregate and Point is the point of the pipe values.
+// Aggregates of an Expr instead of a pipe require an Alias.
+// Count may omit the pipe to count rows.
 type AggColumn struct {
 	ViewColumn `json:",omitempty"`
-	Op         AggOp  `json:"op,omitempty"`
-	Arg        string `json:"arg,omitempty"`
-	Distinct   bool   `json:"distinct,omitempty"`
-	Expr       string `json:"expr,omitempty"`
-	Filter     string `json:"filter,omitempty"`
-	OrderBy    string `json:"order_by,omitempty"`
+	Op         AggOp `json:"op,omitempty"`
+	// Arg is the separator of string_agg which defaults to ",".
+	Arg      string `json:"arg,omitempty"`
+	Distinct bool   `json:"distinct,omitempty"`
+	// Filter is a bool expression which rows must match to be aggregated.
+	Filter string `json:"filter,omitempty"`
+	// OrderBy names the column which orders the values of string_agg.
+	// A " desc" suffix reverses the order.
+	OrderBy string `json:"order_by,omitempty"`
 }
 
 type AggOp = string
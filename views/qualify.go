@@ -11,26 +11,37 @@ import (
 
 // Qualify adds digests to referenced pipes, where not present.
 //
+// Floating columns are left unqualified.
 // Qualify fails if the pipes index does not have a unique entry for the given name
-// or if the name@digest is malformed.
+// (or any entry for floating columns) or if the name@digest is malformed.
 func Qualify(pipes *pipes.Index, view nuggit.View) (nuggit.View, error) {
 	copyCols := slices.Clip(slices.Clone(view.Columns))
 	for i, c := range copyCols {
+		if c.Pipe == "" {
+			continue // Computed column.
+		}
 		nameDigest, err := integrity.ParseNameDigest(c.Pipe)
 		if err != nil {
 			return nuggit.View{}, err
 		}
-		if nameDigest.GetDigest() == "" {
-			digest, ok := pipes.GetUnique(nameDigest.GetName())
-			if !ok {
-				return nuggit.View{}, fmt.Errorf("no unique pipe found (%q)", nameDigest.GetName())
-			}
-			pipe, err := integrity.FormatString(integrity.KeyLit(nameDigest.GetName(), digest))
-			if err != nil {
-				return nuggit.View{}, err
+		if nameDigest.GetDigest() != "" {
+			continue
+		}
+		if c.Floating {
+			if !pipes.HasName(nameDigest.GetName()) {
+				return nuggit.View{}, fmt.Errorf("no pipe found (%q)", nameDigest.GetName())
 			}
-			copyCols[i].Pipe = pipe
+			continue
+		}
+		digest, ok := pipes.GetUnique(nameDigest.GetName())
+		if !ok {
+			return nuggit.View{}, fmt.Errorf("no unique pipe found (%q)", nameDigest.GetName())
+		}
+		pipe, err := integrity.FormatString(integrity.KeyLit(nameDigest.GetName(), digest))
+		if err != nil {
+			return nuggit.View{}, err
 		}
+		copyCols[i].Pipe = pipe
 	}
 	view.Columns = copyCols
 	return view, nil
@@ -0,0 +1,35 @@
+package views
+
+import (
+	"testing"
+
+	"github.com/wenooij/nuggit"
+	"github.com/wenooij/nuggit/pipes"
+)
+
+func TestQualify(t *testing.T) {
+	var idx pipes.Index
+	idx.Add("title", "abc", nuggit.Pipe{})
+
+	view, err := Qualify(&idx, nuggit.View{Columns: []nuggit.ViewColumn{
+		{Pipe: "title"},
+		{Pipe: "title", Alias: "floating", Floating: true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := view.Columns[0].Pipe, "title@abc"; got != want {
+		t.Errorf("Qualify(): got pipe %q, want %q", got, want)
+	}
+	if got, want := view.Columns[1].Pipe, "title"; got != want {
+		t.Errorf("Qualify(floating): got pipe %q, want %q", got, want)
+	}
+
+	idx.Add("title", "def", nuggit.Pipe{})
+	if _, err := Qualify(&idx, nuggit.View{Columns: []nuggit.ViewColumn{{Pipe: "title"}}}); err == nil {
+		t.Errorf("Qualify(ambiguous): want error")
+	}
+	if _, err := Qualify(&idx, nuggit.View{Columns: []nuggit.ViewColumn{{Pipe: "title", Floating: true}}}); err != nil {
+		t.Errorf("Qualify(ambiguous floating): %v", err)
+	}
+}